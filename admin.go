@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mca3/pikorv/client"
+	"github.com/mca3/pikorv/config"
+	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/routes"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// These commands change the database directly, so a running server won't
+// notify gateway clients of what was changed.
+//
+// The exception is "device rm", which asks the running server to delete the
+// device through the admin API so that it is cut off right away. With
+// -offline, it is deleted from the database instead, and dropped as a
+// WireGuard peer when the server next starts.
+
+var userCommands = map[string]subcommand{
+	"add":    {"-email address [-name name] [-admin] <username>", userAdd},
+	"list":   {"[-json]", userList},
+	"passwd": {"<username>", userPasswd},
+	"admin":  {"[-revoke] <username>", userAdmin},
+	"rm":     {"<username>", userRm},
+}
+
+var deviceCommands = map[string]subcommand{
+	"list": {"[-json] [-user username]", deviceList},
+	"show": {"[-json] <id|ip|public key>", deviceShow},
+	"rm":   {"[-server url] [-offline] <id|ip|public key>", deviceRm},
+}
+
+var networkCommands = map[string]subcommand{
+	"list": {"[-json] [-user username]", networkList},
+	"show": {"[-json] <id>", networkShow},
+}
+
+// cmdUser manages users.
+func cmdUser(args []string) error {
+	return runSubcommand("user", userCommands, args)
+}
+
+// cmdDevice manages devices.
+func cmdDevice(args []string) error {
+	return runSubcommand("device", deviceCommands, args)
+}
+
+// cmdNetwork inspects networks.
+func cmdNetwork(args []string) error {
+	return runSubcommand("network", networkCommands, args)
+}
+
+// orDash returns s, or "-" if it is empty, so that table columns line up.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// usernames returns a map of user IDs to usernames.
+func usernames(ctx context.Context, s db.Store) (map[int64]string, error) {
+	us, err := s.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int64]string, len(us))
+	for _, u := range us {
+		names[u.ID] = u.Username
+	}
+	return names, nil
+}
+
+// findDevice finds a device from its ID, Pikonet IP, or public key.
+func findDevice(ctx context.Context, s db.Store, what string) (db.Device, error) {
+	var dev db.Device
+	var err error
+
+	if id, perr := strconv.ParseInt(what, 10, 64); perr == nil {
+		dev, err = s.DeviceID(ctx, id)
+	} else if ip := net.ParseIP(what); ip != nil {
+		dev, err = s.DeviceIP(ctx, ip.String())
+	} else {
+		dev, err = s.DeviceKey(ctx, what)
+	}
+
+	if errors.Is(err, db.ErrNotFound) {
+		return dev, fmt.Errorf("device %q not found", what)
+	}
+	return dev, err
+}
+
+// findUser finds a user from their username.
+func findUser(ctx context.Context, s db.Store, username string) (db.User, error) {
+	u, err := s.Username(ctx, username)
+	if errors.Is(err, db.ErrNotFound) {
+		return u, fmt.Errorf("user %q not found", username)
+	}
+	return u, err
+}
+
+func userAdd(args []string) error {
+	fs, _ := newFlags("user add")
+	email := fs.String("email", "", "email address of the user")
+	name := fs.String("name", "", "display name of the user")
+	admin := fs.Bool("admin", false, "make the user an administrator")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() != 1 || *email == "" {
+		return errors.New("usage: pikorv user add -email address [-name name] [-admin] <username>")
+	} else if err := routes.CheckUser(fs.Arg(0), *email, *name); err != nil {
+		return err
+	}
+
+	pass, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	u := db.User{
+		Username: fs.Arg(0),
+		Email:    *email,
+		Name:     *name,
+		Admin:    *admin,
+	}
+	if err := s.SaveUser(ctx, &u); db.IsConflict(err) {
+		return fmt.Errorf("username or email is already taken")
+	} else if err != nil {
+		return err
+	}
+
+	if err := s.SetPassword(ctx, u.ID, pass); err != nil {
+		return err
+	}
+
+	fmt.Println(u.ID)
+	return nil
+}
+
+func userList(args []string) error {
+	fs, out := newFlags("user list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	us, err := s.Users(context.Background())
+	if err != nil {
+		return err
+	}
+
+	out.set(us)
+	out.table("ID", "USERNAME", "EMAIL", "NAME", "ADMIN", "STATUS")
+	for _, u := range us {
+		out.row(u.ID, u.Username, u.Email, orDash(u.Name), u.Admin, userStatus(u))
+	}
+	return out.flush()
+}
+
+func userPasswd(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: pikorv user passwd <username>")
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	u, err := findUser(ctx, s, args[0])
+	if err != nil {
+		return err
+	}
+
+	pass, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	return s.SetPassword(ctx, u.ID, pass)
+}
+
+// userStatus describes whether u may log in.
+func userStatus(u db.User) string {
+	switch {
+	case u.Disabled:
+		return "disabled"
+	case u.Locked():
+		return "locked until " + time.Unix(u.LockedUntil, 0).Format(time.RFC3339)
+	}
+	return "active"
+}
+
+func userAdmin(args []string) error {
+	fs, _ := newFlags("user admin")
+	revoke := fs.Bool("revoke", false, "take away administrator access instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() != 1 {
+		return errors.New("usage: pikorv user admin [-revoke] <username>")
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	u, err := findUser(ctx, s, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	u.Admin = !*revoke
+	return s.SaveUser(ctx, &u)
+}
+
+// bootstrapAdmins makes the users in config.Admins administrators, so that
+// there is somebody to use the admin API on a fresh server.
+func bootstrapAdmins(ctx context.Context, s db.Store) error {
+	for _, name := range config.Admins {
+		u, err := s.Username(ctx, name)
+		if errors.Is(err, db.ErrNotFound) {
+			slog.Warn("administrator does not exist yet", "username", name)
+			continue
+		} else if err != nil {
+			return err
+		} else if u.Admin {
+			continue
+		}
+
+		slog.Info("making user an administrator", "username", name)
+		u.Admin = true
+		if err := s.SaveUser(ctx, &u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func userRm(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: pikorv user rm <username>")
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	u, err := findUser(ctx, s, args[0])
+	if err != nil {
+		return err
+	}
+
+	return s.DeleteUser(ctx, u.ID)
+}
+
+func deviceList(args []string) error {
+	fs, out := newFlags("device list")
+	user := fs.String("user", "", "only list devices owned by this user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	var devs []db.Device
+	if *user != "" {
+		var u db.User
+		if u, err = findUser(ctx, s, *user); err != nil {
+			return err
+		}
+		devs, err = s.Devices(ctx, u.ID)
+	} else {
+		devs, err = s.AllDevices(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	names, err := usernames(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	out.set(devs)
+	out.table("ID", "OWNER", "NAME", "IP", "PUBLIC KEY", "ENDPOINT")
+	for _, d := range devs {
+		out.row(d.ID, names[d.Owner], d.Name, d.IP, d.PublicKey, orDash(d.Endpoint))
+	}
+	return out.flush()
+}
+
+func deviceShow(args []string) error {
+	fs, out := newFlags("device show")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() != 1 {
+		return errors.New("usage: pikorv device show [-json] <id|ip|public key>")
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	dev, err := findDevice(ctx, s, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	owner, err := s.UserID(ctx, dev.Owner)
+	if err != nil {
+		return err
+	}
+
+	nws, err := s.DeviceNetworks(ctx, dev.ID)
+	if err != nil {
+		return err
+	}
+
+	out.set(struct {
+		db.Device
+		Networks []db.Network `json:"networks"`
+	}{dev, nws})
+
+	out.table("FIELD", "VALUE")
+	out.row("id", dev.ID)
+	out.row("owner", owner.Username)
+	out.row("name", dev.Name)
+	out.row("ip", dev.IP)
+	out.row("public key", dev.PublicKey)
+	out.row("endpoint", orDash(dev.Endpoint))
+	out.row("nat", orDash(dev.NAT))
+	for _, nw := range nws {
+		out.row("network", fmt.Sprintf("%s (%d)", nw.Name, nw.ID))
+	}
+	return out.flush()
+}
+
+func deviceRm(args []string) error {
+	fs, _ := newFlags("device rm")
+	server := fs.String("server", "", "URL of the running server; by default, the one at the configured HTTP address")
+	offline := fs.Bool("offline", false, "delete the device from the database, for when the server isn't running")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() != 1 {
+		return errors.New("usage: pikorv device rm [-server url] [-offline] <id|ip|public key>")
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	dev, err := findDevice(ctx, s, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *offline {
+		return s.DeleteDevice(ctx, dev.ID)
+	}
+
+	token, err := adminToken(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if *server == "" {
+		*server = localURL(config.HttpAddr)
+	}
+
+	c := client.New(*server)
+	c.Token = token
+
+	err = c.AdminDeleteDevice(ctx, dev.ID)
+	if _, ok := err.(*client.Error); err != nil && !ok {
+		return fmt.Errorf("failed to reach the server at %s, use -offline if it isn't running: %v", *server, err)
+	}
+	return err
+}
+
+// adminToken creates a short-lived token for the first administrator who may
+// log in, so commands can use the admin API of the running server.
+func adminToken(ctx context.Context, s db.Store) (string, error) {
+	us, err := s.Users(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, u := range us {
+		if !u.Admin || u.Disabled || u.Locked() {
+			continue
+		}
+
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"id":  u.ID,
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}).SignedString([]byte(config.JWTSecret))
+	}
+	return "", errors.New("there is no administrator to use the admin API as; use -offline, or make someone an administrator with \"pikorv user admin\"")
+}
+
+// localURL returns the URL of the server listening on addr from this host.
+func localURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+func networkList(args []string) error {
+	fs, out := newFlags("network list")
+	user := fs.String("user", "", "only list networks owned by this user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	var nws []db.Network
+	if *user != "" {
+		var u db.User
+		if u, err = findUser(ctx, s, *user); err != nil {
+			return err
+		}
+		nws, err = s.Networks(ctx, u.ID)
+	} else {
+		nws, err = s.AllNetworks(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	names, err := usernames(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	out.set(nws)
+	out.table("ID", "OWNER", "NAME", "APPROVAL")
+	for _, nw := range nws {
+		out.row(nw.ID, names[nw.Owner], nw.Name, nw.Approval)
+	}
+	return out.flush()
+}
+
+func networkShow(args []string) error {
+	fs, out := newFlags("network show")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() != 1 {
+		return errors.New("usage: pikorv network show [-json] <id>")
+	}
+
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid network ID %q", fs.Arg(0))
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	nw, err := s.NetworkID(ctx, id)
+	if errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("network %d not found", id)
+	} else if err != nil {
+		return err
+	}
+
+	devs, err := s.NetworkDevices(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	reqs, err := s.NetworkRequests(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	names, err := usernames(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	out.set(struct {
+		db.Network
+		Devices  []db.Device `json:"devices"`
+		Requests []db.Device `json:"requests"`
+	}{nw, devs, reqs})
+
+	if !out.json {
+		fmt.Printf("%s (%d), owned by %s", nw.Name, nw.ID, names[nw.Owner])
+		if nw.Approval {
+			fmt.Print(", requires approval")
+		}
+		fmt.Print("\n\n")
+	}
+
+	out.table("ID", "OWNER", "NAME", "IP", "STATUS")
+	for _, d := range devs {
+		out.row(d.ID, names[d.Owner], d.Name, d.IP, db.MemberActive)
+	}
+	for _, d := range reqs {
+		out.row(d.ID, names[d.Owner], d.Name, d.IP, db.MemberPending)
+	}
+	return out.flush()
+}
+
+// cmdKeygen generates a WireGuard key pair for punch_private_key and
+// punch_public_key.
+func cmdKeygen(args []string) error {
+	fs, out := newFlags("keygen")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+
+	out.set(struct {
+		PrivateKey string `json:"punch_private_key"`
+		PublicKey  string `json:"punch_public_key"`
+	}{key.String(), key.PublicKey().String()})
+
+	out.table("KEY", "VALUE")
+	out.row("punch_private_key", key.String())
+	out.row("punch_public_key", key.PublicKey().String())
+	return out.flush()
+}
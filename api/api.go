@@ -0,0 +1,68 @@
+// Package api holds the types that the rendezvous server and its clients
+// exchange over the HTTP API and the gateway.
+//
+// It has no dependencies outside of the standard library, so that clients
+// may import it without pulling in the server.
+package api
+
+import "time"
+
+// User represents a rendezvous user.
+type User struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Name     string `json:"name,omitempty"`
+
+	// Admin users may manage every user, network, and device.
+	Admin bool `json:"is_admin"`
+
+	// Disabled users may not log in, and their tokens are rejected until
+	// they are enabled again.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// LockedUntil is the Unix time until which the user may not log in,
+	// like Disabled. Zero means the user is not locked.
+	LockedUntil int64 `json:"locked_until,omitempty"`
+}
+
+// Locked determines if the user is disabled or locked, and may not log in.
+func (u *User) Locked() bool {
+	return u.Disabled || u.LockedUntil > time.Now().Unix()
+}
+
+// Network represents a network to which devices connect to
+type Network struct {
+	ID    int64  `json:"id"`
+	Owner int64  `json:"owner"`
+	Name  string `json:"name"`
+
+	// Approval is set when devices not owned by the network owner need
+	// their approval before joining the network.
+	Approval bool `json:"approval"`
+}
+
+// Device represnets a device, its unique Pikonet IP, and its public key.
+type Device struct {
+	ID    int64  `json:"id"`
+	Owner int64  `json:"owner"`
+	Name  string `json:"name"`
+
+	// PublicKey is the WireGuard public key for this device.
+	PublicKey string `json:"key"`
+
+	// IP is the Pikonet IP, which likely means a random IP in the range
+	// fd00::/32.
+	// This IP is not routable by the Internet, and only by Pikonet nodes.
+	IP string `json:"ip"`
+
+	// Endpoint is the endpoint of this device, which is updated whenever
+	// the endpoint pings us.
+	//
+	// TODO: Store a date with this, dump it if it's too old.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// NAT is the type of NAT the device is behind, as reported by the
+	// device after probing the pikopunch server.
+	NAT string `json:"nat,omitempty"`
+}
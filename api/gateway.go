@@ -0,0 +1,174 @@
+package api
+
+// ProtocolVersion is the version of the gateway protocol described here.
+//
+// Clients start by sending MessageHello with the version they speak and the
+// device they are, to which the server replies with MessageReady. Only then
+// does the server send them anything else.
+//
+// Clients which never say hello are spoken to in the legacy protocol, which
+// has integer message types and no errors, until they disconnect.
+const ProtocolVersion = 1
+
+// Subprotocols of the gateway, which choose how messages are encoded.
+//
+// Clients list the subprotocols they accept when connecting, and the server
+// picks the most compact one it knows. Clients which list none are sent JSON.
+const (
+	SubprotocolJSON = "pikorv.json"
+
+	// SubprotocolCBOR encodes messages in CBOR, with the same keys as JSON,
+	// in binary websocket messages.
+	SubprotocolCBOR = "pikorv.cbor"
+)
+
+// MessageType is the type of a gateway message.
+type MessageType string
+
+// Types of gateway messages.
+//
+// Each type lists the fields of Message that it uses; all others are empty.
+const (
+	// MessageHello is sent by clients as their first message.
+	// Version and DeviceID must be set, and Endpoint and NAT may be set as
+	// in MessagePing.
+	MessageHello MessageType = "hello"
+
+	// MessageReady is the reply to MessageHello.
+	// Version is the version the server will speak, and Capabilities holds
+	// the optional features the server has enabled.
+	MessageReady MessageType = "ready"
+
+	// MessageError is sent when the server could not handle a message,
+	// with Error set.
+	// The connection stays open.
+	MessageError MessageType = "error"
+
+	// MessagePing is sent by devices to report their Endpoint and NAT,
+	// either of which may be empty.
+	// DeviceID may be set, and must be the device that said hello.
+	MessagePing MessageType = "ping"
+
+	// MessageNetworkJoin and MessageNetworkLeave are sent when Device joins
+	// or leaves Network.
+	MessageNetworkJoin  MessageType = "network_join"
+	MessageNetworkLeave MessageType = "network_leave"
+
+	// MessageDeviceUpdate is sent when Device changes.
+	// OldKey and OldKeyExpires are set if it rotated its public key.
+	MessageDeviceUpdate MessageType = "device_update"
+
+	// MessageJoinRequest is sent to the owner of Network when Device asks
+	// to join it, or when Remove is set, once the request was rejected or
+	// withdrawn.
+	MessageJoinRequest MessageType = "join_request"
+
+	// MessageNetworkUpdate is sent when Network changes.
+	MessageNetworkUpdate MessageType = "network_update"
+
+	// MessageDNSRecords carries Records.
+	MessageDNSRecords MessageType = "dns_records"
+
+	// MessageRelay carries Relay.
+	MessageRelay MessageType = "relay"
+)
+
+// Capabilities of the server, sent in MessageReady.
+const (
+	// CapabilityDNS is set when the DNS server is enabled, and devices are
+	// sent MessageDNSRecords.
+	CapabilityDNS = "dns"
+
+	// CapabilityRelay is set when the relay is enabled, and devices are
+	// sent MessageRelay.
+	CapabilityRelay = "relay"
+)
+
+// Message is a message sent over the gateway.
+type Message struct {
+	Type MessageType `json:"type"`
+
+	Device  *Device  `json:"device,omitempty"`
+	Network *Network `json:"network,omitempty"`
+	Remove  bool     `json:"remove,omitempty"`
+
+	Endpoint  string `json:"endpoint,omitempty"`
+	DeviceID  int64  `json:"device_id,omitempty"`
+	NetworkID int64  `json:"network_id,omitempty"`
+
+	// NAT may be sent by devices in pings once they have classified the
+	// NAT they are behind.
+	NAT string `json:"nat,omitempty"`
+
+	// OldKey is set on device updates when the device rotated its public
+	// key, and may be accepted by peers until OldKeyExpires.
+	OldKey        string `json:"old_key,omitempty"`
+	OldKeyExpires int64  `json:"old_key_expires,omitempty"`
+
+	// Records are sent with MessageDNSRecords, and hold every name the
+	// device is able to resolve.
+	Records []DNSRecord `json:"records,omitempty"`
+
+	// Relay is sent with MessageRelay when the relay is available.
+	Relay *RelayInfo `json:"relay,omitempty"`
+
+	// Version and Capabilities are sent in the handshake.
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Error is sent with MessageError.
+	Error *ProtocolError `json:"error,omitempty"`
+}
+
+// DNSRecord is a name that a device is able to resolve using the DNS server.
+type DNSRecord struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+}
+
+// RelayInfo tells a device how to use the relay.
+type RelayInfo struct {
+	Endpoint string `json:"endpoint"`
+	Token    string `json:"token"`
+}
+
+// Codes of protocol errors.
+const (
+	// ErrMalformed is sent when a message could not be decoded.
+	ErrMalformed = "malformed"
+
+	// ErrUnexpected is sent for messages of unknown types, or of types that
+	// only the server sends.
+	ErrUnexpected = "unexpected_message"
+
+	// ErrUnsupportedVersion is sent when the server doesn't speak the
+	// version given in MessageHello.
+	ErrUnsupportedVersion = "unsupported_version"
+
+	// ErrUnknownDevice is sent when a device doesn't exist, or isn't owned
+	// by the user.
+	ErrUnknownDevice = "unknown_device"
+
+	// ErrNotIdentified is sent for messages sent before MessageHello.
+	ErrNotIdentified = "not_identified"
+
+	// ErrAlreadyIdentified is sent for a second MessageHello.
+	ErrAlreadyIdentified = "already_identified"
+
+	// ErrInternal is sent when the server failed to handle a message on
+	// its own.
+	ErrInternal = "internal"
+)
+
+// ProtocolError describes why the server could not handle a message.
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
@@ -0,0 +1,166 @@
+package api
+
+// NextCursorHeader is the header which holds the cursor of the next page of a
+// list, if there is one.
+const NextCursorHeader = "X-Next-Cursor"
+
+// RequestIDHeader is the header which holds the ID of a request, which is
+// included in everything the server logs about it.
+// Proxies may set it, otherwise the server picks one.
+const RequestIDHeader = "X-Request-ID"
+
+// AuthRequest asks for a token.
+type AuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// Method is how the user is authenticated, which must be one of the
+	// methods in AuthMethods.
+	Method string `json:"method"`
+}
+
+// AuthMethods lists the ways users may authenticate.
+type AuthMethods struct {
+	Methods []string `json:"methods"`
+}
+
+// Token is a token which authenticates requests in the Authorization header as
+// "Bearer <token>".
+type Token struct {
+	Token string `json:"token"`
+}
+
+// NewUserRequest creates a user.
+type NewUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// UpdateUserRequest changes the profile of a user.
+// Fields which are nil are left alone, and an empty name removes it.
+type UpdateUserRequest struct {
+	Name  *string `json:"name,omitempty"`
+	Email *string `json:"email,omitempty"`
+}
+
+// NewDeviceRequest creates a device.
+type NewDeviceRequest struct {
+	Name string `json:"name"`
+
+	// Key is the WireGuard public key of the device.
+	Key string `json:"key"`
+}
+
+// UpdateDeviceRequest changes the settings of a device.
+// Fields which are nil are left alone.
+type UpdateDeviceRequest struct {
+	Name *string `json:"name,omitempty"`
+
+	// Tags replaces every tag of the device.
+	Tags *[]string `json:"tags,omitempty"`
+}
+
+// RotateKeyRequest replaces the WireGuard public key of a device.
+type RotateKeyRequest struct {
+	Key string `json:"key"`
+
+	// Overlap is the amount of seconds the peers of the device may keep
+	// accepting the old key for, up to ten minutes.
+	//
+	// Overlap only changes what the peers are told: the server stops
+	// accepting the old key right away, as WireGuard only lets one of its
+	// peers use the IP of the device.
+	Overlap int64 `json:"overlap,omitempty"`
+}
+
+// ListedDevice is a device as it is listed, along with the networks it is in,
+// its tags, and whether it is connected to the gateway.
+type ListedDevice struct {
+	Device
+	Networks []Network `json:"networks"`
+	Tags     []string  `json:"tags"`
+	Online   bool      `json:"online"`
+}
+
+// NewNetworkRequest creates a network.
+type NewNetworkRequest struct {
+	Name string `json:"name"`
+
+	// Approval allows devices owned by other users to request to join the
+	// network.
+	Approval bool `json:"approval,omitempty"`
+}
+
+// UpdateNetworkRequest changes the settings of a network.
+// Fields which are nil are left alone.
+type UpdateNetworkRequest struct {
+	Name     *string `json:"name,omitempty"`
+	Approval *bool   `json:"approval,omitempty"`
+}
+
+// NetworkDevices is a network along with the devices in it.
+type NetworkDevices struct {
+	Network
+	Devices []Device `json:"devices"`
+}
+
+// Punch describes a Pikopunch server for the client to connect to over
+// WireGuard.
+type Punch struct {
+	Endpoint  string `json:"endpoint"`
+	PublicKey string `json:"public_key"`
+
+	// The pikopunch service listens on Port at IP once the tunnel is up.
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+
+	// Probe holds the addresses of pikopunch servers that may be probed to
+	// classify the client's NAT, and Public holds those that may be used
+	// without a tunnel.
+	Probe  []string `json:"probe,omitempty"`
+	Public []string `json:"public,omitempty"`
+}
+
+// DisableUserRequest disables or enables a user.
+type DisableUserRequest struct {
+	Disabled bool `json:"disabled"`
+}
+
+// LockUserRequest prevents a user from logging in for some time.
+type LockUserRequest struct {
+	// Duration is the amount of seconds to lock the user for, or zero to
+	// unlock them.
+	Duration int64 `json:"duration"`
+}
+
+// RelayStats holds the traffic a device has sent through the relay since it
+// registered with it.
+type RelayStats struct {
+	// Registered is false if the device isn't using the relay, in which
+	// case everything else is zero.
+	Registered bool `json:"registered"`
+
+	TxBytes   int64 `json:"tx_bytes"`
+	TxPackets int64 `json:"tx_packets"`
+	RxBytes   int64 `json:"rx_bytes"`
+	RxPackets int64 `json:"rx_packets"`
+
+	// Dropped counts the packets sent by the device which were not
+	// forwarded.
+	Dropped int64 `json:"dropped"`
+}
+
+// Connection describes a live gateway connection.
+type Connection struct {
+	// ID identifies the connection until the server restarts.
+	ID int64 `json:"id"`
+
+	User     int64  `json:"user"`
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+	Since    int64  `json:"since"`
+
+	// Device is zero until the client has identified itself by pinging.
+	Device int64 `json:"device,omitempty"`
+}
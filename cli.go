@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mca3/pikorv/config"
+	"github.com/mca3/pikorv/db"
+	"golang.org/x/term"
+)
+
+// commands are run instead of the server when given as the first argument.
+//
+// Commands load the config themselves if they need it, since not all of them
+// do.
+var commands = map[string]func(args []string) error{
+	"migrate": cmdMigrate,
+	"user":    cmdUser,
+	"device":  cmdDevice,
+	"network": cmdNetwork,
+	"keygen":  cmdKeygen,
+}
+
+// subcommand is a subcommand of a command, such as "add" in "pikorv user add".
+type subcommand struct {
+	usage string
+	run   func(args []string) error
+}
+
+// runSubcommand runs the subcommand of name given in args.
+func runSubcommand(name string, subs map[string]subcommand, args []string) error {
+	if len(args) == 0 {
+		return subcommandUsage(name, subs)
+	}
+
+	sub, ok := subs[args[0]]
+	if !ok {
+		return subcommandUsage(name, subs)
+	}
+	return sub.run(args[1:])
+}
+
+// subcommandUsage returns the usage of every subcommand of name.
+func subcommandUsage(name string, subs map[string]subcommand) error {
+	names := make([]string, 0, len(subs))
+	for k := range subs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("usage:")
+	for _, k := range names {
+		fmt.Fprintf(&b, "\n  pikorv %s %s %s", name, k, subs[k].usage)
+	}
+	return errors.New(b.String())
+}
+
+// newFlags creates the flag set for a subcommand, which always has -json.
+func newFlags(name string) (*flag.FlagSet, *output) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	out := &output{}
+	fs.BoolVar(&out.json, "json", false, "print JSON instead of a table")
+	return fs, out
+}
+
+// openStore loads the config and opens the database, migrating it if needed
+// like the server would.
+func openStore() (db.Store, error) {
+	if err := config.Load(); err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+
+	store, err := db.Open(config.DatabaseUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the database: %v", err)
+	}
+	return store, nil
+}
+
+// output prints either a table or JSON.
+type output struct {
+	json bool
+
+	header []string
+	rows   [][]string
+	value  any
+}
+
+// table sets the header of the table.
+func (o *output) table(header ...string) {
+	o.header = header
+}
+
+// row adds a row to the table.
+func (o *output) row(cols ...any) {
+	row := make([]string, len(cols))
+	for i, v := range cols {
+		row[i] = fmt.Sprint(v)
+	}
+	o.rows = append(o.rows, row)
+}
+
+// set sets what is printed as JSON.
+func (o *output) set(v any) {
+	o.value = v
+}
+
+// flush writes the output to stdout.
+func (o *output) flush() error {
+	if o.json {
+		if o.value == nil {
+			return nil
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(o.value)
+	}
+
+	if o.header == nil {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(o.header, "\t"))
+	for _, r := range o.rows {
+		fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+	return tw.Flush()
+}
+
+// readPassword reads a password from the first line of standard input. If
+// standard input is a terminal, it prompts for the password and reads it
+// without echoing it.
+func readPassword() (string, error) {
+	var line string
+
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password: %v", err)
+		}
+		line = string(b)
+	} else {
+		var err error
+		line, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return "", fmt.Errorf("failed to read password: %v", err)
+		}
+	}
+
+	pass := strings.TrimRight(line, "\r\n")
+	if pass == "" {
+		return "", errors.New("password is empty")
+	}
+	return pass, nil
+}
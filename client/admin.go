@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/mca3/pikorv/api"
+)
+
+// The methods in this file may only be used by administrators.
+
+// AdminUsers lists all users, returning the cursor of the next page if there
+// may be one. Users are sorted by their username when sorting by name.
+func (c *Client) AdminUsers(ctx context.Context, o ListOptions) ([]api.User, string, error) {
+	var out []api.User
+	resp, err := c.do(ctx, "GET", "/api/v1/admin/users"+encode(o.values()), nil, &out)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, resp.Header.Get(api.NextCursorHeader), nil
+}
+
+// AdminDisableUser disables or enables a user.
+func (c *Client) AdminDisableUser(ctx context.Context, user int64, disabled bool) (api.User, error) {
+	var out api.User
+	_, err := c.do(ctx, "POST", "/api/v1/admin/users/"+id(user)+"/disable", api.DisableUserRequest{
+		Disabled: disabled,
+	}, &out)
+	return out, err
+}
+
+// AdminLockUser prevents a user from logging in for d, or unlocks them if d
+// is zero.
+func (c *Client) AdminLockUser(ctx context.Context, user int64, d time.Duration) (api.User, error) {
+	var out api.User
+	_, err := c.do(ctx, "POST", "/api/v1/admin/users/"+id(user)+"/lock", api.LockUserRequest{
+		Duration: int64(d / time.Second),
+	}, &out)
+	return out, err
+}
+
+// AdminDevices lists all devices, returning the cursor of the next page if there may
+// be one.
+func (c *Client) AdminDevices(ctx context.Context, o ListOptions) ([]api.Device, string, error) {
+	var out []api.Device
+	resp, err := c.do(ctx, "GET", "/api/v1/admin/devices"+encode(o.values()), nil, &out)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, resp.Header.Get(api.NextCursorHeader), nil
+}
+
+// AdminDeleteDevice deletes any device.
+func (c *Client) AdminDeleteDevice(ctx context.Context, dev int64) error {
+	_, err := c.do(ctx, "DELETE", "/api/v1/admin/devices/"+id(dev), nil, nil)
+	return err
+}
+
+// AdminNetworks lists all networks, returning the cursor of the next page if there may
+// be one.
+func (c *Client) AdminNetworks(ctx context.Context, o ListOptions) ([]api.Network, string, error) {
+	var out []api.Network
+	resp, err := c.do(ctx, "GET", "/api/v1/admin/networks"+encode(o.values()), nil, &out)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, resp.Header.Get(api.NextCursorHeader), nil
+}
+
+// AdminGateway lists the connections to the gateway, returning the cursor of
+// the next page if there may be one. Connections are always sorted by ID, and
+// their names are the usernames of their users.
+func (c *Client) AdminGateway(ctx context.Context, o ListOptions) ([]api.Connection, string, error) {
+	var out []api.Connection
+	resp, err := c.do(ctx, "GET", "/api/v1/admin/gateway"+encode(o.values()), nil, &out)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, resp.Header.Get(api.NextCursorHeader), nil
+}
@@ -0,0 +1,349 @@
+// Package client is a client for the rendezvous server's HTTP API and
+// gateway.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mca3/pikorv/api"
+)
+
+// Client talks to a rendezvous server.
+type Client struct {
+	// URL is the base URL of the server, such as "https://example.com".
+	URL string
+
+	// Token authenticates requests, and is set by Login.
+	Token string
+
+	// HTTP is the client used to send requests, or http.DefaultClient if
+	// nil.
+	HTTP *http.Client
+
+	// CBOR asks the gateway to send messages in CBOR rather than JSON,
+	// which is more compact.
+	CBOR bool
+}
+
+// Error is returned when the server responds with an error.
+type Error struct {
+	Status  int
+	Message string
+
+	// RequestID identifies the request in the logs of the server.
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+// responseError reads the error from a response.
+func responseError(resp *http.Response) *Error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	return &Error{
+		Status:    resp.StatusCode,
+		Message:   strings.TrimSpace(string(msg)),
+		RequestID: resp.Header.Get(api.RequestIDHeader),
+	}
+}
+
+// IsNotFound determines if err is a 404 from the server.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// New creates a client for the server at url.
+func New(url string) *Client {
+	return &Client{URL: strings.TrimSuffix(url, "/")}
+}
+
+// do sends a request to path, with in encoded as JSON if it is not nil.
+// If out is not nil, the response is decoded into it.
+func (c *Client) do(ctx context.Context, method, path string, in, out any) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return resp, responseError(resp)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, err
+		}
+	}
+
+	return resp, nil
+}
+
+// id formats an ID for use in a path.
+func id(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+// ListOptions changes which items a list returns, and in which order.
+// The zero value lists every item by ID.
+type ListOptions struct {
+	// Prefix only lists items whose name starts with it.
+	Prefix string
+
+	// Sort is "id" or "name".
+	Sort string
+	Desc bool
+
+	// Limit is the most items to list at once.
+	// The cursor of the next page is returned along with the items.
+	Limit  int
+	Cursor string
+}
+
+func (o ListOptions) values() url.Values {
+	v := url.Values{}
+	if o.Prefix != "" {
+		v.Set("prefix", o.Prefix)
+	}
+	if o.Sort != "" {
+		v.Set("sort", o.Sort)
+	}
+	if o.Desc {
+		v.Set("order", "desc")
+	}
+	if o.Limit > 0 {
+		v.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Cursor != "" {
+		v.Set("cursor", o.Cursor)
+	}
+	return v
+}
+
+// DeviceOptions changes which devices ListDevices returns.
+type DeviceOptions struct {
+	ListOptions
+
+	// Tag only lists devices which have it.
+	Tag string
+
+	// Online only lists devices which are connected to the gateway if it
+	// points to true, or those which aren't if it points to false.
+	Online *bool
+}
+
+// encode encodes v as a query string, with its "?".
+func encode(v url.Values) string {
+	if len(v) == 0 {
+		return ""
+	}
+	return "?" + v.Encode()
+}
+
+// AuthMethods lists the ways users may authenticate.
+func (c *Client) AuthMethods(ctx context.Context) ([]string, error) {
+	var out api.AuthMethods
+	_, err := c.do(ctx, "GET", "/api/v1/auth", nil, &out)
+	return out.Methods, err
+}
+
+// Login authenticates as a user, and uses their token for every request after.
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	var out api.Token
+	_, err := c.do(ctx, "POST", "/api/v1/auth", api.AuthRequest{
+		Username: username,
+		Password: password,
+		Method:   "username-password",
+	}, &out)
+	if err != nil {
+		return err
+	}
+
+	c.Token = out.Token
+	return nil
+}
+
+// NewUser creates a user, returning its ID.
+func (c *Client) NewUser(ctx context.Context, req api.NewUserRequest) (int64, error) {
+	var out int64
+	_, err := c.do(ctx, "POST", "/api/v1/users", req, &out)
+	return out, err
+}
+
+// UpdateUser changes the profile of the authenticated user.
+func (c *Client) UpdateUser(ctx context.Context, req api.UpdateUserRequest) (api.User, error) {
+	var out api.User
+	_, err := c.do(ctx, "PATCH", "/api/v1/user", req, &out)
+	return out, err
+}
+
+// ListDevices lists the devices of the authenticated user, returning the
+// cursor of the next page if there may be one.
+func (c *Client) ListDevices(ctx context.Context, o DeviceOptions) ([]api.ListedDevice, string, error) {
+	v := o.values()
+	if o.Tag != "" {
+		v.Set("tag", o.Tag)
+	}
+	if o.Online != nil {
+		v.Set("online", strconv.FormatBool(*o.Online))
+	}
+
+	var out []api.ListedDevice
+	resp, err := c.do(ctx, "GET", "/api/v1/devices"+encode(v), nil, &out)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, resp.Header.Get(api.NextCursorHeader), nil
+}
+
+// NewDevice creates a device.
+func (c *Client) NewDevice(ctx context.Context, req api.NewDeviceRequest) (api.Device, error) {
+	var out api.Device
+	_, err := c.do(ctx, "POST", "/api/v1/devices", req, &out)
+	return out, err
+}
+
+// Device fetches a device.
+func (c *Client) Device(ctx context.Context, dev int64) (api.Device, error) {
+	var out api.Device
+	_, err := c.do(ctx, "GET", "/api/v1/devices/"+id(dev), nil, &out)
+	return out, err
+}
+
+// UpdateDevice changes the settings of a device.
+func (c *Client) UpdateDevice(ctx context.Context, dev int64, req api.UpdateDeviceRequest) (api.Device, error) {
+	var out api.Device
+	_, err := c.do(ctx, "PATCH", "/api/v1/devices/"+id(dev), req, &out)
+	return out, err
+}
+
+// DeleteDevice deletes a device.
+func (c *Client) DeleteDevice(ctx context.Context, dev int64) error {
+	_, err := c.do(ctx, "DELETE", "/api/v1/devices/"+id(dev), nil, nil)
+	return err
+}
+
+// RotateDeviceKey replaces the public key of a device.
+func (c *Client) RotateDeviceKey(ctx context.Context, dev int64, req api.RotateKeyRequest) (api.Device, error) {
+	var out api.Device
+	_, err := c.do(ctx, "POST", "/api/v1/devices/"+id(dev)+"/rotate-key", req, &out)
+	return out, err
+}
+
+// ListNetworks lists the networks of the authenticated user along with their
+// devices, returning the cursor of the next page if there may be one.
+func (c *Client) ListNetworks(ctx context.Context, o ListOptions) ([]api.NetworkDevices, string, error) {
+	var out []api.NetworkDevices
+	resp, err := c.do(ctx, "GET", "/api/v1/networks"+encode(o.values()), nil, &out)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, resp.Header.Get(api.NextCursorHeader), nil
+}
+
+// NewNetwork creates a network.
+func (c *Client) NewNetwork(ctx context.Context, req api.NewNetworkRequest) (api.Network, error) {
+	var out api.Network
+	_, err := c.do(ctx, "POST", "/api/v1/networks", req, &out)
+	return out, err
+}
+
+// Network fetches a network along with its devices.
+func (c *Client) Network(ctx context.Context, nw int64) (api.NetworkDevices, error) {
+	var out api.NetworkDevices
+	_, err := c.do(ctx, "GET", "/api/v1/networks/"+id(nw), nil, &out)
+	return out, err
+}
+
+// UpdateNetwork changes the settings of a network.
+func (c *Client) UpdateNetwork(ctx context.Context, nw int64, req api.UpdateNetworkRequest) (api.Network, error) {
+	var out api.Network
+	_, err := c.do(ctx, "PATCH", "/api/v1/networks/"+id(nw), req, &out)
+	return out, err
+}
+
+// DeleteNetwork deletes a network.
+func (c *Client) DeleteNetwork(ctx context.Context, nw int64) error {
+	_, err := c.do(ctx, "DELETE", "/api/v1/networks/"+id(nw), nil, nil)
+	return err
+}
+
+// Join adds a device to a network.
+// If the network needs the approval of its owner, pending is true and the
+// device joins once they approve.
+func (c *Client) Join(ctx context.Context, nw, dev int64) (pending bool, err error) {
+	resp, err := c.do(ctx, "PUT", "/api/v1/networks/"+id(nw)+"/devices/"+id(dev), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	return resp.StatusCode == http.StatusAccepted, nil
+}
+
+// Leave removes a device from a network.
+func (c *Client) Leave(ctx context.Context, nw, dev int64) error {
+	_, err := c.do(ctx, "DELETE", "/api/v1/networks/"+id(nw)+"/devices/"+id(dev), nil, nil)
+	return err
+}
+
+// Requests lists the devices asking to join a network.
+func (c *Client) Requests(ctx context.Context, nw int64) ([]api.Device, error) {
+	var out []api.Device
+	_, err := c.do(ctx, "GET", "/api/v1/networks/"+id(nw)+"/requests", nil, &out)
+	return out, err
+}
+
+// Approve approves the request of a device to join a network.
+func (c *Client) Approve(ctx context.Context, nw, dev int64) error {
+	_, err := c.do(ctx, "POST", "/api/v1/networks/"+id(nw)+"/requests/"+id(dev), nil, nil)
+	return err
+}
+
+// Reject rejects the request of a device to join a network.
+func (c *Client) Reject(ctx context.Context, nw, dev int64) error {
+	_, err := c.do(ctx, "DELETE", "/api/v1/networks/"+id(nw)+"/requests/"+id(dev), nil, nil)
+	return err
+}
+
+// Punch fetches the pikopunch server to use.
+func (c *Client) Punch(ctx context.Context) (api.Punch, error) {
+	var out api.Punch
+	_, err := c.do(ctx, "GET", "/api/v1/punch", nil, &out)
+	return out, err
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mca3/mwr"
+	"github.com/mca3/pikorv/api"
+	"github.com/mca3/pikorv/config"
+	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/internal/logging"
+	"github.com/mca3/pikorv/routes"
+	"github.com/mca3/pikorv/routes/gateway"
+)
+
+var workers sync.Once
+
+// newServer serves the routes against an in-memory store.
+func newServer(t *testing.T) *httptest.Server {
+	config.JWTSecret = "test secret"
+	_, config.SubnetIp, _ = net.ParseCIDR("fd00::/32")
+
+	s := db.NewMemory()
+	routes.SetStore(s)
+	gateway.SetStore(s)
+	workers.Do(func() { gateway.InitWorkers(1, 16) })
+	t.Cleanup(gateway.WaitNotifications)
+
+	h := &mwr.Handler{}
+	h.Use(func(c *mwr.Ctx) error {
+		if err := c.Next(); err != nil {
+			t.Logf("%s %s: %v", c.Method(), c.Path(), err)
+		}
+		return nil
+	})
+	routes.Register(h)
+
+	srv := httptest.NewServer(logging.RequestIDs(h))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// login creates a user and logs in as them.
+func login(t *testing.T, srv *httptest.Server, name string) *Client {
+	t.Helper()
+
+	ctx := context.Background()
+	c := New(srv.URL)
+
+	if _, err := c.NewUser(ctx, api.NewUserRequest{
+		Username: name,
+		Email:    name + "@example.com",
+		Password: "hunter2",
+	}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	if err := c.Login(ctx, name, "hunter2"); err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+
+	return c
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t)
+	alice := login(t, srv, "alice")
+	bob := login(t, srv, "bob")
+
+	nw, err := alice.NewNetwork(ctx, api.NewNetworkRequest{Name: "home", Approval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev, err := bob.NewDevice(ctx, api.NewDeviceRequest{Name: "laptop", Key: "bob's key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "desktop"
+	if dev, err = bob.UpdateDevice(ctx, dev.ID, api.UpdateDeviceRequest{Name: &name}); err != nil {
+		t.Fatal(err)
+	} else if dev.Name != name {
+		t.Fatalf("device was not renamed: %+v", dev)
+	}
+
+	if _, err := alice.Device(ctx, dev.ID); !IsNotFound(err) {
+		t.Fatalf("expected 404, got %v", err)
+	} else if err.(*Error).RequestID == "" {
+		t.Fatal("error has no request ID")
+	}
+
+	if pending, err := bob.Join(ctx, nw.ID, dev.ID); err != nil {
+		t.Fatal(err)
+	} else if !pending {
+		t.Fatalf("joined without approval")
+	}
+
+	if reqs, err := alice.Requests(ctx, nw.ID); err != nil {
+		t.Fatal(err)
+	} else if len(reqs) != 1 || reqs[0].ID != dev.ID {
+		t.Fatalf("expected a request from %d, got %+v", dev.ID, reqs)
+	}
+
+	if err := alice.Approve(ctx, nw.ID, dev.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := alice.Network(ctx, nw.ID); err != nil {
+		t.Fatal(err)
+	} else if len(got.Devices) != 1 || got.Devices[0].ID != dev.ID {
+		t.Fatalf("expected %d in the network, got %+v", dev.ID, got.Devices)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := bob.NewDevice(ctx, api.NewDeviceRequest{Name: "phone" + id(int64(i)), Key: "key" + id(int64(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	o := DeviceOptions{ListOptions: ListOptions{Limit: 3}}
+	devs, cur, err := bob.ListDevices(ctx, o)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(devs) != 3 || cur == "" {
+		t.Fatalf("expected 3 devices and a cursor, got %d and %q", len(devs), cur)
+	}
+
+	o.Cursor = cur
+	if devs, cur, err = bob.ListDevices(ctx, o); err != nil {
+		t.Fatal(err)
+	} else if len(devs) != 1 || cur != "" {
+		t.Fatalf("expected 1 device and no cursor, got %d and %q", len(devs), cur)
+	}
+
+	if err := bob.DeleteDevice(ctx, dev.ID); err != nil {
+		t.Fatal(err)
+	} else if _, err := bob.Device(ctx, dev.ID); !IsNotFound(err) {
+		t.Fatalf("expected 404, got %v", err)
+	}
+
+	if _, _, err := bob.AdminUsers(ctx, ListOptions{}); err == nil {
+		t.Fatalf("bob is not an administrator")
+	}
+}
+
+// isProtocolError determines if err is a protocol error with the given code.
+func isProtocolError(err error, code string) bool {
+	var perr *api.ProtocolError
+	return errors.As(err, &perr) && perr.Code == code
+}
+
+func TestGateway(t *testing.T) {
+	t.Run("JSON", func(t *testing.T) { testGateway(t, "json") })
+	t.Run("CBOR", func(t *testing.T) { testGateway(t, "cbor") })
+	t.Run("Events", func(t *testing.T) { testGateway(t, "events") })
+}
+
+func testGateway(t *testing.T, transport string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := newServer(t)
+	alice := login(t, srv, "alice")
+	alice.CBOR = transport == "cbor"
+
+	connect := alice.Gateway
+	if transport == "events" {
+		connect = alice.GatewayEvents
+	}
+
+	nw, err := alice.NewNetwork(ctx, api.NewNetworkRequest{Name: "home"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	laptop, err := alice.NewDevice(ctx, api.NewDeviceRequest{Name: "laptop", Key: "laptop key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := connect(ctx, laptop.ID+1); !isProtocolError(err, api.ErrUnknownDevice) && !IsNotFound(err) {
+		t.Fatalf("expected %s, got %v", api.ErrUnknownDevice, err)
+	}
+
+	gw, err := connect(ctx, laptop.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	// Without a websocket, errors are returned right away.
+	if err := gw.Ping(ctx, "192.0.2.1:1234", "bogus"); transport == "events" {
+		var e *Error
+		if !errors.As(err, &e) || e.Status != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %v", err)
+		}
+	} else if err != nil {
+		t.Fatal(err)
+	} else if _, err := gw.Read(ctx); !isProtocolError(err, api.ErrMalformed) {
+		t.Fatalf("expected %s, got %v", api.ErrMalformed, err)
+	}
+
+	if err := gw.Ping(ctx, "192.0.2.1:1234", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := alice.Join(ctx, nw.ID, laptop.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		msg, err := gw.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type == api.MessageNetworkJoin {
+			if msg.Device == nil || msg.Device.ID != laptop.ID || msg.Network == nil || msg.Network.ID != nw.ID {
+				t.Fatalf("unexpected join message: %+v", msg)
+			}
+			break
+		}
+	}
+}
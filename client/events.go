@@ -0,0 +1,155 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mca3/pikorv/api"
+)
+
+// event is a message read from an event stream, or the error which ended it.
+type event struct {
+	msg api.Message
+	err error
+}
+
+// eventsConn receives messages as server-sent events, and sends pings with
+// plain requests.
+type eventsConn struct {
+	c      *Client
+	dev    int64
+	events chan event
+
+	// done is closed once the stream is closed.
+	done   <-chan struct{}
+	cancel context.CancelFunc
+}
+
+func (e *eventsConn) read(ctx context.Context) (api.Message, error) {
+	select {
+	case <-ctx.Done():
+		return api.Message{}, ctx.Err()
+	case ev, ok := <-e.events:
+		if !ok {
+			return api.Message{}, io.EOF
+		}
+		return ev.msg, ev.err
+	}
+}
+
+// send sends pings, which are the only messages that may be sent without a
+// websocket.
+func (e *eventsConn) send(ctx context.Context, msg api.Message) error {
+	msg.DeviceID = e.dev
+	_, err := e.c.do(ctx, "POST", "/api/v1/gateway/ping", msg, nil)
+	return err
+}
+
+func (e *eventsConn) close() error {
+	e.cancel()
+	return nil
+}
+
+// stream reads events from r until it ends.
+func (e *eventsConn) stream(r io.ReadCloser) {
+	defer close(e.events)
+	defer r.Close()
+
+	var data bytes.Buffer
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+
+		// Only the data matters, as it holds the type of the message.
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+
+			ev := event{}
+			ev.err = json.Unmarshal(data.Bytes(), &ev.msg)
+			data.Reset()
+
+			select {
+			case e.events <- ev:
+			case <-e.done:
+				return
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		select {
+		case e.events <- event{err: err}:
+		case <-e.done:
+		}
+	}
+}
+
+// GatewayEvents connects to the gateway as the device dev like Gateway, but
+// receives messages as server-sent events rather than over a websocket, which
+// works through proxies that don't support websockets.
+//
+// Only pings may be sent, which are sent as separate requests.
+// The stream ends once the connection is closed, so c.HTTP shouldn't have a
+// timeout.
+func (c *Client) GatewayEvents(ctx context.Context, dev int64) (*Gateway, error) {
+	// The stream outlives ctx.
+	sctx, cancel := context.WithCancel(context.Background())
+
+	connected := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-connected:
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(sctx, "GET", c.URL+"/api/v1/gateway/events?device="+id(dev), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(req)
+	close(connected)
+	if err != nil {
+		cancel()
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		err := responseError(resp)
+		resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+
+	e := &eventsConn{c: c, dev: dev, events: make(chan event, 16), done: sctx.Done(), cancel: cancel}
+	go e.stream(resp.Body)
+
+	g := &Gateway{conn: e}
+	if err := g.ready(ctx); err != nil {
+		e.close()
+		return nil, err
+	}
+	return g, nil
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/mca3/pikorv/api"
+	"nhooyr.io/websocket"
+)
+
+// Gateway is a connection to the gateway, over which the server tells devices
+// about changes to their networks and peers.
+type Gateway struct {
+	conn gatewayConn
+
+	// Capabilities holds the optional features of the server, such as
+	// api.CapabilityDNS.
+	Capabilities []string
+}
+
+// gatewayConn is how messages are exchanged with the gateway.
+type gatewayConn interface {
+	read(ctx context.Context) (api.Message, error)
+	send(ctx context.Context, msg api.Message) error
+	close() error
+}
+
+// wsConn exchanges messages over a websocket.
+type wsConn struct {
+	c *websocket.Conn
+
+	// typ is the type of websocket messages, which is binary for CBOR.
+	typ       websocket.MessageType
+	marshal   func(v any) ([]byte, error)
+	unmarshal func(b []byte, v any) error
+}
+
+func (w *wsConn) read(ctx context.Context) (api.Message, error) {
+	msg := api.Message{}
+
+	_, b, err := w.c.Read(ctx)
+	if err != nil {
+		return msg, err
+	}
+	return msg, w.unmarshal(b, &msg)
+}
+
+func (w *wsConn) send(ctx context.Context, msg api.Message) error {
+	b, err := w.marshal(msg)
+	if err != nil {
+		return err
+	}
+	return w.c.Write(ctx, w.typ, b)
+}
+
+func (w *wsConn) close() error {
+	return w.c.Close(websocket.StatusNormalClosure, "")
+}
+
+// Gateway connects to the gateway over a websocket as the device dev, which
+// must be owned by the authenticated user.
+func (c *Client) Gateway(ctx context.Context, dev int64) (*Gateway, error) {
+	url := "ws" + strings.TrimPrefix(c.URL, "http") + "/api/v1/gateway"
+
+	protos := []string{api.SubprotocolJSON}
+	if c.CBOR {
+		protos = []string{api.SubprotocolCBOR, api.SubprotocolJSON}
+	}
+
+	conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPClient: c.HTTP,
+		HTTPHeader: http.Header{
+			"Authorization": {"Bearer " + c.Token},
+		},
+		Subprotocols:    protos,
+		CompressionMode: websocket.CompressionContextTakeover,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wsConn{c: conn, typ: websocket.MessageText, marshal: json.Marshal, unmarshal: json.Unmarshal}
+	if conn.Subprotocol() == api.SubprotocolCBOR {
+		w.typ, w.marshal, w.unmarshal = websocket.MessageBinary, cbor.Marshal, cbor.Unmarshal
+	}
+
+	g := &Gateway{conn: w}
+
+	err = g.Send(ctx, api.Message{
+		Type:     api.MessageHello,
+		Version:  api.ProtocolVersion,
+		DeviceID: dev,
+	})
+	if err == nil {
+		err = g.ready(ctx)
+	}
+	if err != nil {
+		w.close()
+		return nil, err
+	}
+	return g, nil
+}
+
+// ready waits for the server to be ready.
+func (g *Gateway) ready(ctx context.Context) error {
+	msg, err := g.Read(ctx)
+	if err != nil {
+		return err
+	} else if msg.Type != api.MessageReady {
+		return fmt.Errorf("expected %q, got %q", api.MessageReady, msg.Type)
+	}
+
+	g.Capabilities = msg.Capabilities
+	return nil
+}
+
+// Read waits for the next message from the gateway.
+// Error messages are returned as a *api.ProtocolError, after which more
+// messages may be read.
+func (g *Gateway) Read(ctx context.Context) (api.Message, error) {
+	msg, err := g.conn.read(ctx)
+	if err != nil {
+		return msg, err
+	}
+
+	if msg.Type == api.MessageError {
+		if msg.Error == nil {
+			msg.Error = &api.ProtocolError{}
+		}
+		return msg, msg.Error
+	}
+	return msg, nil
+}
+
+// Send sends a message to the gateway.
+func (g *Gateway) Send(ctx context.Context, msg api.Message) error {
+	return g.conn.send(ctx, msg)
+}
+
+// Ping reports the endpoint of the device and the NAT it is behind, either of
+// which may be empty.
+func (g *Gateway) Ping(ctx context.Context, endpoint, nat string) error {
+	return g.Send(ctx, api.Message{
+		Type:     api.MessagePing,
+		Endpoint: endpoint,
+		NAT:      nat,
+	})
+}
+
+// Close closes the connection.
+func (g *Gateway) Close() error {
+	return g.conn.close()
+}
@@ -19,20 +19,110 @@ var (
 	PunchPort       = 18732
 	PunchPrivateKey = ""
 	PunchPublicKey  = ""
+
+	// PunchService is the port the pikopunch server listens on at PunchIP,
+	// over WireGuard, and which clients are told to use.
+	PunchService = 8743
+
+	// PunchProbe holds the addresses of pikopunch servers which clients may
+	// probe to classify their NAT. There must be none, or at least two, as
+	// the NAT is classified by comparing what each of them sees.
+	PunchProbe []string
+
+	// PunchPublic holds the addresses of pikopunch servers which clients may
+	// use without a WireGuard tunnel. There are none by default.
+	PunchPublic []string
+
+	// PunchRate is the amount of packets per second that a single address
+	// may send to each pikopunch server.
+	PunchRate = 10
+
+	// PunchBackend is the WireGuard implementation used: the "kernel"
+	// module, or "userspace" for wireguard-go.
+	PunchBackend = "kernel"
+
+	// PunchExisting is what the kernel backend does with a WireGuard
+	// interface which already exists: "recreate" it, or "adopt" it as it
+	// is.
+	PunchExisting = "recreate"
+
+	// DNSListen is the address the DNS server listens on over UDP and
+	// TCP, which may be reachable only over WireGuard. DNS isn't served if
+	// it is empty.
+	DNSListen = ""
+
+	// DNSZone is the zone the DNS server is authoritative for.
+	DNSZone = "pikonet."
+
+	// RelayListen is the UDP address the relay listens on. The relay is
+	// disabled if it is empty.
+	RelayListen = ""
+
+	// RelayEndpoint is the address clients are told to send relay packets
+	// to, which is OurIP with the port of RelayListen if empty.
+	RelayEndpoint = ""
+
+	// RelayRate is the amount of bytes per second each device may send
+	// through the relay, which is 1 MiB/s by default.
+	RelayRate = 1 << 20
+
+	// RelaySecret is used to sign the tokens devices present to the relay.
+	// If it is empty, a random secret is used, and tokens are only valid
+	// until the server restarts.
+	RelaySecret = ""
+
+	// Admins holds the usernames of users which are made administrators
+	// when the server starts.
+	Admins []string
+
+	// GatewayCompression is how gateway messages are compressed: not at
+	// all ("disabled"), each on their own ("message"), or using everything
+	// sent before ("context"), which takes 8 KiB per connection.
+	GatewayCompression = "context"
+
+	// MetricsListen is the address metrics are served on at /metrics, which
+	// is kept apart from HttpAddr so it needn't be public. Metrics aren't
+	// served if it is empty.
+	MetricsListen = ""
+
+	// LogLevel is the least severe level which is logged: "debug",
+	// "info", "warn", or "error".
+	LogLevel = "info"
+
+	// LogFormat is how logs are written: as "text", or as "json" with a
+	// record on each line.
+	LogFormat = "text"
 )
 
 func Load() error {
 	cfg := struct {
-		Dburl           string `json:"database"`
-		Http            string `json:"http"`
-		Subnet          string `json:"subnet"`
-		Jwt             string `json:"jwt_secret"`
-		Punch           string `json:"punch_interface"`
-		PunchIP         string `json:"punch_ip"`
-		PunchPort       int    `json:"punch_port"`
-		PunchPrivateKey string `json:"punch_private_key"`
-		PunchPublicKey  string `json:"punch_public_key"`
-		OurIP           string `json:"our_ip"`
+		Dburl           string   `json:"database"`
+		Http            string   `json:"http"`
+		Subnet          string   `json:"subnet"`
+		Jwt             string   `json:"jwt_secret"`
+		Punch           string   `json:"punch_interface"`
+		PunchIP         string   `json:"punch_ip"`
+		PunchPort       int      `json:"punch_port"`
+		PunchPrivateKey string   `json:"punch_private_key"`
+		PunchPublicKey  string   `json:"punch_public_key"`
+		OurIP           string   `json:"our_ip"`
+		DNSListen       string   `json:"dns_listen"`
+		DNSZone         string   `json:"dns_zone"`
+		RelayListen     string   `json:"relay_listen"`
+		RelayEndpoint   string   `json:"relay_endpoint"`
+		RelayRate       int      `json:"relay_rate"`
+		RelaySecret     string   `json:"relay_secret"`
+		PunchProbe      []string `json:"punch_probe"`
+		PunchRate       int      `json:"punch_rate"`
+		PunchService    int      `json:"punch_service_port"`
+		PunchPublic     []string `json:"punch_public"`
+		PunchBackend    string   `json:"punch_backend"`
+		PunchExisting   string   `json:"punch_existing"`
+		Admins          []string `json:"admins"`
+		GatewayCompress string   `json:"gateway_compression"`
+		MetricsListen   string   `json:"metrics_listen"`
+		LogLevel        string   `json:"log_level"`
+		LogFormat       string   `json:"log_format"`
 	}{}
 
 	f, err := os.Open(ConfPath)
@@ -63,6 +153,72 @@ func Load() error {
 	if cfg.PunchPort != 0 {
 		PunchPort = cfg.PunchPort
 	}
+	if cfg.DNSListen != "" {
+		DNSListen = cfg.DNSListen
+	}
+	if cfg.DNSZone != "" {
+		DNSZone = cfg.DNSZone
+	}
+	if cfg.RelayListen != "" {
+		RelayListen = cfg.RelayListen
+	}
+	if cfg.RelayEndpoint != "" {
+		RelayEndpoint = cfg.RelayEndpoint
+	}
+	if cfg.RelayRate != 0 {
+		RelayRate = cfg.RelayRate
+	}
+	if cfg.RelaySecret != "" {
+		RelaySecret = cfg.RelaySecret
+	}
+	if len(cfg.PunchProbe) == 1 {
+		panic("punch_probe needs at least two addresses")
+	}
+	PunchProbe = cfg.PunchProbe
+	if cfg.PunchRate != 0 {
+		PunchRate = cfg.PunchRate
+	}
+	if cfg.PunchService != 0 {
+		PunchService = cfg.PunchService
+	}
+	PunchPublic = cfg.PunchPublic
+	switch cfg.PunchBackend {
+	case "":
+	case "kernel", "userspace":
+		PunchBackend = cfg.PunchBackend
+	default:
+		panic("punch_backend must be kernel or userspace")
+	}
+	switch cfg.PunchExisting {
+	case "":
+	case "recreate", "adopt":
+		PunchExisting = cfg.PunchExisting
+	default:
+		panic("punch_existing must be recreate or adopt")
+	}
+	Admins = cfg.Admins
+	switch cfg.GatewayCompress {
+	case "":
+	case "disabled", "message", "context":
+		GatewayCompression = cfg.GatewayCompress
+	default:
+		panic("gateway_compression must be disabled, message, or context")
+	}
+	MetricsListen = cfg.MetricsListen
+	switch cfg.LogLevel {
+	case "":
+	case "debug", "info", "warn", "error":
+		LogLevel = cfg.LogLevel
+	default:
+		panic("log_level must be debug, info, warn, or error")
+	}
+	switch cfg.LogFormat {
+	case "":
+	case "text", "json":
+		LogFormat = cfg.LogFormat
+	default:
+		panic("log_format must be text or json")
+	}
 	if cfg.PunchPrivateKey == "" {
 		panic("punch_private_key is empty")
 	}
@@ -0,0 +1,330 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Sort orders of lists.
+const (
+	SortID   = "id"
+	SortName = "name"
+)
+
+// Cursor is the position of the last item of a page, which the next page
+// starts after.
+type Cursor struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// ListOptions selects and orders a page of a list of users, networks, or
+// devices.
+//
+// The names of users are their usernames.
+type ListOptions struct {
+	// Prefix only includes items whose names start with it.
+	Prefix string
+
+	// Sort is either SortID or SortName, and defaults to SortID.
+	// Desc reverses the order.
+	Sort string
+	Desc bool
+
+	// After only includes items after it in the sort order.
+	After *Cursor
+
+	// Limit is the most items that are returned, or zero for no limit.
+	Limit int
+}
+
+// DeviceOptions selects and orders a page of a list of devices.
+type DeviceOptions struct {
+	ListOptions
+
+	// Tag only includes devices with this tag.
+	Tag string
+
+	// Only, if not nil, only includes devices with these IDs.
+	// Except excludes devices with these IDs.
+	Only, Except []int64
+}
+
+// CursorOf returns the cursor for an item with the given ID and name.
+func (o ListOptions) CursorOf(id int64, name string) *Cursor {
+	if o.Sort == SortName {
+		return &Cursor{ID: id, Name: name}
+	}
+	return &Cursor{ID: id}
+}
+
+// listQuery builds a query for a list using options.
+//
+// Conditions are written with "?" placeholders, which are numbered for
+// PostgreSQL.
+type listQuery struct {
+	numbered bool
+
+	// nameCol is the column holding the names of items, which is "name"
+	// if empty.
+	nameCol string
+
+	where []string
+	args  []any
+}
+
+// cond adds a condition and its arguments.
+func (q *listQuery) cond(c string, args ...any) {
+	q.where = append(q.where, c)
+	q.args = append(q.args, args...)
+}
+
+// in adds a condition that col is one of ids.
+func (q *listQuery) in(col string, ids []int64, not bool) {
+	if len(ids) == 0 {
+		if !not {
+			q.cond("FALSE")
+		}
+		return
+	}
+
+	args := make([]any, len(ids))
+	for i, v := range ids {
+		args[i] = v
+	}
+
+	op := "IN"
+	if not {
+		op = "NOT IN"
+	}
+	q.cond(col+" "+op+" ("+strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")+")", args...)
+}
+
+// list adds the conditions and order of o, for a table with the id column
+// and q.nameCol.
+func (q *listQuery) list(o ListOptions) string {
+	name := q.nameCol
+	if name == "" {
+		name = "name"
+	}
+
+	if o.Prefix != "" {
+		// Not LIKE, which would need escaping and is case-insensitive in
+		// SQLite.
+		q.cond("substr("+name+", 1, ?) = ?", utf8.RuneCountInString(o.Prefix), o.Prefix)
+	}
+
+	col := "id"
+	if o.Sort == SortName {
+		col = name
+	}
+
+	dir, cmp := "ASC", ">"
+	if o.Desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	// Names are unique, so they alone are enough for the cursor.
+	if o.After != nil && col == name {
+		q.cond(name+" "+cmp+" ?", o.After.Name)
+	} else if o.After != nil {
+		q.cond("id "+cmp+" ?", o.After.ID)
+	}
+
+	order := " ORDER BY " + col + " " + dir
+	if o.Limit > 0 {
+		order += " LIMIT " + strconv.Itoa(o.Limit)
+	}
+	return order
+}
+
+// build returns the query, which is the columns and table in sel followed by
+// the conditions and then suffix, along with its arguments.
+func (q *listQuery) build(sel, suffix string) (string, []any) {
+	s := sel
+	if len(q.where) > 0 {
+		s += " WHERE " + strings.Join(q.where, " AND ")
+	}
+	s += suffix
+
+	if q.numbered {
+		var b strings.Builder
+		n := 0
+		for _, r := range s {
+			if r != '?' {
+				b.WriteRune(r)
+				continue
+			}
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		}
+		s = b.String()
+	}
+
+	return s, q.args
+}
+
+// userListQuery builds the query for ListUsers.
+func userListQuery(o ListOptions, numbered bool) (string, []any) {
+	q := &listQuery{numbered: numbered, nameCol: "username"}
+
+	order := q.list(o)
+	return q.build("SELECT id, username, email, name, is_admin, disabled, locked_until FROM users", order)
+}
+
+// deviceListQuery builds the query for ListDevices.
+func deviceListQuery(owner int64, o DeviceOptions, numbered bool) (string, []any) {
+	q := &listQuery{numbered: numbered}
+	if owner != 0 {
+		q.cond("owner = ?", owner)
+	}
+
+	if o.Tag != "" {
+		q.cond("id IN (SELECT device FROM device_tags WHERE tag = ?)", o.Tag)
+	}
+	if o.Only != nil {
+		q.in("id", o.Only, false)
+	}
+	if o.Except != nil {
+		q.in("id", o.Except, true)
+	}
+
+	order := q.list(o.ListOptions)
+	return q.build("SELECT id, owner, name, pubkey, ip, endpoint, nat FROM devices", order)
+}
+
+// networkListQuery builds the query for ListNetworks.
+func networkListQuery(owner int64, o ListOptions, numbered bool) (string, []any) {
+	q := &listQuery{numbered: numbered}
+	if owner != 0 {
+		q.cond("owner = ?", owner)
+	}
+
+	order := q.list(o)
+	return q.build("SELECT id, owner, name, approval FROM networks", order)
+}
+
+// membersQuery builds a query which selects the active members of the
+// networks nwids, or the networks of the devices devids, depending on which
+// of the two is not nil.
+// The first column is the network or device ID that each row belongs to.
+func membersQuery(nwids, devids []int64, numbered bool) (string, []any) {
+	q := &listQuery{numbered: numbered}
+	q.cond("nwdevs.status = ?", MemberActive)
+
+	if nwids != nil {
+		q.in("nwdevs.network", nwids, false)
+		return q.build(`
+			SELECT
+				nwdevs.network,
+				devices.id,
+				devices.owner,
+				devices.name,
+				devices.pubkey,
+				devices.ip,
+				devices.endpoint,
+				devices.nat
+			FROM nwdevs
+			INNER JOIN devices ON devices.id = nwdevs.device
+		`, " ORDER BY devices.id")
+	}
+
+	q.in("nwdevs.device", devids, false)
+	return q.build(`
+		SELECT
+			nwdevs.device,
+			networks.id,
+			networks.owner,
+			networks.name,
+			networks.approval
+		FROM nwdevs
+		INNER JOIN networks ON networks.id = nwdevs.network
+	`, " ORDER BY networks.id")
+}
+
+// tagsQuery builds a query which selects the device and tag of every tag of
+// the devices devids.
+func tagsQuery(devids []int64, numbered bool) (string, []any) {
+	q := &listQuery{numbered: numbered}
+	q.in("device", devids, false)
+	return q.build("SELECT device, tag FROM device_tags", " ORDER BY device, tag")
+}
+
+// rowScanner is implemented by both pgx.Rows and *sql.Rows.
+type rowScanner interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+}
+
+// scanUsers reads the rows of a userListQuery, or any other query selecting
+// the same columns.
+func scanUsers(rows rowScanner) ([]User, error) {
+	var us []User
+
+	for rows.Next() {
+		u := User{}
+		var ns sql.NullString
+		if err := rows.Scan(&u.ID, &u.Username, &u.Email, &ns, &u.Admin, &u.Disabled, &u.LockedUntil); err != nil {
+			return us, err
+		}
+		u.Name = ns.String
+		us = append(us, u)
+	}
+
+	return us, rows.Err()
+}
+
+// scanMemberDevices reads the rows of a membersQuery for networks.
+func scanMemberDevices(rows rowScanner) (map[int64][]Device, error) {
+	m := map[int64][]Device{}
+
+	for rows.Next() {
+		var nwid int64
+		d := Device{}
+		var ens, nns sql.NullString
+		if err := rows.Scan(&nwid, &d.ID, &d.Owner, &d.Name, &d.PublicKey, &d.IP, &ens, &nns); err != nil {
+			return m, err
+		}
+		d.Endpoint = ens.String
+		d.NAT = nns.String
+		m[nwid] = append(m[nwid], d)
+	}
+
+	return m, rows.Err()
+}
+
+// scanMemberNetworks reads the rows of a membersQuery for devices.
+func scanMemberNetworks(rows rowScanner) (map[int64][]Network, error) {
+	m := map[int64][]Network{}
+
+	for rows.Next() {
+		var devid int64
+		n := Network{}
+		if err := rows.Scan(&devid, &n.ID, &n.Owner, &n.Name, &n.Approval); err != nil {
+			return m, err
+		}
+		m[devid] = append(m[devid], n)
+	}
+
+	return m, rows.Err()
+}
+
+// scanTags reads the rows of a tagsQuery.
+func scanTags(rows rowScanner) (map[int64][]string, error) {
+	m := map[int64][]string{}
+
+	for rows.Next() {
+		var devid int64
+		var tag string
+		if err := rows.Scan(&devid, &tag); err != nil {
+			return m, err
+		}
+		m[devid] = append(m[devid], tag)
+	}
+
+	return m, rows.Err()
+}
@@ -0,0 +1,684 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Memory is a Store which keeps everything in memory, intended for tests.
+//
+// It enforces the same uniqueness constraints and cascading deletes as the
+// Postgres store.
+type Memory struct {
+	mu sync.Mutex
+
+	users    map[int64]*memUser
+	networks map[int64]Network
+	devices  map[int64]Device
+	members  map[member]string
+	tags     map[int64][]string
+
+	lastID int64
+}
+
+var _ Store = (*Memory)(nil)
+
+type memUser struct {
+	User
+	password, salt []byte
+}
+
+// member identifies the membership of a device in a network.
+type member struct {
+	network, device int64
+}
+
+// NewMemory creates an empty Memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		users:    make(map[int64]*memUser),
+		networks: make(map[int64]Network),
+		devices:  make(map[int64]Device),
+		members:  make(map[member]string),
+		tags:     make(map[int64][]string),
+	}
+}
+
+// nextID returns a new ID.
+// m.mu is assumed to be locked.
+func (m *Memory) nextID() int64 {
+	m.lastID++
+	return m.lastID
+}
+
+// conflict returns an error for a uniqueness constraint violation.
+func conflict(what string) error {
+	return fmt.Errorf("%w: %s", ErrConflict, what)
+}
+
+// sortedKeys returns the keys of a map in ascending order.
+func sortedKeys[K int | int64, T any](m map[K]T) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func (m *Memory) Users(ctx context.Context) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var us []User
+	for _, k := range sortedKeys(m.users) {
+		us = append(us, m.users[k].User)
+	}
+	return us, nil
+}
+
+func (m *Memory) ListUsers(ctx context.Context, o ListOptions) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var us []User
+	for _, u := range m.users {
+		if o.includes(u.ID, u.Username) {
+			us = append(us, u.User)
+		}
+	}
+
+	return page(us, o, func(u User) (int64, string) { return u.ID, u.Username }), nil
+}
+
+func (m *Memory) UserID(ctx context.Context, id int64) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return User{ID: id}, ErrNotFound
+	}
+	return u.User, nil
+}
+
+func (m *Memory) Username(ctx context.Context, username string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Username == username {
+			return u.User, nil
+		}
+	}
+	return User{Username: username}, ErrNotFound
+}
+
+func (m *Memory) SaveUser(ctx context.Context, u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, v := range m.users {
+		if v.ID == u.ID {
+			continue
+		} else if u.ID == 0 && v.Username == u.Username {
+			return conflict("username")
+		} else if v.Email == u.Email {
+			return conflict("email")
+		}
+	}
+
+	if u.ID == 0 {
+		u.ID = m.nextID()
+		m.users[u.ID] = &memUser{User: *u}
+		return nil
+	}
+
+	mu, ok := m.users[u.ID]
+	if !ok {
+		return nil
+	}
+
+	// The username can't be changed.
+	mu.Email = u.Email
+	mu.Name = u.Name
+	mu.Admin = u.Admin
+	mu.Disabled = u.Disabled
+	mu.LockedUntil = u.LockedUntil
+	return nil
+}
+
+func (m *Memory) SetPassword(ctx context.Context, id int64, pass string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil
+	}
+
+	u.salt = makeSalt()
+	u.password = hashPassword(pass, u.salt)
+	return nil
+}
+
+func (m *Memory) CheckPassword(ctx context.Context, username, pass string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Username != username {
+			continue
+		}
+
+		if u.password != nil && bytes.Equal(hashPassword(pass, u.salt), u.password) {
+			return u.ID
+		}
+		return -1
+	}
+	return -1
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.users, id)
+
+	for k, v := range m.networks {
+		if v.Owner == id {
+			m.deleteNetwork(k)
+		}
+	}
+
+	for k, v := range m.devices {
+		if v.Owner == id {
+			m.deleteDevice(k)
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) Networks(ctx context.Context, owner int64) ([]Network, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ns []Network
+	for _, k := range sortedKeys(m.networks) {
+		if nw := m.networks[k]; nw.Owner == owner {
+			ns = append(ns, nw)
+		}
+	}
+	return ns, nil
+}
+
+func (m *Memory) ListNetworks(ctx context.Context, owner int64, o ListOptions) ([]Network, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ns []Network
+	for _, nw := range m.networks {
+		if (owner == 0 || nw.Owner == owner) && o.includes(nw.ID, nw.Name) {
+			ns = append(ns, nw)
+		}
+	}
+
+	return page(ns, o, func(nw Network) (int64, string) { return nw.ID, nw.Name }), nil
+}
+
+func (m *Memory) AllNetworks(ctx context.Context) ([]Network, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ns []Network
+	for _, k := range sortedKeys(m.networks) {
+		ns = append(ns, m.networks[k])
+	}
+	return ns, nil
+}
+
+func (m *Memory) NetworkID(ctx context.Context, id int64) (Network, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nw, ok := m.networks[id]
+	if !ok {
+		return Network{ID: id}, ErrNotFound
+	}
+	return nw, nil
+}
+
+func (m *Memory) SaveNetwork(ctx context.Context, n *Network) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, v := range m.networks {
+		if v.ID != n.ID && v.Name == n.Name {
+			return conflict("network name")
+		}
+	}
+
+	if n.ID == 0 {
+		if _, ok := m.users[n.Owner]; !ok {
+			return fmt.Errorf("user %d does not exist", n.Owner)
+		}
+
+		n.ID = m.nextID()
+		m.networks[n.ID] = *n
+		return nil
+	}
+
+	old, ok := m.networks[n.ID]
+	if !ok {
+		return nil
+	}
+
+	// The owner can't be changed.
+	old.Name = n.Name
+	old.Approval = n.Approval
+	m.networks[n.ID] = old
+	return nil
+}
+
+func (m *Memory) DeleteNetwork(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteNetwork(id)
+	return nil
+}
+
+// deleteNetwork deletes a network and its memberships.
+// m.mu is assumed to be locked.
+func (m *Memory) deleteNetwork(id int64) {
+	delete(m.networks, id)
+
+	for k := range m.members {
+		if k.network == id {
+			delete(m.members, k)
+		}
+	}
+}
+
+func (m *Memory) NetworkDevices(ctx context.Context, nwid int64) ([]Device, error) {
+	return m.networkDevices(nwid, MemberActive), nil
+}
+
+func (m *Memory) NetworksDevices(ctx context.Context, nwids []int64) (map[int64][]Device, error) {
+	ds := map[int64][]Device{}
+	for _, id := range nwids {
+		if v := m.networkDevices(id, MemberActive); v != nil {
+			ds[id] = v
+		}
+	}
+	return ds, nil
+}
+
+func (m *Memory) NetworkRequests(ctx context.Context, nwid int64) ([]Device, error) {
+	return m.networkDevices(nwid, MemberPending), nil
+}
+
+// networkDevices returns all devices in a network with the given membership
+// status.
+func (m *Memory) networkDevices(nwid int64, status string) []Device {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ds []Device
+	for _, k := range sortedKeys(m.devices) {
+		if m.members[member{nwid, k}] == status {
+			ds = append(ds, m.devices[k])
+		}
+	}
+	return ds
+}
+
+// addMember adds a device to a network with the given status.
+func (m *Memory) addMember(nwid, devid int64, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.networks[nwid]; !ok {
+		return fmt.Errorf("network %d does not exist", nwid)
+	} else if _, ok := m.devices[devid]; !ok {
+		return fmt.Errorf("device %d does not exist", devid)
+	}
+
+	k := member{nwid, devid}
+	if _, ok := m.members[k]; ok {
+		return conflict("membership")
+	}
+
+	m.members[k] = status
+	return nil
+}
+
+func (m *Memory) NetworkAdd(ctx context.Context, nwid, devid int64) error {
+	return m.addMember(nwid, devid, MemberActive)
+}
+
+func (m *Memory) NetworkRequest(ctx context.Context, nwid, devid int64) error {
+	return m.addMember(nwid, devid, MemberPending)
+}
+
+func (m *Memory) NetworkApprove(ctx context.Context, nwid, devid int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := member{nwid, devid}
+	if m.members[k] != MemberPending {
+		return ErrNotFound
+	}
+
+	m.members[k] = MemberActive
+	return nil
+}
+
+func (m *Memory) NetworkReject(ctx context.Context, nwid, devid int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := member{nwid, devid}
+	if m.members[k] != MemberPending {
+		return ErrNotFound
+	}
+
+	delete(m.members, k)
+	return nil
+}
+
+func (m *Memory) NetworkStatus(ctx context.Context, nwid, devid int64) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status, ok := m.members[member{nwid, devid}]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return status, nil
+}
+
+func (m *Memory) NetworkRemove(ctx context.Context, nwid, devid int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.members, member{nwid, devid})
+	return nil
+}
+
+func (m *Memory) AllDevices(ctx context.Context) ([]Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ds []Device
+	for _, k := range sortedKeys(m.devices) {
+		ds = append(ds, m.devices[k])
+	}
+	return ds, nil
+}
+
+func (m *Memory) Devices(ctx context.Context, owner int64) ([]Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ds []Device
+	for _, k := range sortedKeys(m.devices) {
+		if d := m.devices[k]; d.Owner == owner {
+			ds = append(ds, d)
+		}
+	}
+	return ds, nil
+}
+
+func (m *Memory) ListDevices(ctx context.Context, owner int64, o DeviceOptions) ([]Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ds []Device
+	for _, d := range m.devices {
+		if (owner != 0 && d.Owner != owner) || !o.includes(d.ID, d.Name) {
+			continue
+		} else if o.Tag != "" && !contains(m.tags[d.ID], o.Tag) {
+			continue
+		} else if o.Only != nil && !contains(o.Only, d.ID) {
+			continue
+		} else if contains(o.Except, d.ID) {
+			continue
+		}
+		ds = append(ds, d)
+	}
+
+	return page(ds, o.ListOptions, func(d Device) (int64, string) { return d.ID, d.Name }), nil
+}
+
+// includes determines if an item with the given ID and name matches the
+// prefix and comes after the cursor of o.
+func (o ListOptions) includes(id int64, name string) bool {
+	if !strings.HasPrefix(name, o.Prefix) {
+		return false
+	} else if o.After == nil {
+		return true
+	}
+
+	cmp := 0
+	if o.Sort == SortName {
+		cmp = strings.Compare(name, o.After.Name)
+	} else if id < o.After.ID {
+		cmp = -1
+	} else if id > o.After.ID {
+		cmp = 1
+	}
+
+	if o.Desc {
+		return cmp < 0
+	}
+	return cmp > 0
+}
+
+// page sorts items as o asks for, and returns at most o.Limit of them.
+func page[T any](items []T, o ListOptions, key func(v T) (int64, string)) []T {
+	sort.Slice(items, func(i, j int) bool {
+		if o.Desc {
+			i, j = j, i
+		}
+
+		ii, in := key(items[i])
+		ji, jn := key(items[j])
+		if o.Sort == SortName {
+			return in < jn
+		}
+		return ii < ji
+	})
+
+	if o.Limit > 0 && len(items) > o.Limit {
+		items = items[:o.Limit]
+	}
+	return items
+}
+
+// contains determines if v is in s.
+func contains[T comparable](s []T, v T) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// findDevice returns the first device for which f returns true.
+func (m *Memory) findDevice(f func(d Device) bool) (Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, d := range m.devices {
+		if f(d) {
+			return d, nil
+		}
+	}
+	return Device{}, ErrNotFound
+}
+
+func (m *Memory) DeviceID(ctx context.Context, id int64) (Device, error) {
+	return m.findDevice(func(d Device) bool { return d.ID == id })
+}
+
+func (m *Memory) DeviceIP(ctx context.Context, ip string) (Device, error) {
+	return m.findDevice(func(d Device) bool { return d.IP == ip })
+}
+
+func (m *Memory) DeviceKey(ctx context.Context, key string) (Device, error) {
+	return m.findDevice(func(d Device) bool { return d.PublicKey == key })
+}
+
+func (m *Memory) SaveDevice(ctx context.Context, d *Device) error {
+	if d.IP == "" {
+		panic("ip is nil")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, v := range m.devices {
+		if v.ID == d.ID {
+			continue
+		} else if v.Name == d.Name {
+			return conflict("device name")
+		} else if v.PublicKey == d.PublicKey {
+			return conflict("public key")
+		} else if v.IP == d.IP {
+			return conflict("ip")
+		}
+	}
+
+	if d.ID == 0 {
+		if _, ok := m.users[d.Owner]; !ok {
+			return fmt.Errorf("user %d does not exist", d.Owner)
+		}
+
+		d.ID = m.nextID()
+		m.devices[d.ID] = *d
+		return nil
+	}
+
+	old, ok := m.devices[d.ID]
+	if !ok {
+		return nil
+	}
+
+	// The owner can't be changed.
+	nd := *d
+	nd.Owner = old.Owner
+	m.devices[d.ID] = nd
+	return nil
+}
+
+func (m *Memory) DeleteDevice(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteDevice(id)
+	return nil
+}
+
+// deleteDevice deletes a device and its memberships.
+// m.mu is assumed to be locked.
+func (m *Memory) deleteDevice(id int64) {
+	delete(m.devices, id)
+	delete(m.tags, id)
+
+	for k := range m.members {
+		if k.device == id {
+			delete(m.members, k)
+		}
+	}
+}
+
+func (m *Memory) DeviceNetworks(ctx context.Context, devid int64) ([]Network, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ns []Network
+	for _, k := range sortedKeys(m.networks) {
+		if m.members[member{k, devid}] == MemberActive {
+			ns = append(ns, m.networks[k])
+		}
+	}
+	return ns, nil
+}
+
+func (m *Memory) DevicesNetworks(ctx context.Context, devids []int64) (map[int64][]Network, error) {
+	ns := map[int64][]Network{}
+	for _, id := range devids {
+		v, _ := m.DeviceNetworks(ctx, id)
+		if v != nil {
+			ns[id] = v
+		}
+	}
+	return ns, nil
+}
+
+func (m *Memory) DeviceTags(ctx context.Context, devids []int64) (map[int64][]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ts := map[int64][]string{}
+	for _, id := range devids {
+		if v := m.tags[id]; v != nil {
+			ts[id] = append([]string(nil), v...)
+		}
+	}
+	return ts, nil
+}
+
+func (m *Memory) SetDeviceTags(ctx context.Context, devid int64, tags []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[devid]; !ok {
+		return nil
+	}
+
+	var ts []string
+	for _, t := range tags {
+		if !contains(ts, t) {
+			ts = append(ts, t)
+		}
+	}
+	sort.Strings(ts)
+
+	if ts == nil {
+		delete(m.tags, devid)
+	} else {
+		m.tags[devid] = ts
+	}
+	return nil
+}
+
+func (m *Memory) ConnectedTo(ctx context.Context, devid int64) ([]Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ds []Device
+	for _, k := range sortedKeys(m.devices) {
+		if k == devid {
+			continue
+		}
+
+		for nw := range m.networks {
+			if m.members[member{nw, devid}] == MemberActive && m.members[member{nw, k}] == MemberActive {
+				ds = append(ds, m.devices[k])
+				break
+			}
+		}
+	}
+	return ds, nil
+}
+
+// Close does nothing.
+func (m *Memory) Close() {}
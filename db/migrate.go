@@ -0,0 +1,248 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrModified is returned when a migration that has already been
+	// applied was changed afterwards.
+	ErrModified = errors.New("applied migration was modified")
+
+	// ErrIrreversible is returned when trying to revert a migration that
+	// has no down SQL.
+	ErrIrreversible = errors.New("migration cannot be reverted")
+)
+
+// migrationLockKey is the key of the PostgreSQL advisory lock held while
+// migrating, so that several servers starting at once don't race.
+const migrationLockKey = 0x70696b6f7276 // "pikorv"
+
+// Migration is a numbered change to the database schema.
+type Migration struct {
+	Version int
+	Name    string
+
+	// Up applies the migration, and Down reverts it.
+	Up, Down string
+}
+
+// Checksum returns the checksum of the migration's up SQL, which is recorded
+// when it is applied so that later changes to it can be noticed.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrationStatus describes a migration and whether it has been applied.
+type MigrationStatus struct {
+	Migration
+
+	Applied   bool
+	AppliedAt time.Time
+
+	// Modified is set if the migration was changed after it was applied.
+	Modified bool
+
+	// Unknown is set if the migration was applied by a newer version of
+	// pikorv, in which case only Version and AppliedAt are meaningful.
+	Unknown bool
+}
+
+// Migrator is implemented by stores which have a schema that may need to be
+// migrated.
+type Migrator interface {
+	// Migrations returns the status of every migration, known or applied,
+	// in order.
+	Migrations(ctx context.Context) ([]MigrationStatus, error)
+
+	// MigrateUp applies every migration up to and including version to.
+	// If to is zero, all migrations are applied.
+	MigrateUp(ctx context.Context, to int) error
+
+	// MigrateDown reverts every migration after version to.
+	MigrateDown(ctx context.Context, to int) error
+}
+
+// appliedMigration is a row of the schema_migrations table.
+type appliedMigration struct {
+	Version   int
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// migrationTx is a transaction which holds the migration lock.
+//
+// Each store provides its own, and the logic shared between them lives in
+// the functions below.
+type migrationTx interface {
+	// exec runs SQL from a migration.
+	exec(ctx context.Context, sql string) error
+
+	// applied returns every applied migration, creating the
+	// schema_migrations table if it does not exist.
+	applied(ctx context.Context) (map[int]appliedMigration, error)
+
+	// legacyVersion returns the version from the config table that was
+	// used before schema_migrations, and removes the table.
+	// Zero is returned if there is no such table.
+	legacyVersion(ctx context.Context) (int, error)
+
+	// record marks m as applied.
+	record(ctx context.Context, m Migration) error
+
+	// forget marks the migration with the given version as not applied.
+	forget(ctx context.Context, version int) error
+
+	commit(ctx context.Context) error
+	rollback(ctx context.Context) error
+}
+
+// loadApplied returns every applied migration.
+//
+// Databases which still use the old config table are carried over, since
+// its version was the number of migrations in ms that were applied.
+func loadApplied(ctx context.Context, tx migrationTx, ms []Migration) (map[int]appliedMigration, error) {
+	applied, err := tx.applied(ctx)
+	if err != nil || len(applied) > 0 {
+		return applied, err
+	}
+
+	ver, err := tx.legacyVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine version: %v", err)
+	} else if ver > len(ms) {
+		return nil, fmt.Errorf("database is at version %d, which is newer than this version of pikorv", ver)
+	}
+
+	for _, m := range ms[:ver] {
+		if err := tx.record(ctx, m); err != nil {
+			return nil, err
+		}
+	}
+
+	return tx.applied(ctx)
+}
+
+// migrationStatus merges the known migrations with the applied ones.
+func migrationStatus(ms []Migration, applied map[int]appliedMigration) []MigrationStatus {
+	var st []MigrationStatus
+	latest := 0
+
+	for _, m := range ms {
+		s := MigrationStatus{Migration: m}
+		if a, ok := applied[m.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = a.AppliedAt
+			s.Modified = a.Checksum != m.Checksum()
+		}
+		st = append(st, s)
+		latest = m.Version
+	}
+
+	// Anything left over was applied by something newer than us.
+	for _, v := range sortedKeys(applied) {
+		if v <= latest {
+			continue
+		}
+		st = append(st, MigrationStatus{
+			Migration: Migration{Version: v},
+			Applied:   true,
+			AppliedAt: applied[v].AppliedAt,
+			Unknown:   true,
+		})
+	}
+
+	return st
+}
+
+// migrationsStatus returns the status of every migration.
+// Nothing is changed; tx is rolled back.
+func migrationsStatus(ctx context.Context, tx migrationTx, ms []Migration) ([]MigrationStatus, error) {
+	defer tx.rollback(ctx)
+
+	applied, err := loadApplied(ctx, tx, ms)
+	if err != nil {
+		return nil, err
+	}
+
+	return migrationStatus(ms, applied), nil
+}
+
+// migrateUp applies every migration in ms up to and including version to, or
+// all of them if to is zero, and commits tx.
+func migrateUp(ctx context.Context, tx migrationTx, ms []Migration, to int) error {
+	defer tx.rollback(ctx)
+
+	applied, err := loadApplied(ctx, tx, ms)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range migrationStatus(ms, applied) {
+		if s.Unknown {
+			return fmt.Errorf("database has migration %d, which is newer than this version of pikorv", s.Version)
+		} else if s.Modified {
+			return fmt.Errorf("%w: %d_%s", ErrModified, s.Version, s.Name)
+		}
+	}
+
+	for _, m := range ms {
+		if to > 0 && m.Version > to {
+			break
+		} else if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		if err := tx.exec(ctx, m.Up); err != nil {
+			return fmt.Errorf("failed to apply %d_%s: %v", m.Version, m.Name, err)
+		}
+
+		if err := tx.record(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	return tx.commit(ctx)
+}
+
+// migrateDown reverts every migration in ms after version to, and commits
+// tx.
+func migrateDown(ctx context.Context, tx migrationTx, ms []Migration, to int) error {
+	defer tx.rollback(ctx)
+
+	applied, err := loadApplied(ctx, tx, ms)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range migrationStatus(ms, applied) {
+		if s.Unknown && s.Version > to {
+			return fmt.Errorf("database has migration %d, which is newer than this version of pikorv", s.Version)
+		}
+	}
+
+	for i := len(ms) - 1; i >= 0 && ms[i].Version > to; i-- {
+		m := ms[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		} else if m.Down == "" {
+			return fmt.Errorf("%w: %d_%s", ErrIrreversible, m.Version, m.Name)
+		}
+
+		if err := tx.exec(ctx, m.Down); err != nil {
+			return fmt.Errorf("failed to revert %d_%s: %v", m.Version, m.Name, err)
+		}
+
+		if err := tx.forget(ctx, m.Version); err != nil {
+			return err
+		}
+	}
+
+	return tx.commit(ctx)
+}
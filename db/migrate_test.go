@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// dialTestSQLite opens an empty SQLite database without migrating it.
+func dialTestSQLite(t *testing.T) *SQLite {
+	s, err := dialSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func mustMigrations(t *testing.T, m Migrator) []MigrationStatus {
+	st, err := m.Migrations(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get migration status: %v", err)
+	}
+	return st
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	s := dialTestSQLite(t)
+
+	for _, v := range mustMigrations(t, s) {
+		if v.Applied {
+			t.Fatalf("migration %d applied on an empty database", v.Version)
+		}
+	}
+
+	if err := s.MigrateUp(context.Background(), 0); err != nil {
+		t.Fatalf("failed to migrate up: %v", err)
+	}
+
+	for _, v := range mustMigrations(t, s) {
+		if !v.Applied || v.Modified || v.AppliedAt.IsZero() {
+			t.Fatalf("migration %d not applied: %+v", v.Version, v)
+		}
+	}
+
+	// Applying again does nothing.
+	if err := s.MigrateUp(context.Background(), 0); err != nil {
+		t.Fatalf("failed to migrate up again: %v", err)
+	}
+
+	makeUser(t, s)
+
+	if err := s.MigrateDown(context.Background(), 0); err != nil {
+		t.Fatalf("failed to migrate down: %v", err)
+	}
+
+	for _, v := range mustMigrations(t, s) {
+		if v.Applied {
+			t.Fatalf("migration %d still applied", v.Version)
+		}
+	}
+
+	if err := s.SaveUser(context.Background(), &User{Username: "a", Email: "a"}); err == nil {
+		t.Fatalf("users table still exists")
+	}
+
+	if err := s.MigrateUp(context.Background(), 0); err != nil {
+		t.Fatalf("failed to migrate up after down: %v", err)
+	}
+
+	makeUser(t, s)
+}
+
+func TestMigrateModified(t *testing.T) {
+	s := dialTestSQLite(t)
+
+	if err := s.MigrateUp(context.Background(), 0); err != nil {
+		t.Fatalf("failed to migrate up: %v", err)
+	}
+
+	if _, err := s.db.Exec("UPDATE schema_migrations SET checksum = 'nope' WHERE version = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := mustMigrations(t, s); !st[0].Modified {
+		t.Errorf("migration not marked as modified: %+v", st[0])
+	}
+
+	if err := s.MigrateUp(context.Background(), 0); !errors.Is(err, ErrModified) {
+		t.Errorf("expected ErrModified, got %v", err)
+	}
+}
+
+func TestMigrateUnknown(t *testing.T) {
+	s := dialTestSQLite(t)
+
+	if err := s.MigrateUp(context.Background(), 0); err != nil {
+		t.Fatalf("failed to migrate up: %v", err)
+	}
+
+	if _, err := s.db.Exec("INSERT INTO schema_migrations VALUES (99, 'future', '', 0)"); err != nil {
+		t.Fatal(err)
+	}
+
+	st := mustMigrations(t, s)
+	if last := st[len(st)-1]; last.Version != 99 || !last.Unknown {
+		t.Errorf("expected unknown migration 99, got %+v", last)
+	}
+
+	if err := s.MigrateUp(context.Background(), 0); err == nil {
+		t.Errorf("migrated a database newer than us")
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	s := dialTestSQLite(t)
+
+	// This is what a database looked like before schema_migrations.
+	if _, err := s.db.Exec(sqliteMigrations[0].Up); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.db.Exec(`
+		CREATE TABLE config(id INTEGER PRIMARY KEY, version INTEGER NOT NULL DEFAULT 0);
+		INSERT INTO config VALUES (1, 1);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	// The status is read without changing anything.
+	if st := mustMigrations(t, s); !st[0].Applied {
+		t.Fatalf("legacy version not carried over: %+v", st[0])
+	}
+
+	if err := s.MigrateUp(context.Background(), 0); err != nil {
+		t.Fatalf("failed to migrate up: %v", err)
+	}
+
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'config'").Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("config table was not removed")
+	}
+
+	makeUser(t, s)
+}
@@ -0,0 +1,904 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Postgres is a Store backed by PostgreSQL.
+type Postgres struct {
+	db *pgxpool.Pool
+}
+
+var (
+	_ Store    = (*Postgres)(nil)
+	_ Migrator = (*Postgres)(nil)
+	_ Pooler   = (*Postgres)(nil)
+)
+
+// pqMigrations holds every PostgreSQL migration, in order.
+//
+// Migrations must never be changed once they have been released; add a new
+// one instead.
+var pqMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "init",
+		Up: `
+			CREATE TABLE users(
+				id SERIAL PRIMARY KEY,
+				username VARCHAR(32) NOT NULL UNIQUE,
+				email VARCHAR(256) NOT NULL UNIQUE,
+				name VARCHAR(64),
+				password bytea,
+				salt bytea
+			);
+
+			CREATE TABLE networks(
+				id SERIAL PRIMARY KEY,
+				owner INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				name VARCHAR(64) NOT NULL UNIQUE
+			);
+
+			CREATE TABLE devices(
+				id SERIAL PRIMARY KEY,
+				owner INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				name VARCHAR(64) NOT NULL UNIQUE,
+				pubkey VARCHAR(64) NOT NULL UNIQUE,
+				ip VARCHAR(39) NOT NULL UNIQUE
+			);
+
+			CREATE TABLE nwdevs(
+				network INTEGER NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+				device INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+
+				UNIQUE(network, device)
+			);
+		`,
+		Down: `
+			DROP TABLE nwdevs;
+			DROP TABLE devices;
+			DROP TABLE networks;
+			DROP TABLE users;
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "device_endpoint",
+		// Older schemas created this column up front.
+		Up:   "ALTER TABLE devices ADD COLUMN IF NOT EXISTS endpoint VARCHAR(64)",
+		Down: "ALTER TABLE devices DROP COLUMN endpoint",
+	},
+	{
+		Version: 3,
+		Name:    "network_approval",
+		Up: `
+			ALTER TABLE networks ADD COLUMN approval BOOLEAN NOT NULL DEFAULT FALSE;
+			ALTER TABLE nwdevs ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'active';
+		`,
+		Down: `
+			ALTER TABLE nwdevs DROP COLUMN status;
+			ALTER TABLE networks DROP COLUMN approval;
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "device_nat",
+		Up:      "ALTER TABLE devices ADD COLUMN nat VARCHAR(16)",
+		Down:    "ALTER TABLE devices DROP COLUMN nat",
+	},
+	{
+		Version: 5,
+		Name:    "user_admin",
+		Up: `
+			ALTER TABLE users
+				ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+				ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE,
+				ADD COLUMN locked_until BIGINT NOT NULL DEFAULT 0;
+		`,
+		Down: `
+			ALTER TABLE users
+				DROP COLUMN is_admin,
+				DROP COLUMN disabled,
+				DROP COLUMN locked_until;
+		`,
+	},
+	{
+		Version: 6,
+		Name:    "device_tags",
+		Up: `
+			CREATE TABLE device_tags(
+				device INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+				tag VARCHAR(32) NOT NULL,
+
+				UNIQUE(device, tag)
+			);
+
+			CREATE INDEX device_tags_tag ON device_tags(tag);
+		`,
+		Down: "DROP TABLE device_tags",
+	},
+}
+
+// Connect connects to PostgreSQL and applies any pending migrations.
+func Connect(url string, test ...bool) (*Postgres, error) {
+	p, err := dialPostgres(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if test != nil {
+		_, err := p.db.Exec(context.Background(), "SET search_path TO pg_temp")
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if err := p.MigrateUp(context.Background(), 0); err != nil {
+		p.db.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// dialPostgres connects to PostgreSQL without touching the schema.
+func dialPostgres(url string) (*Postgres, error) {
+	pool, err := pgxpool.Connect(context.Background(), url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+
+	return &Postgres{db: pool}, nil
+}
+
+// Close disconnects from PostgreSQL.
+func (p *Postgres) Close() {
+	p.db.Close()
+}
+
+// PoolStats returns the statistics of the connection pool.
+func (p *Postgres) PoolStats() PoolStats {
+	st := p.db.Stat()
+
+	return PoolStats{
+		Max:      int(st.MaxConns()),
+		Open:     int(st.TotalConns()),
+		InUse:    int(st.AcquiredConns()),
+		Idle:     int(st.IdleConns()),
+		Waits:    st.EmptyAcquireCount(),
+		WaitTime: st.AcquireDuration(),
+	}
+}
+
+// pqMigrationTx is a migrationTx for PostgreSQL.
+type pqMigrationTx struct {
+	pgx.Tx
+}
+
+// beginMigration starts a transaction and takes the migration lock, which is
+// released when the transaction ends.
+func (p *Postgres) beginMigration(ctx context.Context) (*pqMigrationTx, error) {
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", int64(migrationLockKey)); err != nil {
+		tx.Rollback(ctx)
+		return nil, fmt.Errorf("failed to lock database: %v", err)
+	}
+
+	return &pqMigrationTx{tx}, nil
+}
+
+func (tx *pqMigrationTx) exec(ctx context.Context, sql string) error {
+	_, err := tx.Exec(ctx, sql)
+	return err
+}
+
+func (tx *pqMigrationTx) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	if _, err := tx.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations(
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(64) NOT NULL,
+			checksum VARCHAR(64) NOT NULL,
+			applied_at BIGINT NOT NULL
+		)
+	`); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	rows, err := tx.Query(ctx, "SELECT version, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]appliedMigration{}
+	for rows.Next() {
+		var a appliedMigration
+		var at int64
+		if err := rows.Scan(&a.Version, &a.Checksum, &at); err != nil {
+			return nil, err
+		}
+		a.AppliedAt = time.Unix(at, 0)
+		applied[a.Version] = a
+	}
+
+	return applied, rows.Err()
+}
+
+func (tx *pqMigrationTx) legacyVersion(ctx context.Context) (int, error) {
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT to_regclass('config') IS NOT NULL").Scan(&exists); err != nil || !exists {
+		return 0, err
+	}
+
+	ver := 0
+	if err := tx.QueryRow(ctx, "SELECT version FROM config").Scan(&ver); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return 0, err
+	}
+
+	_, err := tx.Exec(ctx, "DROP TABLE config")
+	return ver, err
+}
+
+func (tx *pqMigrationTx) record(ctx context.Context, m Migration) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO schema_migrations(version, name, checksum, applied_at)
+		VALUES ($1, $2, $3, $4)
+	`, m.Version, m.Name, m.Checksum(), time.Now().Unix())
+	return err
+}
+
+func (tx *pqMigrationTx) forget(ctx context.Context, version int) error {
+	_, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", version)
+	return err
+}
+
+func (tx *pqMigrationTx) commit(ctx context.Context) error {
+	return tx.Commit(ctx)
+}
+
+func (tx *pqMigrationTx) rollback(ctx context.Context) error {
+	return tx.Rollback(ctx)
+}
+
+// Migrations returns the status of every migration.
+func (p *Postgres) Migrations(ctx context.Context) ([]MigrationStatus, error) {
+	tx, err := p.beginMigration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return migrationsStatus(ctx, tx, pqMigrations)
+}
+
+// MigrateUp applies every migration up to and including version to, or all
+// of them if to is zero.
+func (p *Postgres) MigrateUp(ctx context.Context, to int) error {
+	tx, err := p.beginMigration(ctx)
+	if err != nil {
+		return err
+	}
+
+	return migrateUp(ctx, tx, pqMigrations, to)
+}
+
+// MigrateDown reverts every migration after version to.
+func (p *Postgres) MigrateDown(ctx context.Context, to int) error {
+	tx, err := p.beginMigration(ctx)
+	if err != nil {
+		return err
+	}
+
+	return migrateDown(ctx, tx, pqMigrations, to)
+}
+
+// translate converts errors from PostgreSQL into the errors documented by
+// Store.
+func translate(err error) error {
+	var pgerr *pgconn.PgError
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	} else if errors.As(err, &pgerr) && pgerr.Code == "23505" { // unique_violation
+		return fmt.Errorf("%w: %s", ErrConflict, pgerr.ConstraintName)
+	}
+	return err
+}
+
+// scanDevices reads devices from rows, which must select the id, owner, name,
+// pubkey, ip, endpoint, and nat columns in that order.
+func scanDevices(rows pgx.Rows) ([]Device, error) {
+	defer rows.Close()
+
+	var ns []Device
+
+	for rows.Next() {
+		n := Device{}
+		var ens, nns sql.NullString
+		if err := rows.Scan(&n.ID, &n.Owner, &n.Name, &n.PublicKey, &n.IP, &ens, &nns); err != nil {
+			return ns, err
+		}
+		n.Endpoint = ens.String
+		n.NAT = nns.String
+		ns = append(ns, n)
+	}
+
+	return ns, rows.Err()
+}
+
+// scanNetworks reads networks from rows, which must select the id, owner,
+// name, and approval columns in that order.
+func scanNetworks(rows pgx.Rows) ([]Network, error) {
+	defer rows.Close()
+
+	var ns []Network
+
+	for rows.Next() {
+		n := Network{}
+		if err := rows.Scan(&n.ID, &n.Owner, &n.Name, &n.Approval); err != nil {
+			return ns, err
+		}
+		ns = append(ns, n)
+	}
+
+	return ns, rows.Err()
+}
+
+// queryDevice returns the single device matching where, which is given arg.
+func (p *Postgres) queryDevice(ctx context.Context, where string, arg any) (Device, error) {
+	d := Device{}
+	var ens, nns sql.NullString
+
+	err := p.db.QueryRow(ctx, `
+		SELECT
+			id,
+			owner,
+			name,
+			pubkey,
+			ip,
+			endpoint,
+			nat
+		FROM devices
+		WHERE `+where+` = $1
+	`, arg).Scan(&d.ID, &d.Owner, &d.Name, &d.PublicKey, &d.IP, &ens, &nns)
+	d.Endpoint = ens.String
+	d.NAT = nns.String
+	return d, translate(err)
+}
+
+// Users returns all users in the database.
+func (p *Postgres) Users(ctx context.Context) ([]User, error) {
+	rows, err := p.db.Query(ctx, "SELECT id, username, email, name, is_admin, disabled, locked_until FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanUsers(rows)
+}
+
+// ListUsers returns users selected and ordered by o.
+func (p *Postgres) ListUsers(ctx context.Context, o ListOptions) ([]User, error) {
+	query, args := userListQuery(o, true)
+	rows, err := p.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanUsers(rows)
+}
+
+// UserID returns a user from their ID.
+func (p *Postgres) UserID(ctx context.Context, user int64) (User, error) {
+	u := User{ID: user}
+
+	var ns sql.NullString
+
+	err := p.db.QueryRow(ctx, `
+		SELECT
+			username,
+			email,
+			name,
+			is_admin,
+			disabled,
+			locked_until
+		FROM users
+		WHERE id = $1
+	`, user).Scan(&u.Username, &u.Email, &ns, &u.Admin, &u.Disabled, &u.LockedUntil)
+	u.Name = ns.String
+	return u, translate(err)
+}
+
+// Username returns a user from their username.
+func (p *Postgres) Username(ctx context.Context, user string) (User, error) {
+	u := User{Username: user}
+
+	var ns sql.NullString
+
+	err := p.db.QueryRow(ctx, `
+		SELECT
+			id,
+			email,
+			name,
+			is_admin,
+			disabled,
+			locked_until
+		FROM users
+		WHERE username = $1
+	`, user).Scan(&u.ID, &u.Email, &ns, &u.Admin, &u.Disabled, &u.LockedUntil)
+	u.Name = ns.String
+	return u, translate(err)
+}
+
+// SaveUser saves user information.
+//
+// If the user's ID is zero, a new user will be created.
+func (p *Postgres) SaveUser(ctx context.Context, n *User) error {
+	var err error
+	if n.ID == 0 {
+		err = p.db.QueryRow(ctx, `
+			INSERT INTO users (
+				username, email, name, is_admin, disabled, locked_until
+			) VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id
+		`, n.Username, n.Email, nullString(n.Name), n.Admin, n.Disabled, n.LockedUntil).Scan(&n.ID)
+	} else {
+		_, err = p.db.Exec(ctx, `
+			UPDATE users SET
+				email = $2,
+				name = $3,
+				is_admin = $4,
+				disabled = $5,
+				locked_until = $6
+			WHERE
+				id = $1
+		`, n.ID, n.Email, nullString(n.Name), n.Admin, n.Disabled, n.LockedUntil)
+	}
+	return translate(err)
+}
+
+// SetPassword sets the user password.
+func (p *Postgres) SetPassword(ctx context.Context, id int64, pass string) error {
+	salt := makeSalt()
+	ct := hashPassword(pass, salt)
+
+	_, err := p.db.Exec(ctx, "UPDATE users SET password = $1, salt = $2 WHERE id = $3", ct, salt, id)
+	return err
+}
+
+// CheckPassword compares a supplied password with the user's password.
+//
+// If the password is invalid or the user does not exist, -1 is returned.
+// Otherwise, the returned int64 is the user's ID.
+func (p *Postgres) CheckPassword(ctx context.Context, user, pass string) int64 {
+	var ct, salt []byte
+	var id int64
+
+	if err := p.db.QueryRow(ctx, `SELECT id, password, salt FROM users WHERE username = $1`, user).Scan(&id, &ct, &salt); err != nil {
+		return -1
+	}
+
+	if bytes.Equal(hashPassword(pass, salt), ct) {
+		return id
+	}
+	return -1
+}
+
+// DeleteUser deletes the user from the database, along with all of their
+// networks and devices.
+func (p *Postgres) DeleteUser(ctx context.Context, id int64) error {
+	_, err := p.db.Exec(ctx, "DELETE FROM users WHERE id = $1", id)
+	return err
+}
+
+// Networks returns all networks that a user has created.
+func (p *Postgres) Networks(ctx context.Context, user int64) ([]Network, error) {
+	rows, err := p.db.Query(ctx, "SELECT id, owner, name, approval FROM networks WHERE owner = $1 ORDER BY id", user)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanNetworks(rows)
+}
+
+// AllNetworks returns all networks.
+func (p *Postgres) AllNetworks(ctx context.Context) ([]Network, error) {
+	rows, err := p.db.Query(ctx, "SELECT id, owner, name, approval FROM networks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	return scanNetworks(rows)
+}
+
+// NetworkID returns a network from its ID.
+func (p *Postgres) NetworkID(ctx context.Context, nwid int64) (Network, error) {
+	n := Network{ID: nwid}
+
+	err := p.db.QueryRow(ctx, `
+		SELECT
+			owner,
+			name,
+			approval
+		FROM networks
+		WHERE id = $1
+	`, nwid).Scan(&n.Owner, &n.Name, &n.Approval)
+	return n, translate(err)
+}
+
+// NetworkDevices returns all devices that are supposed to be connected to a
+// given network.
+func (p *Postgres) NetworkDevices(ctx context.Context, nwid int64) ([]Device, error) {
+	return p.networkDevices(ctx, nwid, MemberActive)
+}
+
+// NetworkRequests returns all devices that are waiting for approval to join a
+// given network.
+func (p *Postgres) NetworkRequests(ctx context.Context, nwid int64) ([]Device, error) {
+	return p.networkDevices(ctx, nwid, MemberPending)
+}
+
+// networkDevices returns all devices in a network with the given membership
+// status.
+func (p *Postgres) networkDevices(ctx context.Context, nwid int64, status string) ([]Device, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT
+			devices.id,
+			devices.owner,
+			devices.name,
+			devices.pubkey,
+			devices.ip,
+			devices.endpoint,
+			devices.nat
+		FROM nwdevs
+		INNER JOIN devices ON devices.id = nwdevs.device
+		WHERE network = $1 AND status = $2
+		ORDER BY devices.id
+	`, nwid, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanDevices(rows)
+}
+
+// DeviceNetworks returns all networks that this device is supposed to be
+// connected to.
+func (p *Postgres) DeviceNetworks(ctx context.Context, devid int64) ([]Network, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT
+			networks.id,
+			networks.owner,
+			networks.name,
+			networks.approval
+		FROM nwdevs
+		INNER JOIN networks ON networks.id = nwdevs.network
+		WHERE device = $1 AND status = $2
+		ORDER BY networks.id
+	`, devid, MemberActive)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanNetworks(rows)
+}
+
+// NetworkAdd adds a device to the network.
+func (p *Postgres) NetworkAdd(ctx context.Context, nwid, devid int64) error {
+	_, err := p.db.Exec(ctx, `INSERT INTO nwdevs(Network, device) VALUES($1, $2)`, nwid, devid)
+	return translate(err)
+}
+
+// NetworkRequest asks for a device to be added to the network.
+// The device will not be part of the network until it is approved.
+func (p *Postgres) NetworkRequest(ctx context.Context, nwid, devid int64) error {
+	_, err := p.db.Exec(ctx, `INSERT INTO nwdevs(Network, device, status) VALUES($1, $2, $3)`, nwid, devid, MemberPending)
+	return translate(err)
+}
+
+// NetworkApprove approves a pending request for a device to join the network.
+//
+// If there is no such request, ErrNotFound is returned.
+func (p *Postgres) NetworkApprove(ctx context.Context, nwid, devid int64) error {
+	tag, err := p.db.Exec(ctx, `
+		UPDATE nwdevs SET
+			status = $3
+		WHERE
+			network = $1 AND device = $2 AND status = $4
+	`, nwid, devid, MemberActive, MemberPending)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// NetworkReject rejects a pending request for a device to join the network.
+//
+// If there is no such request, ErrNotFound is returned.
+func (p *Postgres) NetworkReject(ctx context.Context, nwid, devid int64) error {
+	tag, err := p.db.Exec(ctx, `DELETE FROM nwdevs WHERE network = $1 AND device = $2 AND status = $3`, nwid, devid, MemberPending)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// NetworkStatus returns the membership status of a device in the network.
+//
+// If the device is not in the network, ErrNotFound is returned.
+func (p *Postgres) NetworkStatus(ctx context.Context, nwid, devid int64) (string, error) {
+	var status string
+	err := p.db.QueryRow(ctx, `SELECT status FROM nwdevs WHERE network = $1 AND device = $2`, nwid, devid).Scan(&status)
+	return status, translate(err)
+}
+
+// NetworkRemove removes a device from the network.
+func (p *Postgres) NetworkRemove(ctx context.Context, nwid, devid int64) error {
+	_, err := p.db.Exec(ctx, `DELETE FROM nwdevs WHERE network = $1 AND device = $2`, nwid, devid)
+	return err
+}
+
+// SaveNetwork updates existing network information or creates a new network.
+func (p *Postgres) SaveNetwork(ctx context.Context, n *Network) error {
+	var err error
+	if n.ID == 0 {
+		err = p.db.QueryRow(ctx, `
+			INSERT INTO networks (owner, name, approval) VALUES ($1, $2, $3)
+			RETURNING id
+		`, n.Owner, n.Name, n.Approval).Scan(&n.ID)
+	} else {
+		_, err = p.db.Exec(ctx, `
+			UPDATE networks SET
+				name = $2,
+				approval = $3
+			WHERE
+				id = $1
+		`, n.ID, n.Name, n.Approval)
+	}
+	return translate(err)
+}
+
+// DeleteNetwork deletes the network.
+func (p *Postgres) DeleteNetwork(ctx context.Context, id int64) error {
+	_, err := p.db.Exec(ctx, "DELETE FROM networks WHERE id = $1", id)
+	return err
+}
+
+// AllDevices returns all devices.
+func (p *Postgres) AllDevices(ctx context.Context) ([]Device, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT
+			id,
+			owner,
+			name,
+			pubkey,
+			ip,
+			endpoint,
+			nat
+		FROM devices
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanDevices(rows)
+}
+
+// Devices returns all devices for a user.
+func (p *Postgres) Devices(ctx context.Context, user int64) ([]Device, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT
+			id,
+			owner,
+			name,
+			pubkey,
+			ip,
+			endpoint,
+			nat
+		FROM devices
+		WHERE owner = $1
+		ORDER BY id
+	`, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanDevices(rows)
+}
+
+// DeviceID returns a device from its ID.
+func (p *Postgres) DeviceID(ctx context.Context, devid int64) (Device, error) {
+	return p.queryDevice(ctx, "id", devid)
+}
+
+// DeviceIP returns a device from its Pikonet IP.
+func (p *Postgres) DeviceIP(ctx context.Context, ip string) (Device, error) {
+	return p.queryDevice(ctx, "ip", ip)
+}
+
+// DeviceKey returns a device from its public key.
+func (p *Postgres) DeviceKey(ctx context.Context, key string) (Device, error) {
+	return p.queryDevice(ctx, "pubkey", key)
+}
+
+// SaveDevice updates existing device information or creates a new device.
+func (p *Postgres) SaveDevice(ctx context.Context, n *Device) error {
+	if n.IP == "" {
+		panic("ip is nil")
+	}
+
+	var err error
+	if n.ID == 0 {
+		err = p.db.QueryRow(ctx, `
+			INSERT INTO devices(
+				owner, name, pubkey, ip, endpoint, nat
+			) VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id
+		`, n.Owner, nullString(n.Name), n.PublicKey, n.IP, nullString(n.Endpoint), nullString(n.NAT)).Scan(&n.ID)
+	} else {
+		_, err = p.db.Exec(ctx, `
+			UPDATE devices
+			SET
+				name = $2,
+				pubkey = $3,
+				ip = $4,
+				endpoint = $5,
+				nat = $6
+			WHERE
+				id = $1
+		`, n.ID, nullString(n.Name), n.PublicKey, n.IP, nullString(n.Endpoint), nullString(n.NAT))
+	}
+	return translate(err)
+}
+
+// DeleteDevice deletes the device from the database.
+func (p *Postgres) DeleteDevice(ctx context.Context, id int64) error {
+	_, err := p.db.Exec(ctx, "DELETE FROM devices WHERE id = $1", id)
+	return err
+}
+
+// ConnectedTo returns a list of devices that this device is connected to.
+func (p *Postgres) ConnectedTo(ctx context.Context, devid int64) ([]Device, error) {
+	rows, err := p.db.Query(ctx, `
+		WITH nets AS (
+			SELECT
+				network
+			FROM nwdevs
+			WHERE device = $1 AND status = $2
+		)
+		SELECT
+			devices.id,
+			devices.owner,
+			devices.name,
+			devices.pubkey,
+			devices.ip,
+			devices.endpoint,
+			devices.nat
+		FROM devices
+		INNER JOIN nwdevs ON
+			nwdevs.device = devices.id
+			AND nwdevs.device != $1
+			AND nwdevs.status = $2
+			AND network IN (SELECT network FROM nets)
+		GROUP BY devices.id
+		ORDER BY devices.id
+	`, devid, MemberActive)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanDevices(rows)
+}
+
+// ListNetworks returns the networks of a user selected and ordered by o, or
+// those of every user if user is zero.
+func (p *Postgres) ListNetworks(ctx context.Context, user int64, o ListOptions) ([]Network, error) {
+	query, args := networkListQuery(user, o, true)
+	rows, err := p.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanNetworks(rows)
+}
+
+// ListDevices returns the devices of a user selected and ordered by o, or
+// those of every user if user is zero.
+func (p *Postgres) ListDevices(ctx context.Context, user int64, o DeviceOptions) ([]Device, error) {
+	query, args := deviceListQuery(user, o, true)
+	rows, err := p.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanDevices(rows)
+}
+
+// NetworksDevices returns the devices that are supposed to be connected to
+// each of the given networks.
+func (p *Postgres) NetworksDevices(ctx context.Context, nwids []int64) (map[int64][]Device, error) {
+	if len(nwids) == 0 {
+		return map[int64][]Device{}, nil
+	}
+
+	query, args := membersQuery(nwids, nil, true)
+	rows, err := p.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMemberDevices(rows)
+}
+
+// DevicesNetworks returns the networks that each of the given devices are
+// supposed to be connected to.
+func (p *Postgres) DevicesNetworks(ctx context.Context, devids []int64) (map[int64][]Network, error) {
+	if len(devids) == 0 {
+		return map[int64][]Network{}, nil
+	}
+
+	query, args := membersQuery(nil, devids, true)
+	rows, err := p.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMemberNetworks(rows)
+}
+
+// DeviceTags returns the tags of each of the given devices.
+func (p *Postgres) DeviceTags(ctx context.Context, devids []int64) (map[int64][]string, error) {
+	if len(devids) == 0 {
+		return map[int64][]string{}, nil
+	}
+
+	query, args := tagsQuery(devids, true)
+	rows, err := p.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTags(rows)
+}
+
+// SetDeviceTags replaces the tags of a device.
+func (p *Postgres) SetDeviceTags(ctx context.Context, devid int64, tags []string) error {
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM device_tags WHERE device = $1", devid); err != nil {
+		return err
+	}
+
+	for _, t := range tags {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO device_tags(device, tag) VALUES($1, $2)
+			ON CONFLICT DO NOTHING
+		`, devid, t)
+		if err != nil {
+			return translate(err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,920 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLite is a Store backed by an embedded SQLite database.
+//
+// It is intended for small deployments where running PostgreSQL would be
+// overkill.
+type SQLite struct {
+	db *sql.DB
+}
+
+var (
+	_ Store    = (*SQLite)(nil)
+	_ Migrator = (*SQLite)(nil)
+	_ Pooler   = (*SQLite)(nil)
+)
+
+// sqliteMigrations holds every SQLite migration, in order.
+//
+// They are numbered separately from pqMigrations, since the SQLite schema was
+// written after every PostgreSQL migration.
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "init",
+		Up: `
+			CREATE TABLE users(
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username TEXT NOT NULL UNIQUE,
+				email TEXT NOT NULL UNIQUE,
+				name TEXT,
+				password BLOB,
+				salt BLOB
+			);
+
+			CREATE TABLE networks(
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				owner INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				name TEXT NOT NULL UNIQUE,
+				approval BOOLEAN NOT NULL DEFAULT FALSE
+			);
+
+			CREATE TABLE devices(
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				owner INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				name TEXT NOT NULL UNIQUE,
+				pubkey TEXT NOT NULL UNIQUE,
+				ip TEXT NOT NULL UNIQUE,
+				endpoint TEXT,
+				nat TEXT
+			);
+
+			CREATE TABLE nwdevs(
+				network INTEGER NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+				device INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+				status TEXT NOT NULL DEFAULT 'active',
+
+				UNIQUE(network, device)
+			);
+		`,
+		Down: `
+			DROP TABLE nwdevs;
+			DROP TABLE devices;
+			DROP TABLE networks;
+			DROP TABLE users;
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "user_admin",
+		Up: `
+			ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+			ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
+			ALTER TABLE users ADD COLUMN locked_until INTEGER NOT NULL DEFAULT 0;
+		`,
+		Down: `
+			ALTER TABLE users DROP COLUMN is_admin;
+			ALTER TABLE users DROP COLUMN disabled;
+			ALTER TABLE users DROP COLUMN locked_until;
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "device_tags",
+		Up: `
+			CREATE TABLE device_tags(
+				device INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+				tag TEXT NOT NULL,
+
+				UNIQUE(device, tag)
+			);
+
+			CREATE INDEX device_tags_tag ON device_tags(tag);
+		`,
+		Down: "DROP TABLE device_tags",
+	},
+}
+
+// OpenSQLite opens the SQLite database at path, creating it if it does not
+// exist, and applies any pending migrations.
+//
+// path may be a file name, ":memory:", or a "file:" URI.
+func OpenSQLite(path string) (*SQLite, error) {
+	s, err := dialSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.MigrateUp(context.Background(), 0); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// dialSQLite opens the SQLite database at path without touching the schema.
+func dialSQLite(path string) (*SQLite, error) {
+	// Foreign keys are off by default in SQLite, and we need them for
+	// cascading deletes.
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	dsn := path + sep + "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	// SQLite only allows one writer at a time anyway, and every
+	// connection to ":memory:" would otherwise get its own database.
+	db.SetMaxOpenConns(1)
+
+	return &SQLite{db: db}, nil
+}
+
+// Close closes the database.
+func (s *SQLite) Close() {
+	s.db.Close()
+}
+
+// PoolStats returns the statistics of the connection pool.
+func (s *SQLite) PoolStats() PoolStats {
+	st := s.db.Stats()
+
+	return PoolStats{
+		Max:      st.MaxOpenConnections,
+		Open:     st.OpenConnections,
+		InUse:    st.InUse,
+		Idle:     st.Idle,
+		Waits:    st.WaitCount,
+		WaitTime: st.WaitDuration,
+	}
+}
+
+// sqliteMigrationTx is a migrationTx for SQLite.
+type sqliteMigrationTx struct {
+	*sql.Conn
+	done bool
+}
+
+// beginMigration starts a transaction which holds the database's write lock
+// until it ends, so that other processes can't migrate at the same time.
+func (s *SQLite) beginMigration(ctx context.Context) (*sqliteMigrationTx, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// database/sql can't start an IMMEDIATE transaction itself.
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to lock database: %v", err)
+	}
+
+	return &sqliteMigrationTx{Conn: conn}, nil
+}
+
+func (tx *sqliteMigrationTx) exec(ctx context.Context, sql string) error {
+	_, err := tx.ExecContext(ctx, sql)
+	return err
+}
+
+func (tx *sqliteMigrationTx) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	if _, err := tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations(
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		)
+	`); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT version, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]appliedMigration{}
+	for rows.Next() {
+		var a appliedMigration
+		var at int64
+		if err := rows.Scan(&a.Version, &a.Checksum, &at); err != nil {
+			return nil, err
+		}
+		a.AppliedAt = time.Unix(at, 0)
+		applied[a.Version] = a
+	}
+
+	return applied, rows.Err()
+}
+
+func (tx *sqliteMigrationTx) legacyVersion(ctx context.Context) (int, error) {
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'config'").Scan(&n); err != nil || n == 0 {
+		return 0, err
+	}
+
+	ver := 0
+	if err := tx.QueryRowContext(ctx, "SELECT version FROM config").Scan(&ver); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	_, err := tx.ExecContext(ctx, "DROP TABLE config")
+	return ver, err
+}
+
+func (tx *sqliteMigrationTx) record(ctx context.Context, m Migration) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO schema_migrations(version, name, checksum, applied_at)
+		VALUES (?1, ?2, ?3, ?4)
+	`, m.Version, m.Name, m.Checksum(), time.Now().Unix())
+	return err
+}
+
+func (tx *sqliteMigrationTx) forget(ctx context.Context, version int) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?1", version)
+	return err
+}
+
+func (tx *sqliteMigrationTx) commit(ctx context.Context) error {
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+	defer tx.Close()
+
+	_, err := tx.ExecContext(ctx, "COMMIT")
+	if err != nil {
+		tx.ExecContext(context.Background(), "ROLLBACK")
+	}
+	return err
+}
+
+func (tx *sqliteMigrationTx) rollback(ctx context.Context) error {
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+	defer tx.Close()
+
+	// The context may already be canceled, and the connection must not
+	// be given back while still in a transaction.
+	_, err := tx.ExecContext(context.Background(), "ROLLBACK")
+	return err
+}
+
+// Migrations returns the status of every migration.
+func (s *SQLite) Migrations(ctx context.Context) ([]MigrationStatus, error) {
+	tx, err := s.beginMigration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return migrationsStatus(ctx, tx, sqliteMigrations)
+}
+
+// MigrateUp applies every migration up to and including version to, or all
+// of them if to is zero.
+func (s *SQLite) MigrateUp(ctx context.Context, to int) error {
+	tx, err := s.beginMigration(ctx)
+	if err != nil {
+		return err
+	}
+
+	return migrateUp(ctx, tx, sqliteMigrations, to)
+}
+
+// MigrateDown reverts every migration after version to.
+func (s *SQLite) MigrateDown(ctx context.Context, to int) error {
+	tx, err := s.beginMigration(ctx)
+	if err != nil {
+		return err
+	}
+
+	return migrateDown(ctx, tx, sqliteMigrations, to)
+}
+
+// translateSQLite converts errors from SQLite into the errors documented by
+// Store.
+func translateSQLite(err error) error {
+	var serr *sqlite.Error
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	} else if errors.As(err, &serr) && (serr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || serr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY) {
+		return fmt.Errorf("%w: %s", ErrConflict, serr.Error())
+	}
+	return err
+}
+
+// scanSQLiteDevices reads devices from rows, which must select the id, owner,
+// name, pubkey, ip, endpoint, and nat columns in that order.
+func scanSQLiteDevices(rows *sql.Rows) ([]Device, error) {
+	defer rows.Close()
+
+	var ns []Device
+
+	for rows.Next() {
+		n := Device{}
+		var ens, nns sql.NullString
+		if err := rows.Scan(&n.ID, &n.Owner, &n.Name, &n.PublicKey, &n.IP, &ens, &nns); err != nil {
+			return ns, err
+		}
+		n.Endpoint = ens.String
+		n.NAT = nns.String
+		ns = append(ns, n)
+	}
+
+	return ns, rows.Err()
+}
+
+// scanSQLiteNetworks reads networks from rows, which must select the id,
+// owner, name, and approval columns in that order.
+func scanSQLiteNetworks(rows *sql.Rows) ([]Network, error) {
+	defer rows.Close()
+
+	var ns []Network
+
+	for rows.Next() {
+		n := Network{}
+		if err := rows.Scan(&n.ID, &n.Owner, &n.Name, &n.Approval); err != nil {
+			return ns, err
+		}
+		ns = append(ns, n)
+	}
+
+	return ns, rows.Err()
+}
+
+// queryDevice returns the single device matching where, which is given arg.
+func (s *SQLite) queryDevice(ctx context.Context, where string, arg any) (Device, error) {
+	d := Device{}
+	var ens, nns sql.NullString
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			id,
+			owner,
+			name,
+			pubkey,
+			ip,
+			endpoint,
+			nat
+		FROM devices
+		WHERE `+where+` = ?1
+	`, arg).Scan(&d.ID, &d.Owner, &d.Name, &d.PublicKey, &d.IP, &ens, &nns)
+	d.Endpoint = ens.String
+	d.NAT = nns.String
+	return d, translateSQLite(err)
+}
+
+// Users returns all users in the database.
+func (s *SQLite) Users(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, username, email, name, is_admin, disabled, locked_until FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanUsers(rows)
+}
+
+// ListUsers returns users selected and ordered by o.
+func (s *SQLite) ListUsers(ctx context.Context, o ListOptions) ([]User, error) {
+	query, args := userListQuery(o, false)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanUsers(rows)
+}
+
+// UserID returns a user from their ID.
+func (s *SQLite) UserID(ctx context.Context, user int64) (User, error) {
+	u := User{ID: user}
+
+	var ns sql.NullString
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			username,
+			email,
+			name,
+			is_admin,
+			disabled,
+			locked_until
+		FROM users
+		WHERE id = ?1
+	`, user).Scan(&u.Username, &u.Email, &ns, &u.Admin, &u.Disabled, &u.LockedUntil)
+	u.Name = ns.String
+	return u, translateSQLite(err)
+}
+
+// Username returns a user from their username.
+func (s *SQLite) Username(ctx context.Context, user string) (User, error) {
+	u := User{Username: user}
+
+	var ns sql.NullString
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			id,
+			email,
+			name,
+			is_admin,
+			disabled,
+			locked_until
+		FROM users
+		WHERE username = ?1
+	`, user).Scan(&u.ID, &u.Email, &ns, &u.Admin, &u.Disabled, &u.LockedUntil)
+	u.Name = ns.String
+	return u, translateSQLite(err)
+}
+
+// SaveUser saves user information.
+//
+// If the user's ID is zero, a new user will be created.
+func (s *SQLite) SaveUser(ctx context.Context, n *User) error {
+	var err error
+	if n.ID == 0 {
+		err = s.db.QueryRowContext(ctx, `
+			INSERT INTO users (
+				username, email, name, is_admin, disabled, locked_until
+			) VALUES (?1, ?2, ?3, ?4, ?5, ?6)
+			RETURNING id
+		`, n.Username, n.Email, nullString(n.Name), n.Admin, n.Disabled, n.LockedUntil).Scan(&n.ID)
+	} else {
+		_, err = s.db.ExecContext(ctx, `
+			UPDATE users SET
+				email = ?2,
+				name = ?3,
+				is_admin = ?4,
+				disabled = ?5,
+				locked_until = ?6
+			WHERE
+				id = ?1
+		`, n.ID, n.Email, nullString(n.Name), n.Admin, n.Disabled, n.LockedUntil)
+	}
+	return translateSQLite(err)
+}
+
+// SetPassword sets the user password.
+func (s *SQLite) SetPassword(ctx context.Context, id int64, pass string) error {
+	salt := makeSalt()
+	ct := hashPassword(pass, salt)
+
+	_, err := s.db.ExecContext(ctx, "UPDATE users SET password = ?1, salt = ?2 WHERE id = ?3", ct, salt, id)
+	return err
+}
+
+// CheckPassword compares a supplied password with the user's password.
+//
+// If the password is invalid or the user does not exist, -1 is returned.
+// Otherwise, the returned int64 is the user's ID.
+func (s *SQLite) CheckPassword(ctx context.Context, user, pass string) int64 {
+	var ct, salt []byte
+	var id int64
+
+	if err := s.db.QueryRowContext(ctx, `SELECT id, password, salt FROM users WHERE username = ?1`, user).Scan(&id, &ct, &salt); err != nil {
+		return -1
+	}
+
+	if bytes.Equal(hashPassword(pass, salt), ct) {
+		return id
+	}
+	return -1
+}
+
+// DeleteUser deletes the user from the database, along with all of their
+// networks and devices.
+func (s *SQLite) DeleteUser(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE id = ?1", id)
+	return err
+}
+
+// Networks returns all networks that a user has created.
+func (s *SQLite) Networks(ctx context.Context, user int64) ([]Network, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, owner, name, approval FROM networks WHERE owner = ?1 ORDER BY id", user)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSQLiteNetworks(rows)
+}
+
+// AllNetworks returns all networks.
+func (s *SQLite) AllNetworks(ctx context.Context) ([]Network, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, owner, name, approval FROM networks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSQLiteNetworks(rows)
+}
+
+// NetworkID returns a network from its ID.
+func (s *SQLite) NetworkID(ctx context.Context, nwid int64) (Network, error) {
+	n := Network{ID: nwid}
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			owner,
+			name,
+			approval
+		FROM networks
+		WHERE id = ?1
+	`, nwid).Scan(&n.Owner, &n.Name, &n.Approval)
+	return n, translateSQLite(err)
+}
+
+// NetworkDevices returns all devices that are supposed to be connected to a
+// given network.
+func (s *SQLite) NetworkDevices(ctx context.Context, nwid int64) ([]Device, error) {
+	return s.networkDevices(ctx, nwid, MemberActive)
+}
+
+// NetworkRequests returns all devices that are waiting for approval to join a
+// given network.
+func (s *SQLite) NetworkRequests(ctx context.Context, nwid int64) ([]Device, error) {
+	return s.networkDevices(ctx, nwid, MemberPending)
+}
+
+// networkDevices returns all devices in a network with the given membership
+// status.
+func (s *SQLite) networkDevices(ctx context.Context, nwid int64, status string) ([]Device, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			devices.id,
+			devices.owner,
+			devices.name,
+			devices.pubkey,
+			devices.ip,
+			devices.endpoint,
+			devices.nat
+		FROM nwdevs
+		INNER JOIN devices ON devices.id = nwdevs.device
+		WHERE network = ?1 AND status = ?2
+		ORDER BY devices.id
+	`, nwid, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSQLiteDevices(rows)
+}
+
+// DeviceNetworks returns all networks that this device is supposed to be
+// connected to.
+func (s *SQLite) DeviceNetworks(ctx context.Context, devid int64) ([]Network, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			networks.id,
+			networks.owner,
+			networks.name,
+			networks.approval
+		FROM nwdevs
+		INNER JOIN networks ON networks.id = nwdevs.network
+		WHERE device = ?1 AND status = ?2
+		ORDER BY networks.id
+	`, devid, MemberActive)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSQLiteNetworks(rows)
+}
+
+// NetworkAdd adds a device to the network.
+func (s *SQLite) NetworkAdd(ctx context.Context, nwid, devid int64) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO nwdevs(network, device) VALUES(?1, ?2)`, nwid, devid)
+	return translateSQLite(err)
+}
+
+// NetworkRequest asks for a device to be added to the network.
+// The device will not be part of the network until it is approved.
+func (s *SQLite) NetworkRequest(ctx context.Context, nwid, devid int64) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO nwdevs(network, device, status) VALUES(?1, ?2, ?3)`, nwid, devid, MemberPending)
+	return translateSQLite(err)
+}
+
+// NetworkApprove approves a pending request for a device to join the network.
+//
+// If there is no such request, ErrNotFound is returned.
+func (s *SQLite) NetworkApprove(ctx context.Context, nwid, devid int64) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE nwdevs SET
+			status = ?3
+		WHERE
+			network = ?1 AND device = ?2 AND status = ?4
+	`, nwid, devid, MemberActive, MemberPending)
+	return affected(res, err)
+}
+
+// NetworkReject rejects a pending request for a device to join the network.
+//
+// If there is no such request, ErrNotFound is returned.
+func (s *SQLite) NetworkReject(ctx context.Context, nwid, devid int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM nwdevs WHERE network = ?1 AND device = ?2 AND status = ?3`, nwid, devid, MemberPending)
+	return affected(res, err)
+}
+
+// affected returns ErrNotFound if res shows that no rows were changed.
+func affected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// NetworkStatus returns the membership status of a device in the network.
+//
+// If the device is not in the network, ErrNotFound is returned.
+func (s *SQLite) NetworkStatus(ctx context.Context, nwid, devid int64) (string, error) {
+	var status string
+	err := s.db.QueryRowContext(ctx, `SELECT status FROM nwdevs WHERE network = ?1 AND device = ?2`, nwid, devid).Scan(&status)
+	return status, translateSQLite(err)
+}
+
+// NetworkRemove removes a device from the network.
+func (s *SQLite) NetworkRemove(ctx context.Context, nwid, devid int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM nwdevs WHERE network = ?1 AND device = ?2`, nwid, devid)
+	return err
+}
+
+// SaveNetwork updates existing network information or creates a new network.
+func (s *SQLite) SaveNetwork(ctx context.Context, n *Network) error {
+	var err error
+	if n.ID == 0 {
+		err = s.db.QueryRowContext(ctx, `
+			INSERT INTO networks (owner, name, approval) VALUES (?1, ?2, ?3)
+			RETURNING id
+		`, n.Owner, n.Name, n.Approval).Scan(&n.ID)
+	} else {
+		_, err = s.db.ExecContext(ctx, `
+			UPDATE networks SET
+				name = ?2,
+				approval = ?3
+			WHERE
+				id = ?1
+		`, n.ID, n.Name, n.Approval)
+	}
+	return translateSQLite(err)
+}
+
+// DeleteNetwork deletes the network.
+func (s *SQLite) DeleteNetwork(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM networks WHERE id = ?1", id)
+	return err
+}
+
+// AllDevices returns all devices.
+func (s *SQLite) AllDevices(ctx context.Context) ([]Device, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			id,
+			owner,
+			name,
+			pubkey,
+			ip,
+			endpoint,
+			nat
+		FROM devices
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSQLiteDevices(rows)
+}
+
+// Devices returns all devices for a user.
+func (s *SQLite) Devices(ctx context.Context, user int64) ([]Device, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			id,
+			owner,
+			name,
+			pubkey,
+			ip,
+			endpoint,
+			nat
+		FROM devices
+		WHERE owner = ?1
+		ORDER BY id
+	`, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSQLiteDevices(rows)
+}
+
+// DeviceID returns a device from its ID.
+func (s *SQLite) DeviceID(ctx context.Context, devid int64) (Device, error) {
+	return s.queryDevice(ctx, "id", devid)
+}
+
+// DeviceIP returns a device from its Pikonet IP.
+func (s *SQLite) DeviceIP(ctx context.Context, ip string) (Device, error) {
+	return s.queryDevice(ctx, "ip", ip)
+}
+
+// DeviceKey returns a device from its public key.
+func (s *SQLite) DeviceKey(ctx context.Context, key string) (Device, error) {
+	return s.queryDevice(ctx, "pubkey", key)
+}
+
+// SaveDevice updates existing device information or creates a new device.
+func (s *SQLite) SaveDevice(ctx context.Context, n *Device) error {
+	if n.IP == "" {
+		panic("ip is nil")
+	}
+
+	var err error
+	if n.ID == 0 {
+		err = s.db.QueryRowContext(ctx, `
+			INSERT INTO devices(
+				owner, name, pubkey, ip, endpoint, nat
+			) VALUES (?1, ?2, ?3, ?4, ?5, ?6)
+			RETURNING id
+		`, n.Owner, nullString(n.Name), n.PublicKey, n.IP, nullString(n.Endpoint), nullString(n.NAT)).Scan(&n.ID)
+	} else {
+		_, err = s.db.ExecContext(ctx, `
+			UPDATE devices
+			SET
+				name = ?2,
+				pubkey = ?3,
+				ip = ?4,
+				endpoint = ?5,
+				nat = ?6
+			WHERE
+				id = ?1
+		`, n.ID, nullString(n.Name), n.PublicKey, n.IP, nullString(n.Endpoint), nullString(n.NAT))
+	}
+	return translateSQLite(err)
+}
+
+// DeleteDevice deletes the device from the database.
+func (s *SQLite) DeleteDevice(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM devices WHERE id = ?1", id)
+	return err
+}
+
+// ConnectedTo returns a list of devices that this device is connected to.
+func (s *SQLite) ConnectedTo(ctx context.Context, devid int64) ([]Device, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		WITH nets AS (
+			SELECT
+				network
+			FROM nwdevs
+			WHERE device = ?1 AND status = ?2
+		)
+		SELECT
+			devices.id,
+			devices.owner,
+			devices.name,
+			devices.pubkey,
+			devices.ip,
+			devices.endpoint,
+			devices.nat
+		FROM devices
+		INNER JOIN nwdevs ON
+			nwdevs.device = devices.id
+			AND nwdevs.device != ?1
+			AND nwdevs.status = ?2
+			AND network IN (SELECT network FROM nets)
+		GROUP BY devices.id
+		ORDER BY devices.id
+	`, devid, MemberActive)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSQLiteDevices(rows)
+}
+
+// ListNetworks returns the networks of a user selected and ordered by o, or
+// those of every user if user is zero.
+func (s *SQLite) ListNetworks(ctx context.Context, user int64, o ListOptions) ([]Network, error) {
+	query, args := networkListQuery(user, o, false)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSQLiteNetworks(rows)
+}
+
+// ListDevices returns the devices of a user selected and ordered by o, or
+// those of every user if user is zero.
+func (s *SQLite) ListDevices(ctx context.Context, user int64, o DeviceOptions) ([]Device, error) {
+	query, args := deviceListQuery(user, o, false)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSQLiteDevices(rows)
+}
+
+// NetworksDevices returns the devices that are supposed to be connected to
+// each of the given networks.
+func (s *SQLite) NetworksDevices(ctx context.Context, nwids []int64) (map[int64][]Device, error) {
+	if len(nwids) == 0 {
+		return map[int64][]Device{}, nil
+	}
+
+	query, args := membersQuery(nwids, nil, false)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMemberDevices(rows)
+}
+
+// DevicesNetworks returns the networks that each of the given devices are
+// supposed to be connected to.
+func (s *SQLite) DevicesNetworks(ctx context.Context, devids []int64) (map[int64][]Network, error) {
+	if len(devids) == 0 {
+		return map[int64][]Network{}, nil
+	}
+
+	query, args := membersQuery(nil, devids, false)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMemberNetworks(rows)
+}
+
+// DeviceTags returns the tags of each of the given devices.
+func (s *SQLite) DeviceTags(ctx context.Context, devids []int64) (map[int64][]string, error) {
+	if len(devids) == 0 {
+		return map[int64][]string{}, nil
+	}
+
+	query, args := tagsQuery(devids, false)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTags(rows)
+}
+
+// SetDeviceTags replaces the tags of a device.
+func (s *SQLite) SetDeviceTags(ctx context.Context, devid int64, tags []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM device_tags WHERE device = ?1", devid); err != nil {
+		return err
+	}
+
+	for _, t := range tags {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO device_tags(device, tag) VALUES(?1, ?2)
+			ON CONFLICT DO NOTHING
+		`, devid, t)
+		if err != nil {
+			return translateSQLite(err)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,250 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mca3/pikorv/api"
+)
+
+var (
+	// ErrNotFound is returned when a user, network, device, or membership
+	// does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is returned when saving something would violate a
+	// uniqueness constraint, such as when a name is already taken.
+	ErrConflict = errors.New("conflict")
+)
+
+// Membership statuses of devices in a network.
+const (
+	// MemberActive devices are part of the network and are told about
+	// their peers.
+	MemberActive = "active"
+
+	// MemberPending devices have asked to join a network which requires
+	// approval, and are waiting for the network owner to approve them.
+	MemberPending = "pending"
+)
+
+// User, Network, and Device are defined by the API, since they are sent to
+// clients as they are stored.
+type (
+	User    = api.User
+	Network = api.Network
+	Device  = api.Device
+)
+
+// Store stores users, networks, devices, and the membership of devices in
+// networks.
+//
+// Saving a user, network, or device with an ID of zero creates it and sets its
+// ID; otherwise, the existing one is updated.
+type Store interface {
+	// Users returns all users.
+	Users(ctx context.Context) ([]User, error)
+
+	// ListUsers returns users selected and ordered by o, where the names
+	// of users are their usernames.
+	ListUsers(ctx context.Context, o ListOptions) ([]User, error)
+
+	// UserID returns a user from their ID.
+	UserID(ctx context.Context, id int64) (User, error)
+
+	// Username returns a user from their username.
+	Username(ctx context.Context, username string) (User, error)
+
+	// SaveUser saves user information.
+	SaveUser(ctx context.Context, u *User) error
+
+	// SetPassword sets the password of a user.
+	SetPassword(ctx context.Context, id int64, pass string) error
+
+	// CheckPassword compares a supplied password with the user's
+	// password.
+	//
+	// If the password is invalid or the user does not exist, -1 is
+	// returned. Otherwise, the returned int64 is the user's ID.
+	CheckPassword(ctx context.Context, username, pass string) int64
+
+	// DeleteUser deletes a user, along with all of their networks and
+	// devices.
+	DeleteUser(ctx context.Context, id int64) error
+
+	// Networks returns all networks that a user has created.
+	Networks(ctx context.Context, owner int64) ([]Network, error)
+
+	// ListNetworks returns the networks of a user selected and ordered by
+	// o, or those of every user if owner is zero.
+	ListNetworks(ctx context.Context, owner int64, o ListOptions) ([]Network, error)
+
+	// AllNetworks returns all networks.
+	AllNetworks(ctx context.Context) ([]Network, error)
+
+	// NetworkID returns a network from its ID.
+	NetworkID(ctx context.Context, id int64) (Network, error)
+
+	// SaveNetwork saves network information.
+	SaveNetwork(ctx context.Context, n *Network) error
+
+	// DeleteNetwork deletes a network.
+	DeleteNetwork(ctx context.Context, id int64) error
+
+	// NetworkDevices returns all devices that are supposed to be connected
+	// to a given network.
+	NetworkDevices(ctx context.Context, nwid int64) ([]Device, error)
+
+	// NetworksDevices returns the devices that are supposed to be
+	// connected to each of the given networks, like NetworkDevices, using a
+	// single query.
+	NetworksDevices(ctx context.Context, nwids []int64) (map[int64][]Device, error)
+
+	// NetworkRequests returns all devices that are waiting for approval to
+	// join a given network.
+	NetworkRequests(ctx context.Context, nwid int64) ([]Device, error)
+
+	// NetworkAdd adds a device to a network.
+	NetworkAdd(ctx context.Context, nwid, devid int64) error
+
+	// NetworkRequest asks for a device to be added to a network.
+	// The device will not be part of the network until it is approved.
+	NetworkRequest(ctx context.Context, nwid, devid int64) error
+
+	// NetworkApprove approves a pending request for a device to join a
+	// network.
+	//
+	// If there is no such request, ErrNotFound is returned.
+	NetworkApprove(ctx context.Context, nwid, devid int64) error
+
+	// NetworkReject rejects a pending request for a device to join a
+	// network.
+	//
+	// If there is no such request, ErrNotFound is returned.
+	NetworkReject(ctx context.Context, nwid, devid int64) error
+
+	// NetworkStatus returns the membership status of a device in a
+	// network.
+	//
+	// If the device is not in the network, ErrNotFound is returned.
+	NetworkStatus(ctx context.Context, nwid, devid int64) (string, error)
+
+	// NetworkRemove removes a device from a network.
+	NetworkRemove(ctx context.Context, nwid, devid int64) error
+
+	// AllDevices returns all devices.
+	AllDevices(ctx context.Context) ([]Device, error)
+
+	// Devices returns all devices of a user.
+	Devices(ctx context.Context, owner int64) ([]Device, error)
+
+	// ListDevices returns the devices of a user selected and ordered by o,
+	// or those of every user if owner is zero.
+	ListDevices(ctx context.Context, owner int64, o DeviceOptions) ([]Device, error)
+
+	// DeviceID returns a device from its ID.
+	DeviceID(ctx context.Context, id int64) (Device, error)
+
+	// DeviceIP returns a device from its Pikonet IP.
+	DeviceIP(ctx context.Context, ip string) (Device, error)
+
+	// DeviceKey returns a device from its public key.
+	DeviceKey(ctx context.Context, key string) (Device, error)
+
+	// SaveDevice saves device information.
+	SaveDevice(ctx context.Context, d *Device) error
+
+	// DeleteDevice deletes a device.
+	DeleteDevice(ctx context.Context, id int64) error
+
+	// DeviceNetworks returns all networks that a device is supposed to be
+	// connected to.
+	DeviceNetworks(ctx context.Context, devid int64) ([]Network, error)
+
+	// DevicesNetworks returns the networks that each of the given devices
+	// are supposed to be connected to, like DeviceNetworks, using a single
+	// query.
+	DevicesNetworks(ctx context.Context, devids []int64) (map[int64][]Network, error)
+
+	// DeviceTags returns the tags of each of the given devices, in
+	// alphabetical order.
+	DeviceTags(ctx context.Context, devids []int64) (map[int64][]string, error)
+
+	// SetDeviceTags replaces the tags of a device.
+	SetDeviceTags(ctx context.Context, devid int64, tags []string) error
+
+	// ConnectedTo returns all devices that a device is connected to.
+	ConnectedTo(ctx context.Context, devid int64) ([]Device, error)
+
+	// Close closes the store.
+	Close()
+}
+
+// PoolStats describes the connections a Store has open to its database.
+type PoolStats struct {
+	// Max is the most connections which may be open at once, and Open is
+	// how many are.
+	Max, Open int
+
+	// InUse connections are being used, and Idle ones are waiting to be.
+	InUse, Idle int
+
+	// Waits counts the times a connection had to be waited for.
+	Waits int64
+
+	// WaitTime is the time spent waiting for connections.
+	// PostgreSQL also counts the time spent acquiring idle connections.
+	WaitTime time.Duration
+}
+
+// Pooler is implemented by stores which keep a pool of connections to their
+// database.
+type Pooler interface {
+	PoolStats() PoolStats
+}
+
+// Open opens the store described by url and applies any pending migrations.
+//
+// URLs starting with "sqlite:" or "file:" open an SQLite database, such as
+// "sqlite:///var/lib/pikorv/pikorv.db" or "sqlite::memory:". Anything else is
+// passed to PostgreSQL.
+func Open(url string) (Store, error) {
+	s, err := Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if m, ok := s.(Migrator); ok {
+		if err := m.MigrateUp(context.Background(), 0); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Dial opens the store described by url like Open, but leaves the schema
+// alone.
+func Dial(url string) (Store, error) {
+	var s Store
+	var err error
+
+	switch {
+	case strings.HasPrefix(url, "sqlite://"):
+		s, err = dialSQLite(strings.TrimPrefix(url, "sqlite://"))
+	case strings.HasPrefix(url, "sqlite:"):
+		s, err = dialSQLite(strings.TrimPrefix(url, "sqlite:"))
+	case strings.HasPrefix(url, "file:"):
+		s, err = dialSQLite(url)
+	default:
+		s, err = dialPostgres(url)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,905 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var devCount = 1
+var nwCount = 1
+
+// eachStore runs f against every Store implementation.
+//
+// SQLite is tested against a temporary file, and Postgres is only tested if
+// POSTGRES_TEST is set.
+func eachStore(t *testing.T, f func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		s := NewMemory()
+		t.Cleanup(s.Close)
+		f(t, s)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		s, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Close)
+		f(t, s)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		u := os.Getenv("POSTGRES_TEST")
+		if u == "" {
+			t.Skip("Set POSTGRES_TEST to run database tests")
+		}
+
+		s, err := Connect(u, true)
+		if err != nil {
+			panic(err)
+		}
+		t.Cleanup(s.Close)
+		f(t, s)
+	})
+}
+
+func makeUser(t *testing.T, s Store) User {
+	u := User{
+		Username: "test",
+		Email:    "test@example.com",
+		Name:     "Test User",
+	}
+
+	if err := s.SaveUser(context.Background(), &u); err != nil {
+		t.Fatalf("failed saving user: %v", err)
+	}
+
+	return u
+}
+
+func makeNetwork(t *testing.T, s Store, u User) Network {
+	n := Network{
+		Owner: u.ID,
+		Name:  fmt.Sprintf("test network %d", nwCount),
+	}
+	nwCount++
+
+	if err := s.SaveNetwork(context.Background(), &n); err != nil {
+		t.Fatalf("failed saving user: %v", err)
+	}
+
+	return n
+}
+
+func makeDevice(t *testing.T, s Store, u User) Device {
+	n := Device{
+		Owner:     u.ID,
+		Name:      fmt.Sprintf("my test device %d", devCount),
+		PublicKey: fmt.Sprintf("dummy value goes here %d", devCount),
+		IP:        fmt.Sprintf("2001:db8::%d", devCount),
+	}
+	devCount++
+
+	if err := s.SaveDevice(context.Background(), &n); err != nil {
+		t.Fatalf("failed saving user: %v", err)
+	}
+
+	return n
+}
+
+func mustJoinNetwork(t *testing.T, s Store, dev, nwid int64) {
+	if err := s.NetworkAdd(context.Background(), nwid, dev); err != nil {
+		t.Fatalf("failed to add to network: %v", err)
+	}
+}
+
+func TestNewUser(t *testing.T) { eachStore(t, testNewUser) }
+
+func testNewUser(t *testing.T, s Store) {
+	u := makeUser(t, s)
+
+	nu, err := s.Username(context.Background(), u.Username)
+	if err != nil {
+		t.Fatalf("failed fetching user: %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(u, nu) {
+		t.Fatalf("expected %v, got %v", u, nu)
+	}
+
+	nu, err = s.UserID(context.Background(), u.ID)
+	if err != nil {
+		t.Fatalf("failed fetching user: %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(u, nu) {
+		t.Fatalf("expected %v, got %v", u, nu)
+	}
+
+	us, err := s.Users(context.Background())
+	if err != nil {
+		t.Fatalf("failed fetching users: %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(u, us[0]) {
+		t.Fatalf("expected %v, got %v", u, us[0])
+	}
+}
+
+func TestUpdateUser(t *testing.T) { eachStore(t, testUpdateUser) }
+
+func testUpdateUser(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	u.Name = "cool person"
+	if err := s.SaveUser(context.Background(), &u); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+
+	nu, err := s.UserID(context.Background(), u.ID)
+	if err != nil {
+		t.Fatalf("failed fetching user: %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(u, nu) {
+		t.Fatalf("expected %v, got %v", u, nu)
+	}
+}
+
+func TestDelUser(t *testing.T) { eachStore(t, testDelUser) }
+
+func testDelUser(t *testing.T, s Store) {
+	u := makeUser(t, s)
+
+	if err := s.DeleteUser(context.Background(), u.ID); err != nil {
+		t.Fatalf("delete user failed: %v", err)
+		return
+	}
+
+	_, err := s.Username(context.Background(), u.Username)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("delete failed, user still exists: %v", err)
+		return
+	}
+}
+
+func TestUserPassword(t *testing.T) { eachStore(t, testUserPassword) }
+
+func testUserPassword(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	if err := s.SetPassword(context.Background(), u.ID, "hunter2"); err != nil {
+		t.Fatalf("failed setting password: %v", err)
+		return
+	}
+
+	if s.CheckPassword(context.Background(), u.Username, "hunter2") == -1 {
+		t.Fatal("invalid username or password")
+	}
+
+	if s.CheckPassword(context.Background(), u.Username, "hunter1") != -1 {
+		t.Fatal("invalid password passed")
+	}
+}
+
+func TestUserFlags(t *testing.T) { eachStore(t, testUserFlags) }
+
+func testUserFlags(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	if u.Locked() {
+		t.Fatalf("new user is locked")
+	}
+
+	u.Admin = true
+	u.Disabled = true
+	u.LockedUntil = time.Now().Add(time.Hour).Unix()
+	if err := s.SaveUser(context.Background(), &u); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+
+	nu, err := s.Username(context.Background(), u.Username)
+	if err != nil {
+		t.Fatalf("failed fetching user: %v", err)
+	}
+
+	if !reflect.DeepEqual(u, nu) {
+		t.Fatalf("expected %v, got %v", u, nu)
+	}
+
+	nu.Disabled = false
+	if !nu.Locked() {
+		t.Errorf("user with LockedUntil in the future is not locked")
+	}
+
+	nu.LockedUntil = time.Now().Add(-time.Hour).Unix()
+	if nu.Locked() {
+		t.Errorf("user with LockedUntil in the past is locked")
+	}
+}
+
+func TestNewNetwork(t *testing.T) { eachStore(t, testNewNetwork) }
+
+func testNewNetwork(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+
+	nnw, err := s.NetworkID(context.Background(), nw.ID)
+	if err != nil {
+		t.Fatalf("failed fetching network: %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(nw, nnw) {
+		t.Fatalf("expected %v, got %v", nw, nnw)
+	}
+
+	ns, err := s.Networks(context.Background(), u.ID)
+	if err != nil {
+		t.Fatalf("failed fetching users: %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(nw, ns[0]) {
+		t.Fatalf("expected %v, got %v", nw, ns[0])
+	}
+
+	ns, err = s.AllNetworks(context.Background())
+	if err != nil {
+		t.Fatalf("failed fetching all networks: %v", err)
+	}
+
+	if len(ns) != 1 || !reflect.DeepEqual(nw, ns[0]) {
+		t.Fatalf("expected [%v], got %v", nw, ns)
+	}
+}
+
+func TestUpdateNetwork(t *testing.T) { eachStore(t, testUpdateNetwork) }
+
+func testUpdateNetwork(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+	nw.Name = "network name"
+
+	if err := s.SaveNetwork(context.Background(), &nw); err != nil {
+		t.Fatalf("failed saving network: %v", err)
+	}
+
+	nnw, err := s.NetworkID(context.Background(), nw.ID)
+	if err != nil {
+		t.Fatalf("failed fetching network: %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(nw, nnw) {
+		t.Fatalf("expected %v, got %v", nw, nnw)
+	}
+}
+
+func TestDelNetwork(t *testing.T) { eachStore(t, testDelNetwork) }
+
+func testDelNetwork(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+
+	if err := s.DeleteNetwork(context.Background(), nw.ID); err != nil {
+		t.Fatalf("delete network failed: %v", err)
+		return
+	}
+
+	_, err := s.NetworkID(context.Background(), nw.ID)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("delete failed, network still exists: %v", err)
+		return
+	}
+}
+
+func TestNewDevice(t *testing.T) { eachStore(t, testNewDevice) }
+
+func testNewDevice(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	dev := makeDevice(t, s, u)
+
+	if dev.ID == 0 {
+		t.Fatalf("device ID is zero")
+	}
+
+	ndev, err := s.DeviceID(context.Background(), dev.ID)
+	if err != nil {
+		t.Fatalf("failed fetching network: %v", err)
+	}
+
+	if !reflect.DeepEqual(dev, ndev) {
+		t.Fatalf("expected %v, got %v", dev, ndev)
+	}
+
+	devs, err := s.Devices(context.Background(), u.ID)
+	if err != nil {
+		t.Fatalf("failed fetching devices: %v", err)
+	}
+
+	if len(devs) == 0 {
+		t.Fatal("zero items returned, should have one")
+	} else if !reflect.DeepEqual(dev, devs[0]) {
+		t.Fatalf("expected %v, got %v", dev, devs[0])
+	}
+}
+
+func TestUpdateDevice(t *testing.T) { eachStore(t, testUpdateDevice) }
+
+func testUpdateDevice(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	dev := makeDevice(t, s, u)
+	dev.Name = "new device name"
+
+	if err := s.SaveDevice(context.Background(), &dev); err != nil {
+		t.Fatalf("failed updating device: %v", err)
+	}
+
+	ndev, err := s.DeviceID(context.Background(), dev.ID)
+	if err != nil {
+		t.Fatalf("failed fetching network: %v", err)
+	}
+
+	if !reflect.DeepEqual(dev, ndev) {
+		t.Fatalf("expected %v, got %v", dev, ndev)
+	}
+}
+
+func TestDelDevice(t *testing.T) { eachStore(t, testDelDevice) }
+
+func testDelDevice(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	dev := makeDevice(t, s, u)
+
+	if err := s.DeleteDevice(context.Background(), dev.ID); err != nil {
+		t.Fatalf("delete network failed: %v", err)
+		return
+	}
+
+	_, err := s.DeviceID(context.Background(), dev.ID)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("delete failed, network still exists: %v", err)
+		return
+	}
+}
+
+func TestAddDevice(t *testing.T) { eachStore(t, testAddDevice) }
+
+func testAddDevice(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+	dev := makeDevice(t, s, u)
+
+	if err := s.NetworkAdd(context.Background(), nw.ID, dev.ID); err != nil {
+		t.Fatalf("failed to add device to network: %v", err)
+	}
+
+	devs, err := s.NetworkDevices(context.Background(), nw.ID)
+	if err != nil {
+		t.Fatalf("failed to list devices: %v", err)
+	}
+
+	if len(devs) == 0 {
+		t.Fatal("returned zero devices, should have one")
+	}
+
+	if !reflect.DeepEqual(dev, devs[0]) {
+		t.Fatalf("expected %v, got %v", dev, devs[0])
+	}
+}
+
+func TestRemoveDevice(t *testing.T) { eachStore(t, testRemoveDevice) }
+
+func testRemoveDevice(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+	dev := makeDevice(t, s, u)
+
+	if err := s.NetworkAdd(context.Background(), nw.ID, dev.ID); err != nil {
+		t.Fatalf("failed to add device to network: %v", err)
+	}
+
+	if err := s.NetworkRemove(context.Background(), nw.ID, dev.ID); err != nil {
+		t.Fatalf("failed to delete device from network: %v", err)
+	}
+
+	devs, err := s.NetworkDevices(context.Background(), nw.ID)
+	if err != nil {
+		t.Fatalf("failed to list devices: %v", err)
+	}
+
+	if len(devs) != 0 {
+		t.Fatalf("returned %d devices, should have zero", len(devs))
+	}
+}
+
+func TestDeviceNetworks(t *testing.T) { eachStore(t, testDeviceNetworks) }
+
+func testDeviceNetworks(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+	nw2 := makeNetwork(t, s, u)
+	nw3 := makeNetwork(t, s, u)
+	dev := makeDevice(t, s, u)
+	dev2 := makeDevice(t, s, u)
+
+	mustJoinNetwork(t, s, dev.ID, nw.ID)
+	mustJoinNetwork(t, s, dev.ID, nw2.ID)
+	mustJoinNetwork(t, s, dev2.ID, nw2.ID)
+	mustJoinNetwork(t, s, dev2.ID, nw3.ID)
+
+	// device 1
+	nws, err := s.DeviceNetworks(context.Background(), dev.ID)
+	if err != nil {
+		t.Fatalf("failed to fetch device 2 networks: %v", err)
+	}
+
+	if len(nws) != 2 {
+		t.Fatalf("device 1 is in %d networks, expected 2", len(nws))
+	}
+
+	if !reflect.DeepEqual(nws[0], nw) {
+		t.Fatalf("device 1 nws[0] = %v, expected %v", nws[0], nw)
+	}
+	if !reflect.DeepEqual(nws[1], nw2) {
+		t.Fatalf("device 1 nws[1] = %v, expected %v", nws[1], nw2)
+	}
+
+	// device 2
+	nws, err = s.DeviceNetworks(context.Background(), dev2.ID)
+	if err != nil {
+		t.Fatalf("failed to fetch device 2 networks: %v", err)
+	}
+
+	if len(nws) != 2 {
+		t.Fatalf("device 2 is in %d networks, expected 2", len(nws))
+	}
+
+	if !reflect.DeepEqual(nws[0], nw2) {
+		t.Fatalf("device 2 nws[0] = %v, expected %v", nws[0], nw2)
+	}
+	if !reflect.DeepEqual(nws[1], nw3) {
+		t.Fatalf("device 2 nws[1] = %v, expected %v", nws[1], nw3)
+	}
+}
+
+func TestConnectedTo(t *testing.T) { eachStore(t, testConnectedTo) }
+
+func testConnectedTo(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+	nw2 := makeNetwork(t, s, u)
+	dev := makeDevice(t, s, u)
+	dev2 := makeDevice(t, s, u)
+	dev3 := makeDevice(t, s, u)
+
+	mustJoinNetwork(t, s, dev.ID, nw.ID)
+	mustJoinNetwork(t, s, dev2.ID, nw.ID)
+	mustJoinNetwork(t, s, dev3.ID, nw.ID)
+	mustJoinNetwork(t, s, dev2.ID, nw2.ID)
+	mustJoinNetwork(t, s, dev3.ID, nw2.ID)
+
+	devs, err := s.ConnectedTo(context.Background(), dev.ID)
+	if err != nil {
+		t.Fatalf("failed to fetch device connections: %v", err)
+	}
+
+	if len(devs) != 2 {
+		t.Fatalf("device 1 knows %d devices, expected 2", len(devs))
+	}
+
+	if !reflect.DeepEqual(devs[0], dev2) {
+		t.Fatalf("device 1 devs[0] = %v, expected %v", devs[0], dev2)
+	}
+	if !reflect.DeepEqual(devs[1], dev3) {
+		t.Fatalf("device 1 devs[1] = %v, expected %v", devs[1], dev3)
+	}
+}
+
+func TestNetworkApproval(t *testing.T) { eachStore(t, testNetworkApproval) }
+
+func testNetworkApproval(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+	dev := makeDevice(t, s, u)
+	dev2 := makeDevice(t, s, u)
+
+	mustJoinNetwork(t, s, dev.ID, nw.ID)
+
+	if err := s.NetworkRequest(context.Background(), nw.ID, dev2.ID); err != nil {
+		t.Fatalf("failed to request to join network: %v", err)
+	}
+
+	// Pending devices are not part of the network yet
+	devs, err := s.ConnectedTo(context.Background(), dev.ID)
+	if err != nil {
+		t.Fatalf("failed to fetch device connections: %v", err)
+	}
+
+	if len(devs) != 0 {
+		t.Fatalf("device 1 knows %d devices, expected 0", len(devs))
+	}
+
+	devs, err = s.NetworkRequests(context.Background(), nw.ID)
+	if err != nil {
+		t.Fatalf("failed to list requests: %v", err)
+	}
+
+	if len(devs) != 1 || !reflect.DeepEqual(devs[0], dev2) {
+		t.Fatalf("expected [%v], got %v", dev2, devs)
+	}
+
+	if err := s.NetworkApprove(context.Background(), nw.ID, dev2.ID); err != nil {
+		t.Fatalf("failed to approve request: %v", err)
+	}
+
+	if err := s.NetworkApprove(context.Background(), nw.ID, dev2.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("approved request twice: %v", err)
+	}
+
+	devs, err = s.NetworkDevices(context.Background(), nw.ID)
+	if err != nil {
+		t.Fatalf("failed to list devices: %v", err)
+	}
+
+	if len(devs) != 2 {
+		t.Fatalf("returned %d devices, should have two", len(devs))
+	}
+}
+
+func TestDeviceLookup(t *testing.T) { eachStore(t, testDeviceLookup) }
+
+func testDeviceLookup(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	dev := makeDevice(t, s, u)
+
+	ndev, err := s.DeviceIP(context.Background(), dev.IP)
+	if err != nil {
+		t.Fatalf("failed fetching device: %v", err)
+	}
+
+	if !reflect.DeepEqual(dev, ndev) {
+		t.Fatalf("expected %v, got %v", dev, ndev)
+	}
+
+	ndev, err = s.DeviceKey(context.Background(), dev.PublicKey)
+	if err != nil {
+		t.Fatalf("failed fetching device: %v", err)
+	}
+
+	if !reflect.DeepEqual(dev, ndev) {
+		t.Fatalf("expected %v, got %v", dev, ndev)
+	}
+}
+
+func TestConflict(t *testing.T) { eachStore(t, testConflict) }
+
+func testConflict(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+	dev := makeDevice(t, s, u)
+
+	u2 := u
+	u2.ID = 0
+	if err := s.SaveUser(context.Background(), &u2); !IsConflict(err) {
+		t.Fatalf("expected a conflict for a duplicate user, got %v", err)
+	}
+
+	nw2 := nw
+	nw2.ID = 0
+	if err := s.SaveNetwork(context.Background(), &nw2); !IsConflict(err) {
+		t.Fatalf("expected a conflict for a duplicate network, got %v", err)
+	}
+
+	dev2 := dev
+	dev2.ID = 0
+	if err := s.SaveDevice(context.Background(), &dev2); !IsConflict(err) {
+		t.Fatalf("expected a conflict for a duplicate device, got %v", err)
+	}
+
+	mustJoinNetwork(t, s, dev.ID, nw.ID)
+	if err := s.NetworkAdd(context.Background(), nw.ID, dev.ID); !IsConflict(err) {
+		t.Fatalf("expected a conflict for a duplicate membership, got %v", err)
+	}
+}
+
+func TestDeleteCascade(t *testing.T) { eachStore(t, testDeleteCascade) }
+
+func testDeleteCascade(t *testing.T, s Store) {
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+	dev := makeDevice(t, s, u)
+
+	mustJoinNetwork(t, s, dev.ID, nw.ID)
+
+	if err := s.DeleteUser(context.Background(), u.ID); err != nil {
+		t.Fatalf("delete user failed: %v", err)
+	}
+
+	if _, err := s.NetworkID(context.Background(), nw.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("network outlived its owner: %v", err)
+	}
+
+	if _, err := s.DeviceID(context.Background(), dev.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("device outlived its owner: %v", err)
+	}
+
+	if _, err := s.NetworkStatus(context.Background(), nw.ID, dev.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("membership outlived its network: %v", err)
+	}
+}
+
+func TestOpenSQLite(t *testing.T) {
+	for _, u := range []string{"sqlite::memory:", "sqlite://" + filepath.Join(t.TempDir(), "a.db"), "file:" + filepath.Join(t.TempDir(), "b.db")} {
+		s, err := Open(u)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", u, err)
+		}
+
+		if _, ok := s.(*SQLite); !ok {
+			t.Errorf("%q: expected *SQLite, got %T", u, s)
+		}
+		s.Close()
+	}
+}
+
+// deviceIDs returns the IDs of devs.
+func deviceIDs(devs []Device) []int64 {
+	ids := make([]int64, len(devs))
+	for i, d := range devs {
+		ids[i] = d.ID
+	}
+	return ids
+}
+
+func TestListDevices(t *testing.T) { eachStore(t, testListDevices) }
+
+func testListDevices(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	u := makeUser(t, s)
+	other := User{Username: "other", Email: "other@example.com"}
+	if err := s.SaveUser(ctx, &other); err != nil {
+		t.Fatalf("failed saving user: %v", err)
+	}
+
+	var devs []Device
+	for _, name := range []string{"laptop", "phone", "lab-1", "lab-2"} {
+		d := makeDevice(t, s, u)
+		d.Name = name
+		if err := s.SaveDevice(ctx, &d); err != nil {
+			t.Fatalf("failed saving device: %v", err)
+		}
+		devs = append(devs, d)
+	}
+	odev := makeDevice(t, s, other)
+
+	laptop, phone, lab1, lab2 := devs[0], devs[1], devs[2], devs[3]
+
+	if err := s.SetDeviceTags(ctx, lab1.ID, []string{"lab", "server"}); err != nil {
+		t.Fatalf("failed to set tags: %v", err)
+	}
+	if err := s.SetDeviceTags(ctx, lab2.ID, []string{"lab"}); err != nil {
+		t.Fatalf("failed to set tags: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		o    DeviceOptions
+		want []Device
+	}{
+		{"all", DeviceOptions{}, devs},
+		{"by name", DeviceOptions{ListOptions: ListOptions{Sort: SortName}}, []Device{lab1, lab2, laptop, phone}},
+		{"desc", DeviceOptions{ListOptions: ListOptions{Desc: true}}, []Device{lab2, lab1, phone, laptop}},
+		{"prefix", DeviceOptions{ListOptions: ListOptions{Prefix: "la"}}, []Device{laptop, lab1, lab2}},
+		{"limit", DeviceOptions{ListOptions: ListOptions{Limit: 2}}, []Device{laptop, phone}},
+		{"after id", DeviceOptions{ListOptions: ListOptions{After: &Cursor{ID: phone.ID}}}, []Device{lab1, lab2}},
+		{"after name", DeviceOptions{ListOptions: ListOptions{Sort: SortName, After: &Cursor{ID: lab2.ID, Name: lab2.Name}}}, []Device{laptop, phone}},
+		{"after name desc", DeviceOptions{ListOptions: ListOptions{Sort: SortName, Desc: true, After: &Cursor{ID: laptop.ID, Name: laptop.Name}, Limit: 1}}, []Device{lab2}},
+		{"tag", DeviceOptions{Tag: "lab"}, []Device{lab1, lab2}},
+		{"only", DeviceOptions{Only: []int64{phone.ID, lab2.ID}}, []Device{phone, lab2}},
+		{"only none", DeviceOptions{Only: []int64{}}, nil},
+		{"except", DeviceOptions{Except: []int64{phone.ID, lab2.ID}}, []Device{laptop, lab1}},
+	}
+
+	for _, tt := range tests {
+		got, err := s.ListDevices(ctx, u.ID, tt.o)
+		if err != nil {
+			t.Fatalf("%s: failed to list devices: %v", tt.name, err)
+		}
+
+		if !reflect.DeepEqual(deviceIDs(got), deviceIDs(tt.want)) {
+			t.Errorf("%s: got devices %v, expected %v", tt.name, deviceIDs(got), deviceIDs(tt.want))
+		}
+	}
+
+	// Without an owner, everyone's devices are listed.
+	got, err := s.ListDevices(ctx, 0, DeviceOptions{ListOptions: ListOptions{After: &Cursor{ID: lab2.ID}}})
+	if err != nil {
+		t.Fatalf("failed to list devices: %v", err)
+	} else if !reflect.DeepEqual(deviceIDs(got), []int64{odev.ID}) {
+		t.Errorf("got devices %v of every user, expected %v", deviceIDs(got), []int64{odev.ID})
+	}
+}
+
+func TestListNetworks(t *testing.T) { eachStore(t, testListNetworks) }
+
+func testListNetworks(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+	nw2 := makeNetwork(t, s, u)
+	nw2.Name = "another network"
+	if err := s.SaveNetwork(ctx, &nw2); err != nil {
+		t.Fatalf("failed saving network: %v", err)
+	}
+
+	nws, err := s.ListNetworks(ctx, u.ID, ListOptions{Sort: SortName})
+	if err != nil {
+		t.Fatalf("failed to list networks: %v", err)
+	} else if !reflect.DeepEqual(nws, []Network{nw2, nw}) {
+		t.Fatalf("got networks %v, expected %v", nws, []Network{nw2, nw})
+	}
+
+	nws, err = s.ListNetworks(ctx, u.ID, ListOptions{Prefix: "test", Limit: 1})
+	if err != nil {
+		t.Fatalf("failed to list networks: %v", err)
+	} else if !reflect.DeepEqual(nws, []Network{nw}) {
+		t.Fatalf("got networks %v, expected %v", nws, []Network{nw})
+	}
+
+	other := User{Username: "other", Email: "other@example.com"}
+	if err := s.SaveUser(ctx, &other); err != nil {
+		t.Fatalf("failed saving user: %v", err)
+	}
+	onw := makeNetwork(t, s, other)
+
+	nws, err = s.ListNetworks(ctx, 0, ListOptions{Desc: true})
+	if err != nil {
+		t.Fatalf("failed to list networks: %v", err)
+	} else if !reflect.DeepEqual(nws, []Network{onw, nw2, nw}) {
+		t.Fatalf("got networks %v of every user, expected %v", nws, []Network{onw, nw2, nw})
+	}
+}
+
+func TestListUsers(t *testing.T) { eachStore(t, testListUsers) }
+
+func testListUsers(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	var us []User
+	for _, name := range []string{"carol", "alice", "bob"} {
+		// Display names sort the other way, and must not be used.
+		u := User{Username: name, Email: name + "@example.com", Name: "z" + strings.Repeat("z", len(us))}
+		if err := s.SaveUser(ctx, &u); err != nil {
+			t.Fatalf("failed saving user: %v", err)
+		}
+		us = append(us, u)
+	}
+	carol, alice, bob := us[0], us[1], us[2]
+
+	tests := []struct {
+		name string
+		o    ListOptions
+		want []User
+	}{
+		{"all", ListOptions{}, us},
+		{"by name", ListOptions{Sort: SortName}, []User{alice, bob, carol}},
+		{"prefix", ListOptions{Prefix: "b"}, []User{bob}},
+		{"after name", ListOptions{Sort: SortName, After: &Cursor{ID: alice.ID, Name: alice.Username}, Limit: 1}, []User{bob}},
+		{"after id desc", ListOptions{Desc: true, After: &Cursor{ID: bob.ID}}, []User{alice, carol}},
+	}
+
+	for _, tt := range tests {
+		got, err := s.ListUsers(ctx, tt.o)
+		if err != nil {
+			t.Fatalf("%s: failed to list users: %v", tt.name, err)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got users %+v, expected %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMembersBatch(t *testing.T) { eachStore(t, testMembersBatch) }
+
+func testMembersBatch(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	u := makeUser(t, s)
+	nw := makeNetwork(t, s, u)
+	nw2 := makeNetwork(t, s, u)
+	dev := makeDevice(t, s, u)
+	dev2 := makeDevice(t, s, u)
+	dev3 := makeDevice(t, s, u)
+
+	mustJoinNetwork(t, s, dev.ID, nw.ID)
+	mustJoinNetwork(t, s, dev.ID, nw2.ID)
+	mustJoinNetwork(t, s, dev2.ID, nw2.ID)
+	if err := s.NetworkRequest(ctx, nw.ID, dev3.ID); err != nil {
+		t.Fatalf("failed to request to join: %v", err)
+	}
+
+	nws, err := s.DevicesNetworks(ctx, []int64{dev.ID, dev2.ID, dev3.ID})
+	if err != nil {
+		t.Fatalf("failed to fetch networks: %v", err)
+	}
+
+	want := map[int64][]Network{dev.ID: {nw, nw2}, dev2.ID: {nw2}}
+	if !reflect.DeepEqual(nws, want) {
+		t.Fatalf("got networks %v, expected %v", nws, want)
+	}
+
+	devs, err := s.NetworksDevices(ctx, []int64{nw.ID, nw2.ID})
+	if err != nil {
+		t.Fatalf("failed to fetch devices: %v", err)
+	}
+
+	wantDevs := map[int64][]Device{nw.ID: {dev}, nw2.ID: {dev, dev2}}
+	if !reflect.DeepEqual(devs, wantDevs) {
+		t.Fatalf("got devices %v, expected %v", devs, wantDevs)
+	}
+
+	if nws, err := s.DevicesNetworks(ctx, nil); err != nil || len(nws) != 0 {
+		t.Fatalf("DevicesNetworks(nil) = %v, %v", nws, err)
+	}
+}
+
+func TestDeviceTags(t *testing.T) { eachStore(t, testDeviceTags) }
+
+func testDeviceTags(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	u := makeUser(t, s)
+	dev := makeDevice(t, s, u)
+	dev2 := makeDevice(t, s, u)
+
+	if err := s.SetDeviceTags(ctx, dev.ID, []string{"b", "a", "b"}); err != nil {
+		t.Fatalf("failed to set tags: %v", err)
+	}
+
+	tags, err := s.DeviceTags(ctx, []int64{dev.ID, dev2.ID})
+	if err != nil {
+		t.Fatalf("failed to fetch tags: %v", err)
+	} else if want := map[int64][]string{dev.ID: {"a", "b"}}; !reflect.DeepEqual(tags, want) {
+		t.Fatalf("got tags %v, expected %v", tags, want)
+	}
+
+	if err := s.SetDeviceTags(ctx, dev.ID, nil); err != nil {
+		t.Fatalf("failed to clear tags: %v", err)
+	}
+
+	tags, err = s.DeviceTags(ctx, []int64{dev.ID})
+	if err != nil {
+		t.Fatalf("failed to fetch tags: %v", err)
+	} else if len(tags) != 0 {
+		t.Fatalf("got tags %v after clearing them", tags)
+	}
+}
+
+func testPoolStats(t *testing.T, s Store) {
+	p, ok := s.(Pooler)
+	if !ok {
+		t.Skip("store has no pool")
+	}
+
+	makeUser(t, s)
+
+	st := p.PoolStats()
+	if st.Max < 1 || st.Open < 1 || st.Open > st.Max || st.InUse+st.Idle != st.Open {
+		t.Fatalf("inconsistent pool stats: %+v", st)
+	}
+}
+
+func TestPoolStats(t *testing.T) { eachStore(t, testPoolStats) }
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/sha512"
 	"database/sql"
+	"errors"
 )
 
 const saltLength = 16
@@ -35,3 +36,9 @@ func hashPassword(pass string, salt []byte) []byte {
 	ct := sha512.Sum512(pt)
 	return ct[:]
 }
+
+// IsConflict determines if err was caused by a uniqueness constraint, such as
+// when a name is already taken.
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mca3/pikorv/api"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	l, err := New(&buf, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithRequestID(context.Background(), "abc123")
+	l.DebugContext(ctx, "hidden")
+	l.With("user_id", 4).InfoContext(ctx, "hello", "token", "hunter2", "Password", "hunter2")
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("expected a single record, got %s", buf.String())
+	}
+
+	for k, want := range map[string]any{
+		"msg":        "hello",
+		"level":      "INFO",
+		"request_id": "abc123",
+		"user_id":    float64(4),
+		"token":      redacted,
+		"Password":   redacted,
+	} {
+		if rec[k] != want {
+			t.Errorf("expected %s to be %v, got %v", k, want, rec[k])
+		}
+	}
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Fatalf("secret was logged: %s", buf.String())
+	}
+
+	if _, err := New(&buf, "xml", slog.LevelInfo); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	var got string
+	h := RequestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = RequestID(r.Context())
+	}))
+
+	for _, tc := range []struct {
+		header string
+		keep   bool
+	}{
+		{"", false},
+		{"from-proxy.1_a", true},
+		{"bad id\n", false},
+		{strings.Repeat("a", 65), false},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.header != "" {
+			req.Header.Set(api.RequestIDHeader, tc.header)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		sent := w.Header().Get(api.RequestIDHeader)
+		if sent == "" || sent != got {
+			t.Fatalf("%q: sent %q, but the context had %q", tc.header, sent, got)
+		} else if (sent == tc.header) != tc.keep {
+			t.Fatalf("%q: got %q", tc.header, sent)
+		}
+	}
+}
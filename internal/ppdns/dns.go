@@ -0,0 +1,126 @@
+// Package ppdns serves the names of Pikonet devices over DNS.
+package ppdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/mca3/pikorv/config"
+	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/internal/ppwg"
+	"github.com/mca3/pikorv/meshdns"
+)
+
+// store is where devices and networks are looked up.
+var store db.Store
+
+// SetStore sets the store names are looked up in, and must be called before
+// Listen.
+func SetStore(s db.Store) {
+	store = s
+}
+
+// lookup resolves <device>.<network> into the device's Pikonet IP.
+//
+// src must be the Pikonet IP of a device in the same network, so devices may
+// only resolve the peers they are connected to.
+func lookup(ctx context.Context, src netip.Addr, labels []string) (netip.Addr, error) {
+	if len(labels) != 2 {
+		return netip.Addr{}, meshdns.ErrNotFound
+	}
+
+	srcdev, err := store.DeviceIP(ctx, src.String())
+	if errors.Is(err, db.ErrNotFound) {
+		return netip.Addr{}, meshdns.ErrNotFound
+	} else if err != nil {
+		return netip.Addr{}, err
+	}
+
+	nws, err := store.DeviceNetworks(ctx, srcdev.ID)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	// Labels are made unique in the same way as the records sent over the
+	// gateway.
+	names := make([]string, len(nws))
+	for i, nw := range nws {
+		names[i] = nw.Name
+	}
+	nwLabels := meshdns.Labels(names...)
+
+	for i, nw := range nws {
+		if nwLabels[i] != labels[1] {
+			continue
+		}
+
+		devs, err := store.NetworkDevices(ctx, nw.ID)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+
+		names := make([]string, len(devs))
+		for j, dev := range devs {
+			names[j] = dev.Name
+		}
+
+		for j, l := range meshdns.Labels(names...) {
+			if l == labels[0] {
+				return netip.ParseAddr(devs[j].IP)
+			}
+		}
+	}
+
+	return netip.Addr{}, meshdns.ErrNotFound
+}
+
+// Listen serves DNS over UDP and TCP on config.DNSListen until ctx is
+// canceled.
+//
+// Listen may only be called once ppwg.Ready is closed.
+func Listen(ctx context.Context) error {
+	s := meshdns.Server{
+		Zone:   config.DNSZone,
+		Lookup: lookup,
+	}
+
+	ua, err := net.ResolveUDPAddr("udp", config.DNSListen)
+	if err != nil {
+		return err
+	}
+
+	ta, err := net.ResolveTCPAddr("tcp", config.DNSListen)
+	if err != nil {
+		return err
+	}
+
+	// The address may only exist inside the userspace WireGuard backend.
+	uc, err := ppwg.ListenUDP(ua)
+	if err != nil {
+		return err
+	}
+	defer uc.Close()
+
+	tl, err := ppwg.ListenTCP(ta)
+	if err != nil {
+		return err
+	}
+	defer tl.Close()
+
+	go func() {
+		<-ctx.Done()
+		uc.Close()
+		tl.Close()
+	}()
+
+	go s.ServeTCP(ctx, tl)
+
+	err = s.ServeUDP(ctx, uc)
+	if ctx.Err() != nil {
+		// We were told to stop.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+// Package pprelay runs the relay for devices that are unable to reach each
+// other directly.
+package pprelay
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"sync"
+
+	"github.com/mca3/pikorv/config"
+	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/relay"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var (
+	srv       = relay.Server{Allow: allow}
+	setupOnce sync.Once
+
+	store db.Store
+)
+
+// SetStore sets the store used to determine which devices may talk to each
+// other, and must be called before Listen.
+func SetStore(s db.Store) {
+	store = s
+}
+
+// setup configures the relay server from the config.
+func setup() {
+	setupOnce.Do(func() {
+		if config.RelaySecret != "" {
+			srv.Secret = []byte(config.RelaySecret)
+		} else {
+			// Tokens won't survive a restart, but clients are
+			// given new ones when they reconnect anyway.
+			srv.Secret = make([]byte, 32)
+			if _, err := rand.Read(srv.Secret); err != nil {
+				panic(err)
+			}
+		}
+
+		srv.Rate = config.RelayRate
+	})
+}
+
+// allow determines if src is connected to dst.
+//
+// Keys which no longer belong to a device, such as the old key of a device
+// whose key was rotated, are rejected: their tokens stay valid, so they may
+// still register with the relay, but can't send or receive anything.
+func allow(ctx context.Context, src, dst relay.Key) bool {
+	dev, err := store.DeviceKey(ctx, wgtypes.Key(src).String())
+	if err != nil {
+		// Includes db.ErrNotFound, for keys of no device.
+		return false
+	}
+
+	devs, err := store.ConnectedTo(ctx, dev.ID)
+	if err != nil {
+		return false
+	}
+
+	// Devices are listed with their current keys, so an old key of dst is
+	// never found.
+	dstKey := wgtypes.Key(dst).String()
+	for _, v := range devs {
+		if v.PublicKey == dstKey {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled determines if the relay is enabled.
+func Enabled() bool {
+	return config.RelayListen != ""
+}
+
+// Endpoint returns the address that clients should send relay packets to.
+func Endpoint() string {
+	if config.RelayEndpoint != "" {
+		return config.RelayEndpoint
+	}
+
+	_, port, err := net.SplitHostPort(config.RelayListen)
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(config.OurIP, port)
+}
+
+// Token returns the token that the device with the public key pubkey must
+// present to the relay.
+func Token(pubkey string) (string, error) {
+	setup()
+
+	k, err := wgtypes.ParseKey(pubkey)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(relay.Token(srv.Secret, relay.Key(k))), nil
+}
+
+// Stats returns the relay statistics for the device with the public key
+// pubkey.
+func Stats(pubkey string) (relay.Stats, bool) {
+	k, err := wgtypes.ParseKey(pubkey)
+	if err != nil {
+		return relay.Stats{}, false
+	}
+
+	return srv.Stats(relay.Key(k))
+}
+
+// Total returns the relay statistics of every device put together.
+func Total() relay.Stats {
+	return srv.Total()
+}
+
+// Forget cuts off the device with the public key pubkey from the relay and
+// drops its statistics, and is called once it is deleted or its key is
+// replaced.
+func Forget(pubkey string) {
+	k, err := wgtypes.ParseKey(pubkey)
+	if err != nil {
+		return
+	}
+
+	srv.Forget(relay.Key(k))
+}
+
+// Listen runs the relay on config.RelayListen until ctx is canceled.
+func Listen(ctx context.Context) error {
+	setup()
+
+	addr, err := net.ResolveUDPAddr("udp", config.RelayListen)
+	if err != nil {
+		return err
+	}
+
+	c, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	err = srv.Listen(c)
+	if ctx.Err() != nil {
+		// We were told to stop.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package ppwg
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/mca3/pikorv/config"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// backend is a WireGuard device which ppwg can configure.
+type backend interface {
+	// Name returns the name of the device.
+	Name() string
+
+	// Configure applies cfg to the device.
+	Configure(cfg wgtypes.Config) error
+
+	// Device returns the current state of the device.
+	Device() (*wgtypes.Device, error)
+
+	// AddRoute and RemoveRoute make the host route ipn over the device,
+	// if the backend needs it.
+	AddRoute(ipn *net.IPNet) error
+	RemoveRoute(ipn *net.IPNet) error
+
+	// ListenUDP and ListenTCP listen on addr, which may be an address
+	// only reachable over the device.
+	ListenUDP(addr *net.UDPAddr) (net.PacketConn, error)
+	ListenTCP(addr *net.TCPAddr) (net.Listener, error)
+
+	// Close tears down the device.
+	Close() error
+}
+
+// newBackend creates the backend selected by config.PunchBackend, with the
+// address ipn.
+func newBackend(ipn *net.IPNet) (backend, error) {
+	switch config.PunchBackend {
+	case "kernel":
+		return newKernel(config.PunchIface, ipn, config.PunchExisting)
+	case "userspace":
+		return newUserspace(config.PunchIface, ipn)
+	}
+
+	return nil, fmt.Errorf("unknown WireGuard backend %q", config.PunchBackend)
+}
@@ -0,0 +1,110 @@
+package ppwg
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// refreshInterval is how often the peer cache is refreshed from the
+	// WireGuard device.
+	refreshInterval = time.Second * 2
+
+	// maxHandshakeAge is how old a handshake may be before we stop
+	// trusting the endpoint of a peer.
+	// WireGuard rejects sessions older than three minutes.
+	maxHandshakeAge = time.Minute * 3
+)
+
+// peerInfo is what we know about a peer as of the last refresh.
+type peerInfo struct {
+	Endpoint  string
+	Handshake time.Time
+}
+
+var (
+	peerMu sync.RWMutex
+	peers  = map[netip.Addr]peerInfo{}
+
+	// peerCount is the amount of peers on the device, including those
+	// we have never heard from.
+	peerCount int
+
+	// refreshC asks goWireguard to refresh the cache early.
+	refreshC = make(chan struct{}, 1)
+)
+
+// lookupPeer returns the cached information for the peer with the allowed IP
+// ip.
+func lookupPeer(ip netip.Addr) (peerInfo, bool) {
+	peerMu.RLock()
+	defer peerMu.RUnlock()
+
+	p, ok := peers[ip]
+	return p, ok
+}
+
+// forgetPeer removes ip from the cache.
+func forgetPeer(ip netip.Addr) {
+	peerMu.Lock()
+	defer peerMu.Unlock()
+
+	delete(peers, ip)
+}
+
+// cachePeers replaces the cache with the current state of the device's peers.
+func cachePeers(dev *wgtypes.Device) {
+	m := make(map[netip.Addr]peerInfo, len(dev.Peers))
+
+	for _, p := range dev.Peers {
+		if p.Endpoint == nil {
+			// Never heard from them
+			continue
+		}
+
+		pi := peerInfo{
+			Endpoint:  p.Endpoint.String(),
+			Handshake: p.LastHandshakeTime,
+		}
+
+		for _, v := range p.AllowedIPs {
+			ip, ok := netip.AddrFromSlice(v.IP)
+			if !ok {
+				continue
+			}
+			m[ip.Unmap()] = pi
+		}
+	}
+
+	peerMu.Lock()
+	peers = m
+	peerCount = len(dev.Peers)
+	peerMu.Unlock()
+}
+
+// Peers returns the amount of WireGuard peers as of the last refresh, and how
+// many of them have had a handshake recently enough to be reachable.
+func Peers() (total, active int) {
+	peerMu.RLock()
+	defer peerMu.RUnlock()
+
+	for _, p := range peers {
+		if time.Since(p.Handshake) <= maxHandshakeAge {
+			active++
+		}
+	}
+	return peerCount, active
+}
+
+// requestRefresh asks for the cache to be refreshed soon, without waiting for
+// it to happen.
+func requestRefresh() {
+	select {
+	case refreshC <- struct{}{}:
+	default:
+		// Already asked
+	}
+}
@@ -0,0 +1,198 @@
+package ppwg
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// nlWireguard implements netlink.Link, as there is no native way to do this in
+// the netlink package yet.
+type nlWireguard struct {
+	netlink.LinkAttrs
+}
+
+func (w *nlWireguard) Attrs() *netlink.LinkAttrs {
+	return &w.LinkAttrs
+}
+
+func (w *nlWireguard) Type() string {
+	return "wireguard"
+}
+
+// kernel is a backend using a WireGuard interface managed by the kernel.
+//
+// It requires CAP_NET_ADMIN.
+type kernel struct {
+	link netlink.Link
+	wg   *wgctrl.Client
+
+	// owned is true if we created the interface, and should remove it
+	// once we're done.
+	owned bool
+}
+
+// newKernel sets up a kernel WireGuard interface named name with the address
+// ipn.
+//
+// If the interface already exists, such as after a crash, it is either
+// recreated or adopted as it is depending on existing, which is "recreate" or
+// "adopt".
+func newKernel(name string, ipn *net.IPNet, existing string) (*kernel, error) {
+	l, err := netlink.LinkByName(name)
+	if err == nil {
+		if l.Type() != "wireguard" {
+			return nil, fmt.Errorf("interface %s exists, but is a %s interface", name, l.Type())
+		}
+
+		if existing == "recreate" {
+			slog.Info("pikopunch: removing existing interface", "interface", name)
+			if err := netlink.LinkDel(l); err != nil {
+				return nil, fmt.Errorf("failed to remove existing interface %s: %w", name, err)
+			}
+			l = nil
+		} else {
+			slog.Info("pikopunch: adopting existing interface", "interface", name)
+		}
+	} else if !errors.As(err, &netlink.LinkNotFoundError{}) {
+		return nil, err
+	} else {
+		l = nil
+	}
+
+	k := &kernel{}
+
+	if l == nil {
+		// Create the interface
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = name
+		wga := nlWireguard{attrs}
+
+		if err := netlink.LinkAdd(&wga); err != nil {
+			return nil, err
+		}
+
+		l, err = netlink.LinkByName(attrs.Name)
+		if err != nil {
+			netlink.LinkDel(&wga)
+			return nil, fmt.Errorf("cannot access the interface (%s) we just made: %w", attrs.Name, err)
+		}
+
+		k.owned = true
+	}
+
+	k.link = l
+
+	k.wg, err = wgctrl.New()
+	if err != nil {
+		k.Close()
+		return nil, err
+	}
+
+	if err := k.setAddr(ipn); err != nil {
+		k.Close()
+		return nil, err
+	}
+
+	// Set our IP
+	if err := netlink.LinkSetUp(l); err != nil {
+		k.Close()
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// setAddr makes ipn the only address of the interface, leaving link-local
+// addresses alone.
+func (k *kernel) setAddr(ipn *net.IPNet) error {
+	addrs, err := netlink.AddrList(k.link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, v := range addrs {
+		if v.IP.Equal(ipn.IP) && v.Mask.String() == ipn.Mask.String() {
+			found = true
+			continue
+		} else if v.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		slog.Info("pikopunch: removing stale address", "addr", v.IPNet, "interface", k.Name())
+		if err := netlink.AddrDel(k.link, &v); err != nil {
+			return err
+		}
+	}
+
+	if found {
+		return nil
+	}
+
+	// Tell the kernel where we live
+	return netlink.AddrAdd(k.link, &netlink.Addr{IPNet: ipn})
+}
+
+func (k *kernel) Name() string {
+	return k.link.Attrs().Name
+}
+
+func (k *kernel) Configure(cfg wgtypes.Config) error {
+	return k.wg.ConfigureDevice(k.Name(), cfg)
+}
+
+func (k *kernel) Device() (*wgtypes.Device, error) {
+	return k.wg.Device(k.Name())
+}
+
+func (k *kernel) AddRoute(addr *net.IPNet) error {
+	r := netlink.Route{
+		LinkIndex: k.link.Attrs().Index,
+		Protocol:  6,
+		Dst:       addr,
+	}
+
+	// The route may still be there if we adopted the interface.
+	return netlink.RouteReplace(&r)
+}
+
+func (k *kernel) RemoveRoute(addr *net.IPNet) error {
+	routes, err := netlink.RouteGet(addr.IP)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range routes {
+		if v.LinkIndex == k.link.Attrs().Index && v.Dst.IP.Equal(addr.IP) {
+			return netlink.RouteDel(&v)
+		}
+	}
+
+	return nil
+}
+
+func (k *kernel) ListenUDP(addr *net.UDPAddr) (net.PacketConn, error) {
+	return net.ListenUDP("udp", addr)
+}
+
+func (k *kernel) ListenTCP(addr *net.TCPAddr) (net.Listener, error) {
+	return net.ListenTCP("tcp", addr)
+}
+
+func (k *kernel) Close() error {
+	if k.wg != nil {
+		k.wg.Close()
+	}
+
+	if !k.owned {
+		// Someone else may want it.
+		return nil
+	}
+	return netlink.LinkDel(k.link)
+}
@@ -0,0 +1,418 @@
+package ppwg
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mca3/pikorv/config"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// testServer is a ppwg instance running the pikopunch server on its own
+// WireGuard device.
+type testServer struct {
+	Key  wgtypes.Key
+	Port int
+}
+
+// testClient is a simulated Pikonet device, using userspace WireGuard to talk
+// to a testServer.
+type testClient struct {
+	Key  wgtypes.Key
+	IP   string
+	Port int
+
+	srv  *testServer
+	dev  *device.Device
+	tnet *netstack.Net
+}
+
+// startServer brings up ppwg with the given backend, and runs the pikopunch
+// server on it until the test ends.
+//
+// The test is skipped if the backend can't be created, such as when we lack
+// the privileges to create a kernel WireGuard interface.
+func startServer(t *testing.T, backend string) *testServer {
+	t.Helper()
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	config.PunchBackend = backend
+	config.PunchIface = "pptest0"
+	config.PunchIP = "fd00::"
+	config.PunchPort = 0
+	config.PunchPrivateKey = base64.StdEncoding.EncodeToString(key[:])
+	config.PunchRate = 0
+	config.Subnet = "fd00::/32"
+	_, config.SubnetIp, _ = net.ParseCIDR(config.Subnet)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := createWireguard(ctx); err != nil {
+		cancel()
+		t.Skipf("cannot create %s WireGuard device: %v", backend, err)
+	}
+
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+
+		// Don't let peers leak into the next test.
+		drainPeers()
+		peerMu.Lock()
+		peers = map[netip.Addr]peerInfo{}
+		peerCount = 0
+		peerMu.Unlock()
+	})
+
+	go func() {
+		defer close(done)
+		if err := listenPunch(ctx); err != nil {
+			t.Errorf("pikopunch server failed: %v", err)
+		}
+	}()
+
+	dev, err := wgb.Device()
+	if err != nil {
+		t.Fatalf("failed to get device: %v", err)
+	}
+
+	return &testServer{
+		Key:  key.PublicKey(),
+		Port: dev.ListenPort,
+	}
+}
+
+// drainPeers discards peers that were never picked up by goWireguard.
+func drainPeers() {
+	for {
+		select {
+		case <-C:
+		default:
+			return
+		}
+	}
+}
+
+// newClient creates a client with the address ip which uses srv as its only
+// peer.
+func newClient(t *testing.T, srv *testServer, ip string) *testClient {
+	t.Helper()
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tun, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr(ip)}, nil, device.DefaultMTU)
+	if err != nil {
+		t.Fatalf("failed to create client TUN: %v", err)
+	}
+
+	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, "client: "))
+	t.Cleanup(dev.Close)
+
+	port := 0
+	if err := dev.IpcSet(uapiConfig(wgtypes.Config{
+		PrivateKey: &key,
+		ListenPort: &port,
+		Peers:      []wgtypes.PeerConfig{srv.peerConfig()},
+	})); err != nil {
+		t.Fatalf("failed to configure client: %v", err)
+	}
+
+	if err := dev.Up(); err != nil {
+		t.Fatalf("failed to bring client up: %v", err)
+	}
+
+	s, err := dev.IpcGet()
+	if err != nil {
+		t.Fatalf("failed to get client state: %v", err)
+	}
+
+	wd, err := parseUAPI("client", s)
+	if err != nil {
+		t.Fatalf("failed to parse client state: %v", err)
+	}
+
+	return &testClient{
+		Key:  key.PublicKey(),
+		IP:   ip,
+		Port: wd.ListenPort,
+		srv:  srv,
+		dev:  dev,
+		tnet: tnet,
+	}
+}
+
+// peerConfig returns the configuration clients use for srv.
+func (srv *testServer) peerConfig() wgtypes.PeerConfig {
+	_, ipn, _ := net.ParseCIDR(config.PunchIP + "/128")
+
+	return wgtypes.PeerConfig{
+		PublicKey:  srv.Key,
+		Endpoint:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: srv.Port},
+		AllowedIPs: []net.IPNet{*ipn},
+	}
+}
+
+// Reconnect drops the session c has with the server, so the next packet
+// starts a new handshake.
+func (c *testClient) Reconnect() error {
+	return c.dev.IpcSet(uapiConfig(wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{
+			{PublicKey: c.srv.Key, Remove: true},
+			c.srv.peerConfig(),
+		},
+	}))
+}
+
+// Endpoint returns the endpoint the server should see for c.
+func (c *testClient) Endpoint() string {
+	return fmt.Sprintf("127.0.0.1:%d", c.Port)
+}
+
+// Peer returns the message which adds c as a peer of the server.
+func (c *testClient) Peer() wgPeer {
+	return wgPeer{
+		Key: c.Key,
+		IP:  c.IP,
+	}
+}
+
+// Punch sends a packet to the pikopunch server over the tunnel, and returns
+// the reply.
+// An empty reply means that the server doesn't know our endpoint yet.
+func (c *testClient) Punch(timeout time.Duration) (string, error) {
+	uc, err := c.tnet.DialUDP(nil, &net.UDPAddr{
+		IP:   net.ParseIP(config.PunchIP),
+		Port: config.PunchService,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer uc.Close()
+
+	uc.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := uc.Write([]byte{0}); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 128)
+	n, err := uc.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(buf[:n]), "\x00"), nil
+}
+
+// punchUntil punches until the server returns an endpoint, or the deadline
+// passes.
+func (c *testClient) punchUntil(deadline time.Time) (string, error) {
+	for time.Now().Before(deadline) {
+		ret, err := c.Punch(time.Millisecond * 500)
+		if err == nil && ret != "" {
+			return ret, nil
+		}
+
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	return "", errors.New("no endpoint before deadline")
+}
+
+// waitFor polls f until it returns true or the deadline passes.
+func waitFor(deadline time.Time, f func() bool) bool {
+	for time.Now().Before(deadline) {
+		if f() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	return false
+}
+
+func testPunch(t *testing.T, backend string) {
+	srv := startServer(t, backend)
+
+	a := newClient(t, srv, "fd00::2")
+	b := newClient(t, srv, "fd00::3")
+
+	C <- a.Peer()
+	C <- b.Peer()
+
+	deadline := time.Now().Add(time.Second * 10)
+
+	for _, c := range []*testClient{a, b} {
+		ep, err := c.punchUntil(deadline)
+		if err != nil {
+			t.Fatalf("%s: %v", c.IP, err)
+		}
+
+		if ep != c.Endpoint() {
+			t.Fatalf("%s: expected %s, got %s", c.IP, c.Endpoint(), ep)
+		}
+	}
+
+	if total, active := Peers(); total != 2 || active != 2 {
+		t.Fatalf("expected 2 active peers, got %d of %d", active, total)
+	} else if st := PunchStats()["wireguard"]; st.Packets < 2 {
+		t.Fatalf("expected at least 2 packets, got %+v", st)
+	}
+
+	// Take a off the server; b should be unaffected.
+	rm := a.Peer()
+	rm.Remove = true
+	C <- rm
+
+	if !waitFor(deadline, func() bool {
+		_, ok := lookupPeer(netip.MustParseAddr(a.IP))
+		return !ok
+	}) {
+		t.Fatalf("removed peer %s is still cached", a.IP)
+	}
+
+	if _, err := a.Punch(time.Millisecond * 500); err == nil {
+		t.Fatalf("removed peer %s got a reply", a.IP)
+	}
+
+	if ep, err := b.punchUntil(deadline); err != nil || ep != b.Endpoint() {
+		t.Fatalf("%s: expected %s, got %q (%v)", b.IP, b.Endpoint(), ep, err)
+	}
+
+	// And put it back. The server forgot the session, so the client
+	// needs to handshake again; a real client would after a while.
+	C <- a.Peer()
+
+	if err := a.Reconnect(); err != nil {
+		t.Fatalf("failed to reconnect %s: %v", a.IP, err)
+	}
+
+	if ep, err := a.punchUntil(deadline); err != nil || ep != a.Endpoint() {
+		t.Fatalf("%s: expected %s after adding it back, got %q (%v)", a.IP, a.Endpoint(), ep, err)
+	}
+}
+
+func TestPunchUserspace(t *testing.T) {
+	testPunch(t, "userspace")
+}
+
+func TestPunchKernel(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a kernel WireGuard interface requires root")
+	}
+
+	testPunch(t, "kernel")
+}
+
+func TestBackendDevice(t *testing.T) {
+	srv := startServer(t, "userspace")
+	a := newClient(t, srv, "fd00::2")
+
+	C <- a.Peer()
+
+	if !waitFor(time.Now().Add(time.Second*5), func() bool {
+		dev, err := wgb.Device()
+		if err != nil {
+			t.Fatalf("failed to get device: %v", err)
+		}
+
+		for _, p := range dev.Peers {
+			if p.PublicKey == a.Key {
+				return len(p.AllowedIPs) == 1 && p.AllowedIPs[0].IP.Equal(net.ParseIP(a.IP))
+			}
+		}
+		return false
+	}) {
+		t.Fatal("peer never showed up on the device")
+	}
+}
+
+func TestStalePeers(t *testing.T) {
+	ka, kb, kc := wgtypes.Key{1}, wgtypes.Key{2}, wgtypes.Key{3}
+	_, ipa, _ := net.ParseCIDR("fd00::2/128")
+	_, ipb, _ := net.ParseCIDR("fd00::3/128")
+
+	dev := &wgtypes.Device{
+		Peers: []wgtypes.Peer{
+			{PublicKey: ka, AllowedIPs: []net.IPNet{*ipa}},
+			{PublicKey: kb, AllowedIPs: []net.IPNet{*ipb}},
+			{PublicKey: kc},
+		},
+	}
+
+	// a is still around; b's key was rotated to one we don't know about
+	// on the device yet.
+	out := stalePeers(dev, map[wgtypes.Key]bool{ka: true}, map[string]bool{"fd00::2": true, "fd00::3": true})
+
+	if len(out) != 2 {
+		t.Fatalf("expected 2 stale peers, got %+v", out)
+	}
+
+	if out[0].Key != kb || !out[0].Remove || !out[0].KeepRoute || out[0].IP != "fd00::3" {
+		t.Fatalf("bad removal for rotated peer: %+v", out[0])
+	}
+
+	if out[1].Key != kc || !out[1].Remove || !out[1].KeepRoute {
+		t.Fatalf("bad removal for peer without IPs: %+v", out[1])
+	}
+
+	out = stalePeers(dev, map[wgtypes.Key]bool{ka: true, kc: true}, map[string]bool{"fd00::2": true})
+	if len(out) != 1 || out[0].Key != kb || out[0].KeepRoute {
+		t.Fatalf("bad removal for deleted peer: %+v", out)
+	}
+
+	// Peers without an IP have no route to remove, even if we're told to.
+	var b routeBackend
+	handleWgMsg(&b, wgPeer{Key: kc, Remove: true})
+	if len(b.routes) != 0 || len(b.cfgs) != 1 || !b.cfgs[0].Peers[0].Remove {
+		t.Fatalf("bad removal for peer without IPs: routes %v, configured %+v", b.routes, b.cfgs)
+	}
+
+	// They can't be added at all.
+	b = routeBackend{}
+	handleWgMsg(&b, wgPeer{Key: kc})
+	if len(b.routes) != 0 || len(b.cfgs) != 0 {
+		t.Fatalf("added peer without IPs: routes %v, configured %+v", b.routes, b.cfgs)
+	}
+}
+
+// routeBackend records the routes and configuration handleWgMsg applies.
+// Everything else is left unimplemented.
+type routeBackend struct {
+	backend
+
+	routes []string
+	cfgs   []wgtypes.Config
+}
+
+func (b *routeBackend) Configure(cfg wgtypes.Config) error {
+	b.cfgs = append(b.cfgs, cfg)
+	return nil
+}
+
+func (b *routeBackend) AddRoute(ipn *net.IPNet) error {
+	b.routes = append(b.routes, "+"+ipn.String())
+	return nil
+}
+
+func (b *routeBackend) RemoveRoute(ipn *net.IPNet) error {
+	b.routes = append(b.routes, "-"+ipn.String())
+	return nil
+}
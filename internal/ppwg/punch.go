@@ -3,45 +3,90 @@ package ppwg
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net"
+	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/mca3/pikorv/config"
 	"github.com/mca3/pikorv/db"
 	"github.com/mca3/pikorv/punch"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var errNotFound = errors.New("not found")
 
-func punchLookup(_ context.Context, addr *net.UDPAddr) (string, error) {
-	ipstr := addr.IP.String() + "/128"
-	ip, _, err := net.ParseCIDR(ipstr)
-	if err != nil {
-		return "", err
+var ready = make(chan struct{})
+
+// punchServers holds the pikopunch servers which have been started, by what
+// they are for.
+var (
+	punchMu      sync.Mutex
+	punchServers = map[string]*punch.Server{}
+)
+
+// Ready returns a channel which is closed once the WireGuard interface is up,
+// and its address may be listened on.
+func Ready() <-chan struct{} {
+	return ready
+}
+
+// trackPunch adds s to punchServers as name.
+func trackPunch(name string, s *punch.Server) *punch.Server {
+	punchMu.Lock()
+	defer punchMu.Unlock()
+
+	punchServers[name] = s
+	return s
+}
+
+// PunchStats returns the statistics of each pikopunch server which has been
+// started, which is "wireguard" for the one on the WireGuard interface, and
+// "probe" and "public" for those on config.PunchProbe and config.PunchPublic.
+func PunchStats() map[string]punch.Stats {
+	punchMu.Lock()
+	defer punchMu.Unlock()
+
+	m := make(map[string]punch.Stats, len(punchServers))
+	for k, v := range punchServers {
+		m[k] = v.Stats()
 	}
+	return m
+}
 
-	dev, err := wg.Device(config.PunchIface)
-	if err != nil {
-		return "", err
+// punchLookup returns the WireGuard endpoint of the peer which sent a packet
+// from addr, using the peer cache.
+//
+// If we don't know the peer, or its last handshake is too old for the
+// endpoint to be trusted, punch.ErrUnknown is returned and a refresh is
+// requested so a retry will likely succeed.
+func punchLookup(_ context.Context, addr *net.UDPAddr) (string, error) {
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return "", errNotFound
 	}
 
-	for _, p := range dev.Peers {
-		for _, i := range p.AllowedIPs {
-			if i.IP.Equal(ip) {
-				return p.Endpoint.String(), nil
-			}
-		}
+	p, ok := lookupPeer(ip.Unmap())
+	if !ok || time.Since(p.Handshake) > maxHandshakeAge {
+		requestRefresh()
+		return "", punch.ErrUnknown
 	}
 
-	return "", errNotFound
+	return p.Endpoint, nil
 }
 
+// configurePeers adds every device as a peer, and removes peers which are
+// left over from a previous run, such as when an existing interface was
+// adopted.
 func configurePeers(ctx context.Context) error {
-	devs, err := db.AllDevices(ctx)
+	devs, err := store.AllDevices(ctx)
 	if err != nil {
 		return err
 	}
 
+	keys := make(map[wgtypes.Key]bool, len(devs))
+	ips := make(map[string]bool, len(devs))
+
 	for _, dev := range devs {
 		k, err := parseKey(dev.PublicKey)
 		if err != nil {
@@ -49,15 +94,177 @@ func configurePeers(ctx context.Context) error {
 			continue
 		}
 
+		keys[k] = true
+		ips[net.ParseIP(dev.IP).String()] = true
 		C <- wgPeer{
 			IP:  dev.IP,
 			Key: k,
 		}
 	}
 
+	wd, err := wgb.Device()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range stalePeers(wd, keys, ips) {
+		C <- p
+	}
+
 	return nil
 }
 
+// stalePeers returns messages removing the peers of dev whose keys aren't in
+// keys.
+// Routes are left alone for IPs in ips, which are still in use by another
+// peer.
+func stalePeers(dev *wgtypes.Device, keys map[wgtypes.Key]bool, ips map[string]bool) []wgPeer {
+	var out []wgPeer
+
+	for _, p := range dev.Peers {
+		if keys[p.PublicKey] {
+			continue
+		}
+
+		rm := wgPeer{
+			Key:    p.PublicKey,
+			Remove: true,
+		}
+
+		// We only ever give peers a single IP.
+		if len(p.AllowedIPs) > 0 {
+			rm.IP = p.AllowedIPs[0].IP.String()
+		}
+		rm.KeepRoute = rm.IP == "" || ips[rm.IP]
+
+		out = append(out, rm)
+	}
+
+	return out
+}
+
+// RotatePeer replaces the WireGuard peer for dev, which was previously using
+// oldKey, with a peer using its current public key.
+//
+// The old peer is removed right away: WireGuard only lets a single peer use an
+// allowed IP, and adding the new peer moves the IP of the device over to it,
+// so the old key couldn't be used with us anyway. Overlapping keys are only
+// honored by the peers of the device, which are told about the old key.
+func RotatePeer(dev db.Device, oldKey string) error {
+	nk, err := parseKey(dev.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	ok, err := parseKey(oldKey)
+	if err != nil {
+		return err
+	}
+
+	// Adding the new peer moves the allowed IP over to it, so the route
+	// is left as is.
+	C <- wgPeer{
+		IP:        dev.IP,
+		Key:       nk,
+		KeepRoute: true,
+	}
+
+	C <- wgPeer{
+		IP:        dev.IP,
+		Key:       ok,
+		Remove:    true,
+		KeepRoute: true,
+	}
+	return nil
+}
+
+// RemovePeer removes the WireGuard peer for dev, such as when it has been
+// deleted.
+func RemovePeer(dev db.Device) error {
+	k, err := parseKey(dev.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	C <- wgPeer{
+		IP:     dev.IP,
+		Key:    k,
+		Remove: true,
+	}
+	return nil
+}
+
+// listenUDP runs s on each address in addrs.
+//
+// listenUDP returns once ctx is canceled, or any of the listeners fail.
+func listenUDP(ctx context.Context, s *punch.Server, addrs []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errc := make(chan error, len(addrs))
+
+	for _, v := range addrs {
+		addr, err := net.ResolveUDPAddr("udp", v)
+		if err != nil {
+			return err
+		}
+
+		c, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		go func() {
+			errc <- s.Listen(ctx, c)
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errc:
+		return err
+	}
+}
+
+// ListenProbe runs a pikopunch server on each address in config.PunchProbe,
+// which clients may use to classify their NAT.
+//
+// ListenProbe returns once ctx is canceled, or any of the servers fail.
+func ListenProbe(ctx context.Context) error {
+	return listenUDP(ctx, trackPunch("probe", &punch.Server{
+		Rate: config.PunchRate,
+	}), config.PunchProbe)
+}
+
+// ListenPublic runs a plain pikopunch server on each address in
+// config.PunchPublic, for clients which can't bring up a WireGuard tunnel
+// first.
+//
+// ListenPublic returns once ctx is canceled, or any of the servers fail.
+func ListenPublic(ctx context.Context) error {
+	return listenUDP(ctx, trackPunch("public", &punch.Server{
+		Rate: config.PunchRate,
+	}), config.PunchPublic)
+}
+
+// ListenUDP listens for UDP packets on addr, which may be an address only
+// reachable over the WireGuard interface.
+//
+// ListenUDP may only be called once Ready is closed.
+func ListenUDP(addr *net.UDPAddr) (net.PacketConn, error) {
+	return wgb.ListenUDP(addr)
+}
+
+// ListenTCP listens for TCP connections on addr, which may be an address only
+// reachable over the WireGuard interface.
+//
+// ListenTCP may only be called once Ready is closed.
+func ListenTCP(addr *net.TCPAddr) (net.Listener, error) {
+	return wgb.ListenTCP(addr)
+}
+
 func Listen(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -70,16 +277,28 @@ func Listen(ctx context.Context) error {
 		return err
 	}
 
-	s := punch.Server{
+	close(ready)
+
+	return listenPunch(ctx)
+}
+
+// listenPunch runs the pikopunch server on the WireGuard interface until ctx
+// is canceled.
+func listenPunch(ctx context.Context) error {
+	s := trackPunch("wireguard", &punch.Server{
 		Lookup: punchLookup,
-	}
+		Rate:   config.PunchRate,
+	})
 
-	addr, _ := net.ResolveUDPAddr("udp6", fmt.Sprintf("[%s]:8743", config.PunchIP))
-	srv, err := net.ListenUDP("udp6", addr)
+	addr := &net.UDPAddr{
+		IP:   net.ParseIP(config.PunchIP),
+		Port: config.PunchService,
+	}
+	srv, err := wgb.ListenUDP(addr)
 	if err != nil {
 		return err
 	}
 	defer srv.Close()
 
-	return s.Listen(srv)
+	return s.Listen(ctx, srv)
 }
@@ -0,0 +1,255 @@
+package ppwg
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mca3/pikorv/config"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// userspace is a backend using wireguard-go with a userspace network stack.
+//
+// It needs no privileges, but addresses on the device are only reachable
+// through ListenUDP and ListenTCP.
+type userspace struct {
+	name string
+	dev  *device.Device
+	tnet *netstack.Net
+}
+
+// newUserspace creates a userspace WireGuard device named name with the
+// address ipn.
+func newUserspace(name string, ipn *net.IPNet) (*userspace, error) {
+	ip, ok := netip.AddrFromSlice(ipn.IP)
+	if !ok {
+		return nil, fmt.Errorf("invalid address %v", ipn.IP)
+	}
+
+	tun, tnet, err := netstack.CreateNetTUN([]netip.Addr{ip.Unmap()}, nil, device.DefaultMTU)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := device.NewLogger(device.LogLevelError, "pikopunch: ")
+	dev := device.NewDevice(tun, conn.NewDefaultBind(), logger)
+
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	return &userspace{
+		name: name,
+		dev:  dev,
+		tnet: tnet,
+	}, nil
+}
+
+func (u *userspace) Name() string {
+	return u.name
+}
+
+func (u *userspace) Configure(cfg wgtypes.Config) error {
+	return u.dev.IpcSet(uapiConfig(cfg))
+}
+
+func (u *userspace) Device() (*wgtypes.Device, error) {
+	s, err := u.dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseUAPI(u.name, s)
+}
+
+// The network stack routes everything over the device, and wireguard-go
+// picks the peer by its allowed IPs.
+func (u *userspace) AddRoute(*net.IPNet) error    { return nil }
+func (u *userspace) RemoveRoute(*net.IPNet) error { return nil }
+
+// inTunnel determines if ip belongs to the network stack of the device.
+func inTunnel(ip net.IP) bool {
+	return config.SubnetIp != nil && config.SubnetIp.Contains(ip)
+}
+
+func (u *userspace) ListenUDP(addr *net.UDPAddr) (net.PacketConn, error) {
+	if !inTunnel(addr.IP) {
+		return net.ListenUDP("udp", addr)
+	}
+	return u.tnet.ListenUDP(addr)
+}
+
+func (u *userspace) ListenTCP(addr *net.TCPAddr) (net.Listener, error) {
+	if !inTunnel(addr.IP) {
+		return net.ListenTCP("tcp", addr)
+	}
+	return u.tnet.ListenTCP(addr)
+}
+
+func (u *userspace) Close() error {
+	u.dev.Close()
+	return nil
+}
+
+// uapiConfig converts cfg into a set operation for the WireGuard cross-platform
+// userspace API.
+func uapiConfig(cfg wgtypes.Config) string {
+	var sb strings.Builder
+
+	if cfg.PrivateKey != nil {
+		fmt.Fprintf(&sb, "private_key=%s\n", hex.EncodeToString(cfg.PrivateKey[:]))
+	}
+	if cfg.ListenPort != nil {
+		fmt.Fprintf(&sb, "listen_port=%d\n", *cfg.ListenPort)
+	}
+	if cfg.FirewallMark != nil {
+		fmt.Fprintf(&sb, "fwmark=%d\n", *cfg.FirewallMark)
+	}
+	if cfg.ReplacePeers {
+		sb.WriteString("replace_peers=true\n")
+	}
+
+	for _, p := range cfg.Peers {
+		fmt.Fprintf(&sb, "public_key=%s\n", hex.EncodeToString(p.PublicKey[:]))
+
+		if p.Remove {
+			sb.WriteString("remove=true\n")
+			continue
+		}
+
+		if p.UpdateOnly {
+			sb.WriteString("update_only=true\n")
+		}
+		if p.PresharedKey != nil {
+			fmt.Fprintf(&sb, "preshared_key=%s\n", hex.EncodeToString(p.PresharedKey[:]))
+		}
+		if p.Endpoint != nil {
+			fmt.Fprintf(&sb, "endpoint=%s\n", p.Endpoint)
+		}
+		if p.PersistentKeepaliveInterval != nil {
+			fmt.Fprintf(&sb, "persistent_keepalive_interval=%d\n", int(p.PersistentKeepaliveInterval.Seconds()))
+		}
+		if p.ReplaceAllowedIPs {
+			sb.WriteString("replace_allowed_ips=true\n")
+		}
+		for _, v := range p.AllowedIPs {
+			fmt.Fprintf(&sb, "allowed_ip=%s\n", v.String())
+		}
+	}
+
+	return sb.String()
+}
+
+// parseUAPI parses the result of a get operation on the WireGuard
+// cross-platform userspace API.
+func parseUAPI(name, s string) (*wgtypes.Device, error) {
+	dev := &wgtypes.Device{
+		Name: name,
+		Type: wgtypes.Userspace,
+	}
+
+	var p *wgtypes.Peer
+	var hsec, hnsec int64
+
+	// finishPeer fills in the handshake time of the current peer, which is
+	// spread over two keys.
+	finishPeer := func() {
+		if p != nil && (hsec != 0 || hnsec != 0) {
+			p.LastHandshakeTime = time.Unix(hsec, hnsec)
+		}
+		hsec, hnsec = 0, 0
+	}
+
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		var err error
+
+		switch k {
+		case "private_key":
+			dev.PrivateKey, err = parseHexKey(v)
+			dev.PublicKey = dev.PrivateKey.PublicKey()
+		case "listen_port":
+			dev.ListenPort, err = strconv.Atoi(v)
+		case "fwmark":
+			dev.FirewallMark, err = strconv.Atoi(v)
+		case "public_key":
+			finishPeer()
+			dev.Peers = append(dev.Peers, wgtypes.Peer{})
+			p = &dev.Peers[len(dev.Peers)-1]
+			p.PublicKey, err = parseHexKey(v)
+		case "preshared_key":
+			if p != nil {
+				p.PresharedKey, err = parseHexKey(v)
+			}
+		case "protocol_version":
+			if p != nil {
+				p.ProtocolVersion, err = strconv.Atoi(v)
+			}
+		case "endpoint":
+			if p != nil {
+				p.Endpoint, err = net.ResolveUDPAddr("udp", v)
+			}
+		case "last_handshake_time_sec":
+			hsec, err = strconv.ParseInt(v, 10, 64)
+		case "last_handshake_time_nsec":
+			hnsec, err = strconv.ParseInt(v, 10, 64)
+		case "tx_bytes":
+			if p != nil {
+				p.TransmitBytes, err = strconv.ParseInt(v, 10, 64)
+			}
+		case "rx_bytes":
+			if p != nil {
+				p.ReceiveBytes, err = strconv.ParseInt(v, 10, 64)
+			}
+		case "persistent_keepalive_interval":
+			var secs int
+			secs, err = strconv.Atoi(v)
+			if p != nil {
+				p.PersistentKeepaliveInterval = time.Duration(secs) * time.Second
+			}
+		case "allowed_ip":
+			var ipn *net.IPNet
+			_, ipn, err = net.ParseCIDR(v)
+			if p != nil && err == nil {
+				p.AllowedIPs = append(p.AllowedIPs, *ipn)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("bad value for %s: %w", k, err)
+		}
+	}
+	finishPeer()
+
+	return dev, sc.Err()
+}
+
+// parseHexKey parses a key as used by the userspace API.
+func parseHexKey(s string) (wgtypes.Key, error) {
+	var k wgtypes.Key
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return k, err
+	} else if len(b) != wgtypes.KeyLen {
+		return k, fmt.Errorf("key is %d bytes, expected %d", len(b), wgtypes.KeyLen)
+	}
+
+	copy(k[:], b)
+	return k, nil
+}
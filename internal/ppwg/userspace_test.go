@@ -0,0 +1,74 @@
+package ppwg
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestUAPIConfig(t *testing.T) {
+	k := wgtypes.Key{1}
+	port := 1234
+	_, ipn, _ := net.ParseCIDR("fd00::1/128")
+
+	s := uapiConfig(wgtypes.Config{
+		ListenPort: &port,
+		Peers: []wgtypes.PeerConfig{
+			{PublicKey: k, AllowedIPs: []net.IPNet{*ipn}},
+			{PublicKey: k, Remove: true},
+		},
+	})
+
+	hk := "01" + strings.Repeat("00", 31)
+	exp := "listen_port=1234\n" +
+		"public_key=" + hk + "\nallowed_ip=fd00::1/128\n" +
+		"public_key=" + hk + "\nremove=true\n"
+
+	if s != exp {
+		t.Fatalf("expected %q, got %q", exp, s)
+	}
+}
+
+func TestParseUAPI(t *testing.T) {
+	hk := "02" + strings.Repeat("00", 31)
+	s := "listen_port=1234\n" +
+		"public_key=" + hk + "\n" +
+		"protocol_version=1\n" +
+		"endpoint=192.0.2.1:5678\n" +
+		"last_handshake_time_sec=1700000000\n" +
+		"last_handshake_time_nsec=5\n" +
+		"allowed_ip=fd00::2/128\n" +
+		"public_key=" + hk + "\n" +
+		"last_handshake_time_sec=0\n" +
+		"last_handshake_time_nsec=0\n"
+
+	dev, err := parseUAPI("pp0", s)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	if dev.Name != "pp0" || dev.ListenPort != 1234 || len(dev.Peers) != 2 {
+		t.Fatalf("bad device: %+v", dev)
+	}
+
+	p := dev.Peers[0]
+	if p.PublicKey != (wgtypes.Key{2}) {
+		t.Fatalf("bad public key: %v", p.PublicKey)
+	}
+	if p.Endpoint.String() != "192.0.2.1:5678" {
+		t.Fatalf("bad endpoint: %v", p.Endpoint)
+	}
+	if !p.LastHandshakeTime.Equal(time.Unix(1700000000, 5)) {
+		t.Fatalf("bad handshake time: %v", p.LastHandshakeTime)
+	}
+	if len(p.AllowedIPs) != 1 || p.AllowedIPs[0].String() != "fd00::2/128" {
+		t.Fatalf("bad allowed IPs: %v", p.AllowedIPs)
+	}
+
+	if !dev.Peers[1].LastHandshakeTime.IsZero() {
+		t.Fatalf("expected no handshake, got %v", dev.Peers[1].LastHandshakeTime)
+	}
+}
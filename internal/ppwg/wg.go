@@ -6,36 +6,38 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/netip"
+	"time"
 
 	"github.com/mca3/pikorv/config"
-	"github.com/vishvananda/netlink"
-	"golang.zx2c4.com/wireguard/wgctrl"
+	"github.com/mca3/pikorv/db"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var C = make(chan wgPeer, 1000)
-var wg *wgctrl.Client
+
+// store is where devices are read from when we start.
+var store db.Store
+
+// SetStore sets the store devices are read from, and must be called before
+// Listen.
+func SetStore(s db.Store) {
+	store = s
+}
+
+// wgb is the WireGuard backend, which is set before Ready is closed.
+var wgb backend
 
 type wgPeer struct {
 	Key    wgtypes.Key
 	IP     string
 	Remove bool
-}
-
-// nlWireguard implements netlink.Link, as there is no native way to do this in
-// the netlink package yet.
-type nlWireguard struct {
-	netlink.LinkAttrs
-}
-
-func (w *nlWireguard) Attrs() *netlink.LinkAttrs {
-	return &w.LinkAttrs
-}
 
-func (w *nlWireguard) Type() string {
-	return "wireguard"
+	// KeepRoute leaves the route for IP alone, which is needed when
+	// another peer is using the same IP, such as during key rotation.
+	KeepRoute bool
 }
 
 func (m *wgPeer) IPNet() *net.IPNet {
@@ -57,39 +59,77 @@ func parseKey(key string) (wgtypes.Key, error) {
 	return wgtypes.Key(dst), nil
 }
 
-func handleWgMsg(link netlink.Link, wg *wgctrl.Client, pcfg wgPeer) {
+func handleWgMsg(b backend, pcfg wgPeer) {
 	peer := wgtypes.PeerConfig{
 		PublicKey: pcfg.Key,
 		Remove:    pcfg.Remove,
 	}
 
-	ipn := pcfg.IPNet() // Never nil
+	// ipn is nil for peers without an IP, such as stale peers found on the
+	// device without any allowed IPs; they have no route to change.
+	ipn := pcfg.IPNet()
 
 	if pcfg.Remove {
-		log.Printf("pikopunch: removing %s as WireGuard peer", pcfg.IP)
-		rmRoute(link, ipn)
+		slog.Info("pikopunch: removing WireGuard peer", "ip", pcfg.IP)
+		if !pcfg.KeepRoute && ipn != nil {
+			if err := b.RemoveRoute(ipn); err != nil {
+				slog.Error("pikopunch: failed to delete route", "ip", ipn.IP, "error", err)
+			}
+
+			if ip, ok := netip.AddrFromSlice(ipn.IP); ok {
+				forgetPeer(ip.Unmap())
+			}
+		}
 	} else {
+		if ipn == nil {
+			slog.Error("pikopunch: refusing to add WireGuard peer without an IP", "ip", pcfg.IP)
+			return
+		}
+
 		peer.AllowedIPs = []net.IPNet{*ipn}
 
-		log.Printf("pikopunch: adding %s as WireGuard peer", pcfg.IP)
-		addRoute(link, ipn)
+		slog.Info("pikopunch: adding WireGuard peer", "ip", pcfg.IP)
+		if !pcfg.KeepRoute {
+			if err := b.AddRoute(ipn); err != nil {
+				slog.Error("pikopunch: failed to add route", "ip", ipn.IP, "error", err)
+			}
+		}
 	}
 
-	wg.ConfigureDevice(link.Attrs().Name, wgtypes.Config{
+	if err := b.Configure(wgtypes.Config{
 		Peers: []wgtypes.PeerConfig{peer},
-	})
+	}); err != nil {
+		slog.Error("pikopunch: failed to configure peer", "ip", pcfg.IP, "error", err)
+	}
 }
 
-func goWireguard(ctx context.Context, link netlink.Link, wg *wgctrl.Client) {
-	defer netlink.LinkDel(link)
-	defer wg.Close()
+// refreshPeers refreshes the peer cache from the WireGuard device.
+func refreshPeers(b backend) {
+	dev, err := b.Device()
+	if err != nil {
+		slog.Error("pikopunch: failed to refresh peers", "error", err)
+		return
+	}
+
+	cachePeers(dev)
+}
+
+func goWireguard(ctx context.Context, b backend) {
+	defer b.Close()
+
+	t := time.NewTicker(refreshInterval)
+	defer t.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case e := <-C:
-			handleWgMsg(link, wg, e)
+			handleWgMsg(b, e)
+		case <-t.C:
+			refreshPeers(b)
+		case <-refreshC:
+			refreshPeers(b)
 		}
 	}
 }
@@ -102,20 +142,14 @@ func createWireguard(ctx context.Context) error {
 	}
 	ipn.IP = ip
 
-	// Create the interface
-	attrs := netlink.NewLinkAttrs()
-	attrs.Name = config.PunchIface
-	wga := nlWireguard{attrs}
-
-	err = netlink.LinkAdd(&wga)
+	wgkey, err := parseKey(config.PunchPrivateKey)
 	if err != nil {
-		return err
+		return fmt.Errorf("couldn't parse private key: %w", err)
 	}
 
-	l, err := netlink.LinkByName(attrs.Name)
+	b, err := newBackend(ipn)
 	if err != nil {
-		// This shouldn't fail...
-		log.Fatalf("pikopunch: cannot access the interface (%s) we just made: %v", attrs.Name, err)
+		return err
 	}
 
 	// Unfortunately since this spawns a goroutine to handle messages being
@@ -123,73 +157,16 @@ func createWireguard(ctx context.Context) error {
 	// multiple goroutines using it at once, we cannot defer and must
 	// instead cleanup whenever we would exit in a bad way.
 
-	// Configure WireGuard
-	wg, err = wgctrl.New()
-	if err != nil {
-		netlink.LinkDel(l)
-		return err
-	}
-
-	wgkey, err := parseKey(config.PunchPrivateKey)
-	if err != nil {
-		wg.Close()
-		netlink.LinkDel(l)
-		return fmt.Errorf("couldn't parse private key: %w", err)
-	}
-
-	if err := wg.ConfigureDevice(attrs.Name, wgtypes.Config{
+	if err := b.Configure(wgtypes.Config{
 		PrivateKey: &wgkey,
 		ListenPort: &config.PunchPort,
 	}); err != nil {
-		wg.Close()
-		netlink.LinkDel(l)
-		return err
-	}
-
-	// Tell the kernel where we live
-	if err := netlink.AddrAdd(l, &netlink.Addr{IPNet: ipn}); err != nil {
-		wg.Close()
-		netlink.LinkDel(l)
-		return err
-	}
-
-	// Set our IP
-	if err := netlink.LinkSetUp(l); err != nil {
-		wg.Close()
-		netlink.LinkDel(l)
+		b.Close()
 		return err
 	}
 
-	go goWireguard(ctx, l, wg)
+	wgb = b
+	go goWireguard(ctx, b)
 
 	return nil
 }
-
-func addRoute(link netlink.Link, addr *net.IPNet) {
-	r := netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Protocol:  6,
-		Dst:       addr,
-	}
-
-	if err := netlink.RouteAdd(&r); err != nil {
-		log.Printf("failed to add route for %s: %v", addr.IP, err)
-	}
-}
-
-func rmRoute(link netlink.Link, addr *net.IPNet) {
-	routes, err := netlink.RouteGet(addr.IP)
-	if err != nil {
-		return
-	}
-
-	for _, v := range routes {
-		if v.LinkIndex == link.Attrs().Index && v.Dst.IP.Equal(addr.IP) {
-			if err := netlink.RouteDel(&v); err != nil {
-				log.Printf("failed to delete route for %s: %v", v.Dst, err)
-			}
-
-			break
-		}
-	}
-}
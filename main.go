@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,6 +14,9 @@ import (
 	"github.com/mca3/mwr"
 	"github.com/mca3/pikorv/config"
 	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/internal/logging"
+	"github.com/mca3/pikorv/internal/ppdns"
+	"github.com/mca3/pikorv/internal/pprelay"
 	"github.com/mca3/pikorv/internal/ppwg"
 	"github.com/mca3/pikorv/routes"
 	"github.com/mca3/pikorv/routes/gateway"
@@ -30,88 +33,160 @@ func startHttp() {
 	srvh = &mwr.Handler{}
 	srv = &http.Server{
 		Addr:    config.HttpAddr,
-		Handler: srvh,
+		Handler: logging.RequestIDs(instrument(srvh)),
 	}
 
 	srvh.Use(func(c *mwr.Ctx) error {
 		defer func() {
 			if v := recover(); v != nil {
-				log.Println(v)
-				log.Println(string(debug.Stack()))
+				slog.ErrorContext(c.Context(), "panic while handling request",
+					"method", c.Method(),
+					"path", c.Path(),
+					"panic", v,
+					"stack", string(debug.Stack()))
 			}
 		}()
 
 		err := c.Next()
 		if err != nil {
-			log.Printf("%s %s ERROR %v", c.IP(), c.Path(), err)
-		} else {
-			log.Printf("%s %s", c.IP(), c.Path())
+			slog.ErrorContext(c.Context(), "request failed",
+				"method", c.Method(),
+				"path", c.Path(),
+				"error", err)
 		}
 		return err
 	})
 
-	// New routes
-	srvh.Post("/api/new/user", routes.NewUser)
-	srvh.Post("/api/new/device", routes.NewDevice)
-	srvh.Post("/api/new/network", routes.NewNetwork)
+	routes.Register(srvh)
 
-	// User stuff
-	srvh.Get("/api/list/devices", routes.ListDevices)
-	srvh.Get("/api/list/networks", routes.ListNetworks)
-
-	// Delete routes
-	srvh.Post("/api/del/user", routes.DeleteUser)
-	srvh.Post("/api/del/device", routes.DeleteDevice)
-	srvh.Post("/api/del/network", routes.DeleteNetwork)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		fatal("HTTP server failed", "error", err)
+	}
+}
 
-	// Device stuff
-	srvh.Get("/api/device/info", routes.DeviceInfo)
-	srvh.Post("/api/device/join", routes.DeviceJoin)
-	srvh.Post("/api/device/leave", routes.DeviceLeave)
+func stopHttp() {
+	srv.Shutdown(context.Background())
+}
 
-	// Network stuff
-	srvh.Get("/api/network/info", routes.NetworkInfo)
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
 
-	// Auth stuff
-	srvh.Get("/api/auth", routes.Auth)
-	srvh.Post("/api/auth", routes.Auth)
+// setupLogging configures the default logger from the config.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		return err
+	}
 
-	// Misc
-	srvh.Get("/api/gateway", routes.Gateway)
-	srvh.Get("/api/punch", routes.Punch)
+	l, err := logging.New(os.Stderr, config.LogFormat, level)
+	if err != nil {
+		return err
+	}
 
-	log.Fatal(srv.ListenAndServe())
-}
-
-func stopHttp() {
-	srv.Shutdown(context.Background())
+	slog.SetDefault(l)
+	return nil
 }
 
 func main() {
 	flag.Parse()
 
+	config.ConfPath = *cfgPath
+
+	if flag.NArg() > 0 {
+		cmd, ok := commands[flag.Arg(0)]
+		if !ok {
+			fatal("unknown command", "command", flag.Arg(0))
+		}
+
+		if err := cmd(flag.Args()[1:]); err != nil {
+			fatal("command failed", "command", flag.Arg(0), "error", err)
+		}
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	config.ConfPath = *cfgPath
-
 	if err := config.Load(); err != nil {
-		log.Fatalf("failed to load config: %v", err)
+		fatal("failed to load config", "error", err)
 	}
 
-	if err := db.Connect(config.DatabaseUrl); err != nil {
-		log.Fatalf("failed to connect to the database: %v", err)
+	if err := setupLogging(); err != nil {
+		fatal("failed to set up logging", "error", err)
 	}
 
-	defer db.Disconnect()
+	store, err := db.Open(config.DatabaseUrl)
+	if err != nil {
+		fatal("failed to connect to the database", "error", err)
+	}
+
+	defer store.Close()
+
+	if err := bootstrapAdmins(ctx, store); err != nil {
+		fatal("failed to set up administrators", "error", err)
+	}
+
+	routes.SetStore(store)
+	gateway.SetStore(store)
+	ppwg.SetStore(store)
+	ppdns.SetStore(store)
+	pprelay.SetStore(store)
+
+	if config.MetricsListen != "" {
+		registerMetrics(store)
+		go startMetrics()
+	}
 
 	go func() {
 		if err := ppwg.Listen(ctx); err != nil {
-			log.Fatalf("pikopunch failed to listen: %v", err)
+			fatal("pikopunch failed to listen", "error", err)
 			cancel()
 		}
 	}()
 
+	if config.PunchProbe != nil {
+		go func() {
+			if err := ppwg.ListenProbe(ctx); err != nil {
+				fatal("pikopunch probe failed to listen", "error", err)
+			}
+		}()
+	}
+
+	if config.PunchPublic != nil {
+		go func() {
+			if err := ppwg.ListenPublic(ctx); err != nil {
+				fatal("public pikopunch failed to listen", "error", err)
+			}
+		}()
+	}
+
+	if config.DNSListen != "" {
+		go func() {
+			// The DNS server may be listening on the punch
+			// interface, so wait for it to come up.
+			select {
+			case <-ctx.Done():
+				return
+			case <-ppwg.Ready():
+			}
+
+			if err := ppdns.Listen(ctx); err != nil {
+				fatal("DNS server failed to listen", "error", err)
+			}
+		}()
+	}
+
+	if pprelay.Enabled() {
+		go func() {
+			if err := pprelay.Listen(ctx); err != nil {
+				fatal("relay failed to listen", "error", err)
+			}
+		}()
+	}
+
 	// The gateway has a couple of workers that send out WebSocket
 	// messages, to prevent spawning many goroutines.
 	gateway.InitWorkers(runtime.GOMAXPROCS(0), 1<<12) // 4096
@@ -119,7 +194,7 @@ func main() {
 	go startHttp()
 	defer stopHttp()
 
-	log.Println("Running.")
+	slog.Info("running", "http", config.HttpAddr)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -129,11 +204,13 @@ func main() {
 	case <-c:
 	}
 
-	log.Println("Exiting.")
+	slog.Info("exiting")
 
 	cancel()
 
-	// Let all gateway workers finish up what they need to do.
+	// Let all gateway workers finish up what they need to do, once the
+	// notifications still being worked out have been queued.
+	gateway.WaitNotifications()
 	gateway.JoinWorkers()
 
 	// TODO: This is really terrible!
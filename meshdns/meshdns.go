@@ -0,0 +1,329 @@
+// This package implements a small authoritative DNS server which answers AAAA
+// queries for Pikonet devices within a single zone.
+package meshdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TTL is the time to live of all records served.
+const TTL = 60
+
+const (
+	// maxUDPSize is the largest UDP message we will read or send.
+	maxUDPSize = 512
+
+	// tcpTimeout is how long a TCP connection may stay idle.
+	tcpTimeout = time.Second * 10
+
+	// lookupTimeout is how long the lookup for a single query may take
+	// before the client is told that it failed.
+	lookupTimeout = time.Second * 2
+)
+
+// ErrNotFound is returned by a LookupFunc when a name does not exist, or
+// when the client is not allowed to see it.
+var ErrNotFound = errors.New("name not found")
+
+// LookupFunc resolves the labels of a name relative to the zone, for example
+// []string{"laptop", "home"} for laptop.home.pikonet., into an address.
+//
+// src is the address of the client which sent the query, and may be used to
+// determine what the client is allowed to resolve.
+type LookupFunc func(ctx context.Context, src netip.Addr, labels []string) (netip.Addr, error)
+
+// Server implements an authoritative DNS server for a single zone.
+type Server struct {
+	// Zone is the zone the server is authoritative for, such as
+	// "pikonet.".
+	Zone string
+
+	// Lookup resolves names within the zone and must not be nil.
+	Lookup LookupFunc
+}
+
+// Label converts a device or network name into a DNS label.
+//
+// Letters are lowercased and anything that isn't a letter, number, or hyphen
+// is replaced by a hyphen.
+func Label(name string) string {
+	b := []byte(strings.ToLower(name))
+	for i, c := range b {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			b[i] = '-'
+		}
+	}
+
+	if len(b) > 63 {
+		b = b[:63]
+	}
+	return string(b)
+}
+
+// Labels converts names into DNS labels like Label, but makes sure that no two
+// are the same, as "my.box" and "my-box" would otherwise both be "my-box".
+//
+// The first name to use a label keeps it, and any others have "-2", "-3", and
+// so on appended, skipping labels already used by another name. names should
+// therefore be in a stable order, such as by ID, so labels don't move around.
+func Labels(names ...string) []string {
+	labels := make([]string, len(names))
+	taken := make(map[string]bool, len(names))
+	for i, v := range names {
+		labels[i] = Label(v)
+		taken[labels[i]] = true
+	}
+
+	seen := make(map[string]bool, len(names))
+	for i, l := range labels {
+		if !seen[l] {
+			seen[l] = true
+			continue
+		}
+
+		for n := 2; ; n++ {
+			suffix := "-" + strconv.Itoa(n)
+			if len(l)+len(suffix) > 63 {
+				l = l[:63-len(suffix)]
+			}
+
+			if c := l + suffix; !taken[c] {
+				labels[i] = c
+				taken[c] = true
+				seen[c] = true
+				break
+			}
+		}
+	}
+	return labels
+}
+
+// Name creates a fully qualified name from names in zone, such as a device
+// name and a network name.
+func Name(zone string, names ...string) string {
+	labels := make([]string, 0, len(names)+1)
+	for _, v := range names {
+		labels = append(labels, Label(v))
+	}
+	labels = append(labels, canonicalZone(zone))
+	return strings.Join(labels, ".")
+}
+
+// canonicalZone lowercases zone and strips the leading and trailing dots.
+func canonicalZone(zone string) string {
+	return strings.Trim(strings.ToLower(zone), ".")
+}
+
+// ServeUDP answers queries sent to c until c is closed.
+//
+// Lookups are canceled once ctx is, and otherwise time out after a short
+// while.
+func (s *Server) ServeUDP(ctx context.Context, c net.PacketConn) error {
+	buf := make([]byte, maxUDPSize)
+
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		src := addrOf(addr)
+
+		resp, ok := s.answerTimeout(ctx, src, buf[:n])
+		if !ok {
+			continue
+		}
+
+		if len(resp) > maxUDPSize {
+			// Our answers are tiny; this shouldn't happen.
+			slog.Warn("meshdns: dropping oversized response", "addr", addr)
+			continue
+		}
+
+		c.WriteTo(resp, addr)
+	}
+}
+
+// ServeTCP answers queries sent over connections accepted from l until l is
+// closed.
+//
+// Lookups are canceled and connections are closed once ctx is canceled.
+func (s *Server) ServeTCP(ctx context.Context, l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serveConn(ctx, c)
+	}
+}
+
+// serveConn answers queries on a single TCP connection until it is idle for
+// too long, the client hangs up, or ctx is canceled.
+func (s *Server) serveConn(ctx context.Context, c net.Conn) {
+	defer c.Close()
+
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	src := addrOf(c.RemoteAddr())
+	lenbuf := make([]byte, 2)
+
+	for {
+		c.SetDeadline(time.Now().Add(tcpTimeout))
+
+		if _, err := io.ReadFull(c, lenbuf); err != nil {
+			return
+		}
+
+		req := make([]byte, binary.BigEndian.Uint16(lenbuf))
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+
+		resp, ok := s.answerTimeout(ctx, src, req)
+		if !ok {
+			return
+		}
+
+		out := make([]byte, 2, len(resp)+2)
+		binary.BigEndian.PutUint16(out, uint16(len(resp)))
+		if _, err := c.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// answerTimeout answers req like answer, giving up on the lookup after
+// lookupTimeout.
+func (s *Server) answerTimeout(ctx context.Context, src netip.Addr, req []byte) ([]byte, bool) {
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+
+	return s.answer(ctx, src, req)
+}
+
+// answer builds a response to req.
+//
+// If req is not worth responding to at all, ok is false.
+func (s *Server) answer(ctx context.Context, src netip.Addr, req []byte) (resp []byte, ok bool) {
+	var p dnsmessage.Parser
+
+	h, err := p.Start(req)
+	if err != nil || h.Response {
+		return nil, false
+	}
+
+	rh := dnsmessage.Header{
+		ID:               h.ID,
+		Response:         true,
+		OpCode:           h.OpCode,
+		RecursionDesired: h.RecursionDesired,
+	}
+
+	q, err := p.Question()
+	if err != nil {
+		rh.RCode = dnsmessage.RCodeFormatError
+		return build(rh, nil, nil)
+	}
+
+	if h.OpCode != 0 {
+		rh.RCode = dnsmessage.RCodeNotImplemented
+		return build(rh, &q, nil)
+	}
+
+	zone := canonicalZone(s.Zone)
+	name := strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")
+
+	if q.Class != dnsmessage.ClassINET || (name != zone && !strings.HasSuffix(name, "."+zone)) {
+		// Not ours
+		rh.RCode = dnsmessage.RCodeRefused
+		return build(rh, &q, nil)
+	}
+
+	rh.Authoritative = true
+
+	if name == zone {
+		// Nothing lives at the apex.
+		return build(rh, &q, nil)
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, "."+zone), ".")
+
+	addr, err := s.Lookup(ctx, src, labels)
+	if errors.Is(err, ErrNotFound) {
+		rh.RCode = dnsmessage.RCodeNameError
+		return build(rh, &q, nil)
+	} else if err != nil {
+		slog.ErrorContext(ctx, "meshdns: lookup failed", "name", name, "src", src, "error", err)
+		rh.RCode = dnsmessage.RCodeServerFailure
+		return build(rh, &q, nil)
+	}
+
+	if q.Type != dnsmessage.TypeAAAA || !addr.Is6() {
+		// The name exists, but there's no record of this type.
+		return build(rh, &q, nil)
+	}
+
+	return build(rh, &q, &dnsmessage.AAAAResource{AAAA: addr.As16()})
+}
+
+// build encodes a DNS message.
+func build(h dnsmessage.Header, q *dnsmessage.Question, aaaa *dnsmessage.AAAAResource) ([]byte, bool) {
+	b := dnsmessage.NewBuilder(make([]byte, 0, maxUDPSize), h)
+	b.EnableCompression()
+
+	if q != nil {
+		if err := b.StartQuestions(); err != nil {
+			return nil, false
+		}
+		if err := b.Question(*q); err != nil {
+			return nil, false
+		}
+	}
+
+	if aaaa != nil {
+		if err := b.StartAnswers(); err != nil {
+			return nil, false
+		}
+
+		rh := dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   TTL,
+		}
+		if err := b.AAAAResource(rh, *aaaa); err != nil {
+			return nil, false
+		}
+	}
+
+	msg, err := b.Finish()
+	return msg, err == nil
+}
+
+// addrOf returns the IP address of a UDP or TCP address.
+func addrOf(addr net.Addr) netip.Addr {
+	var ip net.IP
+
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+
+	ret, _ := netip.AddrFromSlice(ip)
+	return ret.Unmap()
+}
@@ -0,0 +1,241 @@
+package meshdns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testAddr = netip.MustParseAddr("fd00::1234")
+
+func testLookup(_ context.Context, src netip.Addr, labels []string) (netip.Addr, error) {
+	if !src.IsLoopback() {
+		return netip.Addr{}, ErrNotFound
+	}
+
+	if len(labels) == 2 && labels[0] == "laptop" && labels[1] == "home" {
+		return testAddr, nil
+	}
+	return netip.Addr{}, ErrNotFound
+}
+
+func makeQuery(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  typ,
+		Class: dnsmessage.ClassINET,
+	})
+
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("failed to build query: %v", err)
+	}
+	return msg
+}
+
+func parseResponse(t *testing.T, buf []byte) dnsmessage.Message {
+	msg := dnsmessage.Message{}
+	if err := msg.Unpack(buf); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+
+	if msg.ID != 1234 || !msg.Response {
+		t.Fatalf("bad response header: %+v", msg.Header)
+	}
+	return msg
+}
+
+func startUDP(t *testing.T) *net.UDPConn {
+	srvc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("server connection listen failed: %v", err)
+	}
+	t.Cleanup(func() { srvc.Close() })
+
+	srv := Server{Zone: "Pikonet.", Lookup: testLookup}
+
+	// exits when srvc closes
+	go srv.ServeUDP(context.Background(), srvc)
+
+	cli, err := net.DialUDP("udp4", nil, srvc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("client connection open failed: %v", err)
+	}
+	t.Cleanup(func() { cli.Close() })
+
+	cli.SetDeadline(time.Now().Add(time.Second))
+	return cli
+}
+
+func exchangeUDP(t *testing.T, cli *net.UDPConn, name string, typ dnsmessage.Type) dnsmessage.Message {
+	if _, err := cli.Write(makeQuery(t, name, typ)); err != nil {
+		t.Fatalf("failed to send query: %v", err)
+	}
+
+	buf := make([]byte, maxUDPSize)
+	n, err := cli.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+
+	return parseResponse(t, buf[:n])
+}
+
+func TestLabel(t *testing.T) {
+	if l := Label("My Laptop_2"); l != "my-laptop-2" {
+		t.Fatalf("expected my-laptop-2, got %s", l)
+	}
+
+	if n := Name("pikonet.", "Laptop", "Home Lab"); n != "laptop.home-lab.pikonet" {
+		t.Fatalf("expected laptop.home-lab.pikonet, got %s", n)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	long := strings.Repeat("a", 70)
+
+	got := Labels("my.box", "my-box", "My Box", "my-box-2", long, long)
+	want := []string{"my-box", "my-box-3", "my-box-4", "my-box-2", long[:63], long[:61] + "-2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestAAAA(t *testing.T) {
+	cli := startUDP(t)
+
+	msg := exchangeUDP(t, cli, "LAPTOP.home.pikonet.", dnsmessage.TypeAAAA)
+	if msg.RCode != dnsmessage.RCodeSuccess || !msg.Authoritative {
+		t.Fatalf("bad response header: %+v", msg.Header)
+	}
+
+	if len(msg.Answers) != 1 {
+		t.Fatalf("got %d answers, expected 1", len(msg.Answers))
+	}
+
+	aaaa, ok := msg.Answers[0].Body.(*dnsmessage.AAAAResource)
+	if !ok {
+		t.Fatalf("expected AAAA record, got %v", msg.Answers[0].Body)
+	}
+
+	if netip.AddrFrom16(aaaa.AAAA) != testAddr {
+		t.Fatalf("expected %v, got %v", testAddr, netip.AddrFrom16(aaaa.AAAA))
+	}
+}
+
+func TestNoData(t *testing.T) {
+	cli := startUDP(t)
+
+	msg := exchangeUDP(t, cli, "laptop.home.pikonet.", dnsmessage.TypeA)
+	if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 0 {
+		t.Fatalf("expected empty response, got %+v", msg)
+	}
+}
+
+func TestNXDomain(t *testing.T) {
+	cli := startUDP(t)
+
+	msg := exchangeUDP(t, cli, "phone.home.pikonet.", dnsmessage.TypeAAAA)
+	if msg.RCode != dnsmessage.RCodeNameError {
+		t.Fatalf("expected NXDOMAIN, got %v", msg.RCode)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	cli := startUDP(t)
+
+	msg := exchangeUDP(t, cli, "example.com.", dnsmessage.TypeAAAA)
+	if msg.RCode != dnsmessage.RCodeRefused {
+		t.Fatalf("expected REFUSED, got %v", msg.RCode)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("server listen failed: %v", err)
+	}
+	defer l.Close()
+
+	srv := Server{Zone: "pikonet.", Lookup: testLookup}
+
+	// exits when l closes
+	go srv.ServeTCP(context.Background(), l)
+
+	cli, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatalf("client connection open failed: %v", err)
+	}
+	defer cli.Close()
+
+	cli.SetDeadline(time.Now().Add(time.Second))
+
+	// Two queries over the same connection
+	for i := 0; i < 2; i++ {
+		q := makeQuery(t, "laptop.home.pikonet.", dnsmessage.TypeAAAA)
+		out := binary.BigEndian.AppendUint16(nil, uint16(len(q)))
+		if _, err := cli.Write(append(out, q...)); err != nil {
+			t.Fatalf("failed to send query: %v", err)
+		}
+
+		lenbuf := make([]byte, 2)
+		if _, err := io.ReadFull(cli, lenbuf); err != nil {
+			t.Fatalf("failed to read response length: %v", err)
+		}
+
+		buf := make([]byte, binary.BigEndian.Uint16(lenbuf))
+		if _, err := io.ReadFull(cli, buf); err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+
+		msg := parseResponse(t, buf)
+		if len(msg.Answers) != 1 {
+			t.Fatalf("got %d answers, expected 1", len(msg.Answers))
+		}
+	}
+}
+
+func TestLookupCanceled(t *testing.T) {
+	srvc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("server connection listen failed: %v", err)
+	}
+	defer srvc.Close()
+
+	// The lookup stops the server, and then hangs until its own context is
+	// canceled along with it.
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := Server{
+		Zone: "pikonet.",
+		Lookup: func(ctx context.Context, _ netip.Addr, _ []string) (netip.Addr, error) {
+			cancel()
+			<-ctx.Done()
+			return netip.Addr{}, ctx.Err()
+		},
+	}
+
+	go srv.ServeUDP(ctx, srvc)
+
+	cli, err := net.DialUDP("udp4", nil, srvc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("client connection open failed: %v", err)
+	}
+	defer cli.Close()
+
+	cli.SetDeadline(time.Now().Add(time.Second))
+
+	msg := exchangeUDP(t, cli, "laptop.home.pikonet.", dnsmessage.TypeAAAA)
+	if msg.RCode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got %v", msg.RCode)
+	}
+}
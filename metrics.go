@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mca3/pikorv/config"
+	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/internal/pprelay"
+	"github.com/mca3/pikorv/internal/ppwg"
+	"github.com/mca3/pikorv/metrics"
+	"github.com/mca3/pikorv/punch"
+	"github.com/mca3/pikorv/relay"
+	"github.com/mca3/pikorv/routes"
+	"github.com/mca3/pikorv/routes/gateway"
+)
+
+var (
+	httpRequests = metrics.Default.Counter("pikorv_http_requests_total",
+		"HTTP requests handled, by route and status.",
+		"method", "route", "status")
+
+	// Gateway connections are left out, as they take as long as they
+	// stay open; pikorv_gateway_connections tracks them instead.
+	httpDuration = metrics.Default.Histogram("pikorv_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route and status.",
+		nil, "method", "route", "status")
+)
+
+// registerMetrics registers the metrics which are read from elsewhere when
+// they are served.
+func registerMetrics(store db.Store) {
+	r := metrics.Default
+
+	r.GaugeFunc("pikorv_gateway_connections",
+		"Open gateway connections, by transport.",
+		func() []metrics.Sample {
+			var s []metrics.Sample
+			for k, v := range gateway.CurrentStats().Connections {
+				s = append(s, metrics.Sample{Labels: []string{k}, Value: float64(v)})
+			}
+			return s
+		}, "transport")
+	r.GaugeFunc("pikorv_gateway_queue_depth",
+		"Gateway messages waiting to be sent.",
+		func() []metrics.Sample {
+			return metrics.Value(float64(gateway.CurrentStats().Queued))
+		})
+	r.GaugeFunc("pikorv_gateway_queue_size",
+		"Most gateway messages which may wait to be sent.",
+		func() []metrics.Sample {
+			return metrics.Value(float64(gateway.CurrentStats().QueueSize))
+		})
+	r.CounterFunc("pikorv_gateway_messages_sent_total",
+		"Gateway messages sent.",
+		func() []metrics.Sample {
+			return metrics.Value(float64(gateway.CurrentStats().Sent))
+		})
+	r.CounterFunc("pikorv_gateway_messages_dropped_total",
+		"Gateway messages which couldn't be sent.",
+		func() []metrics.Sample {
+			return metrics.Value(float64(gateway.CurrentStats().Dropped))
+		})
+
+	r.CounterFunc("pikorv_punch_packets_total",
+		"Packets received by pikopunch servers, by server.",
+		punchSamples(func(s punch.Stats) uint64 { return s.Packets }), "server")
+	r.CounterFunc("pikorv_punch_limited_total",
+		"Packets dropped by pikopunch servers because of rate limiting, by server.",
+		punchSamples(func(s punch.Stats) uint64 { return s.Limited }), "server")
+	r.CounterFunc("pikorv_punch_lookup_failures_total",
+		"Packets dropped by pikopunch servers because their address couldn't be looked up, by server.",
+		punchSamples(func(s punch.Stats) uint64 { return s.LookupFailures }), "server")
+
+	r.CounterFunc("pikorv_relay_bytes_total",
+		"Payload bytes sent to the relay, and forwarded by it, by direction.",
+		relaySamples(func(s relay.Stats) (uint64, uint64) { return s.TxBytes, s.RxBytes }), "direction")
+	r.CounterFunc("pikorv_relay_packets_total",
+		"Packets sent to the relay, and forwarded by it, by direction.",
+		relaySamples(func(s relay.Stats) (uint64, uint64) { return s.TxPackets, s.RxPackets }), "direction")
+	r.CounterFunc("pikorv_relay_dropped_total",
+		"Packets sent to the relay which weren't forwarded.",
+		func() []metrics.Sample {
+			return metrics.Value(float64(pprelay.Total().Dropped))
+		})
+
+	r.GaugeFunc("pikorv_wireguard_peers",
+		"WireGuard peers of the punch interface.",
+		func() []metrics.Sample {
+			total, _ := ppwg.Peers()
+			return metrics.Value(float64(total))
+		})
+	r.GaugeFunc("pikorv_wireguard_active_peers",
+		"WireGuard peers of the punch interface with a recent handshake.",
+		func() []metrics.Sample {
+			_, active := ppwg.Peers()
+			return metrics.Value(float64(active))
+		})
+
+	p, ok := store.(db.Pooler)
+	if !ok {
+		return
+	}
+
+	r.GaugeFunc("pikorv_db_connections",
+		"Open database connections, by state.",
+		func() []metrics.Sample {
+			st := p.PoolStats()
+			return []metrics.Sample{
+				{Labels: []string{"idle"}, Value: float64(st.Idle)},
+				{Labels: []string{"in_use"}, Value: float64(st.InUse)},
+			}
+		}, "state")
+	r.GaugeFunc("pikorv_db_max_connections",
+		"Most database connections which may be open.",
+		func() []metrics.Sample {
+			return metrics.Value(float64(p.PoolStats().Max))
+		})
+	r.CounterFunc("pikorv_db_waits_total",
+		"Times a database connection had to be waited for.",
+		func() []metrics.Sample {
+			return metrics.Value(float64(p.PoolStats().Waits))
+		})
+	r.CounterFunc("pikorv_db_wait_seconds_total",
+		"Time spent waiting for database connections.",
+		func() []metrics.Sample {
+			return metrics.Value(p.PoolStats().WaitTime.Seconds())
+		})
+}
+
+// punchSamples reads a statistic of every pikopunch server.
+func punchSamples(stat func(punch.Stats) uint64) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		var s []metrics.Sample
+		for k, v := range ppwg.PunchStats() {
+			s = append(s, metrics.Sample{Labels: []string{k}, Value: float64(stat(v))})
+		}
+		return s
+	}
+}
+
+// relaySamples reads a statistic of the relay for packets sent to it ("rx")
+// and forwarded by it ("tx"), as returned by stat.
+func relaySamples(stat func(relay.Stats) (in, out uint64)) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		in, out := stat(pprelay.Total())
+		return []metrics.Sample{
+			{Labels: []string{"rx"}, Value: float64(in)},
+			{Labels: []string{"tx"}, Value: float64(out)},
+		}
+	}
+}
+
+// startMetrics serves metrics on config.MetricsListen.
+func startMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+
+	if err := http.ListenAndServe(config.MetricsListen, mux); err != nil {
+		fatal("metrics server failed", "error", err)
+	}
+}
+
+// instrument counts and logs the requests handled by h.
+func instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		h.ServeHTTP(sw, r)
+
+		route := routes.Pattern(r.Method, r.URL.Path)
+		if route == "" {
+			// Don't let unknown paths each get a series.
+			route = "unknown"
+		}
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		took := time.Since(start)
+
+		lv := []string{r.Method, route, strconv.Itoa(status)}
+		httpRequests.Inc(lv...)
+		if !sw.streamed() {
+			httpDuration.Observe(took.Seconds(), lv...)
+		}
+
+		// The query is left out, as it is only ever needed to debug
+		// a handler.
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.EscapedPath(),
+			"status", status,
+			"duration", took,
+			"ip", remoteIP(r))
+	})
+}
+
+// remoteIP returns the IP address of the client which sent r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusWriter remembers the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// streamed determines if the response was a websocket or a stream of
+// server-sent events, rather than an ordinary response.
+func (w *statusWriter) streamed() bool {
+	return w.status == http.StatusSwitchingProtocols ||
+		strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the real ResponseWriter.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack is needed for websockets, which check for http.Hijacker themselves.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+
+	w.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
@@ -0,0 +1,355 @@
+// Package metrics implements counters, gauges, and histograms which are
+// exposed in the Prometheus text format.
+//
+// Every metric belongs to a Registry, and is identified by its name and the
+// values of its labels:
+//
+//	requests := r.Counter("http_requests_total", "HTTP requests.", "method", "status")
+//	requests.Inc("GET", "200")
+//
+// Metrics which are already counted elsewhere are read when the Registry is
+// written with CounterFunc and GaugeFunc.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds of histogram buckets suited to request
+// latencies, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry most metrics are registered with.
+var Default = &Registry{}
+
+// Registry holds metrics, and writes them in the order they were registered.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+// Sample is a value of a metric read by a CounterFunc or GaugeFunc, along
+// with the values of its labels.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// family is every series of a metric.
+type family struct {
+	name, help, typ string
+	labels          []string
+
+	// buckets are the upper bounds of the buckets of a histogram, not
+	// including +Inf.
+	buckets []float64
+
+	// collect reads the samples of metrics registered with CounterFunc or
+	// GaugeFunc.
+	collect func() []Sample
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is the value of a metric for a single set of label values.
+type series struct {
+	labels []string
+	value  float64
+
+	// counts holds the amount of observations which fell in each bucket of
+	// a histogram, where the last is +Inf; value is their sum.
+	counts []uint64
+}
+
+// register adds a family to r.
+// It panics if the name is taken, as that's always a mistake.
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range r.families {
+		if v.name == f.name {
+			panic("metrics: " + f.name + " registered twice")
+		}
+	}
+
+	f.series = map[string]*series{}
+	r.families = append(r.families, f)
+	return f
+}
+
+// get returns the series of f with the label values lv, creating it if
+// needed.
+// f.mu must be held.
+func (f *family) get(lv []string) *series {
+	if len(lv) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d", f.name, len(f.labels), len(lv)))
+	}
+
+	key := strings.Join(lv, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), lv...)}
+		if f.typ == "histogram" {
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter is a value which only goes up.
+type Counter struct {
+	f *family
+}
+
+// Counter registers a counter with the given labels.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(&family{name: name, help: help, typ: "counter", labels: labels})}
+}
+
+// Inc adds one to the counter with the label values lv.
+func (c *Counter) Inc(lv ...string) {
+	c.Add(1, lv...)
+}
+
+// Add adds v, which must not be negative, to the counter with the label
+// values lv.
+func (c *Counter) Add(v float64, lv ...string) {
+	if v < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+
+	c.f.mu.Lock()
+	c.f.get(lv).value += v
+	c.f.mu.Unlock()
+}
+
+// Gauge is a value which may go up and down.
+type Gauge struct {
+	f *family
+}
+
+// Gauge registers a gauge with the given labels.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(&family{name: name, help: help, typ: "gauge", labels: labels})}
+}
+
+// Set sets the gauge with the label values lv to v.
+func (g *Gauge) Set(v float64, lv ...string) {
+	g.f.mu.Lock()
+	g.f.get(lv).value = v
+	g.f.mu.Unlock()
+}
+
+// Add adds v, which may be negative, to the gauge with the label values lv.
+func (g *Gauge) Add(v float64, lv ...string) {
+	g.f.mu.Lock()
+	g.f.get(lv).value += v
+	g.f.mu.Unlock()
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	f *family
+}
+
+// Histogram registers a histogram with the given labels.
+// buckets are the upper bounds of each bucket in increasing order, and may be
+// nil to use DefaultBuckets.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: buckets of " + name + " are not sorted")
+	}
+
+	return &Histogram{r.register(&family{name: name, help: help, typ: "histogram", labels: labels, buckets: buckets})}
+}
+
+// Observe adds v to the histogram with the label values lv.
+func (h *Histogram) Observe(v float64, lv ...string) {
+	i := sort.SearchFloat64s(h.f.buckets, v)
+
+	h.f.mu.Lock()
+	s := h.f.get(lv)
+	s.counts[i]++
+	s.value += v
+	h.f.mu.Unlock()
+}
+
+// CounterFunc registers a counter whose samples are read by fn each time r is
+// written.
+func (r *Registry) CounterFunc(name, help string, fn func() []Sample, labels ...string) {
+	r.register(&family{name: name, help: help, typ: "counter", labels: labels, collect: fn})
+}
+
+// GaugeFunc registers a gauge whose samples are read by fn each time r is
+// written.
+func (r *Registry) GaugeFunc(name, help string, fn func() []Sample, labels ...string) {
+	r.register(&family{name: name, help: help, typ: "gauge", labels: labels, collect: fn})
+}
+
+// Value returns a single sample without labels, for use with CounterFunc and
+// GaugeFunc.
+func Value(v float64) []Sample {
+	return []Sample{{Value: v}}
+}
+
+// WriteTo writes every metric in r to w in the text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	for _, f := range families {
+		f.write(bw)
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP sends every metric in r.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+// write writes the series of f, sorted by their label values.
+func (f *family) write(w *bufio.Writer) {
+	var all []*series
+
+	if f.collect != nil {
+		for _, s := range f.collect() {
+			if len(s.Labels) != len(f.labels) {
+				panic(fmt.Sprintf("metrics: %s has %d labels, got %d", f.name, len(f.labels), len(s.Labels)))
+			}
+			all = append(all, &series{labels: s.Labels, value: s.Value})
+		}
+	} else {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		for _, s := range f.series {
+			all = append(all, s)
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i].labels, all[j].labels
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+
+	for _, s := range all {
+		if f.typ != "histogram" {
+			f.sample(w, "", s.labels, "", "", s.value)
+			continue
+		}
+
+		var n uint64
+		for i, c := range s.counts {
+			n += c
+
+			le := math.Inf(1)
+			if i < len(f.buckets) {
+				le = f.buckets[i]
+			}
+			f.sample(w, "_bucket", s.labels, "le", formatFloat(le), float64(n))
+		}
+		f.sample(w, "_sum", s.labels, "", "", s.value)
+		f.sample(w, "_count", s.labels, "", "", float64(n))
+	}
+}
+
+// sample writes a single line, with an extra label if name isn't empty.
+func (f *family) sample(w *bufio.Writer, suffix string, lv []string, name, value string, v float64) {
+	w.WriteString(f.name)
+	w.WriteString(suffix)
+
+	if len(lv) > 0 || name != "" {
+		w.WriteByte('{')
+		for i, l := range f.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, l, lv[i])
+		}
+		if name != "" {
+			if len(lv) > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, name, value)
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func writeLabel(w *bufio.Writer, name, value string) {
+	w.WriteString(name)
+	w.WriteString(`="`)
+	w.WriteString(labelEscaper.Replace(value))
+	w.WriteByte('"')
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// formatFloat formats v the way Prometheus expects.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := &Registry{}
+
+	c := r.Counter("requests_total", "Requests handled.", "method", "status")
+	c.Inc("POST", "201")
+	c.Inc("GET", "200")
+	c.Add(2, "GET", "200")
+
+	g := r.Gauge("temperature", "A \\ multiline\nhelp.")
+	g.Set(20)
+	g.Add(-0.5)
+
+	h := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/a")
+	h.Observe(0.1, "/a")
+	h.Observe(5, "/a")
+
+	r.GaugeFunc("queue", "Queued things.", func() []Sample {
+		return []Sample{
+			{Labels: []string{"b"}, Value: 2},
+			{Labels: []string{"a\"\n"}, Value: 1},
+		}
+	}, "name")
+	r.CounterFunc("dropped_total", "Dropped things.", func() []Sample {
+		return Value(3)
+	})
+
+	want := `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{method="GET",status="200"} 3
+requests_total{method="POST",status="201"} 1
+# HELP temperature A \\ multiline\nhelp.
+# TYPE temperature gauge
+temperature 19.5
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 2
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 5.15
+latency_seconds_count{route="/a"} 3
+# HELP queue Queued things.
+# TYPE queue gauge
+queue{name="a\"\n"} 1
+queue{name="b"} 2
+# HELP dropped_total Dropped things.
+# TYPE dropped_total counter
+dropped_total 3
+`
+
+	var sb strings.Builder
+	n, err := r.WriteTo(&sb)
+	if err != nil {
+		t.Fatal(err)
+	} else if sb.String() != want {
+		t.Fatalf("expected:\n%s\ngot:\n%s", want, sb.String())
+	} else if n != int64(sb.Len()) {
+		t.Fatalf("wrote %d bytes, but said %d", sb.Len(), n)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Fatalf("expected content type %q, got %q", ContentType, ct)
+	} else if rec.Body.String() != want {
+		t.Fatalf("served a different body:\n%s", rec.Body.String())
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := &Registry{}
+	r.Counter("a", "")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	r.Gauge("a", "")
+}
+
+func TestWrongLabels(t *testing.T) {
+	r := &Registry{}
+	c := r.Counter("a", "", "x")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	c.Inc()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mca3/pikorv/config"
+	"github.com/mca3/pikorv/db"
+)
+
+const migrateUsage = `usage: pikorv migrate status
+       pikorv migrate up [version]
+       pikorv migrate down [version]
+
+up applies every migration up to version, or all of them.
+down reverts every migration after version, or only the latest one.`
+
+// cmdMigrate inspects and changes the database schema.
+func cmdMigrate(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New(migrateUsage)
+	}
+
+	to := -1
+	if len(args) == 2 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		to = v
+	}
+
+	if err := config.Load(); err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	store, err := db.Dial(config.DatabaseUrl)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the database: %v", err)
+	}
+	defer store.Close()
+
+	m, ok := store.(db.Migrator)
+	if !ok {
+		return errors.New("this database has no migrations")
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "status":
+		if to != -1 {
+			return errors.New(migrateUsage)
+		}
+	case "up":
+		if to == -1 {
+			to = 0
+		}
+		if err := m.MigrateUp(ctx, to); err != nil {
+			return err
+		}
+	case "down":
+		if to == -1 {
+			if to, err = previousVersion(ctx, m); err != nil {
+				return err
+			}
+		}
+		if err := m.MigrateDown(ctx, to); err != nil {
+			return err
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	return printMigrations(ctx, m)
+}
+
+// previousVersion returns the version before the latest applied migration.
+func previousVersion(ctx context.Context, m db.Migrator) (int, error) {
+	st, err := m.Migrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	prev, latest := 0, 0
+	for _, v := range st {
+		if v.Applied {
+			prev, latest = latest, v.Version
+		}
+	}
+
+	if latest == 0 {
+		return 0, errors.New("no migrations have been applied")
+	}
+	return prev, nil
+}
+
+// printMigrations prints the status of every migration.
+func printMigrations(ctx context.Context, m db.Migrator) error {
+	st, err := m.Migrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED")
+
+	for _, v := range st {
+		status, applied := "pending", ""
+		if v.Applied {
+			status = "applied"
+			applied = v.AppliedAt.Format(time.RFC3339)
+		}
+		if v.Modified {
+			status = "modified"
+		} else if v.Unknown {
+			status = "unknown"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", v.Version, v.Name, status, applied)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,110 @@
+package punch
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// NAT describes the behavior of a NAT, as seen by the pikopunch server.
+type NAT string
+
+const (
+	// NATUnknown means there wasn't enough information to tell.
+	NATUnknown NAT = ""
+
+	// NATNone means the client is not behind a NAT at all.
+	NATNone NAT = "none"
+
+	// NATEasy means the NAT uses the same mapping no matter the
+	// destination, so peers may hole punch directly.
+	NATEasy NAT = "easy"
+
+	// NATSymmetric means the NAT uses a different mapping for each
+	// destination, so hole punching is unlikely to work.
+	NATSymmetric NAT = "symmetric"
+)
+
+var errNoReply = errors.New("no reply to probe")
+
+// Valid determines if n is one of the known NAT types.
+func (n NAT) Valid() bool {
+	switch n {
+	case NATUnknown, NATNone, NATEasy, NATSymmetric:
+		return true
+	}
+	return false
+}
+
+// Classify determines the type of NAT from the local address of a socket and
+// the addresses seen by at least two pikopunch sockets for that socket.
+func Classify(local string, seen []string) NAT {
+	if len(seen) < 2 {
+		return NATUnknown
+	}
+
+	for _, v := range seen[1:] {
+		if v != seen[0] {
+			return NATSymmetric
+		}
+	}
+
+	if seen[0] == local {
+		return NATNone
+	}
+	return NATEasy
+}
+
+// Probe sends an extended probe to each server in turn using c, and returns
+// the addresses seen by all of them.
+//
+// The servers must be sockets of the same pikopunch server.
+func Probe(ctx context.Context, c *net.UDPConn, servers ...*net.UDPAddr) ([]string, error) {
+	pkt := make([]byte, ProbeSize)
+	pkt[0] = ProbeType
+	if _, err := rand.Read(pkt[1:]); err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second * 5)
+	}
+	c.SetReadDeadline(deadline)
+	defer c.SetReadDeadline(time.Time{})
+
+	var seen []string
+	buf := make([]byte, 256)
+
+	for _, srv := range servers {
+		if _, err := c.WriteToUDP(pkt, srv); err != nil {
+			return nil, err
+		}
+
+		for {
+			n, from, err := c.ReadFromUDP(buf)
+			if err != nil {
+				return nil, err
+			}
+
+			if sameAddr(from, srv) {
+				seen = strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00")
+				break
+			}
+		}
+	}
+
+	if seen == nil {
+		return nil, errNoReply
+	}
+	return seen, nil
+}
+
+// sameAddr compares two UDP addresses, ignoring IPv4-mapped IPv6 addresses.
+func sameAddr(a, b *net.UDPAddr) bool {
+	ap, bp := a.AddrPort(), b.AddrPort()
+	return ap.Addr().Unmap() == bp.Addr().Unmap() && ap.Port() == bp.Port()
+}
@@ -1,19 +1,80 @@
 // This package implements the pikopunch protocol, as described at
 // https://github.com/mca3/pikopunch.
+//
+// In addition to the regular protocol, where any packet is answered with the
+// address it was sent from, the server supports an extended probe used to
+// classify NATs. A probe is a packet consisting of a single 0x01 byte
+// followed by an 8 byte nonce:
+//
+//	| 0x01 | nonce (8 bytes) |
+//
+// When the same Server listens on multiple sockets, the reply to a probe
+// contains the address seen by the socket it was sent to, followed by the
+// addresses seen by the other sockets for the same nonce, each terminated by
+// a NUL byte. By sending the same probe to each socket in turn, the client
+// learns the mapping its NAT created for each destination.
+//
+// If the address of the client is not known at the moment, such as when the
+// server looks it up elsewhere, the reply is a single NUL byte.
 package punch
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
+	"net/netip"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ProbeType is the first byte of an extended probe.
+	ProbeType = 0x01
+
+	// ProbeSize is the size of an extended probe.
+	ProbeSize = 9
+
+	// probeTTL is how long the addresses seen for a probe are kept for.
+	probeTTL = time.Second * 5
+
+	// maxReply is the size of the largest reply we will send.
+	maxReply = 256
+
+	// limitShards is the amount of shards the rate limiter is split into,
+	// so workers don't fight over a single lock.
+	limitShards = 32
+
+	// limitTTL is how long a source address is remembered by the rate
+	// limiter after its last packet.
+	limitTTL = time.Minute
 )
 
+// ErrUnknown may be returned by a LookupFunc when the address is not known at
+// the moment. The client is sent an empty address, and may try again later.
+var ErrUnknown = errors.New("address unknown")
+
 // LookupFunc provides a UDP address which may be used to lookup the source
 // address from a different source, such as if you were to use it over
 // WireGuard.
 type LookupFunc func(ctx context.Context, addr *net.UDPAddr) (string, error)
 
+// Stats counts the packets a Server has handled.
+type Stats struct {
+	// Packets counts every packet received.
+	Packets uint64
+
+	// Limited counts the packets dropped because of rate limiting.
+	Limited uint64
+
+	// LookupFailures counts the packets dropped because their address
+	// couldn't be looked up.
+	LookupFailures uint64
+}
+
 // Server implements the pikopunch server.
 type Server struct {
 	// Lookup defines the lookup function and may be nil, in which case it
@@ -23,16 +84,88 @@ type Server struct {
 	// Lookup must not become nil once Server handles its first request.
 	Lookup        LookupFunc
 	lookupSetOnce sync.Once
+
+	// Workers is the amount of goroutines handling packets for each
+	// connection passed to Listen.
+	// If zero, runtime.GOMAXPROCS(0) is used.
+	Workers int
+
+	// Rate is the amount of packets per second a single source address
+	// may send, and Burst is the amount it may send at once.
+	// A Rate of zero disables rate limiting.
+	Rate, Burst int
+
+	probeMu   sync.Mutex
+	probes    map[[ProbeSize - 1]byte]*probe
+	lastSweep time.Time
+
+	limits [limitShards]limitShard
+
+	packets, limited, failures atomic.Uint64
+}
+
+// probe holds the addresses seen for a single probe nonce.
+type probe struct {
+	listeners []string
+	addrs     []string
+	expires   time.Time
+}
+
+// limitShard holds the token buckets of a subset of all source addresses.
+type limitShard struct {
+	sync.Mutex
+	buckets   map[netip.Addr]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// udpConn is implemented by *net.UDPConn, and lets workers handle packets
+// without allocating an address for each one.
+type udpConn interface {
+	net.PacketConn
+	ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error)
+	WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error)
+}
+
+// packetConn adapts a net.PacketConn which only deals with UDP addresses,
+// such as one from a userspace network stack, to udpConn.
+type packetConn struct {
+	net.PacketConn
+}
+
+func (c packetConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	n, addr, err := c.ReadFrom(b)
+	if err != nil {
+		return n, netip.AddrPort{}, err
+	}
+
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return n, netip.AddrPort{}, fmt.Errorf("unexpected address type %T", addr)
+	}
+	return n, ua.AddrPort(), nil
+}
+
+func (c packetConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	return c.WriteTo(b, net.UDPAddrFromAddrPort(addr))
 }
 
 // Listen is the read loop for the pikopunch server.
 //
-// Listen waits until a packet is read or the connection is closed.
-// All packets have their address looked up with s.Lookup which is in turn sent
-// back to the client.
-func (s *Server) Listen(c *net.UDPConn) error {
-	c.SetWriteBuffer(64)
-
+// Packets are handled by s.Workers goroutines, which each wait until a packet
+// is read, look up its address with s.Lookup, and send the result back to the
+// client.
+//
+// c is usually a *net.UDPConn, but any net.PacketConn dealing in UDP
+// addresses will do.
+//
+// Listen returns once ctx is canceled or reading from c fails.
+// c is not closed.
+func (s *Server) Listen(ctx context.Context, pc net.PacketConn) error {
 	s.lookupSetOnce.Do(func() {
 		if s.Lookup != nil {
 			return
@@ -41,31 +174,227 @@ func (s *Server) Listen(c *net.UDPConn) error {
 		s.Lookup = defaultLookup
 	})
 
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	c, ok := pc.(udpConn)
+	if !ok {
+		c = packetConn{pc}
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Unblock all workers once we're done.
+	go func() {
+		<-ctx.Done()
+		c.SetReadDeadline(time.Now())
+	}()
+
+	local := c.LocalAddr().String()
+	errc := make(chan error, workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			errc <- s.worker(ctx, c, local)
+		}()
+	}
+
+	var err error
+	for i := 0; i < workers; i++ {
+		if werr := <-errc; werr != nil && err == nil {
+			err = werr
+			cancel()
+		}
+	}
+
+	if parent.Err() != nil {
+		// We were told to stop, and the error is from unblocking the
+		// workers.
+		return nil
+	}
+	return err
+}
+
+// worker reads and answers packets from c until reading fails.
+func (s *Server) worker(ctx context.Context, c udpConn, local string) error {
+	buf := make([]byte, ProbeSize)
+	out := make([]byte, 0, maxReply)
+
+	// Reused for every lookup so we don't allocate one for each packet.
+	addr := &net.UDPAddr{IP: make(net.IP, net.IPv6len)}
+
 	for {
-		// TODO: The server isn't particularly fast because it is,
-		// well, single-threaded, but I think for something of this
-		// simplicity a multi-threaded server isn't very important.
-		//
-		// Responses don't have to be instantaneous, they just have to
-		// arrive eventually, within about five seconds ideally.
-
-		_, addr, err := c.ReadFromUDP([]byte(nil))
+		n, ap, err := c.ReadFromUDPAddrPort(buf)
 		if err != nil {
 			return err
 		}
 
-		ret, err := s.Lookup(context.TODO(), addr)
+		s.packets.Add(1)
+
+		if !s.allow(ap.Addr(), time.Now()) {
+			s.limited.Add(1)
+			continue
+		}
+
+		setUDPAddr(addr, ap)
+
+		ret, err := s.Lookup(ctx, addr)
+		if errors.Is(err, ErrUnknown) {
+			ret, err = "", nil
+		}
+
 		if err != nil || len(ret) > 64 {
 			// Ignore the packet
-			log.Printf("punch: lookup failed for %v: %v", addr, err)
+			s.failures.Add(1)
+			slog.Warn("punch: lookup failed", "addr", ap, "error", err)
 			continue
 		}
-		ret += "\x00"
 
-		c.WriteToUDP([]byte(ret), addr)
+		if n == ProbeSize && buf[0] == ProbeType {
+			out = append(out[:0], s.probe(buf[1:], local, ret)...)
+		} else {
+			out = append(append(out[:0], ret...), 0)
+		}
+
+		c.WriteToUDPAddrPort(out, ap)
+	}
+}
+
+// Stats returns the amount of packets s has handled.
+func (s *Server) Stats() Stats {
+	return Stats{
+		Packets:        s.packets.Load(),
+		Limited:        s.limited.Load(),
+		LookupFailures: s.failures.Load(),
+	}
+}
+
+// setUDPAddr fills addr from ap without allocating.
+// addr.IP must have room for an IPv6 address.
+func setUDPAddr(addr *net.UDPAddr, ap netip.AddrPort) {
+	ip := ap.Addr()
+	if ip.Is4() || ip.Is4In6() {
+		addr.IP = addr.IP[:net.IPv4len]
+		a := ip.Unmap().As4()
+		copy(addr.IP, a[:])
+	} else {
+		addr.IP = addr.IP[:net.IPv6len]
+		a := ip.As16()
+		copy(addr.IP, a[:])
+	}
+
+	addr.Port = int(ap.Port())
+	addr.Zone = ip.Zone()
+}
+
+// allow determines if a packet from ip should be handled, according to the
+// rate limit.
+func (s *Server) allow(ip netip.Addr, now time.Time) bool {
+	if s.Rate <= 0 {
+		return true
 	}
 
-	// Unreachable.
+	ip = ip.Unmap()
+	a := ip.As16()
+	sh := &s.limits[(a[15]^a[13]^a[11])%limitShards]
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	if sh.buckets == nil {
+		sh.buckets = make(map[netip.Addr]*bucket)
+	}
+
+	if now.Sub(sh.lastSweep) > limitTTL {
+		for k, v := range sh.buckets {
+			if now.Sub(v.last) > limitTTL {
+				delete(sh.buckets, k)
+			}
+		}
+		sh.lastSweep = now
+	}
+
+	burst := float64(s.Burst)
+	if burst < 1 {
+		burst = float64(s.Rate)
+	}
+
+	b, ok := sh.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		sh.buckets[ip] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * float64(s.Rate)
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// probe records the address seen by listener for a probe nonce, and returns
+// the reply to send.
+func (s *Server) probe(nonce []byte, listener, addr string) string {
+	now := time.Now()
+
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+
+	if s.probes == nil {
+		s.probes = make(map[[ProbeSize - 1]byte]*probe)
+	}
+
+	if now.Sub(s.lastSweep) > time.Second {
+		for k, v := range s.probes {
+			if now.After(v.expires) {
+				delete(s.probes, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	key := [ProbeSize - 1]byte{}
+	copy(key[:], nonce)
+
+	p, ok := s.probes[key]
+	if !ok || now.After(p.expires) {
+		p = &probe{}
+		s.probes[key] = p
+	}
+	p.expires = now.Add(probeTTL)
+
+	found := false
+	for i, v := range p.listeners {
+		if v == listener {
+			p.addrs[i] = addr
+			found = true
+			break
+		}
+	}
+	if !found {
+		p.listeners = append(p.listeners, listener)
+		p.addrs = append(p.addrs, addr)
+	}
+
+	// Our own address always comes first.
+	ret := addr + "\x00"
+	for i, v := range p.addrs {
+		if p.listeners[i] != listener {
+			ret += v + "\x00"
+		}
+	}
+	return ret
 }
 
 func defaultLookup(_ context.Context, addr *net.UDPAddr) (string, error) {
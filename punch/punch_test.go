@@ -1,7 +1,9 @@
 package punch
 
 import (
+	"context"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -24,7 +26,7 @@ func TestPunch4(t *testing.T) {
 	srv := Server{}
 
 	// exits when srvc closes
-	go srv.Listen(srvc)
+	go srv.Listen(context.Background(), srvc)
 
 	cli, err := net.DialUDP("udp4", resolveUDP("udp4", "127.0.0.1:0"), srvc.LocalAddr().(*net.UDPAddr))
 	if err != nil {
@@ -68,7 +70,7 @@ func TestPunch6(t *testing.T) {
 	srv := Server{}
 
 	// exits when srvc closes
-	go srv.Listen(srvc)
+	go srv.Listen(context.Background(), srvc)
 
 	cli, err := net.DialUDP("udp6", resolveUDP("udp6", "[::1]:0"), srvc.LocalAddr().(*net.UDPAddr))
 	if err != nil {
@@ -102,19 +104,24 @@ func TestPunch6(t *testing.T) {
 	}
 }
 
-func BenchmarkPunch(b *testing.B) {
+// startBench starts a server for benchmarks.
+func startBench(b *testing.B, srv *Server) *net.UDPAddr {
 	srvc, err := net.ListenUDP("udp6", resolveUDP("udp6", "[::1]:0"))
 	if err != nil {
 		panic(err)
 	}
-	defer srvc.Close()
-
-	srv := Server{}
+	b.Cleanup(func() { srvc.Close() })
 
 	// exits when srvc closes
-	go srv.Listen(srvc)
+	go srv.Listen(context.Background(), srvc)
 
-	cli, err := net.DialUDP("udp6", resolveUDP("udp6", "[::1]:0"), srvc.LocalAddr().(*net.UDPAddr))
+	return srvc.LocalAddr().(*net.UDPAddr)
+}
+
+func BenchmarkPunch(b *testing.B) {
+	addr := startBench(b, &Server{})
+
+	cli, err := net.DialUDP("udp6", resolveUDP("udp6", "[::1]:0"), addr)
 	if err != nil {
 		panic(err)
 	}
@@ -130,3 +137,230 @@ func BenchmarkPunch(b *testing.B) {
 		cli.Read(buf)
 	}
 }
+
+// BenchmarkPunchParallel measures throughput with many clients sending
+// requests at once.
+func BenchmarkPunchParallel(b *testing.B) {
+	addr := startBench(b, &Server{})
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	b.RunParallel(func(pb *testing.PB) {
+		cli, err := net.DialUDP("udp6", resolveUDP("udp6", "[::1]:0"), addr)
+		if err != nil {
+			panic(err)
+		}
+		defer cli.Close()
+
+		buf := make([]byte, 64)
+
+		for pb.Next() {
+			cli.SetReadDeadline(time.Now().Add(time.Second))
+			cli.Write([]byte(nil))
+			cli.Read(buf)
+		}
+	})
+}
+
+// BenchmarkPunchSlowLookup measures throughput when some lookups take a long
+// time, which should not hold up other clients.
+func BenchmarkPunchSlowLookup(b *testing.B) {
+	var n atomic.Int64
+
+	addr := startBench(b, &Server{
+		Lookup: func(ctx context.Context, addr *net.UDPAddr) (string, error) {
+			if n.Add(1)%64 == 0 {
+				time.Sleep(time.Millisecond * 10)
+			}
+			return defaultLookup(ctx, addr)
+		},
+		Workers: 16,
+	})
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		cli, err := net.DialUDP("udp6", resolveUDP("udp6", "[::1]:0"), addr)
+		if err != nil {
+			panic(err)
+		}
+		defer cli.Close()
+
+		buf := make([]byte, 64)
+
+		for pb.Next() {
+			cli.SetReadDeadline(time.Now().Add(time.Second))
+			cli.Write([]byte(nil))
+			cli.Read(buf)
+		}
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	srvc, err := net.ListenUDP("udp4", resolveUDP("udp4", "127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("server connection listen failed: %v", err)
+	}
+	defer srvc.Close()
+
+	srv := Server{Rate: 1, Burst: 2}
+
+	// exits when srvc closes
+	go srv.Listen(context.Background(), srvc)
+
+	cli, err := net.DialUDP("udp4", resolveUDP("udp4", "127.0.0.1:0"), srvc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("client connection open failed: %v", err)
+	}
+	defer cli.Close()
+
+	buf := make([]byte, 64)
+
+	// The first two fit in the bucket.
+	for i := 0; i < 2; i++ {
+		cli.SetReadDeadline(time.Now().Add(time.Second))
+		cli.Write([]byte(nil))
+		if _, err := cli.Read(buf); err != nil {
+			t.Fatalf("failed to read from the server: %v", err)
+		}
+	}
+
+	cli.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	cli.Write([]byte(nil))
+	if _, err := cli.Read(buf); err == nil {
+		t.Fatal("server answered a packet over the rate limit")
+	}
+
+	if st := srv.Stats(); st.Packets != 3 || st.Limited != 1 {
+		t.Fatalf("expected 3 packets with 1 limited, got %+v", st)
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	srvc, err := net.ListenUDP("udp4", resolveUDP("udp4", "127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("server connection listen failed: %v", err)
+	}
+	defer srvc.Close()
+
+	srv := Server{
+		Lookup: func(_ context.Context, _ *net.UDPAddr) (string, error) {
+			return "", ErrUnknown
+		},
+	}
+
+	// exits when srvc closes
+	go srv.Listen(context.Background(), srvc)
+
+	cli, err := net.DialUDP("udp4", resolveUDP("udp4", "127.0.0.1:0"), srvc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("client connection open failed: %v", err)
+	}
+	defer cli.Close()
+
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	cli.Write([]byte(nil))
+
+	buf := make([]byte, 64)
+	n, err := cli.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read from the server: %v", err)
+	}
+
+	if n != 1 || buf[0] != 0 {
+		t.Fatalf("expected an empty address, got %q", buf[:n])
+	}
+}
+
+func TestListenContext(t *testing.T) {
+	srvc, err := net.ListenUDP("udp4", resolveUDP("udp4", "127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("server connection listen failed: %v", err)
+	}
+	defer srvc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	srv := Server{}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Listen(ctx, srvc)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Listen did not return after cancelation")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	srv := Server{}
+
+	var addrs []*net.UDPAddr
+	for i := 0; i < 2; i++ {
+		srvc, err := net.ListenUDP("udp4", resolveUDP("udp4", "127.0.0.1:0"))
+		if err != nil {
+			t.Fatalf("server connection listen failed: %v", err)
+		}
+		defer srvc.Close()
+
+		// exits when srvc closes
+		go srv.Listen(context.Background(), srvc)
+
+		addrs = append(addrs, srvc.LocalAddr().(*net.UDPAddr))
+	}
+
+	cli, err := net.ListenUDP("udp4", resolveUDP("udp4", "127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("client connection open failed: %v", err)
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	seen, err := Probe(ctx, cli, addrs...)
+	if err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+
+	if len(seen) != 2 {
+		t.Fatalf("expected 2 addresses, got %v", seen)
+	}
+
+	for _, v := range seen {
+		if v != cli.LocalAddr().String() {
+			t.Fatalf("expected %v, got %v", cli.LocalAddr(), v)
+		}
+	}
+
+	if nat := Classify(cli.LocalAddr().String(), seen); nat != NATNone {
+		t.Fatalf("expected %q, got %q", NATNone, nat)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		local string
+		seen  []string
+		nat   NAT
+	}{
+		{"10.0.0.2:1234", []string{"198.51.100.1:4000"}, NATUnknown},
+		{"10.0.0.2:1234", []string{"10.0.0.2:1234", "10.0.0.2:1234"}, NATNone},
+		{"10.0.0.2:1234", []string{"198.51.100.1:4000", "198.51.100.1:4000"}, NATEasy},
+		{"10.0.0.2:1234", []string{"198.51.100.1:4000", "198.51.100.1:4001"}, NATSymmetric},
+	}
+
+	for _, v := range tests {
+		if nat := Classify(v.local, v.seen); nat != v.nat {
+			t.Errorf("Classify(%q, %v) = %q, expected %q", v.local, v.seen, nat, v.nat)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+// This package implements a relay which forwards encrypted WireGuard packets
+// between two devices which are unable to reach each other directly, such as
+// when both are behind symmetric NATs.
+//
+// Every packet starts with a single byte describing its type.
+//
+// Devices register their address with the relay by sending a hello packet,
+// containing their WireGuard public key and a token for that key handed out
+// by the rendezvous server:
+//
+//	| 0x01 | public key (32 bytes) | token (32 bytes) |
+//
+// The relay replies with a single 0x01 byte. Hello packets should be sent
+// periodically to keep the registration alive.
+//
+// Data packets sent to the relay contain the public key of the destination,
+// and are forwarded with the public key of the source in its place:
+//
+//	| 0x02 | public key (32 bytes) | payload |
+package relay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Packet types.
+const (
+	TypeHello = 0x01
+	TypeData  = 0x02
+)
+
+const (
+	// KeySize is the size of a WireGuard public key.
+	KeySize = 32
+
+	// TokenSize is the size of a token.
+	TokenSize = sha256.Size
+
+	// MaxPacketSize is the largest packet the relay will forward,
+	// including the header.
+	MaxPacketSize = 1 + KeySize + 65535
+
+	// Expiry is how long a device stays registered after its last hello.
+	Expiry = time.Minute * 2
+
+	// allowTTL is how long the result of Server.Allow is cached for.
+	allowTTL = time.Minute
+
+	// allowTimeout is how long a single call to Server.Allow may take.
+	allowTimeout = time.Second * 5
+
+	// maxLookups is the amount of calls to Server.Allow which may run at
+	// once.
+	maxLookups = 16
+)
+
+var (
+	errShortPacket = errors.New("packet too short")
+	errBadType     = errors.New("unexpected packet type")
+)
+
+// Key is a WireGuard public key.
+type Key [KeySize]byte
+
+// Stats holds the traffic a device has sent through the relay.
+//
+// A device's statistics are kept for as long as it is registered.
+type Stats struct {
+	// TxBytes and TxPackets count the payload bytes and packets the
+	// device has sent to the relay.
+	TxBytes, TxPackets uint64
+
+	// RxBytes and RxPackets count the payload bytes and packets the relay
+	// has forwarded to the device.
+	RxBytes, RxPackets uint64
+
+	// Dropped counts the packets sent by the device that were dropped,
+	// either because of rate limiting, because the destination was
+	// unknown or not allowed, or because the relay was still checking if
+	// it was allowed.
+	Dropped uint64
+}
+
+// Server implements the relay.
+type Server struct {
+	// Secret is used to create and verify tokens and must not be empty.
+	Secret []byte
+
+	// Allow determines if src may send packets to dst, and may be nil in
+	// which case all registered devices may talk to each other.
+	//
+	// Allow is called outside of the read loop, and packets are dropped
+	// until it returns. Results are cached for a short while, and stale
+	// results are used while they are refreshed.
+	Allow func(ctx context.Context, src, dst Key) bool
+
+	// Rate is the amount of payload bytes per second a device may send
+	// through the relay, and Burst is the amount of bytes it may send at
+	// once.
+	// A Rate of zero disables rate limiting.
+	Rate, Burst int
+
+	mu      sync.Mutex
+	clients map[Key]*client
+	addrs   map[netip.AddrPort]Key
+	allowed map[[2]Key]allowEntry
+	stats   map[Key]*Stats
+
+	// looking holds the pairs that Allow is being called for, along with
+	// an ID for the call, and lookups limits the amount of calls.
+	looking  map[[2]Key]uint64
+	lookups  chan struct{}
+	lookupID uint64
+
+	// total is the traffic of every device which has ever used the relay,
+	// including those which have since been forgotten.
+	total Stats
+}
+
+type client struct {
+	addr netip.AddrPort
+	seen time.Time
+
+	// Token bucket
+	tokens float64
+	last   time.Time
+}
+
+type allowEntry struct {
+	ok      bool
+	expires time.Time
+}
+
+// Token creates the token that the device with public key k must present to
+// the relay.
+func Token(secret []byte, k Key) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write(k[:])
+	return m.Sum(nil)
+}
+
+// AppendHello appends a hello packet to buf.
+func AppendHello(buf []byte, k Key, token []byte) []byte {
+	buf = append(buf, TypeHello)
+	buf = append(buf, k[:]...)
+	return append(buf, token...)
+}
+
+// AppendData appends a data packet to buf.
+func AppendData(buf []byte, k Key, payload []byte) []byte {
+	buf = append(buf, TypeData)
+	buf = append(buf, k[:]...)
+	return append(buf, payload...)
+}
+
+// ParseData parses a data packet, returning the key and the payload.
+// The payload shares memory with pkt.
+func ParseData(pkt []byte) (Key, []byte, error) {
+	var k Key
+
+	if len(pkt) < 1+KeySize {
+		return k, nil, errShortPacket
+	} else if pkt[0] != TypeData {
+		return k, nil, errBadType
+	}
+
+	copy(k[:], pkt[1:])
+	return k, pkt[1+KeySize:], nil
+}
+
+// Stats returns the traffic statistics of a device.
+func (s *Server) Stats(k Key) (Stats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.stats[k]
+	if !ok {
+		return Stats{}, false
+	}
+	return *st, true
+}
+
+// Total returns the traffic statistics of every device put together.
+func (s *Server) Total() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.total
+}
+
+// Forget unregisters a device right away, such as when it is deleted.
+//
+// Its token stays valid, so the next hello registers it again; Allow should
+// reject it by then, as cached results involving it are forgotten too, along
+// with the results of calls to Allow which were running.
+func (s *Server) Forget(k Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forget(k)
+	for pair := range s.allowed {
+		if pair[0] == k || pair[1] == k {
+			delete(s.allowed, pair)
+		}
+	}
+	for pair := range s.looking {
+		if pair[0] == k || pair[1] == k {
+			delete(s.looking, pair)
+		}
+	}
+}
+
+// forget removes a device and its statistics.
+// s.mu is assumed to be locked.
+func (s *Server) forget(k Key) {
+	if cl, ok := s.clients[k]; ok {
+		delete(s.addrs, cl.addr)
+		delete(s.clients, k)
+	}
+	delete(s.stats, k)
+}
+
+// Listen is the read loop for the relay.
+//
+// Listen returns once c is closed.
+func (s *Server) Listen(c *net.UDPConn) error {
+	s.mu.Lock()
+	if s.clients == nil {
+		s.clients = make(map[Key]*client)
+		s.addrs = make(map[netip.AddrPort]Key)
+		s.allowed = make(map[[2]Key]allowEntry)
+		s.stats = make(map[Key]*Stats)
+		s.looking = make(map[[2]Key]uint64)
+		s.lookups = make(chan struct{}, maxLookups)
+	}
+	s.mu.Unlock()
+
+	buf := make([]byte, MaxPacketSize)
+	out := make([]byte, 0, MaxPacketSize)
+
+	for {
+		n, addr, err := c.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return err
+		}
+
+		// v4-mapped and v4 addresses of the same client must look the
+		// same.
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+		pkt := buf[:n]
+		if len(pkt) == 0 {
+			continue
+		}
+
+		switch pkt[0] {
+		case TypeHello:
+			if s.hello(addr, pkt[1:]) {
+				c.WriteToUDPAddrPort([]byte{TypeHello}, addr)
+			}
+		case TypeData:
+			dst, payload, err := ParseData(pkt)
+			if err != nil {
+				continue
+			}
+
+			to, src, ok := s.route(addr, dst, len(payload))
+			if !ok {
+				continue
+			}
+
+			out = AppendData(out[:0], src, payload)
+			c.WriteToUDPAddrPort(out, to)
+		}
+	}
+}
+
+// hello registers the source of a hello packet.
+func (s *Server) hello(addr netip.AddrPort, body []byte) bool {
+	if len(body) != KeySize+TokenSize {
+		return false
+	}
+
+	var k Key
+	copy(k[:], body)
+
+	if !hmac.Equal(Token(s.Secret, k), body[KeySize:]) {
+		return false
+	}
+
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cl, ok := s.clients[k]
+	if !ok {
+		cl = &client{
+			tokens: s.burst(),
+			last:   now,
+		}
+		s.clients[k] = cl
+	} else if cl.addr != addr {
+		// Roamed, forget about the old address
+		delete(s.addrs, cl.addr)
+	}
+
+	if old, ok := s.addrs[addr]; ok && old != k {
+		// Someone else was here before
+		delete(s.clients, old)
+		delete(s.stats, old)
+	}
+
+	cl.addr = addr
+	cl.seen = now
+	s.addrs[addr] = k
+
+	if _, ok := s.stats[k]; !ok {
+		s.stats[k] = &Stats{}
+	}
+
+	s.expire(now)
+	return true
+}
+
+// expire forgets about devices which haven't sent a hello in a while.
+// s.mu is assumed to be locked.
+func (s *Server) expire(now time.Time) {
+	for k, cl := range s.clients {
+		if now.Sub(cl.seen) > Expiry {
+			s.forget(k)
+		}
+	}
+
+	// Stale results are still used while they are refreshed, so they are
+	// only forgotten once they have been stale for as long again.
+	for k, v := range s.allowed {
+		if now.Sub(v.expires) > allowTTL {
+			delete(s.allowed, k)
+		}
+	}
+}
+
+// route determines where a data packet from addr for dst should go.
+//
+// If the packet should be dropped, ok is false.
+func (s *Server) route(addr netip.AddrPort, dst Key, size int) (to netip.AddrPort, src Key, ok bool) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, ok = s.addrs[addr]
+	if !ok {
+		// Never said hello
+		return to, src, false
+	}
+
+	st := s.stats[src]
+	st.TxBytes += uint64(size)
+	st.TxPackets++
+	s.total.TxBytes += uint64(size)
+	s.total.TxPackets++
+
+	scl := s.clients[src]
+	dcl, ok := s.clients[dst]
+	if !ok || now.Sub(dcl.seen) > Expiry || !s.take(scl, now, size) {
+		st.Dropped++
+		s.total.Dropped++
+		return to, src, false
+	}
+	to = dcl.addr
+
+	if s.Allow != nil {
+		pair := [2]Key{src, dst}
+		ae, cached := s.allowed[pair]
+		if !cached || now.After(ae.expires) {
+			s.lookup(pair)
+		}
+
+		if !ae.ok {
+			// Either not allowed, or we don't know yet.
+			st.Dropped++
+			s.total.Dropped++
+			return to, src, false
+		}
+	}
+
+	rst := s.stats[dst]
+	rst.RxBytes += uint64(size)
+	rst.RxPackets++
+	s.total.RxBytes += uint64(size)
+	s.total.RxPackets++
+
+	return to, src, true
+}
+
+// lookup calls Allow for pair in the background and caches the result, unless
+// it is already being called for pair or too many calls are running, in which
+// case a later packet will try again.
+// s.mu is assumed to be locked.
+func (s *Server) lookup(pair [2]Key) {
+	if _, ok := s.looking[pair]; ok {
+		return
+	}
+
+	select {
+	case s.lookups <- struct{}{}:
+	default:
+		return
+	}
+
+	s.lookupID++
+	id := s.lookupID
+	s.looking[pair] = id
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), allowTimeout)
+		ok := s.Allow(ctx, pair[0], pair[1])
+		cancel()
+
+		<-s.lookups
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.looking[pair] != id {
+			// Forgotten in the meantime.
+			return
+		}
+		delete(s.looking, pair)
+
+		s.allowed[pair] = allowEntry{
+			ok:      ok,
+			expires: time.Now().Add(allowTTL),
+		}
+	}()
+}
+
+// burst returns the size of the token bucket, which defaults to a second's
+// worth of traffic.
+func (s *Server) burst() float64 {
+	if s.Burst == 0 {
+		return float64(s.Rate)
+	}
+	return float64(s.Burst)
+}
+
+// take removes size tokens from the bucket of cl.
+// s.mu is assumed to be locked.
+func (s *Server) take(cl *client, now time.Time, size int) bool {
+	if s.Rate == 0 {
+		return true
+	}
+
+	cl.tokens += now.Sub(cl.last).Seconds() * float64(s.Rate)
+	if burst := s.burst(); cl.tokens > burst {
+		cl.tokens = burst
+	}
+	cl.last = now
+
+	if cl.tokens < float64(size) {
+		return false
+	}
+
+	cl.tokens -= float64(size)
+	return true
+}
@@ -0,0 +1,243 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("relay test secret")
+
+func makeKey(b byte) Key {
+	var k Key
+	for i := range k {
+		k[i] = b
+	}
+	return k
+}
+
+func startServer(t *testing.T, srv *Server) *net.UDPAddr {
+	srvc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("server connection listen failed: %v", err)
+	}
+	t.Cleanup(func() { srvc.Close() })
+
+	// exits when srvc closes
+	go srv.Listen(srvc)
+
+	return srvc.LocalAddr().(*net.UDPAddr)
+}
+
+// dialClient opens a client connection to the relay and says hello.
+func dialClient(t *testing.T, addr *net.UDPAddr, k Key, token []byte) *net.UDPConn {
+	cli, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		t.Fatalf("client connection open failed: %v", err)
+	}
+	t.Cleanup(func() { cli.Close() })
+
+	cli.SetDeadline(time.Now().Add(time.Second))
+
+	if _, err := cli.Write(AppendHello(nil, k, token)); err != nil {
+		t.Fatalf("failed to send hello: %v", err)
+	}
+
+	buf := make([]byte, 16)
+	n, err := cli.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read hello reply: %v", err)
+	} else if n != 1 || buf[0] != TypeHello {
+		t.Fatalf("bad hello reply: %v", buf[:n])
+	}
+
+	return cli
+}
+
+func TestRelay(t *testing.T) {
+	srv := &Server{Secret: testSecret}
+	addr := startServer(t, srv)
+
+	ka, kb := makeKey(1), makeKey(2)
+	a := dialClient(t, addr, ka, Token(testSecret, ka))
+	b := dialClient(t, addr, kb, Token(testSecret, kb))
+
+	payload := []byte("pretend this is a WireGuard packet")
+	if _, err := a.Write(AppendData(nil, kb, payload)); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+
+	buf := make([]byte, MaxPacketSize)
+	n, err := b.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read data: %v", err)
+	}
+
+	src, got, err := ParseData(buf[:n])
+	if err != nil {
+		t.Fatalf("failed to parse data: %v", err)
+	}
+
+	if src != ka {
+		t.Fatalf("expected packet from %x, got %x", ka, src)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("expected %q, got %q", payload, got)
+	}
+
+	st, ok := srv.Stats(ka)
+	if !ok || st.TxBytes != uint64(len(payload)) || st.TxPackets != 1 {
+		t.Fatalf("bad stats for sender: %+v", st)
+	}
+
+	st, ok = srv.Stats(kb)
+	if !ok || st.RxBytes != uint64(len(payload)) || st.RxPackets != 1 {
+		t.Fatalf("bad stats for receiver: %+v", st)
+	}
+
+	// Forgotten devices lose their statistics and can't send anything,
+	// but still count towards the total.
+	srv.Forget(ka)
+	if _, ok := srv.Stats(ka); ok {
+		t.Fatal("stats of a forgotten device were kept")
+	}
+
+	a.Write(AppendData(nil, kb, payload))
+	b.SetDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, err := b.Read(buf); err == nil {
+		t.Fatal("relay forwarded a packet from a forgotten device")
+	}
+
+	if tot := srv.Total(); tot.TxPackets != 1 || tot.RxPackets != 1 || tot.RxBytes != uint64(len(payload)) {
+		t.Fatalf("bad total: %+v", tot)
+	}
+}
+
+func TestBadToken(t *testing.T) {
+	srv := &Server{Secret: testSecret}
+	addr := startServer(t, srv)
+
+	cli, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		t.Fatalf("client connection open failed: %v", err)
+	}
+	defer cli.Close()
+
+	cli.SetDeadline(time.Now().Add(time.Millisecond * 100))
+
+	k := makeKey(1)
+	cli.Write(AppendHello(nil, k, Token([]byte("wrong secret"), k)))
+
+	if _, err := cli.Read(make([]byte, 16)); err == nil {
+		t.Fatal("relay accepted a bad token")
+	}
+}
+
+func TestNotAllowed(t *testing.T) {
+	srv := &Server{
+		Secret: testSecret,
+		Allow: func(_ context.Context, src, dst Key) bool {
+			return false
+		},
+	}
+	addr := startServer(t, srv)
+
+	ka, kb := makeKey(1), makeKey(2)
+	a := dialClient(t, addr, ka, Token(testSecret, ka))
+	b := dialClient(t, addr, kb, Token(testSecret, kb))
+
+	a.Write(AppendData(nil, kb, []byte("hello")))
+
+	b.SetDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, err := b.Read(make([]byte, MaxPacketSize)); err == nil {
+		t.Fatal("relay forwarded a packet that wasn't allowed")
+	}
+
+	if st, _ := srv.Stats(ka); st.Dropped != 1 {
+		t.Fatalf("expected 1 dropped packet, got %d", st.Dropped)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := &Server{
+		Secret: testSecret,
+		Rate:   100,
+		Burst:  100,
+	}
+	addr := startServer(t, srv)
+
+	ka, kb := makeKey(1), makeKey(2)
+	a := dialClient(t, addr, ka, Token(testSecret, ka))
+	b := dialClient(t, addr, kb, Token(testSecret, kb))
+
+	// The first fits in the bucket, the second does not.
+	payload := make([]byte, 80)
+	a.Write(AppendData(nil, kb, payload))
+	a.Write(AppendData(nil, kb, payload))
+
+	buf := make([]byte, MaxPacketSize)
+	if _, err := b.Read(buf); err != nil {
+		t.Fatalf("failed to read data: %v", err)
+	}
+
+	b.SetDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, err := b.Read(buf); err == nil {
+		t.Fatal("relay forwarded a packet over the rate limit")
+	}
+
+	if st, _ := srv.Stats(ka); st.Dropped != 1 || st.TxPackets != 2 {
+		t.Fatalf("bad stats for sender: %+v", st)
+	}
+}
+
+// recvRetry sends payload from a to the device with key k until b receives
+// it, as packets are dropped until Allow has been called.
+func recvRetry(t *testing.T, a, b *net.UDPConn, k Key, payload []byte) {
+	t.Helper()
+
+	buf := make([]byte, MaxPacketSize)
+	for i := 0; i < 20; i++ {
+		a.Write(AppendData(nil, k, payload))
+
+		b.SetDeadline(time.Now().Add(time.Millisecond * 50))
+		if _, err := b.Read(buf); err == nil {
+			return
+		}
+	}
+	t.Fatal("relay never forwarded the packet")
+}
+
+func TestSlowAllow(t *testing.T) {
+	ka, kb := makeKey(1), makeKey(2)
+	kc, kd := makeKey(3), makeKey(4)
+
+	release := make(chan struct{})
+	srv := &Server{
+		Secret: testSecret,
+		Allow: func(ctx context.Context, src, dst Key) bool {
+			if src == ka {
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return false
+				}
+			}
+			return true
+		},
+	}
+	addr := startServer(t, srv)
+
+	a := dialClient(t, addr, ka, Token(testSecret, ka))
+	b := dialClient(t, addr, kb, Token(testSecret, kb))
+	c := dialClient(t, addr, kc, Token(testSecret, kc))
+	d := dialClient(t, addr, kd, Token(testSecret, kd))
+
+	// The lookup for a and b is stuck, which must not hold up c and d.
+	a.Write(AppendData(nil, kb, []byte("hello")))
+	recvRetry(t, c, d, kd, []byte("hello"))
+
+	close(release)
+	recvRetry(t, a, b, kb, []byte("hello"))
+}
@@ -0,0 +1,314 @@
+package routes
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mca3/mwr"
+	"github.com/mca3/pikorv/api"
+	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/internal/pprelay"
+	"github.com/mca3/pikorv/routes/gateway"
+)
+
+// adminListOptions reads the query parameters of an admin list like
+// listOptions, except that admin lists, which cover every user, are always
+// paginated.
+func adminListOptions(c *mwr.Ctx) (db.ListOptions, error) {
+	o, err := listOptions(c)
+	if err == nil && o.Limit == 0 {
+		o.Limit = defaultPageLimit
+	}
+	return o, err
+}
+
+// AdminUsers lists all users, whose names are their usernames.
+//
+// The cursor of the next page, if there is one, is in the X-Next-Cursor
+// header.
+//
+// Path: /api/v1/admin/users
+// Method: GET
+// Legacy: GET /api/admin/users
+// Authenticated as an administrator.
+// Query: prefix=<username prefix>, sort=id|name, order=asc|desc, limit=<n>,
+// cursor=<cursor>; all optional.
+func AdminUsers(c *mwr.Ctx) error {
+	if _, ok := isAdmin(c); !ok {
+		return api403(c, errNotAdmin)
+	}
+
+	o, err := adminListOptions(c)
+	if err != nil {
+		return api400(c, err)
+	}
+
+	us, err := store.ListUsers(c.Context(), peek(o))
+	if err != nil {
+		return api500(c, err)
+	}
+
+	return sendJSON(c, nextPage(c, o, us, func(u db.User) (int64, string) { return u.ID, u.Username }))
+}
+
+// AdminDevices lists all devices.
+//
+// The cursor of the next page, if there is one, is in the X-Next-Cursor
+// header.
+//
+// Path: /api/v1/admin/devices
+// Method: GET
+// Legacy: GET /api/admin/devices
+// Authenticated as an administrator.
+// Query: prefix=<name prefix>, sort=id|name, order=asc|desc, limit=<n>,
+// cursor=<cursor>; all optional.
+func AdminDevices(c *mwr.Ctx) error {
+	if _, ok := isAdmin(c); !ok {
+		return api403(c, errNotAdmin)
+	}
+
+	o, err := adminListOptions(c)
+	if err != nil {
+		return api400(c, err)
+	}
+
+	devs, err := store.ListDevices(c.Context(), 0, db.DeviceOptions{ListOptions: peek(o)})
+	if err != nil {
+		return api500(c, err)
+	}
+
+	return sendJSON(c, nextPage(c, o, devs, func(d db.Device) (int64, string) { return d.ID, d.Name }))
+}
+
+// AdminNetworks lists all networks.
+//
+// The cursor of the next page, if there is one, is in the X-Next-Cursor
+// header.
+//
+// Path: /api/v1/admin/networks
+// Method: GET
+// Legacy: GET /api/admin/networks
+// Authenticated as an administrator.
+// Query: prefix=<name prefix>, sort=id|name, order=asc|desc, limit=<n>,
+// cursor=<cursor>; all optional.
+func AdminNetworks(c *mwr.Ctx) error {
+	if _, ok := isAdmin(c); !ok {
+		return api403(c, errNotAdmin)
+	}
+
+	o, err := adminListOptions(c)
+	if err != nil {
+		return api400(c, err)
+	}
+
+	nws, err := store.ListNetworks(c.Context(), 0, peek(o))
+	if err != nil {
+		return api500(c, err)
+	}
+
+	return sendJSON(c, nextPage(c, o, nws, func(nw db.Network) (int64, string) { return nw.ID, nw.Name }))
+}
+
+// AdminGateway lists all live gateway connections.
+//
+// Path: /api/v1/admin/gateway
+// Method: GET
+// Legacy: GET /api/admin/gateway
+// Authenticated as an administrator.
+// Query: prefix=<username prefix>, order=asc|desc, limit=<n>, cursor=<from
+// X-Next-Cursor>; all optional. Connections are sorted by ID, as several may
+// belong to the same user.
+func AdminGateway(c *mwr.Ctx) error {
+	if _, ok := isAdmin(c); !ok {
+		return api403(c, errNotAdmin)
+	}
+
+	o, err := adminListOptions(c)
+	if err != nil {
+		return api400(c, err)
+	} else if o.Sort != db.SortID {
+		return api400(c, errors.New("invalid sort"))
+	}
+
+	conns := gateway.Connections(peek(o))
+	return sendJSON(c, nextPage(c, o, conns, func(v api.Connection) (int64, string) { return v.ID, v.Username }))
+}
+
+// errSelf is returned when administrators try to lock themselves out.
+var errSelf = errors.New("cannot change own account")
+
+// adminUser fetches the user with the given ID for an administrator to
+// change, who may not change themselves.
+func adminUser(c *mwr.Ctx, admin *db.User, id int64) (db.User, error) {
+	if id == admin.ID {
+		return db.User{}, errSelf
+	}
+
+	return store.UserID(c.Context(), id)
+}
+
+// saveLocked saves u after it was disabled, enabled, locked, or unlocked, and
+// disconnects it from the gateway if it may no longer log in.
+func saveLocked(c *mwr.Ctx, u db.User) error {
+	if err := store.SaveUser(c.Context(), &u); err != nil {
+		return api500(c, err)
+	}
+
+	if u.Locked() {
+		gateway.DisconnectUser(u.ID, "account locked")
+	}
+
+	return sendJSON(c, u)
+}
+
+// AdminDisableUser disables or enables a user.
+// Disabled users may not log in, and are disconnected from the gateway.
+//
+// Path: /api/v1/admin/users/:id/disable
+// Method: POST
+// Legacy: POST /api/admin/user/disable, with "id" in the body
+// Authenticated as an administrator.
+// Body: JSON. Specify "disabled".
+func AdminDisableUser(c *mwr.Ctx) error {
+	admin, ok := isAdmin(c)
+	if !ok {
+		return api403(c, errNotAdmin)
+	}
+
+	data := struct {
+		ID int64 `param:"id"`
+		api.DisableUserRequest
+	}{}
+
+	if err := bind(c, &data); err != nil {
+		return api400(c, err)
+	}
+
+	u, err := adminUser(c, admin, data.ID)
+	if errors.Is(err, errSelf) {
+		return api400(c, err)
+	} else if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	u.Disabled = data.Disabled
+	return saveLocked(c, u)
+}
+
+// AdminLockUser prevents a user from logging in for some time.
+// Locked users are disconnected from the gateway.
+//
+// Path: /api/v1/admin/users/:id/lock
+// Method: POST
+// Legacy: POST /api/admin/user/lock, with "id" in the body
+// Authenticated as an administrator.
+// Body: JSON. Specify "duration", the amount of seconds to lock the user for.
+// A duration of zero unlocks the user.
+func AdminLockUser(c *mwr.Ctx) error {
+	admin, ok := isAdmin(c)
+	if !ok {
+		return api403(c, errNotAdmin)
+	}
+
+	data := struct {
+		ID int64 `param:"id"`
+		api.LockUserRequest
+	}{}
+
+	if err := bind(c, &data); err != nil {
+		return api400(c, err)
+	} else if data.Duration < 0 {
+		return api400(c)
+	}
+
+	u, err := adminUser(c, admin, data.ID)
+	if errors.Is(err, errSelf) {
+		return api400(c, err)
+	} else if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	u.LockedUntil = 0
+	if data.Duration > 0 {
+		u.LockedUntil = time.Now().Unix() + data.Duration
+	}
+	return saveLocked(c, u)
+}
+
+// AdminDeleteDevice deletes any device.
+// Its peers are notified, and it is disconnected from the gateway.
+//
+// Path: /api/v1/admin/devices/:id
+// Method: DELETE
+// Legacy: POST /api/admin/device/delete, with "id" in the body
+// Authenticated as an administrator.
+func AdminDeleteDevice(c *mwr.Ctx) error {
+	if _, ok := isAdmin(c); !ok {
+		return api403(c, errNotAdmin)
+	}
+
+	data := struct {
+		ID int64 `param:"id"`
+	}{}
+
+	if err := bind(c, &data); err != nil {
+		return api400(c, err)
+	} else if data.ID == 0 {
+		return api400(c)
+	}
+
+	dev, err := store.DeviceID(c.Context(), data.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	if err := removeDevice(c.Context(), dev); err != nil {
+		return api500(c, err)
+	}
+
+	return c.SendStatus(204)
+}
+
+// AdminDeviceRelay fetches the relay statistics of any device.
+//
+// Path: /api/v1/admin/devices/:id/relay
+// Method: GET
+// Authenticated as an administrator.
+func AdminDeviceRelay(c *mwr.Ctx) error {
+	if _, ok := isAdmin(c); !ok {
+		return api403(c, errNotAdmin)
+	}
+
+	data := struct {
+		ID int64 `param:"id"`
+	}{}
+
+	if err := bind(c, &data); err != nil {
+		return api400(c, err)
+	} else if data.ID == 0 {
+		return api400(c)
+	}
+
+	dev, err := store.DeviceID(c.Context(), data.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	st, ok := pprelay.Stats(dev.PublicKey)
+	return sendJSON(c, api.RelayStats{
+		Registered: ok,
+		TxBytes:    int64(st.TxBytes),
+		TxPackets:  int64(st.TxPackets),
+		RxBytes:    int64(st.RxBytes),
+		RxPackets:  int64(st.RxPackets),
+		Dropped:    int64(st.Dropped),
+	})
+}
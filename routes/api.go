@@ -7,11 +7,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/mca3/mwr"
+	"github.com/mca3/pikorv/api"
 	"github.com/mca3/pikorv/config"
 	"github.com/mca3/pikorv/db"
 
@@ -19,9 +20,19 @@ import (
 )
 
 var (
-	errNoAuth = errors.New("need authentication")
+	errNoAuth   = errors.New("need authentication")
+	errNotAdmin = errors.New("need administrator")
 )
 
+// store is where all routes get their data from.
+var store db.Store
+
+// SetStore sets the store used by all routes, and must be called before
+// serving any requests.
+func SetStore(s db.Store) {
+	store = s
+}
+
 // genApiError creates a function which is capable of sending predetermined
 // error messages to the client.
 func genApiError(code int, msg string) func(c *mwr.Ctx, e ...error) error {
@@ -39,11 +50,13 @@ var (
 	api400 = genApiError(400, "Bad Request")
 	api403 = genApiError(403, "Forbidden")
 	api404 = genApiError(404, "Not Found")
+	api405 = genApiError(405, "Method Not Allowed")
+	api409 = genApiError(409, "Conflict")
 	api500 = genApiError(500, "Internal Server Error")
 )
 
 // tryAuth decodes a token and attempts to authenticate as a user using it.
-func tryAuth(token string) (*db.User, bool) {
+func tryAuth(ctx context.Context, token string) (*db.User, bool) {
 	jtok, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
 		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
@@ -52,15 +65,32 @@ func tryAuth(token string) (*db.User, bool) {
 		return []byte(config.JWTSecret), nil
 	})
 	if err != nil {
-		log.Println(err)
+		// Only say why, so that nothing about the token ends up in
+		// the logs.
+		slog.DebugContext(ctx, "rejected token", "reason", tokenError(err))
 		return nil, false
 	} else if !jtok.Valid {
 		return nil, false
 	}
 
 	d := jtok.Claims.(jwt.MapClaims)["id"].(float64)
-	u, err := db.UserID(context.Background(), int64(d))
-	return &u, err == nil
+	u, err := store.UserID(ctx, int64(d))
+	return &u, err == nil && !u.Locked()
+}
+
+// tokenError describes why a token was rejected.
+func tokenError(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return "malformed"
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "expired"
+	case errors.Is(err, jwt.ErrTokenNotValidYet):
+		return "not valid yet"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return "invalid signature"
+	}
+	return "invalid"
 }
 
 // sendJSON encodes data as JSON and sends it to the client.
@@ -79,7 +109,7 @@ func isAuthed(c *mwr.Ctx) (*db.User, bool) {
 	// We're looking for the Authorization header or a cookie
 	val := c.Get("Authorization")
 	if val != "" {
-		return tryAuth(strings.TrimPrefix(val, "Bearer "))
+		return tryAuth(c.Context(), strings.TrimPrefix(val, "Bearer "))
 	}
 
 	// TODO: Try cookie. mwr has no support yet.
@@ -87,26 +117,29 @@ func isAuthed(c *mwr.Ctx) (*db.User, bool) {
 	return nil, false
 }
 
+// isAdmin determines if the client is authenticated as an administrator.
+func isAdmin(c *mwr.Ctx) (*db.User, bool) {
+	u, ok := isAuthed(c)
+	return u, ok && u.Admin
+}
+
 // apiAuth creates a token for the client from a username and password.
 // XXX: The token is a dummy token. Should be a JWT.
 //
-// Path: /api/auth
+// Path: /api/v1/auth
 // Method: POST
+// Legacy: POST /api/auth
 // Body: JSON. Must have the strings "username", and "password".
 func Auth(c *mwr.Ctx) error {
 	if c.Method() == "GET" {
-		resp := struct {
-			Methods []string `json:"methods"`
-		}{
+		resp := api.AuthMethods{
 			Methods: []string{
 				"username-password",
 			},
 		}
 		return sendJSON(c, resp)
 	}
-	data := struct {
-		Username, Password, Method string
-	}{}
+	data := api.AuthRequest{}
 
 	if err := c.BodyParser(&data); err != nil {
 		return api400(c, err)
@@ -118,11 +151,18 @@ func Auth(c *mwr.Ctx) error {
 		return api400(c)
 	}
 
-	uid := db.CheckPassword(c.Context(), data.Username, data.Password)
+	uid := store.CheckPassword(c.Context(), data.Username, data.Password)
 	if uid == -1 {
 		return api403(c) // TODO: Something proper
 	}
 
+	u, err := store.UserID(c.Context(), uid)
+	if err != nil {
+		return api500(c, err)
+	} else if u.Locked() {
+		return api403(c)
+	}
+
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"id":  uid,
 		"exp": time.Now().Add(time.Hour * 24 * 7).Unix(),
@@ -133,16 +173,22 @@ func Auth(c *mwr.Ctx) error {
 		return api500(c, err)
 	}
 
-	return sendJSON(c, struct {
-		Token string `json:"token"`
-	}{etoken})
+	return sendJSON(c, api.Token{Token: etoken})
 }
 
 // Punch returns a Pikopunch server for the client to connect to over
 // WireGuard.
 //
-// Path: /api/punch
+// The pikopunch service listens on "port" at "ip" once the tunnel is up.
+//
+// If enabled, the addresses of the pikopunch servers that may be probed to
+// classify the client's NAT are returned in "probe", and the addresses of
+// pikopunch servers that may be used without a tunnel are returned in
+// "public".
+//
+// Path: /api/v1/punch
 // Method: GET
+// Legacy: GET /api/punch
 // Authenticated.
 func Punch(c *mwr.Ctx) error {
 	_, ok := isAuthed(c)
@@ -150,13 +196,12 @@ func Punch(c *mwr.Ctx) error {
 		return api403(c, errNoAuth)
 	}
 
-	return sendJSON(c, struct {
-		Endpoint  string `json:"endpoint"`
-		PublicKey string `json:"public_key"`
-		IP        string `json:"ip"`
-	}{
-		fmt.Sprintf("%s:%d", config.OurIP, config.PunchPort),
-		config.PunchPublicKey,
-		config.PunchIP,
+	return sendJSON(c, api.Punch{
+		Endpoint:  fmt.Sprintf("%s:%d", config.OurIP, config.PunchPort),
+		PublicKey: config.PunchPublicKey,
+		IP:        config.PunchIP,
+		Port:      config.PunchService,
+		Probe:     publicAddrs(config.PunchProbe),
+		Public:    publicAddrs(config.PunchPublic),
 	})
 }
@@ -1,17 +1,29 @@
 package routes
 
 import (
-	"strconv"
+	"context"
+	"errors"
+	"log/slog"
+	"time"
 
 	"github.com/mca3/mwr"
+	"github.com/mca3/pikorv/api"
 	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/internal/pprelay"
+	"github.com/mca3/pikorv/internal/ppwg"
 	"github.com/mca3/pikorv/routes/gateway"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// maxKeyOverlap is the longest time peers may keep accepting an old public key
+// for after it was rotated.
+const maxKeyOverlap = time.Minute * 10
+
 // NewDevice creates a new device and attaches it to the user's account.
 //
-// Path: /api/new/device
+// Path: /api/v1/devices
 // Method: POST
+// Legacy: POST /api/new/device
 // Authenticated.
 // Body: JSON. Specify "name" and "key", where "key" is a WireGuard public key.
 func NewDevice(c *mwr.Ctx) error {
@@ -20,13 +32,11 @@ func NewDevice(c *mwr.Ctx) error {
 		return api403(c, errNoAuth)
 	}
 
-	data := struct {
-		Name, Key string
-	}{}
+	data := api.NewDeviceRequest{}
 
 	if err := c.BodyParser(&data); err != nil {
 		return api400(c, err)
-	} else if data.Name == "" || data.Key == "" {
+	} else if !validName(data.Name) || data.Key == "" {
 		return api400(c)
 	}
 
@@ -36,52 +46,176 @@ func NewDevice(c *mwr.Ctx) error {
 		PublicKey: data.Key,
 		IP:        genIPv6(),
 	}
-	if err := dev.Save(c.Context()); err != nil {
+	if err := store.SaveDevice(c.Context(), &dev); db.IsConflict(err) {
+		return api409(c, err)
+	} else if err != nil {
 		return api500(c, err)
 	}
 
 	return sendJSON(c, dev)
 }
 
-// ListDevices lists the devices on the user's account.
+// ListDevices lists the devices on the user's account, along with the
+// networks they are in, their tags, and whether they are connected to the
+// gateway.
 //
-// Path: /api/list/devices
+// The cursor of the next page, if there is one, is in the X-Next-Cursor
+// header.
+//
+// Path: /api/v1/devices
 // Method: GET
+// Legacy: GET /api/list/devices
 // Authenticated.
+// Query: prefix=<name prefix>, tag=<tag>, online=true|false, sort=id|name,
+// order=asc|desc, limit=<n>, cursor=<cursor>; all optional.
 func ListDevices(c *mwr.Ctx) error {
 	user, ok := isAuthed(c)
 	if !ok {
 		return api403(c, errNoAuth)
 	}
 
-	devs, err := db.Devices(c.Context(), user.ID)
+	o, err := listOptions(c)
+	if err != nil {
+		return api400(c, err)
+	}
+
+	do := db.DeviceOptions{ListOptions: peek(o), Tag: c.Query("tag")}
+
+	// Only the user's own devices, so the query doesn't grow with
+	// everyone else's.
+	online := gateway.OnlineDevices(user.ID)
+	switch c.Query("online") {
+	case "":
+	case "true":
+		do.Only = online
+	case "false":
+		do.Except = online
+	default:
+		return api400(c, errors.New("invalid online"))
+	}
+
+	devs, err := store.ListDevices(c.Context(), user.ID, do)
+	if err != nil {
+		return api500(c, err)
+	}
+	devs = nextPage(c, o, devs, func(d db.Device) (int64, string) { return d.ID, d.Name })
+
+	ids := make([]int64, len(devs))
+	for k, v := range devs {
+		ids[k] = v.ID
+	}
+
+	nws, err := store.DevicesNetworks(c.Context(), ids)
+	if err != nil {
+		return api500(c, err)
+	}
+
+	tags, err := store.DeviceTags(c.Context(), ids)
 	if err != nil {
 		return api500(c, err)
 	}
 
-	out := make([]struct {
-		db.Device
-		Networks []db.Network `json:"networks"`
-	}, len(devs))
+	isOnline := make(map[int64]bool, len(online))
+	for _, v := range online {
+		isOnline[v] = true
+	}
+
+	out := make([]api.ListedDevice, len(devs))
 
 	for k, v := range devs {
 		out[k].Device = v
-		nws, err := db.DeviceNetworks(c.Context(), v.ID)
-		if err != nil {
-			return api500(c, err)
+		out[k].Networks = nws[v.ID]
+		out[k].Tags = tags[v.ID]
+		if out[k].Tags == nil {
+			out[k].Tags = []string{}
 		}
-		out[k].Networks = nws
+		out[k].Online = isOnline[v.ID]
 	}
 
 	return sendJSON(c, out)
 }
 
+// UpdateDevice changes the settings of a device.
+// Peers are notified of the change.
+//
+// Path: /api/v1/devices/:id
+// Method: PATCH
+// Legacy: PATCH /api/device/update, with "id" in the body
+// Authenticated.
+// Body: JSON. Specify the fields to change, which may be "name" and "tags",
+// which replaces every tag of the device.
+func UpdateDevice(c *mwr.Ctx) error {
+	user, ok := isAuthed(c)
+	if !ok {
+		return api403(c, errNoAuth)
+	}
+
+	data := struct {
+		ID int64 `param:"id"`
+		api.UpdateDeviceRequest
+	}{}
+
+	if err := bind(c, &data); err != nil {
+		return api400(c, err)
+	} else if data.ID == 0 {
+		return api400(c)
+	} else if data.Name != nil && !validName(*data.Name) {
+		return api400(c)
+	}
+
+	if data.Tags != nil {
+		if len(*data.Tags) > maxTags {
+			return api400(c)
+		}
+		for _, v := range *data.Tags {
+			if !validTag(v) {
+				return api400(c)
+			}
+		}
+	}
+
+	dev, err := store.DeviceID(c.Context(), data.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	if dev.Owner != user.ID {
+		return api404(c)
+	}
+
+	if data.Name != nil {
+		dev.Name = *data.Name
+	}
+
+	if err := store.SaveDevice(c.Context(), &dev); db.IsConflict(err) {
+		return api409(c, err)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	if data.Tags != nil {
+		if err := store.SetDeviceTags(c.Context(), dev.ID, *data.Tags); err != nil {
+			return api500(c, err)
+		}
+	}
+
+	if data.Name != nil {
+		gateway.Notify(func() { gateway.OnDeviceRename(dev) })
+	} else {
+		gateway.Notify(func() { gateway.OnDeviceChange(dev) })
+	}
+
+	return sendJSON(c, dev)
+}
+
 // DeleteDevice deletes a device from the user's account.
 //
-// Path: /api/del/device
-// Method: POST
+// Path: /api/v1/devices/:id
+// Method: DELETE
+// Legacy: POST /api/del/device, with "id" in the body
 // Authenticated.
-// Body: JSON. Specify "id".
 func DeleteDevice(c *mwr.Ctx) error {
 	user, ok := isAuthed(c)
 	if !ok {
@@ -89,17 +223,19 @@ func DeleteDevice(c *mwr.Ctx) error {
 	}
 
 	data := struct {
-		ID int64
+		ID int64 `param:"id"`
 	}{}
 
-	if err := c.BodyParser(&data); err != nil {
+	if err := bind(c, &data); err != nil {
 		return api400(c, err)
 	} else if data.ID == 0 {
 		return api400(c)
 	}
 
-	dev, err := db.DeviceID(c.Context(), data.ID)
-	if err != nil {
+	dev, err := store.DeviceID(c.Context(), data.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
 		return api500(c, err)
 	}
 
@@ -107,20 +243,48 @@ func DeleteDevice(c *mwr.Ctx) error {
 		return api404(c)
 	}
 
-	if err := dev.Delete(c.Context()); err != nil {
+	if err := removeDevice(c.Context(), dev); err != nil {
 		return api500(c, err)
 	}
 
-	// TODO: Notify networks
-
 	return c.SendStatus(204)
 }
 
+// removeDevice deletes dev.
+//
+// It is removed from its networks first so that its peers can be told it is
+// gone, and it is removed as a WireGuard peer and from the relay.
+func removeDevice(ctx context.Context, dev db.Device) error {
+	nws, err := store.DeviceNetworks(ctx, dev.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, nw := range nws {
+		if err := store.NetworkRemove(ctx, nw.ID, dev.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := store.DeleteDevice(ctx, dev.ID); err != nil {
+		return err
+	}
+
+	gateway.Notify(func() { gateway.OnDeviceDelete(dev, nws) })
+
+	if err := ppwg.RemovePeer(dev); err != nil {
+		slog.ErrorContext(ctx, "failed to remove WireGuard peer", "device_id", dev.ID, "error", err)
+	}
+	pprelay.Forget(dev.PublicKey)
+
+	return nil
+}
+
 // DeviceInfo fetches info for a specific device
 //
-// Path: /api/device/info
-// Query: id=<device id>
+// Path: /api/v1/devices/:id
 // Method: GET
+// Legacy: GET /api/device/info?id=<device id>
 // Authenticated.
 func DeviceInfo(c *mwr.Ctx) error {
 	user, ok := isAuthed(c)
@@ -128,20 +292,72 @@ func DeviceInfo(c *mwr.Ctx) error {
 		return api403(c, errNoAuth)
 	}
 
-	sid := c.Query("id")
-	if sid == "" {
-		// Need to specify ID
+	data := struct {
+		ID int64 `param:"id"`
+	}{}
+
+	if err := bind(c, &data); err != nil {
+		return api400(c, err)
+	} else if data.ID == 0 {
+		return api400(c)
+	}
+
+	dev, err := store.DeviceID(c.Context(), data.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	if dev.Owner != user.ID {
+		return api404(c)
+	}
+
+	return sendJSON(c, dev)
+}
+
+// RotateDeviceKey replaces the WireGuard public key of a device.
+// The device keeps its IP and network memberships.
+//
+// Path: /api/v1/devices/:id/rotate-key
+// Method: POST
+// Legacy: POST /api/device/rotate-key, with "id" in the body
+// Authenticated.
+// Body: JSON. Specify "key", the new WireGuard public key. "overlap" may
+// optionally be specified as the amount of seconds the peers of the device
+// may keep accepting the old key for, up to ten minutes. It only changes what
+// the peers are told; the server itself stops accepting the old key right
+// away.
+func RotateDeviceKey(c *mwr.Ctx) error {
+	user, ok := isAuthed(c)
+	if !ok {
+		return api403(c, errNoAuth)
+	}
+
+	data := struct {
+		ID int64 `param:"id"`
+		api.RotateKeyRequest
+	}{}
+
+	if err := bind(c, &data); err != nil {
+		return api400(c, err)
+	} else if data.ID == 0 || data.Key == "" || data.Overlap < 0 {
 		return api400(c)
 	}
 
-	id, err := strconv.ParseInt(sid, 10, 64)
-	if err != nil || id <= 0 {
-		// Bad ID
+	if _, err := wgtypes.ParseKey(data.Key); err != nil {
 		return api400(c, err)
 	}
 
-	dev, err := db.DeviceID(c.Context(), id)
-	if err != nil {
+	overlap := time.Duration(data.Overlap) * time.Second
+	if overlap > maxKeyOverlap {
+		return api400(c)
+	}
+
+	dev, err := store.DeviceID(c.Context(), data.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
 		return api500(c, err)
 	}
 
@@ -149,15 +365,46 @@ func DeviceInfo(c *mwr.Ctx) error {
 		return api404(c)
 	}
 
+	if dev.PublicKey == data.Key {
+		// Nothing to rotate
+		return api400(c)
+	}
+
+	oldKey := dev.PublicKey
+	dev.PublicKey = data.Key
+	if err := store.SaveDevice(c.Context(), &dev); db.IsConflict(err) {
+		return api409(c, err)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	if err := ppwg.RotatePeer(dev, oldKey); err != nil {
+		return api500(c, err)
+	}
+	pprelay.Forget(oldKey)
+
+	var expires time.Time
+	if overlap > 0 {
+		expires = time.Now().Add(overlap)
+	}
+
+	gateway.Notify(func() { gateway.OnDeviceKeyRotate(dev, oldKey, expires) })
+
 	return sendJSON(c, dev)
 }
 
 // DeviceJoin joins a device to a network.
 //
-// Path: /api/device/join
-// Method: POST
+// Devices may join networks owned by other users if the network requires
+// approval. In that case, the device is only added once the network owner
+// approves it, and 202 is returned.
+//
+// Joining again changes nothing, and gets the same response.
+//
+// Path: /api/v1/networks/:network/devices/:device
+// Method: PUT
+// Legacy: POST /api/device/join, with "device" and "network" in the body
 // Authenticated.
-// Body: JSON. Specify "device" and "network".
 func DeviceJoin(c *mwr.Ctx) error {
 	user, ok := isAuthed(c)
 	if !ok {
@@ -165,17 +412,20 @@ func DeviceJoin(c *mwr.Ctx) error {
 	}
 
 	data := struct {
-		Device, Network int64
+		Device  int64 `param:"device"`
+		Network int64 `param:"network"`
 	}{}
 
-	if err := c.BodyParser(&data); err != nil {
+	if err := bind(c, &data); err != nil {
 		return api400(c, err)
 	} else if data.Device == 0 || data.Network == 0 {
 		return api400(c)
 	}
 
-	dev, err := db.DeviceID(c.Context(), data.Device)
-	if err != nil {
+	dev, err := store.DeviceID(c.Context(), data.Device)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
 		return api500(c, err)
 	}
 
@@ -183,30 +433,65 @@ func DeviceJoin(c *mwr.Ctx) error {
 		return api404(c)
 	}
 
-	nw, err := db.NetworkID(c.Context(), data.Network)
-	if err != nil {
+	nw, err := store.NetworkID(c.Context(), data.Network)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
 		return api500(c, err)
 	}
 
 	if nw.Owner != user.ID {
-		return api404(c)
+		if !nw.Approval {
+			return api404(c)
+		}
+
+		if err := store.NetworkRequest(c.Context(), nw.ID, dev.ID); db.IsConflict(err) {
+			return joined(c, nw.ID, dev.ID)
+		} else if err != nil {
+			return api500(c, err)
+		}
+
+		gateway.Notify(func() { gateway.OnJoinRequest(dev, nw) })
+
+		return c.SendStatus(202)
 	}
 
-	if err := nw.Add(c.Context(), dev.ID); err != nil {
+	if err := store.NetworkAdd(c.Context(), nw.ID, dev.ID); db.IsConflict(err) {
+		return joined(c, nw.ID, dev.ID)
+	} else if err != nil {
 		return api500(c, err)
 	}
 
-	go gateway.OnNetworkJoin(dev, nw)
+	gateway.Notify(func() { gateway.OnNetworkJoin(dev, nw) })
+
+	return c.SendStatus(204)
+}
+
+// joined answers a request to join a network which the device is already in,
+// or has already asked to join.
+func joined(c *mwr.Ctx, nwid, devid int64) error {
+	status, err := store.NetworkStatus(c.Context(), nwid, devid)
+	if errors.Is(err, db.ErrNotFound) {
+		// It left in the meantime.
+		return api409(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
 
+	if status == db.MemberPending {
+		return c.SendStatus(202)
+	}
 	return c.SendStatus(204)
 }
 
-// DeviceLeave removes a device from a network.
+// DeviceLeave removes a device from a network, or withdraws its request to
+// join one.
+// Either the device owner or the network owner may do this.
 //
-// Path: /api/device/leave
-// Method: POST
+// Path: /api/v1/networks/:network/devices/:device
+// Method: DELETE
+// Legacy: POST /api/device/leave, with "device" and "network" in the body
 // Authenticated.
-// Body: JSON. Specify "device" and "network".
 func DeviceLeave(c *mwr.Ctx) error {
 	user, ok := isAuthed(c)
 	if !ok {
@@ -214,38 +499,50 @@ func DeviceLeave(c *mwr.Ctx) error {
 	}
 
 	data := struct {
-		Device, Network int64
+		Device  int64 `param:"device"`
+		Network int64 `param:"network"`
 	}{}
 
-	if err := c.BodyParser(&data); err != nil {
+	if err := bind(c, &data); err != nil {
 		return api400(c, err)
 	} else if data.Device == 0 || data.Network == 0 {
 		return api400(c)
 	}
 
-	dev, err := db.DeviceID(c.Context(), data.Device)
-	if err != nil {
+	dev, err := store.DeviceID(c.Context(), data.Device)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
 		return api500(c, err)
 	}
 
-	if dev.Owner != user.ID {
+	nw, err := store.NetworkID(c.Context(), data.Network)
+	if errors.Is(err, db.ErrNotFound) {
 		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
 	}
 
-	nw, err := db.NetworkID(c.Context(), data.Network)
-	if err != nil {
-		return api500(c, err)
+	if dev.Owner != user.ID && nw.Owner != user.ID {
+		return api404(c)
 	}
 
-	if nw.Owner != user.ID {
+	status, err := store.NetworkStatus(c.Context(), nw.ID, dev.ID)
+	if errors.Is(err, db.ErrNotFound) {
 		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
 	}
 
-	if err := nw.Remove(c.Context(), dev.ID); err != nil {
+	if err := store.NetworkRemove(c.Context(), nw.ID, dev.ID); err != nil {
 		return api500(c, err)
 	}
 
-	go gateway.OnNetworkLeave(dev, nw)
+	if status == db.MemberPending {
+		gateway.Notify(func() { gateway.OnJoinRequestRemoved(dev, nw) })
+	} else {
+		gateway.Notify(func() { gateway.OnNetworkLeave(dev, nw) })
+	}
 
 	return c.SendStatus(204)
 }
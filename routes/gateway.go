@@ -1,14 +1,24 @@
 package routes
 
 import (
+	"errors"
 	"net/http"
 	"net/netip"
 
 	"github.com/mca3/mwr"
+	"github.com/mca3/pikorv/api"
+	"github.com/mca3/pikorv/db"
 	"github.com/mca3/pikorv/routes/gateway"
 	"nhooyr.io/websocket"
 )
 
+// Gateway upgrades the connection to a websocket, over which the client is
+// told about changes to its networks and peers.
+//
+// Path: /api/v1/gateway
+// Method: GET
+// Legacy: GET /api/gateway
+// Authenticated.
 func Gateway(c *mwr.Ctx) error {
 	user, ok := isAuthed(c)
 	if !ok {
@@ -18,7 +28,7 @@ func Gateway(c *mwr.Ctx) error {
 	return c.Hijack(func(w http.ResponseWriter, r *http.Request) {
 		addr := netip.MustParseAddrPort(r.RemoteAddr)
 
-		c, err := websocket.Accept(w, r, nil)
+		c, err := websocket.Accept(w, r, gateway.AcceptOptions())
 		if err != nil { // fail
 			return
 		}
@@ -27,3 +37,68 @@ func Gateway(c *mwr.Ctx) error {
 		gateway.Accept(r.Context(), c, user, addr)
 	})
 }
+
+// GatewayEvents streams gateway messages to a device as server-sent events,
+// for clients which can't use websockets.
+//
+// Path: /api/v1/gateway/events
+// Method: GET
+// Authenticated.
+// Query: device=<device id>
+func GatewayEvents(c *mwr.Ctx) error {
+	user, ok := isAuthed(c)
+	if !ok {
+		return api403(c, errNoAuth)
+	}
+
+	data := struct {
+		Device int64 `param:"device"`
+	}{}
+
+	if err := bind(c, &data); err != nil {
+		return api400(c, err)
+	} else if data.Device == 0 {
+		return api400(c)
+	}
+
+	dev, err := store.DeviceID(c.Context(), data.Device)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && dev.Owner != user.ID) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	return c.Hijack(func(w http.ResponseWriter, r *http.Request) {
+		gateway.Events(r.Context(), w, user, netip.MustParseAddrPort(r.RemoteAddr), dev)
+	})
+}
+
+// GatewayPing updates the endpoint and NAT of a device, like pings sent over
+// the gateway.
+//
+// Path: /api/v1/gateway/ping
+// Method: POST
+// Authenticated.
+// Body: JSON. A ping message, with "device_id" set.
+func GatewayPing(c *mwr.Ctx) error {
+	user, ok := isAuthed(c)
+	if !ok {
+		return api403(c, errNoAuth)
+	}
+
+	msg := api.Message{}
+	if err := c.BodyParser(&msg); err != nil {
+		return api400(c, err)
+	}
+
+	switch perr := gateway.Ping(c.Context(), user, msg); {
+	case perr == nil:
+		return c.SendStatus(204)
+	case perr.Code == api.ErrUnknownDevice:
+		return api404(c)
+	case perr.Code == api.ErrInternal:
+		return api500(c, perr)
+	default:
+		return api400(c, perr)
+	}
+}
@@ -2,47 +2,55 @@ package gateway
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/netip"
 	"sync"
 	"time"
 
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 
+	"github.com/mca3/pikorv/api"
+	"github.com/mca3/pikorv/config"
 	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/internal/pprelay"
+	"github.com/mca3/pikorv/punch"
 )
 
-type gatewayMsgType int
+// store is where the gateway looks up devices and networks.
+var store db.Store
 
-type gatewayMsg struct {
-	Type gatewayMsgType
+// SetStore sets the store used by the gateway, and must be called before any
+// clients connect.
+func SetStore(s db.Store) {
+	store = s
+}
 
-	Device  *db.Device  `json:"device,omitempty"`
-	Network *db.Network `json:"network,omitempty"`
-	Remove  bool
+// transport is how messages are delivered to a client.
+type transport interface {
+	// write sends v to the client.
+	write(ctx context.Context, v any) error
 
-	Endpoint  string `json:"endpoint,omitempty"`
-	DeviceID  int64  `json:"device_id,omitempty"`
-	NetworkID int64  `json:"network_id,omitempty"`
+	// close disconnects the client, waiting for it to respond.
+	close(reason string)
 }
 
 type gatewayClient struct {
-	u  *db.User
-	c  *websocket.Conn
-	d  int64
-	ip netip.Addr
+	id    int64
+	u     *db.User
+	t     transport
+	d     int64
+	ip    netip.Addr
+	since time.Time
+
+	// legacy is set once the client spoke the legacy protocol, and is only
+	// changed before the client is identified.
+	legacy bool
 
 	sync.Mutex
 }
 
-const (
-	gatewayPing gatewayMsgType = iota
-	gatewayNetworkJoin
-	gatewayNetworkLeave
-	gatewayDevUpdate
-)
-
 const (
 	sendTimeout = time.Second * 15
 	// recvTimeout = time.Minute*5
@@ -51,6 +59,10 @@ const (
 var (
 	gatewayClients = []*gatewayClient{}
 	gwcMu          = sync.RWMutex{}
+
+	// lastConnID is the ID of the last client to connect.
+	// gwcMu guards it.
+	lastConnID int64
 )
 
 // findGatewayDevice tries to find dev as a gateway client.
@@ -66,19 +78,23 @@ func findGatewayDevice(dev int64) *gatewayClient {
 	return nil
 }
 
-func Accept(ctx context.Context, c *websocket.Conn, user *db.User, addr netip.AddrPort) {
+// register adds a client to the gateway, returning a function which removes
+// it.
+func register(user *db.User, t transport, addr netip.AddrPort) (*gatewayClient, func()) {
 	gc := &gatewayClient{
-		u:  user,
-		c:  c,
-		ip: addr.Addr(),
+		u:     user,
+		t:     t,
+		ip:    addr.Addr(),
+		since: time.Now(),
 	}
 
 	gwcMu.Lock()
+	lastConnID++
+	gc.id = lastConnID
 	gatewayClients = append(gatewayClients, gc)
 	gwcMu.Unlock()
 
-	// Clean up after ourselves
-	defer func() {
+	return gc, func() {
 		gwcMu.Lock()
 		for i, v := range gatewayClients {
 			if v == gc {
@@ -88,59 +104,225 @@ func Accept(ctx context.Context, c *websocket.Conn, user *db.User, addr netip.Ad
 			}
 		}
 		gwcMu.Unlock()
-	}()
+	}
+}
+
+// Accept serves a client connected over a websocket until it disconnects.
+func Accept(ctx context.Context, c *websocket.Conn, user *db.User, addr netip.AddrPort) {
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	ws := &wsTransport{c: c, codec: codecs[c.Subprotocol()]}
+
+	gc, unregister := register(user, ws, addr)
+	defer unregister()
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	for {
-		msg, err := gc.Read(ctx)
-		if err != nil {
-			log.Println(err)
+		msg, err := gc.read(ctx, ws)
+
+		var perr *api.ProtocolError
+		if errors.As(err, &perr) {
+			gc.fail(ctx, perr)
+			continue
+		} else if err != nil {
+			// Clients disconnecting is nothing unusual.
+			gc.logger().DebugContext(ctx, "gateway client disconnected", "error", err)
 			return
 		}
 
-		gc.handle(ctx, &msg)
+		if perr := gc.handle(ctx, &msg); perr != nil {
+			gc.fail(ctx, perr)
+		}
 	}
-
-	c.Close(websocket.StatusNormalClosure, "")
 }
 
-func (gc *gatewayClient) handle(ctx context.Context, msg *gatewayMsg) {
-	gc.Lock()
-	defer gc.Unlock()
-
+// handle handles a message from the client, returning the error to send back
+// if it couldn't.
+func (gc *gatewayClient) handle(ctx context.Context, msg *api.Message) *api.ProtocolError {
 	switch msg.Type {
-	case gatewayPing:
-		if msg.DeviceID <= 0 || msg.Endpoint == "" {
-			return
-		}
+	case api.MessageHello:
+		return gc.hello(ctx, msg)
+	case api.MessagePing:
+		return gc.ping(ctx, msg)
+	}
 
-		dev, err := db.DeviceID(ctx, msg.DeviceID)
-		if err != nil || dev.Owner != gc.u.ID {
-			return
+	return &api.ProtocolError{
+		Code:    api.ErrUnexpected,
+		Message: fmt.Sprintf("cannot handle messages of type %q", msg.Type),
+	}
+}
+
+// hello identifies the client, and tells it what the server can do.
+func (gc *gatewayClient) hello(ctx context.Context, msg *api.Message) *api.ProtocolError {
+	if gc.d != 0 {
+		return &api.ProtocolError{Code: api.ErrAlreadyIdentified}
+	} else if msg.Version != api.ProtocolVersion {
+		return &api.ProtocolError{
+			Code:    api.ErrUnsupportedVersion,
+			Message: fmt.Sprintf("only version %d is supported", api.ProtocolVersion),
 		}
+	}
 
+	dev, perr := device(ctx, gc.u, msg.DeviceID)
+	if perr != nil {
+		return perr
+	}
+
+	// Nothing else may be sent before the reply, so it is sent before the
+	// client can be found.
+	err := gc.send(ctx, api.Message{
+		Type:         api.MessageReady,
+		Version:      api.ProtocolVersion,
+		Capabilities: capabilities(),
+	})
+	if err != nil {
+		gc.logger().WarnContext(ctx, "failed to send ready", "error", err)
+		return nil
+	}
+
+	gc.identify(dev)
+	return update(ctx, dev, msg)
+}
+
+// ping updates the endpoint and NAT of the client.
+//
+// Clients using the legacy protocol identify themselves with their first
+// ping, and may update any of their user's devices.
+func (gc *gatewayClient) ping(ctx context.Context, msg *api.Message) *api.ProtocolError {
+	if !gc.legacy {
 		if gc.d == 0 {
-			gc.d = dev.ID
+			return &api.ProtocolError{Code: api.ErrNotIdentified}
+		} else if msg.DeviceID != 0 && msg.DeviceID != gc.d {
+			return &api.ProtocolError{
+				Code:    api.ErrUnknownDevice,
+				Message: "pings must be for the device which said hello",
+			}
 		}
+		msg.DeviceID = gc.d
+	}
 
-		// TODO: Sanity checking
-		if dev.Endpoint == msg.Endpoint {
-			return
+	if msg.Endpoint == "" && msg.NAT == "" {
+		return nil
+	}
+
+	dev, perr := device(ctx, gc.u, msg.DeviceID)
+	if perr != nil {
+		return perr
+	}
+
+	if gc.d == 0 {
+		gc.identify(dev)
+	}
+
+	return update(ctx, dev, msg)
+}
+
+// device fetches a device of user.
+func device(ctx context.Context, user *db.User, id int64) (db.Device, *api.ProtocolError) {
+	dev, err := store.DeviceID(ctx, id)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && dev.Owner != user.ID) {
+		return dev, &api.ProtocolError{Code: api.ErrUnknownDevice}
+	} else if err != nil {
+		slog.ErrorContext(ctx, "failed to look up device", "user_id", user.ID, "device_id", id, "error", err)
+		return dev, &api.ProtocolError{Code: api.ErrInternal}
+	}
+	return dev, nil
+}
+
+// identify sets the device of the client, after which it is sent messages
+// about it.
+func (gc *gatewayClient) identify(dev db.Device) {
+	gwcMu.Lock()
+	gc.Lock()
+	gc.d = dev.ID
+	gc.Unlock()
+	gwcMu.Unlock()
+
+	// Now that we know who they are, they can have their DNS records and
+	// be told about the relay.
+	go pushRecords(dev)
+	go advertiseRelay(dev)
+}
+
+// update saves the endpoint and NAT given in msg.
+func update(ctx context.Context, dev db.Device, msg *api.Message) *api.ProtocolError {
+	if msg.NAT != "" && !punch.NAT(msg.NAT).Valid() {
+		return &api.ProtocolError{
+			Code:    api.ErrMalformed,
+			Message: fmt.Sprintf("invalid NAT %q", msg.NAT),
 		}
+	}
 
+	changed := false
+
+	// TODO: Sanity checking
+	if msg.Endpoint != "" && dev.Endpoint != msg.Endpoint {
 		dev.Endpoint = msg.Endpoint
-		if err := dev.Save(ctx); err != nil {
-			return
-		}
+		changed = true
+	}
+
+	if msg.NAT != "" && dev.NAT != msg.NAT {
+		dev.NAT = msg.NAT
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if err := store.SaveDevice(ctx, &dev); err != nil {
+		slog.ErrorContext(ctx, "failed to save device", "user_id", dev.Owner, "device_id", dev.ID, "error", err)
+		return &api.ProtocolError{Code: api.ErrInternal}
+	}
+
+	OnDeviceChange(dev)
+	return nil
+}
 
-		OnDeviceChange(dev)
+// fail tells the client that its message couldn't be handled.
+// Clients using the legacy protocol don't know about errors, so they are only
+// logged.
+func (gc *gatewayClient) fail(ctx context.Context, perr *api.ProtocolError) {
+	if gc.legacy {
+		gc.logger().InfoContext(ctx, "legacy gateway client sent a bad message", "error", perr)
+		return
 	}
+
+	if err := gc.send(ctx, api.Message{Type: api.MessageError, Error: perr}); err != nil {
+		gc.logger().WarnContext(ctx, "failed to send error", "error", err)
+	}
+}
+
+// logger returns a logger which says which user the client is, and which
+// device once it is identified.
+func (gc *gatewayClient) logger() *slog.Logger {
+	gc.Lock()
+	d := gc.d
+	gc.Unlock()
+
+	l := slog.With("user_id", gc.u.ID)
+	if d != 0 {
+		l = l.With("device_id", d)
+	}
+	return l
+}
+
+// capabilities lists the optional features which are enabled.
+func capabilities() []string {
+	caps := []string{}
+	if config.DNSListen != "" {
+		caps = append(caps, api.CapabilityDNS)
+	}
+	if pprelay.Enabled() {
+		caps = append(caps, api.CapabilityRelay)
+	}
+	return caps
 }
 
 // Send queues msg to be sent.
-func (gc *gatewayClient) Send(msg gatewayMsg) {
+func (gc *gatewayClient) Send(msg api.Message) {
 	sendChan <- sendReq{
 		Device: gc.d,
 		Msg:    msg,
@@ -150,19 +332,53 @@ func (gc *gatewayClient) Send(msg gatewayMsg) {
 // send immediately sends a message to the client instead of queuing it to be
 // sent.
 // You shouldn't use this method unless you're working with a worker.
-func (gc *gatewayClient) send(ctx context.Context, msg gatewayMsg) error {
+func (gc *gatewayClient) send(ctx context.Context, msg api.Message) error {
 	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
 	defer cancel()
 
-	return wsjson.Write(ctx, gc.c, msg)
+	if gc.legacy {
+		lm, ok := toLegacy(msg)
+		if !ok {
+			return nil
+		}
+		return gc.t.write(ctx, lm)
+	}
+
+	return gc.t.write(ctx, msg)
 }
 
-// Read reads a message from the client.
-func (gc *gatewayClient) Read(ctx context.Context) (gatewayMsg, error) {
+// read reads a message from a client connected over a websocket.
+//
+// Messages which can't be decoded are returned as a *api.ProtocolError, after
+// which the client may send more.
+func (gc *gatewayClient) read(ctx context.Context, ws *wsTransport) (api.Message, error) {
 	// ctx, cancel := context.WithTimeout(ctx, recvTimeout)
 	// defer cancel()
 
-	msg := gatewayMsg{}
-	err := wsjson.Read(ctx, gc.c, &msg)
-	return msg, err
+	typ, b, err := ws.c.Read(ctx)
+	if err != nil {
+		return api.Message{}, err
+	} else if typ != ws.codec.typ {
+		return api.Message{}, &api.ProtocolError{
+			Code:    api.ErrMalformed,
+			Message: fmt.Sprintf("expected a %v message", ws.codec.typ),
+		}
+	}
+
+	// Clients which never said hello speak the legacy protocol, which
+	// predates subprotocols.
+	if gc.d == 0 && !gc.legacy && ws.c.Subprotocol() == "" && isLegacy(b) {
+		gc.legacy = true
+	}
+
+	msg := api.Message{}
+	if gc.legacy {
+		msg, err = decodeLegacy(b)
+	} else {
+		err = ws.codec.unmarshal(b, &msg)
+	}
+	if err != nil {
+		return msg, &api.ProtocolError{Code: api.ErrMalformed, Message: err.Error()}
+	}
+	return msg, nil
 }
@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+	"nhooyr.io/websocket"
+
+	"github.com/mca3/pikorv/api"
+	"github.com/mca3/pikorv/config"
+)
+
+// codec encodes the messages of a connection.
+type codec struct {
+	typ       websocket.MessageType
+	marshal   func(v any) ([]byte, error)
+	unmarshal func(b []byte, v any) error
+}
+
+var (
+	jsonCodec = codec{websocket.MessageText, json.Marshal, json.Unmarshal}
+	cborCodec = codec{websocket.MessageBinary, cbor.Marshal, cbor.Unmarshal}
+)
+
+// codecs holds the codec of each subprotocol.
+// Clients which didn't ask for one are sent JSON.
+var codecs = map[string]codec{
+	"":                  jsonCodec,
+	api.SubprotocolJSON: jsonCodec,
+	api.SubprotocolCBOR: cborCodec,
+}
+
+// wsTransport delivers messages over a websocket.
+type wsTransport struct {
+	c     *websocket.Conn
+	codec codec
+}
+
+func (ws *wsTransport) write(ctx context.Context, v any) error {
+	b, err := ws.codec.marshal(v)
+	if err != nil {
+		return err
+	}
+	return ws.c.Write(ctx, ws.codec.typ, b)
+}
+
+func (ws *wsTransport) close(reason string) {
+	ws.c.Close(websocket.StatusPolicyViolation, reason)
+}
+
+// AcceptOptions returns the options to accept gateway connections with.
+//
+// The most compact subprotocol the client asks for is picked, and messages are
+// compressed if the client supports it.
+func AcceptOptions() *websocket.AcceptOptions {
+	mode := websocket.CompressionContextTakeover
+	switch config.GatewayCompression {
+	case "disabled":
+		mode = websocket.CompressionDisabled
+	case "message":
+		mode = websocket.CompressionNoContextTakeover
+	}
+
+	return &websocket.AcceptOptions{
+		Subprotocols:    []string{api.SubprotocolCBOR, api.SubprotocolJSON},
+		CompressionMode: mode,
+	}
+}
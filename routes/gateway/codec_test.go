@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+
+	"github.com/mca3/pikorv/api"
+)
+
+// benchMessages are typical messages sent over the gateway.
+var benchMessages = []struct {
+	name string
+	msg  api.Message
+}{
+	{"ping", api.Message{
+		Type:     api.MessagePing,
+		DeviceID: 1234,
+		Endpoint: "[2001:db8::1]:51820",
+		NAT:      "cone",
+	}},
+	{"device_update", api.Message{
+		Type: api.MessageDeviceUpdate,
+		Device: &api.Device{
+			ID:        1234,
+			Owner:     56,
+			Name:      "raspberry-pi",
+			PublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+			IP:        "fd00:1234:5678:9abc:def0:1234:5678:9abc",
+			Endpoint:  "[2001:db8::1]:51820",
+			NAT:       "cone",
+		},
+	}},
+	{"dns_records", api.Message{
+		Type: api.MessageDNSRecords,
+		Records: []api.DNSRecord{
+			{Name: "laptop.alice.pikonet.", IP: "fd00:1234:5678:9abc:def0:1234:5678:9abc"},
+			{Name: "phone.alice.pikonet.", IP: "fd00:1234:5678:9abc:def0:1234:5678:9abd"},
+			{Name: "raspberry-pi.alice.pikonet.", IP: "fd00:1234:5678:9abc:def0:1234:5678:9abe"},
+		},
+	}},
+}
+
+// BenchmarkCodecs compares the encodings of gateway messages, reporting the
+// size of each message on its own and when compressed like permessage-deflate
+// does without context takeover.
+func BenchmarkCodecs(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		codec
+	}{
+		{"json", jsonCodec},
+		{"cbor", cborCodec},
+	} {
+		for _, m := range benchMessages {
+			name, msg := m.name, m.msg
+
+			b.Run(c.name+"/"+name+"/encode", func(b *testing.B) {
+				var out []byte
+				for i := 0; i < b.N; i++ {
+					out, _ = c.marshal(msg)
+				}
+				b.ReportMetric(float64(len(out)), "bytes/msg")
+				b.ReportMetric(float64(deflated(b, out)), "deflated-bytes/msg")
+			})
+
+			b.Run(c.name+"/"+name+"/decode", func(b *testing.B) {
+				in, err := c.marshal(msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var out api.Message
+					if err := c.unmarshal(in, &out); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// deflated returns the size of b once compressed.
+func deflated(tb testing.TB, b []byte) int {
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	w.Write(b)
+	w.Close()
+
+	return buf.Len()
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, c := range []codec{jsonCodec, cborCodec} {
+		for _, m := range benchMessages {
+			name, msg := m.name, m.msg
+
+			b, err := c.marshal(msg)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			var out api.Message
+			if err := c.unmarshal(b, &out); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			again, _ := c.marshal(out)
+			if !bytes.Equal(b, again) {
+				t.Fatalf("%s: round trip changed the message", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mca3/pikorv/api"
+	"github.com/mca3/pikorv/db"
+)
+
+// Connections returns the live gateway connections selected by o, whose names
+// are the usernames of their users.
+//
+// Connections are always sorted by ID, as several of them may have the same
+// name.
+func Connections(o db.ListOptions) []api.Connection {
+	gwcMu.RLock()
+	defer gwcMu.RUnlock()
+
+	conns := []api.Connection{}
+	for _, v := range gatewayClients {
+		v.Lock()
+		c := api.Connection{
+			ID:       v.id,
+			User:     v.u.ID,
+			Username: v.u.Username,
+			IP:       v.ip.String(),
+			Since:    v.since.Unix(),
+			Device:   v.d,
+		}
+		v.Unlock()
+
+		if !strings.HasPrefix(c.Username, o.Prefix) {
+			continue
+		} else if o.After != nil && o.Desc && c.ID >= o.After.ID {
+			continue
+		} else if o.After != nil && !o.Desc && c.ID <= o.After.ID {
+			continue
+		}
+
+		conns = append(conns, c)
+	}
+
+	sort.Slice(conns, func(i, j int) bool {
+		if o.Desc {
+			return conns[i].ID > conns[j].ID
+		}
+		return conns[i].ID < conns[j].ID
+	})
+
+	if o.Limit > 0 && len(conns) > o.Limit {
+		conns = conns[:o.Limit]
+	}
+	return conns
+}
+
+// Stats describes the connections to the gateway and the queue of messages to
+// send them.
+type Stats struct {
+	// Connections counts the open connections by transport, which is
+	// "websocket" or "events".
+	Connections map[string]int
+
+	// Queued is the amount of messages waiting for a worker, out of
+	// QueueSize.
+	Queued, QueueSize int
+
+	// Sent and Dropped count the messages workers have sent, and those
+	// which couldn't be sent.
+	Sent, Dropped uint64
+}
+
+// CurrentStats returns the current statistics of the gateway.
+func CurrentStats() Stats {
+	st := Stats{
+		Connections: map[string]int{"websocket": 0, "events": 0},
+		Queued:      len(sendChan),
+		QueueSize:   cap(sendChan),
+		Sent:        sent.Load(),
+		Dropped:     dropped.Load(),
+	}
+
+	gwcMu.RLock()
+	defer gwcMu.RUnlock()
+
+	for _, v := range gatewayClients {
+		switch v.t.(type) {
+		case *wsTransport:
+			st.Connections["websocket"]++
+		case *sseTransport:
+			st.Connections["events"]++
+		}
+	}
+	return st
+}
+
+// disconnect closes every connection for which match returns true.
+func disconnect(reason string, match func(gc *gatewayClient) bool) {
+	gwcMu.RLock()
+	defer gwcMu.RUnlock()
+
+	for _, v := range gatewayClients {
+		v.Lock()
+		ok := match(v)
+		v.Unlock()
+
+		if ok {
+			// Closing waits for the client to respond.
+			go v.t.close(reason)
+		}
+	}
+}
+
+// DisconnectUser closes every gateway connection of the user.
+func DisconnectUser(id int64, reason string) {
+	disconnect(reason, func(gc *gatewayClient) bool {
+		return gc.u.ID == id
+	})
+}
+
+// DisconnectDevice closes the gateway connection of the device, if it is
+// connected.
+func DisconnectDevice(id int64, reason string) {
+	disconnect(reason, func(gc *gatewayClient) bool {
+		return gc.d == id
+	})
+}
+
+// OnlineDevices returns the IDs of the devices of the user which are
+// connected to the gateway and have identified themselves.
+func OnlineDevices(user int64) []int64 {
+	gwcMu.RLock()
+	defer gwcMu.RUnlock()
+
+	ids := []int64{}
+	for _, v := range gatewayClients {
+		v.Lock()
+		// Clients may only identify as devices of their own user.
+		if v.d != 0 && v.u.ID == user {
+			ids = append(ids, v.d)
+		}
+		v.Unlock()
+	}
+	return ids
+}
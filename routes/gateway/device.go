@@ -2,22 +2,21 @@ package gateway
 
 import (
 	"context"
+	"time"
 
+	"github.com/mca3/pikorv/api"
 	"github.com/mca3/pikorv/db"
 )
 
-func OnDeviceChange(dev db.Device) {
+// broadcastDevice sends msg to all devices connected to dev, and to dev
+// itself.
+func broadcastDevice(dev db.Device, msg api.Message) {
 	// Figure out who we need to notify
-	devs, err := dev.ConnectedTo(context.Background())
+	devs, err := store.ConnectedTo(context.Background(), dev.ID)
 	if err != nil {
 		return
 	}
 
-	msg := gatewayMsg{
-		Type:   gatewayDevUpdate,
-		Device: &dev,
-	}
-
 	for _, v := range devs {
 		sendChan <- sendReq{
 			Device: v.ID,
@@ -31,3 +30,52 @@ func OnDeviceChange(dev db.Device) {
 		Msg:    msg,
 	}
 }
+
+func OnDeviceChange(dev db.Device) {
+	broadcastDevice(dev, api.Message{
+		Type:   api.MessageDeviceUpdate,
+		Device: &dev,
+	})
+}
+
+// OnDeviceRename notifies peers that the name of dev has changed, and sends
+// them updated DNS records.
+func OnDeviceRename(dev db.Device) {
+	OnDeviceChange(dev)
+
+	devs, err := store.ConnectedTo(context.Background(), dev.ID)
+	if err != nil {
+		return
+	}
+
+	pushRecords(append(devs, dev)...)
+}
+
+// OnDeviceKeyRotate notifies peers that dev has a new public key.
+//
+// If expires is not zero, peers may continue to accept oldKey until then.
+func OnDeviceKeyRotate(dev db.Device, oldKey string, expires time.Time) {
+	msg := api.Message{
+		Type:   api.MessageDeviceUpdate,
+		Device: &dev,
+		OldKey: oldKey,
+	}
+
+	if !expires.IsZero() {
+		msg.OldKeyExpires = expires.Unix()
+	}
+
+	broadcastDevice(dev, msg)
+}
+
+// OnDeviceDelete notifies the peers of dev in each of nws that it has left
+// them, and disconnects dev.
+//
+// dev must already have been removed from nws.
+func OnDeviceDelete(dev db.Device, nws []db.Network) {
+	for _, nw := range nws {
+		OnNetworkLeave(dev, nw)
+	}
+
+	DisconnectDevice(dev.ID, "device deleted")
+}
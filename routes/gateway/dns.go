@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"context"
+
+	"github.com/mca3/pikorv/api"
+	"github.com/mca3/pikorv/config"
+	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/meshdns"
+)
+
+// deviceRecords returns all DNS records that dev is able to resolve.
+func deviceRecords(ctx context.Context, dev db.Device) ([]api.DNSRecord, error) {
+	nws, err := store.DeviceNetworks(ctx, dev.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	recs := []api.DNSRecord{}
+
+	// Names which only differ in punctuation or case would otherwise turn
+	// into the same label; both stores list by ID, so the suffixes given
+	// to the later ones stay put.
+	names := make([]string, len(nws))
+	for i, nw := range nws {
+		names[i] = nw.Name
+	}
+	nwLabels := meshdns.Labels(names...)
+
+	for i, nw := range nws {
+		devs, err := store.NetworkDevices(ctx, nw.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, len(devs))
+		for j, v := range devs {
+			names[j] = v.Name
+		}
+
+		for j, l := range meshdns.Labels(names...) {
+			recs = append(recs, api.DNSRecord{
+				Name: meshdns.Name(config.DNSZone, l, nwLabels[i]),
+				IP:   devs[j].IP,
+			})
+		}
+	}
+
+	return recs, nil
+}
+
+// pushRecords sends all connected devices in devs their current set of DNS
+// records, so they may cache them.
+//
+// Nothing is sent if the DNS server is disabled.
+func pushRecords(devs ...db.Device) {
+	if config.DNSListen == "" {
+		return
+	}
+
+	for _, dev := range devs {
+		gwcMu.RLock()
+		gc := findGatewayDevice(dev.ID)
+		gwcMu.RUnlock()
+
+		if gc == nil {
+			// Not connected; they'll get them once they are.
+			continue
+		}
+
+		recs, err := deviceRecords(context.Background(), dev)
+		if err != nil {
+			continue
+		}
+
+		sendChan <- sendReq{
+			Device: dev.ID,
+			Msg: api.Message{
+				Type:    api.MessageDNSRecords,
+				Records: recs,
+			},
+		}
+	}
+}
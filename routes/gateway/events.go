@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/mca3/pikorv/api"
+	"github.com/mca3/pikorv/db"
+)
+
+// keepaliveInterval is how often a comment is sent to event streams, so that
+// proxies don't time them out.
+const keepaliveInterval = time.Second * 30
+
+// errClosed is returned when writing to an event stream which has ended.
+var errClosed = errors.New("event stream closed")
+
+// sseTransport delivers messages as server-sent events, for clients which
+// can't use websockets.
+type sseTransport struct {
+	w      io.Writer
+	rc     *http.ResponseController
+	cancel context.CancelFunc
+
+	// closed is set once the request is over, after which w may not be
+	// used.
+	closed bool
+	sync.Mutex
+}
+
+func (t *sseTransport) write(ctx context.Context, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var typ api.MessageType
+	if msg, ok := v.(api.Message); ok {
+		typ = msg.Type
+	}
+
+	return t.send(fmt.Sprintf("event: %s\ndata: %s\n\n", typ, b))
+}
+
+// send writes an event to the stream, or a comment if it starts with ":".
+func (t *sseTransport) send(ev string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.closed {
+		return errClosed
+	}
+
+	// Slow clients would otherwise hold up the workers.
+	t.rc.SetWriteDeadline(time.Now().Add(sendTimeout))
+
+	if _, err := io.WriteString(t.w, ev); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+func (t *sseTransport) close(reason string) {
+	t.cancel()
+}
+
+// Events serves dev with a stream of server-sent events until the client
+// disconnects.
+//
+// The stream starts with MessageReady, after which messages are sent as
+// events named after their type. Clients report their endpoint with Ping, as
+// they can't send anything over the stream.
+func Events(ctx context.Context, w http.ResponseWriter, user *db.User, addr netip.AddrPort, dev db.Device) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// Tell nginx not to buffer the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	t := &sseTransport{w: w, rc: http.NewResponseController(w), cancel: cancel}
+
+	gc, unregister := register(user, t, addr)
+	defer func() {
+		unregister()
+
+		t.Lock()
+		t.closed = true
+		t.Unlock()
+	}()
+
+	err := gc.send(ctx, api.Message{
+		Type:         api.MessageReady,
+		Version:      api.ProtocolVersion,
+		Capabilities: capabilities(),
+	})
+	if err != nil {
+		return
+	}
+
+	gc.identify(dev)
+
+	tick := time.NewTicker(keepaliveInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if err := t.send(": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Ping updates the endpoint and NAT of a device, like MessagePing does for
+// clients which can't send it over a websocket.
+func Ping(ctx context.Context, user *db.User, msg api.Message) *api.ProtocolError {
+	if msg.Type != api.MessagePing {
+		return &api.ProtocolError{
+			Code:    api.ErrUnexpected,
+			Message: fmt.Sprintf("cannot handle messages of type %q", msg.Type),
+		}
+	}
+
+	dev, perr := device(ctx, user, msg.DeviceID)
+	if perr != nil {
+		return perr
+	}
+
+	return update(ctx, dev, &msg)
+}
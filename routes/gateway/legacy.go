@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"encoding/json"
+
+	"github.com/mca3/pikorv/api"
+)
+
+// legacyTypes holds the types of messages in the legacy protocol, where they
+// are numbered by their index.
+var legacyTypes = []api.MessageType{
+	api.MessagePing,
+	api.MessageNetworkJoin,
+	api.MessageNetworkLeave,
+	api.MessageDeviceUpdate,
+	api.MessageJoinRequest,
+	api.MessageNetworkUpdate,
+	api.MessageDNSRecords,
+	api.MessageRelay,
+}
+
+// legacyMessage is a message in the legacy protocol, spoken by clients which
+// never say hello.
+// It is api.Message with integer types, and without the handshake.
+type legacyMessage struct {
+	Type int
+
+	Device  *api.Device  `json:"device,omitempty"`
+	Network *api.Network `json:"network,omitempty"`
+	Remove  bool
+
+	Endpoint  string `json:"endpoint,omitempty"`
+	DeviceID  int64  `json:"device_id,omitempty"`
+	NetworkID int64  `json:"network_id,omitempty"`
+	NAT       string `json:"nat,omitempty"`
+
+	OldKey        string `json:"old_key,omitempty"`
+	OldKeyExpires int64  `json:"old_key_expires,omitempty"`
+
+	Records []api.DNSRecord `json:"records,omitempty"`
+	Relay   *api.RelayInfo  `json:"relay,omitempty"`
+}
+
+// isLegacy determines if the message in b is in the legacy protocol, by
+// checking whether its type is a number.
+func isLegacy(b []byte) bool {
+	// Field names are matched regardless of case, so this finds both
+	// "Type" and "type".
+	probe := struct {
+		Type json.RawMessage
+	}{}
+
+	if json.Unmarshal(b, &probe) != nil || len(probe.Type) == 0 {
+		return false
+	}
+	return probe.Type[0] == '-' || (probe.Type[0] >= '0' && probe.Type[0] <= '9')
+}
+
+// decodeLegacy decodes a message in the legacy protocol.
+// Messages of unknown types are decoded with an empty type.
+func decodeLegacy(b []byte) (api.Message, error) {
+	lm := legacyMessage{}
+	if err := json.Unmarshal(b, &lm); err != nil {
+		return api.Message{}, err
+	}
+
+	msg := api.Message{
+		Device:        lm.Device,
+		Network:       lm.Network,
+		Remove:        lm.Remove,
+		Endpoint:      lm.Endpoint,
+		DeviceID:      lm.DeviceID,
+		NetworkID:     lm.NetworkID,
+		NAT:           lm.NAT,
+		OldKey:        lm.OldKey,
+		OldKeyExpires: lm.OldKeyExpires,
+		Records:       lm.Records,
+		Relay:         lm.Relay,
+	}
+	if lm.Type >= 0 && lm.Type < len(legacyTypes) {
+		msg.Type = legacyTypes[lm.Type]
+	}
+	return msg, nil
+}
+
+// toLegacy converts msg to the legacy protocol.
+// Messages which don't exist in it, like those of the handshake, can't be
+// converted.
+func toLegacy(msg api.Message) (legacyMessage, bool) {
+	for i, v := range legacyTypes {
+		if v != msg.Type {
+			continue
+		}
+
+		return legacyMessage{
+			Type:          i,
+			Device:        msg.Device,
+			Network:       msg.Network,
+			Remove:        msg.Remove,
+			Endpoint:      msg.Endpoint,
+			DeviceID:      msg.DeviceID,
+			NetworkID:     msg.NetworkID,
+			NAT:           msg.NAT,
+			OldKey:        msg.OldKey,
+			OldKeyExpires: msg.OldKeyExpires,
+			Records:       msg.Records,
+			Relay:         msg.Relay,
+		}, true
+	}
+
+	return legacyMessage{}, false
+}
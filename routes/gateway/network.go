@@ -3,18 +3,19 @@ package gateway
 import (
 	"context"
 
+	"github.com/mca3/pikorv/api"
 	"github.com/mca3/pikorv/db"
 )
 
 func OnNetworkJoin(dev db.Device, nw db.Network) {
 	// Figure out who we need to notify
-	devs, err := db.NetworkDevices(context.Background(), nw.ID)
+	devs, err := store.NetworkDevices(context.Background(), nw.ID)
 	if err != nil {
 		return
 	}
 
-	msg := gatewayMsg{
-		Type:    gatewayNetworkJoin,
+	msg := api.Message{
+		Type:    api.MessageNetworkJoin,
 		Device:  &dev,
 		Network: &nw,
 	}
@@ -35,17 +36,19 @@ func OnNetworkJoin(dev db.Device, nw db.Network) {
 		Device: dev.ID,
 		Msg:    msg,
 	}
+
+	pushRecords(append(devs, dev)...)
 }
 
 func OnNetworkLeave(dev db.Device, nw db.Network) {
 	// Figure out who we need to notify
-	devs, err := db.NetworkDevices(context.Background(), nw.ID)
+	devs, err := store.NetworkDevices(context.Background(), nw.ID)
 	if err != nil {
 		return
 	}
 
-	msg := gatewayMsg{
-		Type:    gatewayNetworkLeave,
+	msg := api.Message{
+		Type:    api.MessageNetworkLeave,
 		Device:  &dev,
 		Network: &nw,
 	}
@@ -66,4 +69,78 @@ func OnNetworkLeave(dev db.Device, nw db.Network) {
 		Device: dev.ID,
 		Msg:    msg,
 	}
+
+	pushRecords(append(devs, dev)...)
+}
+
+// notifyJoinRequest sends msg to all devices owned by the owner of nw, and to
+// dev itself.
+func notifyJoinRequest(dev db.Device, nw db.Network, msg api.Message) {
+	devs, err := store.Devices(context.Background(), nw.Owner)
+	if err != nil {
+		return
+	}
+
+	for _, v := range devs {
+		if v.ID == dev.ID {
+			continue
+		}
+
+		sendChan <- sendReq{
+			Device: v.ID,
+			Msg:    msg,
+		}
+	}
+
+	sendChan <- sendReq{
+		Device: dev.ID,
+		Msg:    msg,
+	}
+}
+
+// OnJoinRequest notifies the owner of nw that dev would like to join it.
+func OnJoinRequest(dev db.Device, nw db.Network) {
+	notifyJoinRequest(dev, nw, api.Message{
+		Type:    api.MessageJoinRequest,
+		Device:  &dev,
+		Network: &nw,
+	})
+}
+
+// OnJoinRequestRemoved notifies dev and the owner of nw that the request for
+// dev to join nw is no longer pending, either because it was rejected or
+// withdrawn.
+//
+// Approved requests should use OnNetworkJoin instead.
+func OnJoinRequestRemoved(dev db.Device, nw db.Network) {
+	notifyJoinRequest(dev, nw, api.Message{
+		Type:    api.MessageJoinRequest,
+		Device:  &dev,
+		Network: &nw,
+		Remove:  true,
+	})
+}
+
+// OnNetworkChange notifies all devices in nw that its settings, such as its
+// name, have changed.
+func OnNetworkChange(nw db.Network) {
+	devs, err := store.NetworkDevices(context.Background(), nw.ID)
+	if err != nil {
+		return
+	}
+
+	msg := api.Message{
+		Type:    api.MessageNetworkUpdate,
+		Network: &nw,
+	}
+
+	for _, v := range devs {
+		sendChan <- sendReq{
+			Device: v.ID,
+			Msg:    msg,
+		}
+	}
+
+	// The network name is part of the DNS name.
+	pushRecords(devs...)
 }
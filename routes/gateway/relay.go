@@ -0,0 +1,30 @@
+package gateway
+
+import (
+	"github.com/mca3/pikorv/api"
+	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/internal/pprelay"
+)
+
+// advertiseRelay tells dev about the relay, if it is enabled.
+func advertiseRelay(dev db.Device) {
+	if !pprelay.Enabled() {
+		return
+	}
+
+	token, err := pprelay.Token(dev.PublicKey)
+	if err != nil {
+		return
+	}
+
+	sendChan <- sendReq{
+		Device: dev.ID,
+		Msg: api.Message{
+			Type: api.MessageRelay,
+			Relay: &api.RelayInfo{
+				Endpoint: pprelay.Endpoint(),
+				Token:    token,
+			},
+		},
+	}
+}
@@ -3,16 +3,44 @@ package gateway
 import (
 	"context"
 	"sync"
+	"sync/atomic"
+
+	"github.com/mca3/pikorv/api"
 )
 
 type sendReq struct {
 	Device int64
-	Msg    gatewayMsg
+	Msg    api.Message
 }
 
 var wg sync.WaitGroup
 var sendChan chan sendReq
 
+// sent and dropped count the messages workers have sent, and those which
+// couldn't be sent, such as to clients which were too slow to take them.
+var sent, dropped atomic.Uint64
+
+// notifying tracks the notifications started by Notify.
+var notifying sync.WaitGroup
+
+// Notify runs fn, which tells devices about a change through one of the On
+// functions, in the background so that the request making the change doesn't
+// wait on it.
+func Notify(fn func()) {
+	notifying.Add(1)
+	go func() {
+		defer notifying.Done()
+		fn()
+	}()
+}
+
+// WaitNotifications blocks until every notification started by Notify has been
+// queued, so they aren't sent to closed workers or read from a store which is
+// gone.
+func WaitNotifications() {
+	notifying.Wait()
+}
+
 // InitWorkers initializes the amount of gateway workers that are available to
 // send messages.
 func InitWorkers(num int, queue int) {
@@ -35,11 +63,19 @@ func worker() {
 	defer wg.Done()
 
 	for req := range sendChan {
+		gwcMu.RLock()
 		gc := findGatewayDevice(req.Device)
+		gwcMu.RUnlock()
+
 		if gc == nil {
 			continue
 		}
 
-		gc.send(context.Background(), req.Msg)
+		if err := gc.send(context.Background(), req.Msg); err != nil {
+			dropped.Add(1)
+			gc.logger().Warn("failed to send gateway message", "type", req.Msg.Type, "error", err)
+		} else {
+			sent.Add(1)
+		}
 	}
 }
@@ -0,0 +1,295 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/mca3/pikorv/api"
+	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/routes/gateway"
+	"nhooyr.io/websocket"
+)
+
+var workers sync.Once
+
+// dialGateway connects to the gateway as the owner of token, asking for the
+// given subprotocols.
+func (ts *testServer) dialGateway(ctx context.Context, token string, protos ...string) *websocket.Conn {
+	ts.t.Helper()
+
+	srv := httptest.NewServer(ts.h)
+	ts.t.Cleanup(srv.Close)
+
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/gateway", &websocket.DialOptions{
+		HTTPHeader:   http.Header{"Authorization": {"Bearer " + token}},
+		Subprotocols: protos,
+	})
+	if err != nil {
+		ts.t.Fatalf("failed to connect to the gateway: %v", err)
+	}
+	ts.t.Cleanup(func() { c.Close(websocket.StatusNormalClosure, "") })
+	return c
+}
+
+// exchange sends the message in req, if it isn't empty, and decodes the next
+// message into resp.
+func exchange(ctx context.Context, t *testing.T, c *websocket.Conn, req string, resp any) {
+	t.Helper()
+
+	if req != "" {
+		if err := c.Write(ctx, websocket.MessageText, []byte(req)); err != nil {
+			t.Fatalf("failed to send %s: %v", req, err)
+		}
+	}
+
+	_, b, err := c.Read(ctx)
+	if err != nil {
+		t.Fatalf("failed to read reply to %s: %v", req, err)
+	} else if err := json.Unmarshal(b, resp); err != nil {
+		t.Fatalf("failed to decode %s: %v", b, err)
+	}
+}
+
+func TestGatewayHandshake(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+
+	var dev db.Device
+	ts.expect(http.StatusOK, "POST", "/api/v1/devices", alice, map[string]string{
+		"name": "laptop",
+		"key":  "laptop key",
+	}, &dev)
+	id := strconv.FormatInt(dev.ID, 10)
+
+	c := ts.dialGateway(ctx, alice)
+
+	for _, tc := range []struct {
+		req, code string
+	}{
+		{`{"type": "ping", "endpoint": "192.0.2.1:1234"}`, api.ErrNotIdentified},
+		{`{"type": "hello", "version": 2, "device_id": ` + id + `}`, api.ErrUnsupportedVersion},
+		{`{"type": "hello", "version": 1, "device_id": 100}`, api.ErrUnknownDevice},
+		{`{"type": "hello", "version": 1, "device_id": "one"}`, api.ErrMalformed},
+		{`{"type": "relay"}`, api.ErrUnexpected},
+	} {
+		var msg api.Message
+		exchange(ctx, t, c, tc.req, &msg)
+		if msg.Type != api.MessageError || msg.Error == nil || msg.Error.Code != tc.code {
+			t.Fatalf("%s: expected %s, got %+v", tc.req, tc.code, msg)
+		}
+	}
+
+	var msg api.Message
+	exchange(ctx, t, c, `{"type": "hello", "version": 1, "device_id": `+id+`}`, &msg)
+	if msg.Type != api.MessageReady || msg.Version != api.ProtocolVersion {
+		t.Fatalf("expected ready, got %+v", msg)
+	}
+
+	if n := gateway.CurrentStats().Connections["websocket"]; n < 1 {
+		t.Fatalf("expected a websocket connection, got %d", n)
+	}
+
+	exchange(ctx, t, c, `{"type": "hello", "version": 1, "device_id": `+id+`}`, &msg)
+	if msg.Type != api.MessageError || msg.Error.Code != api.ErrAlreadyIdentified {
+		t.Fatalf("expected %s, got %+v", api.ErrAlreadyIdentified, msg)
+	}
+}
+
+func TestOnlineDevices(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+	bob := ts.user("bob")
+
+	// Alice's laptop and Bob's desktop are connected, but her phone isn't.
+	devs := map[string]db.Device{}
+	for _, v := range []struct{ token, name string }{{alice, "laptop"}, {alice, "phone"}, {bob, "desktop"}} {
+		var dev db.Device
+		ts.expect(http.StatusOK, "POST", "/api/v1/devices", v.token, map[string]string{
+			"name": v.name,
+			"key":  v.name + " key",
+		}, &dev)
+		devs[v.name] = dev
+
+		if v.name == "phone" {
+			continue
+		}
+
+		var msg api.Message
+		exchange(ctx, t, ts.dialGateway(ctx, v.token), `{"type": "hello", "version": 1, "device_id": `+strconv.FormatInt(dev.ID, 10)+`}`, &msg)
+		if msg.Type != api.MessageReady {
+			t.Fatalf("expected ready, got %+v", msg)
+		}
+	}
+
+	if ids := gateway.OnlineDevices(devs["desktop"].Owner); len(ids) != 1 || ids[0] != devs["desktop"].ID {
+		t.Fatalf("expected only the desktop online for bob, got %v", ids)
+	}
+
+	for online, want := range map[string]string{"true": "laptop", "false": "phone"} {
+		var listed []db.Device
+		ts.expect(http.StatusOK, "GET", "/api/v1/devices?online="+online, alice, nil, &listed)
+		if len(listed) != 1 || listed[0].ID != devs[want].ID {
+			t.Fatalf("online=%s: expected only the %s, got %+v", online, want, listed)
+		}
+	}
+}
+
+func TestAdminGateway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ts := newTestServer(t)
+	carol := ts.user("carol")
+	dave := ts.user("dave")
+	ts.admin("carol")
+
+	// Connections of other tests may still be around, so only Carol's are
+	// looked at.
+	var ids []int64
+	for _, token := range []string{carol, dave, carol, carol} {
+		var msg api.Message
+		exchange(ctx, t, ts.dialGateway(ctx, token), `{"type": "relay"}`, &msg)
+		if msg.Type != api.MessageError {
+			t.Fatalf("expected an error, got %+v", msg)
+		}
+	}
+
+	path := "/api/v1/admin/gateway?prefix=carol&limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 2 {
+			t.Fatalf("too many pages")
+		}
+
+		w := ts.do("GET", path, carol, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+
+		var conns []api.Connection
+		if err := json.NewDecoder(w.Body).Decode(&conns); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		for _, v := range conns {
+			if v.Username != "carol" {
+				t.Fatalf("listed a connection of %s", v.Username)
+			}
+			ids = append(ids, v.ID)
+		}
+
+		cur := w.Header().Get(api.NextCursorHeader)
+		if cur == "" {
+			break
+		}
+		path = "/api/v1/admin/gateway?prefix=carol&limit=2&cursor=" + cur
+	}
+
+	if len(ids) != 3 || ids[0] >= ids[1] || ids[1] >= ids[2] {
+		t.Fatalf("expected three connections in order, got %v", ids)
+	}
+
+	ts.expect(http.StatusForbidden, "GET", "/api/v1/admin/gateway", dave, nil, nil)
+	ts.expect(http.StatusBadRequest, "GET", "/api/v1/admin/gateway?sort=name", carol, nil, nil)
+	ts.expect(http.StatusBadRequest, "GET", "/api/v1/admin/gateway?cursor=!", carol, nil, nil)
+}
+
+func TestGatewayLegacy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+
+	var dev db.Device
+	ts.expect(http.StatusOK, "POST", "/api/v1/devices", alice, map[string]string{
+		"name": "laptop",
+		"key":  "laptop key",
+	}, &dev)
+
+	var nw db.Network
+	ts.expect(http.StatusOK, "POST", "/api/v1/networks", alice, map[string]string{
+		"name": "home",
+	}, &nw)
+
+	c := ts.dialGateway(ctx, alice)
+
+	ping := `{"Type": 0, "device_id": ` + strconv.FormatInt(dev.ID, 10) + `, "endpoint": "192.0.2.1:1234"}`
+	if err := c.Write(ctx, websocket.MessageText, []byte(ping)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The gateway knows who we are once it saved our endpoint.
+	for dev.Endpoint == "" {
+		time.Sleep(10 * time.Millisecond)
+		ts.expect(http.StatusOK, "GET", "/api/v1/devices/"+strconv.FormatInt(dev.ID, 10), alice, nil, &dev)
+	}
+
+	// Our own update comes first, and then the join.
+	ts.expect(http.StatusNoContent, "PUT", "/api/v1/networks/"+strconv.FormatInt(nw.ID, 10)+"/devices/"+strconv.FormatInt(dev.ID, 10), alice, nil, nil)
+
+	for _, typ := range []float64{3, 1} {
+		var msg map[string]any
+		exchange(ctx, t, c, "", &msg)
+
+		if msg["Type"] != typ {
+			t.Fatalf("expected legacy type %v, got %v", typ, msg)
+		} else if _, ok := msg["type"]; ok {
+			t.Fatalf("legacy client was sent a typed message: %v", msg)
+		}
+	}
+}
+
+func TestGatewayCBOR(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+
+	var dev db.Device
+	ts.expect(http.StatusOK, "POST", "/api/v1/devices", alice, map[string]string{
+		"name": "laptop",
+		"key":  "laptop key",
+	}, &dev)
+
+	c := ts.dialGateway(ctx, alice, api.SubprotocolCBOR, api.SubprotocolJSON)
+	if p := c.Subprotocol(); p != api.SubprotocolCBOR {
+		t.Fatalf("expected %s, got %q", api.SubprotocolCBOR, p)
+	}
+
+	// JSON is not understood once CBOR was picked.
+	var msg api.Message
+	if err := c.Write(ctx, websocket.MessageText, []byte(`{"type": "hello"}`)); err != nil {
+		t.Fatal(err)
+	} else if typ, b, err := c.Read(ctx); err != nil || typ != websocket.MessageBinary {
+		t.Fatalf("expected a binary message, got %v, %v", typ, err)
+	} else if err := cbor.Unmarshal(b, &msg); err != nil || msg.Error == nil || msg.Error.Code != api.ErrMalformed {
+		t.Fatalf("expected %s, got %+v, %v", api.ErrMalformed, msg, err)
+	}
+
+	b, _ := cbor.Marshal(api.Message{
+		Type:     api.MessageHello,
+		Version:  api.ProtocolVersion,
+		DeviceID: dev.ID,
+	})
+	if err := c.Write(ctx, websocket.MessageBinary, b); err != nil {
+		t.Fatal(err)
+	} else if _, b, err = c.Read(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := cbor.Unmarshal(b, &msg); err != nil || msg.Type != api.MessageReady {
+		t.Fatalf("expected ready, got %+v, %v", msg, err)
+	}
+}
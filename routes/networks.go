@@ -1,84 +1,161 @@
 package routes
 
 import (
-	"strconv"
+	"errors"
 
 	"github.com/mca3/mwr"
+	"github.com/mca3/pikorv/api"
 	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/routes/gateway"
 )
 
 // apiNewNetwork creates a new network and attaches it to the user's account.
 //
-// Path: /api/new/network
+// Path: /api/v1/networks
 // Method: POST
+// Legacy: POST /api/new/network
 // Authenticated.
-// Body: JSON. Specify "name".
+// Body: JSON. Specify "name". "approval" may be set to allow devices owned by
+// other users to request to join the network.
 func NewNetwork(c *mwr.Ctx) error {
 	user, ok := isAuthed(c)
 	if !ok {
 		return api403(c, errNoAuth)
 	}
 
-	data := struct {
-		Name string
-	}{}
+	data := api.NewNetworkRequest{}
 
 	if err := c.BodyParser(&data); err != nil {
 		return api400(c, err)
-	} else if data.Name == "" {
+	} else if !validName(data.Name) {
 		return api400(c)
 	}
 
 	nw := db.Network{
-		Name:  data.Name,
-		Owner: user.ID,
+		Name:     data.Name,
+		Owner:    user.ID,
+		Approval: data.Approval,
 	}
-	if err := nw.Save(c.Context()); err != nil {
+	if err := store.SaveNetwork(c.Context(), &nw); db.IsConflict(err) {
+		return api409(c, err)
+	} else if err != nil {
 		return api500(c, err)
 	}
 
 	return sendJSON(c, nw)
 }
 
-// apiListNetworks lists the networks on the user's account.
+// ListNetworks lists the networks on the user's account, along with the
+// devices in them.
+//
+// The cursor of the next page, if there is one, is in the X-Next-Cursor
+// header.
 //
-// Path: /api/list/networks
+// Path: /api/v1/networks
 // Method: GET
+// Legacy: GET /api/list/networks
 // Authenticated.
+// Query: prefix=<name prefix>, sort=id|name, order=asc|desc, limit=<n>,
+// cursor=<cursor>; all optional.
 func ListNetworks(c *mwr.Ctx) error {
 	user, ok := isAuthed(c)
 	if !ok {
 		return api403(c, errNoAuth)
 	}
 
-	nws, err := db.Networks(c.Context(), user.ID)
+	o, err := listOptions(c)
+	if err != nil {
+		return api400(c, err)
+	}
+
+	nws, err := store.ListNetworks(c.Context(), user.ID, peek(o))
 	if err != nil {
 		return api500(c, err)
 	}
+	nws = nextPage(c, o, nws, func(nw db.Network) (int64, string) { return nw.ID, nw.Name })
 
-	out := make([]struct {
-		db.Network
-		Devices []db.Device `json:"devices"`
-	}, len(nws))
+	ids := make([]int64, len(nws))
+	for k, v := range nws {
+		ids[k] = v.ID
+	}
+
+	devs, err := store.NetworksDevices(c.Context(), ids)
+	if err != nil {
+		return api500(c, err)
+	}
+
+	out := make([]api.NetworkDevices, len(nws))
 
 	for k, v := range nws {
 		out[k].Network = v
-		devs, err := db.NetworkDevices(c.Context(), v.ID)
-		if err != nil {
-			return api500(c, err)
-		}
-		out[k].Devices = devs
+		out[k].Devices = devs[v.ID]
 	}
 
 	return sendJSON(c, out)
 }
 
+// UpdateNetwork changes the settings of a network.
+// Devices in the network are notified of the change.
+//
+// Path: /api/v1/networks/:id
+// Method: PATCH
+// Legacy: PATCH /api/network/update, with "id" in the body
+// Authenticated.
+// Body: JSON. Specify the fields to change, which may be "name" and "approval".
+func UpdateNetwork(c *mwr.Ctx) error {
+	user, ok := isAuthed(c)
+	if !ok {
+		return api403(c, errNoAuth)
+	}
+
+	data := struct {
+		ID int64 `param:"id"`
+		api.UpdateNetworkRequest
+	}{}
+
+	if err := bind(c, &data); err != nil {
+		return api400(c, err)
+	} else if data.ID == 0 {
+		return api400(c)
+	} else if data.Name != nil && !validName(*data.Name) {
+		return api400(c)
+	}
+
+	nw, err := store.NetworkID(c.Context(), data.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	if nw.Owner != user.ID {
+		return api404(c)
+	}
+
+	if data.Name != nil {
+		nw.Name = *data.Name
+	}
+	if data.Approval != nil {
+		nw.Approval = *data.Approval
+	}
+
+	if err := store.SaveNetwork(c.Context(), &nw); db.IsConflict(err) {
+		return api409(c, err)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	gateway.Notify(func() { gateway.OnNetworkChange(nw) })
+
+	return sendJSON(c, nw)
+}
+
 // apiDeleteNetwork deletes a network from the user's account.
 //
-// Path: /api/del/network
-// Method: POST
+// Path: /api/v1/networks/:id
+// Method: DELETE
+// Legacy: POST /api/del/network, with "id" in the body
 // Authenticated.
-// Body: JSON. Specify "id".
 func DeleteNetwork(c *mwr.Ctx) error {
 	user, ok := isAuthed(c)
 	if !ok {
@@ -86,17 +163,19 @@ func DeleteNetwork(c *mwr.Ctx) error {
 	}
 
 	data := struct {
-		ID int64
+		ID int64 `param:"id"`
 	}{}
 
-	if err := c.BodyParser(&data); err != nil {
+	if err := bind(c, &data); err != nil {
 		return api400(c, err)
 	} else if data.ID == 0 {
 		return api400(c)
 	}
 
-	nw, err := db.NetworkID(c.Context(), data.ID)
-	if err != nil {
+	nw, err := store.NetworkID(c.Context(), data.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
 		return api500(c, err)
 	}
 
@@ -104,7 +183,7 @@ func DeleteNetwork(c *mwr.Ctx) error {
 		return api404(c)
 	}
 
-	if err := nw.Delete(c.Context()); err != nil {
+	if err := store.DeleteNetwork(c.Context(), nw.ID); err != nil {
 		return api500(c, err)
 	}
 
@@ -115,9 +194,9 @@ func DeleteNetwork(c *mwr.Ctx) error {
 
 // NetworkInfo retrieves info about the network.
 //
-// Path: /api/network/info
-// Query: id=<network id>
+// Path: /api/v1/networks/:id
 // Method: GET
+// Legacy: GET /api/network/info?id=<network id>
 // Authenticated.
 func NetworkInfo(c *mwr.Ctx) error {
 	user, ok := isAuthed(c)
@@ -125,39 +204,154 @@ func NetworkInfo(c *mwr.Ctx) error {
 		return api403(c, errNoAuth)
 	}
 
-	sid := c.Query("id")
-	if sid == "" {
-		// Need to specify ID
-		return api400(c)
-	}
+	data := struct {
+		ID int64 `param:"id"`
+	}{}
 
-	id, err := strconv.ParseInt(sid, 10, 64)
-	if err != nil || id <= 0 {
-		// Bad ID
+	if err := bind(c, &data); err != nil {
 		return api400(c, err)
+	} else if data.ID == 0 {
+		return api400(c)
 	}
 
-	nw, err := db.NetworkID(c.Context(), id)
-	if err != nil {
-		return api404(c, err)
+	nw, err := store.NetworkID(c.Context(), data.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
 	}
 
 	if nw.Owner != user.ID {
 		return api404(c)
 	}
 
-	devs, err := db.NetworkDevices(c.Context(), id)
+	devs, err := store.NetworkDevices(c.Context(), data.ID)
 	if err != nil {
 		return api500(c, err)
 	}
 
-	out := struct {
-		db.Network
-		Devices []db.Device `json:"devices"`
-	}{
+	out := api.NetworkDevices{
 		Network: nw,
 		Devices: devs,
 	}
 
 	return sendJSON(c, out)
 }
+
+// NetworkRequests lists the devices waiting for approval to join a network.
+//
+// Path: /api/v1/networks/:id/requests
+// Method: GET
+// Legacy: GET /api/network/requests?id=<network id>
+// Authenticated.
+func NetworkRequests(c *mwr.Ctx) error {
+	user, ok := isAuthed(c)
+	if !ok {
+		return api403(c, errNoAuth)
+	}
+
+	data := struct {
+		ID int64 `param:"id"`
+	}{}
+
+	if err := bind(c, &data); err != nil {
+		return api400(c, err)
+	} else if data.ID == 0 {
+		return api400(c)
+	}
+
+	nw, err := store.NetworkID(c.Context(), data.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	if nw.Owner != user.ID {
+		return api404(c)
+	}
+
+	devs, err := store.NetworkRequests(c.Context(), data.ID)
+	if err != nil {
+		return api500(c, err)
+	}
+
+	return sendJSON(c, devs)
+}
+
+// NetworkApprove approves a device's request to join a network.
+//
+// Path: /api/v1/networks/:network/requests/:device
+// Method: POST
+// Legacy: POST /api/network/approve, with "device" and "network" in the body
+// Authenticated.
+func NetworkApprove(c *mwr.Ctx) error {
+	return handleRequest(c, true)
+}
+
+// NetworkReject rejects a device's request to join a network.
+//
+// Path: /api/v1/networks/:network/requests/:device
+// Method: DELETE
+// Legacy: POST /api/network/reject, with "device" and "network" in the body
+// Authenticated.
+func NetworkReject(c *mwr.Ctx) error {
+	return handleRequest(c, false)
+}
+
+// handleRequest approves or rejects a request to join a network.
+func handleRequest(c *mwr.Ctx, approve bool) error {
+	user, ok := isAuthed(c)
+	if !ok {
+		return api403(c, errNoAuth)
+	}
+
+	data := struct {
+		Device  int64 `param:"device"`
+		Network int64 `param:"network"`
+	}{}
+
+	if err := bind(c, &data); err != nil {
+		return api400(c, err)
+	} else if data.Device == 0 || data.Network == 0 {
+		return api400(c)
+	}
+
+	nw, err := store.NetworkID(c.Context(), data.Network)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	if nw.Owner != user.ID {
+		return api404(c)
+	}
+
+	dev, err := store.DeviceID(c.Context(), data.Device)
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	if approve {
+		err = store.NetworkApprove(c.Context(), nw.ID, dev.ID)
+	} else {
+		err = store.NetworkReject(c.Context(), nw.ID, dev.ID)
+	}
+
+	if errors.Is(err, db.ErrNotFound) {
+		return api404(c)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	if approve {
+		gateway.Notify(func() { gateway.OnNetworkJoin(dev, nw) })
+	} else {
+		gateway.Notify(func() { gateway.OnJoinRequestRemoved(dev, nw) })
+	}
+
+	return c.SendStatus(204)
+}
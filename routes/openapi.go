@@ -0,0 +1,311 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mca3/mwr"
+	"github.com/mca3/pikorv/api"
+)
+
+// openapiOnce guards openapiDoc, which is only generated once it is first
+// asked for.
+var (
+	openapiOnce sync.Once
+	openapiDoc  []byte
+	openapiErr  error
+)
+
+// OpenAPI sends the OpenAPI document describing every route.
+//
+// Path: /api/openapi.json
+// Method: GET
+func OpenAPI(c *mwr.Ctx) error {
+	openapiOnce.Do(func() {
+		openapiDoc, openapiErr = openapiJSON()
+	})
+	if openapiErr != nil {
+		return api500(c, openapiErr)
+	}
+
+	c.Set("Content-Type", "application/json")
+	_, err := c.Write(openapiDoc)
+	return err
+}
+
+// openapiJSON encodes the OpenAPI document.
+//
+// Maps are encoded with their keys sorted, so the output only changes when
+// the routes do.
+func openapiJSON() ([]byte, error) {
+	b, err := json.MarshalIndent(openapi(), "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// openapi generates the OpenAPI document from Routes and LegacyRoutes.
+func openapi() map[string]any {
+	s := schemas{}
+	paths := map[string]map[string]any{}
+	docs := map[string]Doc{}
+
+	for _, r := range Routes {
+		docs[r.Method+" "+r.Path] = r.Doc
+
+		p, params := openapiPath(r.Path)
+		if paths[p] == nil {
+			paths[p] = map[string]any{}
+		}
+		paths[p][strings.ToLower(r.Method)] = s.operation(r.Doc, params)
+	}
+
+	for _, r := range LegacyRoutes {
+		d := docs[r.Successor]
+		op := map[string]any{
+			"deprecated": true,
+			"summary":    d.Summary,
+			"responses":  s.responses(d),
+		}
+		if r.Successor != "" {
+			op["description"] = "Use " + r.Successor + " instead."
+		}
+		if d.Access != Anyone {
+			op["security"] = bearer
+		}
+
+		if paths[r.Path] == nil {
+			paths[r.Path] = map[string]any{}
+		}
+		paths[r.Path][strings.ToLower(r.Method)] = op
+	}
+
+	// The OpenAPI document can't describe websockets, but we include the
+	// messages sent over the gateway so that clients know them anyway.
+	s.of(reflect.TypeOf(api.Message{}))
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "pikorv",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": map[string]any(s),
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+	}
+}
+
+// bearer is the security requirement of authenticated routes.
+var bearer = []map[string][]string{{"bearer": {}}}
+
+// openapiPath converts a path with parameters like ":id" to one with
+// parameters like "{id}", and describes its parameters.
+func openapiPath(path string) (string, []any) {
+	var params []any
+
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if !strings.HasPrefix(p, ":") {
+			continue
+		}
+
+		parts[i] = "{" + p[1:] + "}"
+		params = append(params, map[string]any{
+			"name":     p[1:],
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]any{"type": "integer", "format": "int64"},
+		})
+	}
+
+	return strings.Join(parts, "/"), params
+}
+
+// schemas holds the schemas of named types, by name.
+type schemas map[string]any
+
+// operation describes a route.
+func (s schemas) operation(d Doc, params []any) map[string]any {
+	op := map[string]any{
+		"summary":   d.Summary,
+		"responses": s.responses(d),
+	}
+
+	desc := d.Description
+	switch d.Access {
+	case Authenticated:
+		op["security"] = bearer
+	case Administrator:
+		op["security"] = bearer
+		desc = strings.TrimSpace(desc + " Only administrators may use this.")
+	}
+	if desc != "" {
+		op["description"] = desc
+	}
+
+	for _, q := range d.Query {
+		typ := q.Type
+		if typ == "" {
+			typ = "string"
+		}
+
+		params = append(params, map[string]any{
+			"name":        q.Name,
+			"in":          "query",
+			"description": q.Description,
+			"schema":      map[string]any{"type": typ},
+		})
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+
+	if d.Request != nil {
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content": map[string]any{
+				"application/json": map[string]any{
+					"schema": s.of(reflect.TypeOf(d.Request)),
+				},
+			},
+		}
+	}
+
+	return op
+}
+
+// responses describes the responses of a route.
+func (s schemas) responses(d Doc) map[string]any {
+	status := d.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	resp := map[string]any{
+		"description": http.StatusText(status),
+	}
+
+	if d.Response != nil {
+		t := reflect.TypeOf(d.Response)
+
+		typ := d.ContentType
+		if typ == "" {
+			typ = "text/plain"
+			switch t.Kind() {
+			case reflect.Struct, reflect.Slice, reflect.Pointer:
+				typ = "application/json"
+			}
+		}
+
+		resp["content"] = map[string]any{
+			typ: map[string]any{"schema": s.of(t)},
+		}
+	}
+
+	for _, q := range d.Query {
+		if q.Name != "cursor" {
+			continue
+		}
+
+		resp["headers"] = map[string]any{
+			api.NextCursorHeader: map[string]any{
+				"description": "The cursor of the next page, if there may be one.",
+				"schema":      map[string]any{"type": "string"},
+			},
+		}
+	}
+
+	return map[string]any{
+		strconv.Itoa(status): resp,
+		"default": map[string]any{
+			"description": "An error, described in plain text.",
+		},
+	}
+}
+
+// of returns the schema of t.
+// Structs are added to s and referred to by name.
+func (s schemas) of(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return s.of(t.Elem())
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": s.of(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := s[name]; !ok {
+			// Set it first in case the type refers to itself.
+			s[name] = nil
+			s[name] = s.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+
+	panic("openapi: unsupported type " + t.String())
+}
+
+// object returns the schema of the struct t.
+func (s schemas) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	s.fields(t, props, &required)
+
+	o := map[string]any{
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) > 0 {
+		o["required"] = required
+	}
+	return o
+}
+
+// fields adds the fields of the struct t to props, including those of
+// embedded structs, the same way encoding/json would encode them.
+func (s schemas) fields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			s.fields(f.Type, props, required)
+			continue
+		} else if !f.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = f.Name
+		}
+
+		props[name] = s.of(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestOpenAPI fails when the OpenAPI document no longer matches the one in
+// testdata, which means the routes changed without updating it.
+func TestOpenAPI(t *testing.T) {
+	got, err := openapiJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "openapi.json")
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s is out of date; run go test ./routes -run TestOpenAPI -update", golden)
+	}
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	ts := newTestServer(t)
+
+	w := ts.do("GET", "/api/openapi.json", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Summary    string `json:"summary"`
+			Deprecated bool   `json:"deprecated"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range Routes {
+		p, _ := openapiPath(r.Path)
+		op, ok := doc.Paths[p][strings.ToLower(r.Method)]
+		if !ok {
+			t.Errorf("%s %s is missing", r.Method, p)
+		} else if op.Summary == "" {
+			t.Errorf("%s %s has no summary", r.Method, p)
+		}
+	}
+
+	for _, r := range LegacyRoutes {
+		if op, ok := doc.Paths[r.Path][strings.ToLower(r.Method)]; !ok || !op.Deprecated {
+			t.Errorf("%s %s is missing or not deprecated", r.Method, r.Path)
+		}
+	}
+}
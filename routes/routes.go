@@ -0,0 +1,431 @@
+package routes
+
+import (
+	"strings"
+
+	"github.com/mca3/mwr"
+	"github.com/mca3/pikorv/api"
+)
+
+// Route is a route of the API.
+type Route struct {
+	Method  string
+	Path    string
+	Handler func(*mwr.Ctx) error
+
+	// Doc describes the route in the OpenAPI document.
+	Doc Doc
+}
+
+// Access is who may use a route.
+type Access int
+
+// Kinds of access.
+const (
+	Anyone Access = iota
+	Authenticated
+	Administrator
+)
+
+// Param is a query parameter of a route.
+type Param struct {
+	Name string
+
+	// Type is the JSON schema type of the parameter, which is "string" if
+	// empty.
+	Type string
+
+	Description string
+}
+
+// Doc describes a route in the OpenAPI document.
+type Doc struct {
+	Summary string
+	Access  Access
+	Query   []Param
+
+	// Description explains the route further, if the summary isn't
+	// enough.
+	Description string
+
+	// Request and Response are values of the types of the request and
+	// response bodies, if there are any.
+	// A response which isn't a struct, slice, or pointer is sent as plain
+	// text.
+	Request  any
+	Response any
+
+	// Status is the status of a successful response, which is 200 if zero.
+	Status int
+
+	// ContentType is the type of the response body if it isn't JSON or
+	// plain text.
+	ContentType string
+}
+
+// LegacyRoute is a route from before the API was versioned.
+// It is kept as a deprecated alias of its successor in v1, so that older
+// clients keep working.
+type LegacyRoute struct {
+	Method  string
+	Path    string
+	Handler func(*mwr.Ctx) error
+
+	// Successor is the v1 route which replaces this one, such as
+	// "DELETE /api/v1/devices/:id".
+	Successor string
+}
+
+// Query parameters of lists.
+var (
+	listParams = []Param{
+		{"prefix", "", "Only list items whose name starts with this."},
+		{"sort", "", "Sort by \"id\" or \"name\"; \"id\" by default."},
+		{"order", "", "\"asc\" or \"desc\"; \"asc\" by default."},
+		{"limit", "integer", "The most items to return at once."},
+		{"cursor", "", "The cursor of the page to return, from the X-Next-Cursor header."},
+	}
+
+	connParams = []Param{
+		{"prefix", "", "Only list connections of users whose username starts with this."},
+		{"order", "", "\"asc\" or \"desc\" by ID; \"asc\" by default."},
+		{"limit", "integer", "The most items to return at once."},
+		{"cursor", "", "The cursor of the page to return, from the X-Next-Cursor header."},
+	}
+)
+
+// Routes holds every v1 route.
+//
+// Unlike legacy routes, the IDs of the resources a route acts on are given in
+// its path rather than in the query or body.
+var Routes = []Route{
+	{"POST", "/api/v1/auth", Auth, Doc{
+		Summary:  "Create a token",
+		Request:  api.AuthRequest{},
+		Response: api.Token{},
+	}},
+	{"GET", "/api/v1/auth", Auth, Doc{
+		Summary:  "List the ways users may authenticate",
+		Response: api.AuthMethods{},
+	}},
+
+	{"POST", "/api/v1/users", NewUser, Doc{
+		Summary:  "Create a user, returning its ID",
+		Request:  api.NewUserRequest{},
+		Response: int64(0),
+	}},
+	{"PATCH", "/api/v1/user", UpdateUser, Doc{
+		Summary:  "Change the profile of the authenticated user",
+		Access:   Authenticated,
+		Request:  api.UpdateUserRequest{},
+		Response: api.User{},
+	}},
+
+	{"GET", "/api/v1/devices", ListDevices, Doc{
+		Summary: "List devices",
+		Access:  Authenticated,
+		Query: append([]Param{
+			{"tag", "", "Only list devices with this tag."},
+			{"online", "boolean", "Only list devices which are connected to the gateway, or which aren't."},
+		}, listParams...),
+		Response: []api.ListedDevice{},
+	}},
+	{"POST", "/api/v1/devices", NewDevice, Doc{
+		Summary:  "Create a device",
+		Access:   Authenticated,
+		Request:  api.NewDeviceRequest{},
+		Response: api.Device{},
+	}},
+	{"GET", "/api/v1/devices/:id", DeviceInfo, Doc{
+		Summary:  "Get a device",
+		Access:   Authenticated,
+		Response: api.Device{},
+	}},
+	{"PATCH", "/api/v1/devices/:id", UpdateDevice, Doc{
+		Summary:  "Change the settings of a device",
+		Access:   Authenticated,
+		Request:  api.UpdateDeviceRequest{},
+		Response: api.Device{},
+	}},
+	{"DELETE", "/api/v1/devices/:id", DeleteDevice, Doc{
+		Summary: "Delete a device",
+		Access:  Authenticated,
+		Status:  204,
+	}},
+	{"POST", "/api/v1/devices/:id/rotate-key", RotateDeviceKey, Doc{
+		Summary:     "Replace the public key of a device",
+		Description: "The server stops accepting the old key right away; \"overlap\" only changes what the peers of the device are told.",
+		Access:      Authenticated,
+		Request:     api.RotateKeyRequest{},
+		Response:    api.Device{},
+	}},
+
+	{"GET", "/api/v1/networks", ListNetworks, Doc{
+		Summary:  "List networks",
+		Access:   Authenticated,
+		Query:    listParams,
+		Response: []api.NetworkDevices{},
+	}},
+	{"POST", "/api/v1/networks", NewNetwork, Doc{
+		Summary:  "Create a network",
+		Access:   Authenticated,
+		Request:  api.NewNetworkRequest{},
+		Response: api.Network{},
+	}},
+	{"GET", "/api/v1/networks/:id", NetworkInfo, Doc{
+		Summary:  "Get a network",
+		Access:   Authenticated,
+		Response: api.NetworkDevices{},
+	}},
+	{"PATCH", "/api/v1/networks/:id", UpdateNetwork, Doc{
+		Summary:  "Change the settings of a network",
+		Access:   Authenticated,
+		Request:  api.UpdateNetworkRequest{},
+		Response: api.Network{},
+	}},
+	{"DELETE", "/api/v1/networks/:id", DeleteNetwork, Doc{
+		Summary: "Delete a network",
+		Access:  Authenticated,
+		Status:  204,
+	}},
+	{"PUT", "/api/v1/networks/:network/devices/:device", DeviceJoin, Doc{
+		Summary: "Add a device to a network, or ask to join it with 202 Accepted",
+		Access:  Authenticated,
+		Status:  204,
+	}},
+	{"DELETE", "/api/v1/networks/:network/devices/:device", DeviceLeave, Doc{
+		Summary: "Remove a device from a network",
+		Access:  Authenticated,
+		Status:  204,
+	}},
+	{"GET", "/api/v1/networks/:id/requests", NetworkRequests, Doc{
+		Summary:  "List the devices asking to join a network",
+		Access:   Authenticated,
+		Response: []api.Device{},
+	}},
+	{"POST", "/api/v1/networks/:network/requests/:device", NetworkApprove, Doc{
+		Summary: "Approve a request to join a network",
+		Access:  Authenticated,
+		Status:  204,
+	}},
+	{"DELETE", "/api/v1/networks/:network/requests/:device", NetworkReject, Doc{
+		Summary: "Reject a request to join a network",
+		Access:  Authenticated,
+		Status:  204,
+	}},
+
+	{"GET", "/api/v1/admin/users", AdminUsers, Doc{
+		Summary:  "List all users",
+		Access:   Administrator,
+		Query:    listParams,
+		Response: []api.User{},
+	}},
+	{"POST", "/api/v1/admin/users/:id/disable", AdminDisableUser, Doc{
+		Summary:  "Disable or enable a user",
+		Access:   Administrator,
+		Request:  api.DisableUserRequest{},
+		Response: api.User{},
+	}},
+	{"POST", "/api/v1/admin/users/:id/lock", AdminLockUser, Doc{
+		Summary:  "Lock or unlock a user",
+		Access:   Administrator,
+		Request:  api.LockUserRequest{},
+		Response: api.User{},
+	}},
+	{"GET", "/api/v1/admin/devices", AdminDevices, Doc{
+		Summary:  "List all devices",
+		Access:   Administrator,
+		Query:    listParams,
+		Response: []api.Device{},
+	}},
+	{"DELETE", "/api/v1/admin/devices/:id", AdminDeleteDevice, Doc{
+		Summary: "Delete any device",
+		Access:  Administrator,
+		Status:  204,
+	}},
+	{"GET", "/api/v1/admin/devices/:id/relay", AdminDeviceRelay, Doc{
+		Summary:  "Fetch the relay statistics of any device",
+		Access:   Administrator,
+		Response: api.RelayStats{},
+	}},
+	{"GET", "/api/v1/admin/networks", AdminNetworks, Doc{
+		Summary:  "List all networks",
+		Access:   Administrator,
+		Query:    listParams,
+		Response: []api.Network{},
+	}},
+	{"GET", "/api/v1/admin/gateway", AdminGateway, Doc{
+		Summary:  "List gateway connections",
+		Access:   Administrator,
+		Query:    connParams,
+		Response: []api.Connection{},
+	}},
+
+	{"GET", "/api/v1/gateway", Gateway, Doc{
+		Summary: "Connect to the gateway over a websocket",
+		Access:  Authenticated,
+		Status:  101,
+	}},
+	{"GET", "/api/v1/gateway/events", GatewayEvents, Doc{
+		Summary: "Stream gateway messages as server-sent events",
+		Access:  Authenticated,
+		Query: []Param{
+			{"device", "integer", "The device to receive messages for."},
+		},
+		Response:    api.Message{},
+		ContentType: "text/event-stream",
+	}},
+	{"POST", "/api/v1/gateway/ping", GatewayPing, Doc{
+		Summary: "Report the endpoint and NAT of a device",
+		Access:  Authenticated,
+		Request: api.Message{},
+		Status:  204,
+	}},
+	{"GET", "/api/v1/punch", Punch, Doc{
+		Summary:  "Get the pikopunch server to use",
+		Access:   Authenticated,
+		Response: api.Punch{},
+	}},
+}
+
+// LegacyRoutes holds every route from before the API was versioned.
+var LegacyRoutes = []LegacyRoute{
+	{"POST", "/api/new/user", NewUser, "POST /api/v1/users"},
+	{"POST", "/api/new/device", NewDevice, "POST /api/v1/devices"},
+	{"POST", "/api/new/network", NewNetwork, "POST /api/v1/networks"},
+
+	{"GET", "/api/list/devices", ListDevices, "GET /api/v1/devices"},
+	{"GET", "/api/list/networks", ListNetworks, "GET /api/v1/networks"},
+
+	{"PATCH", "/api/user/update", UpdateUser, "PATCH /api/v1/user"},
+	{"PATCH", "/api/device/update", UpdateDevice, "PATCH /api/v1/devices/:id"},
+	{"PATCH", "/api/network/update", UpdateNetwork, "PATCH /api/v1/networks/:id"},
+
+	// Deleting users is a debug route, and has no successor.
+	{"POST", "/api/del/user", DeleteUser, ""},
+	{"POST", "/api/del/device", DeleteDevice, "DELETE /api/v1/devices/:id"},
+	{"POST", "/api/del/network", DeleteNetwork, "DELETE /api/v1/networks/:id"},
+
+	{"GET", "/api/device/info", DeviceInfo, "GET /api/v1/devices/:id"},
+	{"POST", "/api/device/join", DeviceJoin, "PUT /api/v1/networks/:network/devices/:device"},
+	{"POST", "/api/device/leave", DeviceLeave, "DELETE /api/v1/networks/:network/devices/:device"},
+	{"POST", "/api/device/rotate-key", RotateDeviceKey, "POST /api/v1/devices/:id/rotate-key"},
+
+	{"GET", "/api/network/info", NetworkInfo, "GET /api/v1/networks/:id"},
+	{"GET", "/api/network/requests", NetworkRequests, "GET /api/v1/networks/:id/requests"},
+	{"POST", "/api/network/approve", NetworkApprove, "POST /api/v1/networks/:network/requests/:device"},
+	{"POST", "/api/network/reject", NetworkReject, "DELETE /api/v1/networks/:network/requests/:device"},
+
+	{"GET", "/api/auth", Auth, "GET /api/v1/auth"},
+	{"POST", "/api/auth", Auth, "POST /api/v1/auth"},
+
+	{"GET", "/api/admin/users", AdminUsers, "GET /api/v1/admin/users"},
+	{"GET", "/api/admin/devices", AdminDevices, "GET /api/v1/admin/devices"},
+	{"GET", "/api/admin/networks", AdminNetworks, "GET /api/v1/admin/networks"},
+	{"GET", "/api/admin/gateway", AdminGateway, "GET /api/v1/admin/gateway"},
+	{"POST", "/api/admin/user/disable", AdminDisableUser, "POST /api/v1/admin/users/:id/disable"},
+	{"POST", "/api/admin/user/lock", AdminLockUser, "POST /api/v1/admin/users/:id/lock"},
+	{"POST", "/api/admin/device/delete", AdminDeleteDevice, "DELETE /api/v1/admin/devices/:id"},
+
+	{"GET", "/api/gateway", Gateway, "GET /api/v1/gateway"},
+	{"GET", "/api/punch", Punch, "GET /api/v1/punch"},
+}
+
+// Register adds every route to h, along with the OpenAPI document describing
+// them at /api/openapi.json.
+//
+// Requests to a v1 path with a method it doesn't have are answered with 405.
+func Register(h *mwr.Handler) {
+	var paths []string
+	methods := map[string][]string{}
+
+	for _, r := range Routes {
+		h.Method(r.Method, r.Path, r.Handler)
+
+		if methods[r.Path] == nil {
+			paths = append(paths, r.Path)
+		}
+		methods[r.Path] = append(methods[r.Path], r.Method)
+	}
+
+	for _, p := range paths {
+		h.Method("", p, methodNotAllowed(methods[p]))
+	}
+
+	for _, r := range LegacyRoutes {
+		h.Method(r.Method, r.Path, deprecated(r))
+	}
+
+	h.Method("GET", "/api/openapi.json", OpenAPI)
+}
+
+// Pattern returns the path of the route which handles a request, such as
+// "/api/v1/devices/:id", or "" if no route does.
+//
+// Routes are matched in the same order Register adds them.
+func Pattern(method, path string) string {
+	for _, r := range Routes {
+		if r.Method == method && matchPath(r.Path, path) {
+			return r.Path
+		}
+	}
+
+	// Answered with 405 Method Not Allowed
+	for _, r := range Routes {
+		if matchPath(r.Path, path) {
+			return r.Path
+		}
+	}
+
+	for _, r := range LegacyRoutes {
+		if r.Method == method && matchPath(r.Path, path) {
+			return r.Path
+		}
+	}
+
+	if method == "GET" && path == "/api/openapi.json" {
+		return path
+	}
+	return ""
+}
+
+// matchPath determines if path matches pattern, where parts of the pattern
+// starting with ":" match any part of the path.
+func matchPath(pattern, path string) bool {
+	want := strings.Split(pattern, "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+
+	for i, w := range want {
+		if w != got[i] && !(strings.HasPrefix(w, ":") && got[i] != "") {
+			return false
+		}
+	}
+	return true
+}
+
+// methodNotAllowed answers requests to a path which only has the given
+// methods.
+func methodNotAllowed(methods []string) func(*mwr.Ctx) error {
+	allow := strings.Join(methods, ", ")
+
+	return func(c *mwr.Ctx) error {
+		c.Set("Allow", allow)
+		return api405(c)
+	}
+}
+
+// deprecated marks the responses of a legacy route as deprecated, pointing to
+// its successor if it has one.
+func deprecated(r LegacyRoute) func(*mwr.Ctx) error {
+	return func(c *mwr.Ctx) error {
+		c.Set("Deprecation", "true")
+		if r.Successor != "" {
+			_, path, _ := strings.Cut(r.Successor, " ")
+			c.Set("Link", "<"+path+`>; rel="successor-version"`)
+		}
+		return r.Handler(c)
+	}
+}
@@ -0,0 +1,574 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mca3/mwr"
+	"github.com/mca3/pikorv/api"
+	"github.com/mca3/pikorv/config"
+	"github.com/mca3/pikorv/db"
+	"github.com/mca3/pikorv/internal/logging"
+	"github.com/mca3/pikorv/routes/gateway"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// testServer serves the routes against an in-memory store.
+type testServer struct {
+	t     *testing.T
+	h     *mwr.Handler
+	store *db.Memory
+}
+
+func newTestServer(t *testing.T) *testServer {
+	config.JWTSecret = "test secret"
+	_, config.SubnetIp, _ = net.ParseCIDR("fd00::/32")
+
+	s := db.NewMemory()
+	SetStore(s)
+	gateway.SetStore(s)
+	workers.Do(func() { gateway.InitWorkers(1, 16) })
+	t.Cleanup(gateway.WaitNotifications)
+
+	h := &mwr.Handler{}
+
+	// Errors are only logged, so the status the route set is kept.
+	h.Use(func(c *mwr.Ctx) error {
+		if err := c.Next(); err != nil {
+			t.Logf("%s %s: %v", c.Method(), c.Path(), err)
+		}
+		return nil
+	})
+
+	Register(h)
+
+	return &testServer{t: t, h: h, store: s}
+}
+
+// do sends a request, with body encoded as JSON if it is not nil.
+func (ts *testServer) do(method, path, token string, body any) *httptest.ResponseRecorder {
+	ts.t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			ts.t.Fatalf("failed to encode body: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &buf)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	ts.h.ServeHTTP(w, req)
+	return w
+}
+
+// expect sends a request and fails the test if the status isn't code.
+// If out is not nil, the response is decoded into it.
+func (ts *testServer) expect(code int, method, path, token string, body, out any) {
+	ts.t.Helper()
+
+	w := ts.do(method, path, token, body)
+	if w.Code != code {
+		ts.t.Fatalf("%s %s: expected %d, got %d: %s", method, path, code, w.Code, w.Body.String())
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(w.Body).Decode(out); err != nil {
+			ts.t.Fatalf("%s %s: failed to decode response: %v", method, path, err)
+		}
+	}
+}
+
+// user creates a user and returns a token for them.
+func (ts *testServer) user(name string) string {
+	ts.t.Helper()
+
+	ts.expect(http.StatusOK, "POST", "/api/new/user", "", map[string]string{
+		"username": name,
+		"email":    name + "@example.com",
+		"password": "hunter2",
+	}, nil)
+
+	var resp struct {
+		Token string
+	}
+	ts.expect(http.StatusOK, "POST", "/api/auth", "", map[string]string{
+		"username": name,
+		"password": "hunter2",
+		"method":   "username-password",
+	}, &resp)
+
+	return resp.Token
+}
+
+func TestNewUserConflict(t *testing.T) {
+	ts := newTestServer(t)
+	ts.user("alice")
+
+	ts.expect(http.StatusConflict, "POST", "/api/new/user", "", map[string]string{
+		"username": "alice",
+		"email":    "someone@example.com",
+		"password": "hunter2",
+	}, nil)
+
+	ts.expect(http.StatusForbidden, "POST", "/api/auth", "", map[string]string{
+		"username": "alice",
+		"password": "hunter1",
+		"method":   "username-password",
+	}, nil)
+}
+
+func TestNewUserUsernameLength(t *testing.T) {
+	ts := newTestServer(t)
+
+	// The longest username the database can hold is accepted.
+	ts.user(strings.Repeat("a", maxUsernameLength))
+
+	ts.expect(http.StatusBadRequest, "POST", "/api/new/user", "", map[string]string{
+		"username": strings.Repeat("b", maxUsernameLength+1),
+		"email":    "b@example.com",
+		"password": "hunter2",
+	}, nil)
+}
+
+func TestNetworkApprovalFlow(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+	bob := ts.user("bob")
+
+	var nw db.Network
+	ts.expect(http.StatusOK, "POST", "/api/new/network", alice, map[string]any{
+		"name":     "home",
+		"approval": true,
+	}, &nw)
+
+	var dev db.Device
+	ts.expect(http.StatusOK, "POST", "/api/new/device", bob, map[string]string{
+		"name": "laptop",
+		"key":  "bob's key",
+	}, &dev)
+
+	// Bob can't see Alice's network, and has to ask.
+	ts.expect(http.StatusAccepted, "POST", "/api/device/join", bob, map[string]int64{
+		"device":  dev.ID,
+		"network": nw.ID,
+	}, nil)
+
+	// Asking again changes nothing.
+	joinPath := "/api/v1/networks/" + strconv.FormatInt(nw.ID, 10) + "/devices/" + strconv.FormatInt(dev.ID, 10)
+	ts.expect(http.StatusAccepted, "PUT", joinPath, bob, nil, nil)
+
+	path := "/api/network/requests?id=" + strconv.FormatInt(nw.ID, 10)
+	ts.expect(http.StatusNotFound, "GET", path, bob, nil, nil)
+
+	var reqs []db.Device
+	ts.expect(http.StatusOK, "GET", path, alice, nil, &reqs)
+	if len(reqs) != 1 || reqs[0].ID != dev.ID {
+		t.Fatalf("expected a request from %d, got %+v", dev.ID, reqs)
+	}
+
+	ts.expect(http.StatusNoContent, "POST", "/api/network/approve", alice, map[string]int64{
+		"device":  dev.ID,
+		"network": nw.ID,
+	}, nil)
+
+	devs, err := ts.store.NetworkDevices(context.Background(), nw.ID)
+	if err != nil {
+		t.Fatalf("failed to list devices: %v", err)
+	}
+	if len(devs) != 1 || devs[0].ID != dev.ID {
+		t.Fatalf("expected %d in the network, got %+v", dev.ID, devs)
+	}
+
+	// Now that Bob is in, joining again is a no-op.
+	ts.expect(http.StatusNoContent, "PUT", joinPath, bob, nil, nil)
+}
+
+func TestNoAuth(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.expect(http.StatusForbidden, "GET", "/api/list/networks", "", nil, nil)
+	ts.expect(http.StatusForbidden, "GET", "/api/list/networks", "bogus", nil, nil)
+}
+
+// admin makes the user an administrator.
+func (ts *testServer) admin(name string) {
+	ts.t.Helper()
+
+	u, err := ts.store.Username(context.Background(), name)
+	if err != nil {
+		ts.t.Fatalf("failed to get user: %v", err)
+	}
+
+	u.Admin = true
+	if err := ts.store.SaveUser(context.Background(), &u); err != nil {
+		ts.t.Fatalf("failed to save user: %v", err)
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+	bob := ts.user("bob")
+	ts.admin("alice")
+
+	ts.expect(http.StatusForbidden, "GET", "/api/admin/users", bob, nil, nil)
+
+	// Admin lists are paginated with cursors, like the lists of devices.
+	w := ts.do("GET", "/api/v1/admin/users?sort=name&order=desc&limit=1", alice, nil)
+	var us []db.User
+	if err := json.Unmarshal(w.Body.Bytes(), &us); err != nil || len(us) != 1 || us[0].Username != "bob" {
+		t.Fatalf("expected bob first, got %d %s", w.Code, w.Body)
+	}
+
+	cur := w.Header().Get(api.NextCursorHeader)
+	w = ts.do("GET", "/api/v1/admin/users?sort=name&order=desc&limit=1&cursor="+cur, alice, nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &us); err != nil || len(us) != 1 || us[0].Username != "alice" {
+		t.Fatalf("expected alice next, got %d %s", w.Code, w.Body)
+	} else if cur := w.Header().Get(api.NextCursorHeader); cur != "" {
+		t.Fatalf("expected no page after the last, got cursor %q", cur)
+	}
+
+	ts.expect(http.StatusBadRequest, "GET", "/api/admin/users?limit=0", alice, nil, nil)
+}
+
+func TestAdminLock(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+	bob := ts.user("bob")
+	ts.admin("alice")
+
+	var u db.User
+	ts.expect(http.StatusOK, "POST", "/api/admin/user/disable", alice, map[string]any{
+		"id":       2,
+		"disabled": true,
+	}, &u)
+	if u.Username != "bob" || !u.Disabled {
+		t.Fatalf("expected bob to be disabled, got %+v", u)
+	}
+
+	// Bob's token no longer works, and he can't get another.
+	ts.expect(http.StatusForbidden, "GET", "/api/list/networks", bob, nil, nil)
+	login := map[string]string{
+		"username": "bob",
+		"password": "hunter2",
+		"method":   "username-password",
+	}
+	ts.expect(http.StatusForbidden, "POST", "/api/auth", "", login, nil)
+
+	ts.expect(http.StatusOK, "POST", "/api/admin/user/disable", alice, map[string]any{
+		"id":       2,
+		"disabled": false,
+	}, nil)
+	ts.expect(http.StatusOK, "GET", "/api/list/networks", bob, nil, nil)
+
+	ts.expect(http.StatusOK, "POST", "/api/admin/user/lock", alice, map[string]any{
+		"id":       2,
+		"duration": 60,
+	}, nil)
+	ts.expect(http.StatusForbidden, "POST", "/api/auth", "", login, nil)
+
+	ts.expect(http.StatusOK, "POST", "/api/admin/user/lock", alice, map[string]any{
+		"id":       2,
+		"duration": 0,
+	}, nil)
+	ts.expect(http.StatusOK, "POST", "/api/auth", "", login, nil)
+
+	// Administrators can't lock themselves out, and only administrators
+	// can lock anyone.
+	ts.expect(http.StatusBadRequest, "POST", "/api/admin/user/disable", alice, map[string]any{
+		"id":       1,
+		"disabled": true,
+	}, nil)
+	ts.expect(http.StatusForbidden, "POST", "/api/admin/user/disable", bob, map[string]any{
+		"id":       1,
+		"disabled": true,
+	}, nil)
+	ts.expect(http.StatusNotFound, "POST", "/api/admin/user/lock", alice, map[string]any{
+		"id":       100,
+		"duration": 60,
+	}, nil)
+}
+
+func TestAdminDeleteDevice(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+	bob := ts.user("bob")
+	ts.admin("alice")
+
+	var dev db.Device
+	ts.expect(http.StatusOK, "POST", "/api/new/device", bob, map[string]string{
+		"name": "laptop",
+		"key":  "bob's key",
+	}, &dev)
+
+	relayPath := "/api/v1/admin/devices/" + strconv.FormatInt(dev.ID, 10) + "/relay"
+	ts.expect(http.StatusForbidden, "GET", relayPath, bob, nil, nil)
+
+	var st api.RelayStats
+	ts.expect(http.StatusOK, "GET", relayPath, alice, nil, &st)
+	if st.Registered {
+		t.Fatalf("device which never used the relay is registered: %+v", st)
+	}
+
+	ts.expect(http.StatusForbidden, "POST", "/api/admin/device/delete", bob, map[string]int64{"id": dev.ID}, nil)
+	ts.expect(http.StatusNoContent, "POST", "/api/admin/device/delete", alice, map[string]int64{"id": dev.ID}, nil)
+	ts.expect(http.StatusNotFound, "POST", "/api/admin/device/delete", alice, map[string]int64{"id": dev.ID}, nil)
+
+	if _, err := ts.store.DeviceID(context.Background(), dev.ID); err == nil {
+		t.Fatalf("device still exists")
+	}
+	ts.expect(http.StatusNotFound, "GET", relayPath, alice, nil, nil)
+}
+
+func TestRotateDeviceKey(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+
+	key := func() string {
+		k, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		return k.PublicKey().String()
+	}
+
+	var laptop, phone db.Device
+	ts.expect(http.StatusOK, "POST", "/api/new/device", alice, map[string]string{
+		"name": "laptop",
+		"key":  key(),
+	}, &laptop)
+	ts.expect(http.StatusOK, "POST", "/api/new/device", alice, map[string]string{
+		"name": "phone",
+		"key":  key(),
+	}, &phone)
+
+	path := "/api/v1/devices/" + strconv.FormatInt(laptop.ID, 10) + "/rotate-key"
+	ts.expect(http.StatusConflict, "POST", path, alice, map[string]string{"key": phone.PublicKey}, nil)
+	ts.expect(http.StatusBadRequest, "POST", path, alice, map[string]string{"key": laptop.PublicKey}, nil)
+
+	var dev db.Device
+	newKey := key()
+	ts.expect(http.StatusOK, "POST", path, alice, map[string]any{"key": newKey, "overlap": 60}, &dev)
+	if dev.PublicKey != newKey || dev.IP != laptop.IP {
+		t.Fatalf("bad device after rotation: %+v", dev)
+	}
+}
+
+func TestListDevicesPages(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+
+	for _, name := range []string{"laptop", "phone", "lab-1", "lab-2", "lab-3"} {
+		var dev db.Device
+		ts.expect(http.StatusOK, "POST", "/api/new/device", alice, map[string]string{
+			"name": name,
+			"key":  name + "'s key",
+		}, &dev)
+
+		if strings.HasPrefix(name, "lab") {
+			ts.expect(http.StatusOK, "PATCH", "/api/device/update", alice, map[string]any{
+				"id":   dev.ID,
+				"tags": []string{"lab"},
+			}, nil)
+		}
+	}
+
+	type device struct {
+		Name string
+		Tags []string
+	}
+
+	// Walk every page of lab devices, two at a time.
+	var names []string
+	path := "/api/list/devices?tag=lab&sort=name&order=desc&limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("too many pages")
+		}
+
+		w := ts.do("GET", path, alice, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+
+		var devs []device
+		if err := json.NewDecoder(w.Body).Decode(&devs); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		for _, v := range devs {
+			if len(v.Tags) != 1 || v.Tags[0] != "lab" {
+				t.Fatalf("device %s has tags %v", v.Name, v.Tags)
+			}
+			names = append(names, v.Name)
+		}
+
+		cur := w.Header().Get(api.NextCursorHeader)
+		if cur == "" {
+			break
+		}
+		path = "/api/list/devices?tag=lab&sort=name&order=desc&limit=2&cursor=" + cur
+	}
+
+	if want := []string{"lab-3", "lab-2", "lab-1"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got devices %v, expected %v", names, want)
+	}
+
+	var devs []device
+	ts.expect(http.StatusOK, "GET", "/api/list/devices?prefix=p", alice, nil, &devs)
+	if len(devs) != 1 || devs[0].Name != "phone" {
+		t.Fatalf("expected only phone, got %+v", devs)
+	}
+
+	// Nothing is connected to the gateway.
+	ts.expect(http.StatusOK, "GET", "/api/list/devices?online=true", alice, nil, &devs)
+	if len(devs) != 0 {
+		t.Fatalf("expected no online devices, got %+v", devs)
+	}
+
+	ts.expect(http.StatusBadRequest, "GET", "/api/list/devices?sort=key", alice, nil, nil)
+	ts.expect(http.StatusBadRequest, "GET", "/api/list/devices?limit=0", alice, nil, nil)
+	ts.expect(http.StatusBadRequest, "GET", "/api/list/devices?cursor=!", alice, nil, nil)
+	ts.expect(http.StatusBadRequest, "GET", "/api/list/devices?online=maybe", alice, nil, nil)
+}
+
+func TestV1Routes(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+	bob := ts.user("bob")
+
+	var nw db.Network
+	ts.expect(http.StatusOK, "POST", "/api/v1/networks", alice, map[string]any{
+		"name":     "home",
+		"approval": true,
+	}, &nw)
+
+	var dev db.Device
+	ts.expect(http.StatusOK, "POST", "/api/v1/devices", bob, map[string]string{
+		"name": "laptop",
+		"key":  "bob's key",
+	}, &dev)
+
+	devPath := "/api/v1/devices/" + strconv.FormatInt(dev.ID, 10)
+	nwPath := "/api/v1/networks/" + strconv.FormatInt(nw.ID, 10)
+
+	ts.expect(http.StatusOK, "GET", devPath, bob, nil, &dev)
+	ts.expect(http.StatusNotFound, "GET", devPath, alice, nil, nil)
+	ts.expect(http.StatusNotFound, "GET", "/api/v1/devices/100", bob, nil, nil)
+	ts.expect(http.StatusBadRequest, "GET", "/api/v1/devices/abc", bob, nil, nil)
+
+	ts.expect(http.StatusOK, "PATCH", devPath, bob, map[string]string{"name": "desktop"}, &dev)
+	if dev.Name != "desktop" {
+		t.Fatalf("device was not renamed: %+v", dev)
+	}
+
+	// Bob asks to join, and Alice approves.
+	ts.expect(http.StatusAccepted, "PUT", nwPath+"/devices/"+strconv.FormatInt(dev.ID, 10), bob, nil, nil)
+
+	var reqs []db.Device
+	ts.expect(http.StatusOK, "GET", nwPath+"/requests", alice, nil, &reqs)
+	if len(reqs) != 1 || reqs[0].ID != dev.ID {
+		t.Fatalf("expected a request from %d, got %+v", dev.ID, reqs)
+	}
+
+	ts.expect(http.StatusNoContent, "POST", nwPath+"/requests/"+strconv.FormatInt(dev.ID, 10), alice, nil, nil)
+	ts.expect(http.StatusNoContent, "DELETE", nwPath+"/devices/"+strconv.FormatInt(dev.ID, 10), alice, nil, nil)
+
+	ts.expect(http.StatusNoContent, "DELETE", devPath, bob, nil, nil)
+	ts.expect(http.StatusNotFound, "GET", devPath, bob, nil, nil)
+
+	w := ts.do("PUT", devPath, bob, nil)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("PUT %s: expected 405, got %d", devPath, w.Code)
+	} else if allow := w.Header().Get("Allow"); allow != "GET, PATCH, DELETE" {
+		t.Fatalf("PUT %s: got Allow %q", devPath, allow)
+	}
+}
+
+func TestLegacyDeprecated(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.user("alice")
+
+	w := ts.do("GET", "/api/list/devices", alice, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if v := w.Header().Get("Deprecation"); v != "true" {
+		t.Fatalf("got Deprecation %q", v)
+	} else if v := w.Header().Get("Link"); v != `</api/v1/devices>; rel="successor-version"` {
+		t.Fatalf("got Link %q", v)
+	}
+
+	w = ts.do("GET", "/api/v1/devices", alice, nil)
+	if v := w.Header().Get("Deprecation"); v != "" {
+		t.Fatalf("v1 route is deprecated")
+	}
+}
+
+func TestPattern(t *testing.T) {
+	for _, tc := range []struct {
+		method, path, want string
+	}{
+		{"GET", "/api/v1/devices", "/api/v1/devices"},
+		{"GET", "/api/v1/devices/12", "/api/v1/devices/:id"},
+		{"POST", "/api/v1/devices/12/rotate-key", "/api/v1/devices/:id/rotate-key"},
+		{"PUT", "/api/v1/networks/1/devices/2", "/api/v1/networks/:network/devices/:device"},
+		{"PUT", "/api/v1/devices/12", "/api/v1/devices/:id"},
+		{"GET", "/api/list/devices", "/api/list/devices"},
+		{"GET", "/api/openapi.json", "/api/openapi.json"},
+		{"GET", "/api/v1/devices/", ""},
+		{"GET", "/api/v1/devices/12/secret", ""},
+		{"GET", "/favicon.ico", ""},
+	} {
+		if got := Pattern(tc.method, tc.path); got != tc.want {
+			t.Errorf("%s %s: expected %q, got %q", tc.method, tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestRejectedTokenNotLogged(t *testing.T) {
+	ts := newTestServer(t)
+
+	var buf bytes.Buffer
+	l, err := logging.New(&buf, "text", slog.LevelDebug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := slog.Default()
+	slog.SetDefault(l)
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": 1}).SignedString([]byte("wrong secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := ts.do("GET", "/api/v1/devices", token, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+
+	if out := buf.String(); !strings.Contains(out, "invalid signature") {
+		t.Fatalf("rejection wasn't logged: %q", out)
+	} else if strings.Contains(out, token) || strings.Contains(out, strings.Split(token, ".")[2]) {
+		t.Fatalf("token was logged: %q", out)
+	}
+}
@@ -6,23 +6,23 @@ import (
 	"fmt"
 
 	"github.com/mca3/mwr"
+	"github.com/mca3/pikorv/api"
 	"github.com/mca3/pikorv/db"
 )
 
 // apiNewUser creates a new user.
 // XXX: This is a debug route. There is no authentication.
 //
-// Path: /api/new/user
+// Path: /api/v1/users
 // Method: POST
+// Legacy: POST /api/new/user
 // Body: JSON. Must have the strings "username", "email", and "password".
 func NewUser(c *mwr.Ctx) error {
-	data := struct {
-		Username, Email, Password string
-	}{}
+	data := api.NewUserRequest{}
 
 	if err := c.BodyParser(&data); err != nil {
 		return api400(c, err)
-	} else if data.Username == "" || data.Email == "" || data.Password == "" {
+	} else if !validUsername(data.Username) || !validEmail(data.Email) || data.Password == "" {
 		return api400(c)
 	}
 
@@ -31,17 +31,59 @@ func NewUser(c *mwr.Ctx) error {
 		Email:    data.Email,
 	}
 
-	if err := u.Save(c.Context()); err != nil {
+	if err := store.SaveUser(c.Context(), &u); db.IsConflict(err) {
+		return api409(c, err)
+	} else if err != nil {
 		return api500(c, err)
 	}
 
-	if err := u.SetPassword(c.Context(), data.Password); err != nil {
+	if err := store.SetPassword(c.Context(), u.ID, data.Password); err != nil {
 		return api500(c, err)
 	}
 
 	return c.SendString(fmt.Sprint(u.ID))
 }
 
+// UpdateUser changes the profile of the authenticated user.
+//
+// Path: /api/v1/user
+// Method: PATCH
+// Legacy: PATCH /api/user/update
+// Authenticated.
+// Body: JSON. Specify the fields to change, which may be "name" and "email".
+// An empty "name" removes it.
+func UpdateUser(c *mwr.Ctx) error {
+	user, ok := isAuthed(c)
+	if !ok {
+		return api403(c, errNoAuth)
+	}
+
+	data := api.UpdateUserRequest{}
+
+	if err := c.BodyParser(&data); err != nil {
+		return api400(c, err)
+	} else if data.Name != nil && *data.Name != "" && !validName(*data.Name) {
+		return api400(c)
+	} else if data.Email != nil && !validEmail(*data.Email) {
+		return api400(c)
+	}
+
+	if data.Name != nil {
+		user.Name = *data.Name
+	}
+	if data.Email != nil {
+		user.Email = *data.Email
+	}
+
+	if err := store.SaveUser(c.Context(), user); db.IsConflict(err) {
+		return api409(c, err)
+	} else if err != nil {
+		return api500(c, err)
+	}
+
+	return sendJSON(c, user)
+}
+
 // apiDeleteUser deletes a user.
 // XXX: This is a debug route. There is no authentication.
 //
@@ -65,7 +107,7 @@ func DeleteUser(c *mwr.Ctx) error {
 		ID:       data.ID,
 	}
 
-	if err := u.Delete(c.Context()); err != nil {
+	if err := store.DeleteUser(c.Context(), u.ID); err != nil {
 		return api500(c, err)
 	}
 
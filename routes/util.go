@@ -2,11 +2,260 @@ package routes
 
 import (
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/mca3/mwr"
+	"github.com/mca3/pikorv/api"
 	"github.com/mca3/pikorv/config"
+	"github.com/mca3/pikorv/db"
 )
 
+const (
+	// maxNameLength is the longest a display, device, or network name may
+	// be, as set by the database schema.
+	maxNameLength = 64
+
+	// maxUsernameLength is the longest a username may be, as set by the
+	// database schema.
+	maxUsernameLength = 32
+
+	// maxEmailLength is the longest an email may be, as set by the
+	// database schema.
+	maxEmailLength = 256
+
+	// defaultPageLimit is how many items are in a page if the client
+	// doesn't ask for a specific amount, and maxPageLimit is the most it
+	// may ask for.
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+
+	// maxTagLength is the longest a device tag may be, and maxTags is the
+	// most tags a device may have.
+	maxTagLength = 32
+	maxTags      = 16
+)
+
+// validName determines if name is suitable as a user, device, or network
+// name.
+func validName(name string) bool {
+	if name == "" || len(name) > maxNameLength || !utf8.ValidString(name) {
+		return false
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validUsername determines if name is suitable as a username.
+// Usernames follow the same rules as other names, but are shorter.
+func validUsername(name string) bool {
+	return len(name) <= maxUsernameLength && validName(name)
+}
+
+// validTag determines if tag is suitable as a device tag, which is a short
+// word of printable characters.
+func validTag(tag string) bool {
+	if tag == "" || len(tag) > maxTagLength || !utf8.ValidString(tag) {
+		return false
+	}
+
+	for _, r := range tag {
+		if unicode.IsControl(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validEmail determines if email is a plain email address.
+func validEmail(email string) bool {
+	if len(email) > maxEmailLength {
+		return false
+	}
+
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// CheckUser determines if a user may be created with username, email, and
+// the display name name, which may be empty, by the same rules as the API.
+func CheckUser(username, email, name string) error {
+	switch {
+	case !validUsername(username):
+		return fmt.Errorf("invalid username; it may be at most %d bytes, without control characters", maxUsernameLength)
+	case !validEmail(email):
+		return errors.New("invalid email address")
+	case name != "" && !validName(name):
+		return fmt.Errorf("invalid name; it may be at most %d bytes, without control characters", maxNameLength)
+	}
+	return nil
+}
+
+// listOptions reads the "prefix", "sort", "order", "limit", and "cursor"
+// query parameters of a list.
+//
+// Without a limit, the whole list is returned, as it was before lists could be
+// paginated.
+func listOptions(c *mwr.Ctx) (db.ListOptions, error) {
+	o := db.ListOptions{Prefix: c.Query("prefix")}
+
+	switch v := c.Query("sort", db.SortID); v {
+	case db.SortID, db.SortName:
+		o.Sort = v
+	default:
+		return o, errors.New("invalid sort")
+	}
+
+	switch c.Query("order", "asc") {
+	case "asc":
+	case "desc":
+		o.Desc = true
+	default:
+		return o, errors.New("invalid order")
+	}
+
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxPageLimit {
+			return o, errors.New("invalid limit")
+		}
+		o.Limit = n
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		cur, err := decodeCursor(v)
+		if err != nil {
+			return o, errors.New("invalid cursor")
+		}
+		o.After = &cur
+	}
+
+	return o, nil
+}
+
+// encodeCursor encodes a cursor for clients, who should treat it as opaque.
+func encodeCursor(cur *db.Cursor) string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor decodes a cursor made by encodeCursor.
+func decodeCursor(s string) (db.Cursor, error) {
+	var cur db.Cursor
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, err
+	}
+	return cur, json.Unmarshal(b, &cur)
+}
+
+// peek returns o with room for one more item than the client asked for,
+// which tells nextPage if there is a page after this one.
+func peek(o db.ListOptions) db.ListOptions {
+	if o.Limit > 0 {
+		o.Limit++
+	}
+	return o
+}
+
+// nextPage trims items, which were listed with peek(o), down to the limit of
+// o, and sets the cursor of the next page if there is one.
+//
+// The page is never nil, so that an empty one is sent as [] rather than null.
+func nextPage[T any](c *mwr.Ctx, o db.ListOptions, items []T, key func(v T) (int64, string)) []T {
+	if items == nil {
+		return []T{}
+	} else if o.Limit == 0 || len(items) <= o.Limit {
+		return items
+	}
+
+	items = items[:o.Limit]
+	c.Set(api.NextCursorHeader, encodeCursor(o.CursorOf(key(items[o.Limit-1]))))
+	return items
+}
+
+// bind reads the input of a route into data, which must point to a struct.
+//
+// The JSON body is read into it if there is one. Then, int64 fields tagged
+// with `param:"name"` are set from the path parameter of that name, which v1
+// routes use for IDs, or else from the query parameter of that name, which
+// some legacy routes use.
+func bind(c *mwr.Ctx, data any) error {
+	if c.Get("Content-Type") != "" {
+		if err := c.BodyParser(data); err != nil {
+			return err
+		}
+	}
+
+	v := reflect.ValueOf(data).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := t.Field(i).Tag.Lookup("param")
+		if !ok {
+			continue
+		}
+
+		s := c.Param(name)
+		if s == "" {
+			s = c.Query(name)
+		}
+		if s == "" {
+			continue
+		}
+
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid %s", name)
+		}
+		v.Field(i).SetInt(n)
+	}
+
+	return nil
+}
+
+// publicAddrs replaces the host of listen addresses with config.OurIP where
+// they listen on all addresses, so they may be handed out to clients.
+// Duplicates, such as from listening on both 0.0.0.0 and [::], are removed.
+func publicAddrs(addrs []string) []string {
+	var out []string
+	seen := map[string]bool{}
+
+	for _, v := range addrs {
+		host, port, err := net.SplitHostPort(v)
+		if err != nil {
+			continue
+		}
+
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = config.OurIP
+		}
+
+		addr := net.JoinHostPort(host, port)
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		out = append(out, addr)
+	}
+
+	return out
+}
+
 func getBit(b []byte, i int) bool {
 	index := int(i / 32)
 	if index > len(b) {
@@ -2,6 +2,8 @@ package routes
 
 import (
 	"net"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/mca3/pikorv/config"
@@ -24,3 +26,71 @@ func TestApplySubnet(t *testing.T) {
 		t.Fatalf("expected %s, got %s", exp.String(), ip.String())
 	}
 }
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"laptop", true},
+		{"my cool phone", true},
+		{"", false},
+		{"bad\nname", false},
+		{"\xff", false},
+		{string(make([]byte, maxNameLength+1)), false},
+	}
+
+	for _, v := range tests {
+		if ok := validName(v.name); ok != v.ok {
+			t.Errorf("validName(%q) = %v, expected %v", v.name, ok, v.ok)
+		}
+	}
+}
+
+func TestValidUsername(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"alice", true},
+		{strings.Repeat("a", maxUsernameLength), true},
+		{strings.Repeat("a", maxUsernameLength+1), false},
+		{"", false},
+		{"bad\nname", false},
+	}
+
+	for _, v := range tests {
+		if ok := validUsername(v.name); ok != v.ok {
+			t.Errorf("validUsername(%q) = %v, expected %v", v.name, ok, v.ok)
+		}
+	}
+}
+
+func TestValidEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		ok    bool
+	}{
+		{"test@example.com", true},
+		{"", false},
+		{"test", false},
+		{"Test <test@example.com>", false},
+	}
+
+	for _, v := range tests {
+		if ok := validEmail(v.email); ok != v.ok {
+			t.Errorf("validEmail(%q) = %v, expected %v", v.email, ok, v.ok)
+		}
+	}
+}
+
+func TestPublicAddrs(t *testing.T) {
+	config.OurIP = "198.51.100.1"
+
+	out := publicAddrs([]string{":8744", "[::]:8745", "203.0.113.1:8746", "bogus", "0.0.0.0:8745"})
+	exp := []string{"198.51.100.1:8744", "198.51.100.1:8745", "203.0.113.1:8746"}
+
+	if !reflect.DeepEqual(out, exp) {
+		t.Fatalf("expected %v, got %v", exp, out)
+	}
+}